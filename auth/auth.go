@@ -0,0 +1,436 @@
+// Package auth implements ix.io-style accounts. Clients send HTTP basic
+// credentials (usually from curl -n and a .netrc entry); the first request
+// using a name claims it with that password, and later requests must match.
+// Accounts can also be created explicitly through /register, and API tokens
+// issued there or by /token are accepted as "Authorization: Bearer <token>".
+// Requests without credentials are anonymous, unless they came over TLS
+// with a verified client certificate mapped to a user. Invite-only
+// instances turn off claiming names and require an invite code to register.
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"pb/internal/pairfile"
+)
+
+const (
+	passwordsFileName = "passwords.txt"
+	tokensFileName    = "tokens.txt"
+	tiersFileName     = "tiers.txt"
+	invitesFileName   = "invites.txt"
+	sshKeysFileName   = "sshkeys.txt"
+	rolesFileName     = "roles.txt"
+	githubFileName    = "github.txt"
+)
+
+// FileNames are the files in its directory that New keeps accounts in, for
+// backups to copy.
+var FileNames = []string{passwordsFileName, tokensFileName, tiersFileName, invitesFileName, sshKeysFileName, rolesFileName, githubFileName}
+
+// Accounts holds the users of a pb instance and their API tokens. It is safe
+// for concurrent use.
+type Accounts struct {
+	sync.Mutex
+	passwordsPath string
+	tokensPath    string
+	tiersPath     string
+	invitesPath   string
+	sshKeysPath   string
+	rolesPath     string
+	githubPath    string
+	// passwords maps a user name to a bcrypt hash of its password.
+	passwords map[string]string
+	// tokens maps the SHA-256 of an API token to its user.
+	tokens map[string]string
+	// tiers maps a user name to its service tier, if one was assigned.
+	tiers map[string]string
+	// invites maps the SHA-256 of an invite code to its issuer, followed
+	// by the user who redeemed it once it is used.
+	invites map[string]string
+	// sshKeys maps the SHA256 fingerprint of an SSH public key to its user.
+	sshKeys map[string]string
+	// roles maps a user name to its role, if one was granted.
+	roles map[string]string
+	// github maps a user name to "1 <token>" or "0 <token>", the GitHub
+	// token they gave and whether to mirror all their pastes.
+	github map[string]string
+
+	// InviteOnly stops names being claimed on first use and makes Register
+	// require an invite code. Set it before serving requests.
+	InviteOnly bool
+	// CertUsers maps client certificate identities (the subject common
+	// name, or a DNS, email or URI subject alternative name) to users.
+	// Requests without other credentials that present a verified
+	// certificate with a mapped identity act as that user. Set it before
+	// serving requests.
+	CertUsers map[string]string
+}
+
+// New loads the accounts kept in passwords.txt, tokens.txt, tiers.txt,
+// invites.txt, sshkeys.txt, roles.txt and github.txt under dir.
+func New(dir string) (*Accounts, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	a := &Accounts{
+		passwordsPath: filepath.Join(dir, passwordsFileName),
+		tokensPath:    filepath.Join(dir, tokensFileName),
+		tiersPath:     filepath.Join(dir, tiersFileName),
+		invitesPath:   filepath.Join(dir, invitesFileName),
+		sshKeysPath:   filepath.Join(dir, sshKeysFileName),
+		rolesPath:     filepath.Join(dir, rolesFileName),
+		githubPath:    filepath.Join(dir, githubFileName),
+	}
+	a.passwords = pairfile.Read(a.passwordsPath)
+	a.tokens = pairfile.Read(a.tokensPath)
+	a.tiers = pairfile.Read(a.tiersPath)
+	a.invites = pairfile.Read(a.invitesPath)
+	a.sshKeys = pairfile.Read(a.sshKeysPath)
+	a.roles = pairfile.Read(a.rolesPath)
+	a.github = pairfile.Read(a.githubPath)
+	a.migratePlaintextPasswords()
+	return a, nil
+}
+
+// Authenticate returns the user making the request, or "" for anonymous
+// requests. ok is false when credentials were sent but do not match.
+func (a *Accounts) Authenticate(r *http.Request) (user string, ok bool) {
+	if user, found := r.Context().Value(userKey{}).(string); found {
+		return user, true
+	}
+	if token, isBearer := bearerToken(r); isBearer {
+		a.Lock()
+		defer a.Unlock()
+		user, ok = a.tokens[tokenHash(token)]
+		return user, ok
+	}
+
+	user, password, hasAuth := r.BasicAuth()
+	if !hasAuth {
+		return a.certUser(r), true
+	}
+	if !ValidUserName(user) {
+		return "", false
+	}
+
+	a.Lock()
+	stored, exists := a.passwords[user]
+	if !exists && a.InviteOnly {
+		a.Unlock()
+		return "", false
+	}
+	if !exists {
+		a.passwords[user] = hashPassword(password)
+		pairfile.Write(a.passwordsPath, a.passwords)
+		a.Unlock()
+		return user, true
+	}
+	a.Unlock()
+
+	ok, outdated := checkPassword(stored, password)
+	if ok && outdated {
+		a.Lock()
+		if a.passwords[user] == stored {
+			a.passwords[user] = hashPassword(password)
+			pairfile.Write(a.passwordsPath, a.passwords)
+		}
+		a.Unlock()
+	}
+	return user, ok
+}
+
+// certUser returns the user mapped to the verified client certificate r
+// came with, or "".
+func (a *Accounts) certUser(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(a.CertUsers) == 0 {
+		return ""
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	identities := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	identities = append(identities, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		identities = append(identities, u.String())
+	}
+	for _, identity := range identities {
+		if user, ok := a.CertUsers[identity]; ok && identity != "" {
+			return user
+		}
+	}
+	return ""
+}
+
+// LoadCertUsers reads a file of "<certificate identity> <user>" lines for
+// CertUsers.
+func LoadCertUsers(fileName string) (map[string]string, error) {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]string)
+	for n, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		identity, user, _ := strings.Cut(line, " ")
+		user = strings.TrimSpace(user)
+		if !ValidUserName(user) {
+			return nil, fmt.Errorf("%s:%d: want a certificate identity and a valid user name", fileName, n+1)
+		}
+		users[identity] = user
+	}
+	return users, nil
+}
+
+// Register creates an account, failing if the name is taken. On invite-only
+// instances invite must be an unused invite code, which it uses up;
+// otherwise it is ignored.
+func (a *Accounts) Register(user, password, invite string) error {
+	if !ValidUserName(user) {
+		return ErrInvalidUserName
+	}
+	if password == "" {
+		return ErrEmptyPassword
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	if _, exists := a.passwords[user]; exists {
+		return ErrUserExists
+	}
+	if a.InviteOnly {
+		key := tokenHash(invite)
+		issuer, ok := a.invites[key]
+		if invite == "" || !ok || strings.Contains(issuer, " ") {
+			return ErrInvalidInvite
+		}
+		a.invites[key] = issuer + " " + user
+		pairfile.Write(a.invitesPath, a.invites)
+	}
+	a.passwords[user] = hashPassword(password)
+	pairfile.Write(a.passwordsPath, a.passwords)
+	return nil
+}
+
+// Delete removes user's account with its API tokens, SSH keys, tier and
+// role, freeing the name. Invites the user issued or redeemed stay on
+// record. What becomes of the user's snippets is up to the caller.
+func (a *Accounts) Delete(user string) error {
+	a.Lock()
+	defer a.Unlock()
+
+	if _, exists := a.passwords[user]; !exists {
+		return ErrNoSuchUser
+	}
+	delete(a.passwords, user)
+	pairfile.Write(a.passwordsPath, a.passwords)
+	if deleteValue(a.tokens, user) {
+		pairfile.Write(a.tokensPath, a.tokens)
+	}
+	if deleteValue(a.sshKeys, user) {
+		pairfile.Write(a.sshKeysPath, a.sshKeys)
+	}
+	if _, ok := a.tiers[user]; ok {
+		delete(a.tiers, user)
+		pairfile.Write(a.tiersPath, a.tiers)
+	}
+	if _, ok := a.roles[user]; ok {
+		delete(a.roles, user)
+		pairfile.Write(a.rolesPath, a.roles)
+	}
+	if _, ok := a.github[user]; ok {
+		delete(a.github, user)
+		a.saveGitHub()
+	}
+	return nil
+}
+
+// deleteValue deletes the entries of m whose value is value, reporting
+// whether there were any.
+func deleteValue(m map[string]string, value string) bool {
+	deleted := false
+	for key, v := range m {
+		if v == value {
+			delete(m, key)
+			deleted = true
+		}
+	}
+	return deleted
+}
+
+// CreateInvite issues a single-use invite code on behalf of issuer, who may
+// have issued at most budget codes in all; a budget of zero or less is
+// unlimited. Only the code's hash is stored, so it is shown once.
+func (a *Accounts) CreateInvite(issuer string, budget int) (string, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	if issued, _ := a.countInvites(issuer); budget > 0 && issued >= budget {
+		return "", ErrInviteBudget
+	}
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		panic("unable to generate invite code: " + err.Error())
+	}
+	code := hex.EncodeToString(raw)
+	a.invites[tokenHash(code)] = issuer
+	pairfile.Write(a.invitesPath, a.invites)
+	return code, nil
+}
+
+// Invites returns how many invite codes issuer has issued, and how many of
+// those were used to register.
+func (a *Accounts) Invites(issuer string) (issued, redeemed int) {
+	a.Lock()
+	defer a.Unlock()
+	return a.countInvites(issuer)
+}
+
+// countInvites is Invites for callers holding the lock.
+func (a *Accounts) countInvites(issuer string) (issued, redeemed int) {
+	for _, value := range a.invites {
+		by, _, used := strings.Cut(value, " ")
+		if by == issuer {
+			issued++
+			if used {
+				redeemed++
+			}
+		}
+	}
+	return issued, redeemed
+}
+
+// IssueToken creates a new API token for user. Only its hash is stored, so
+// the token is shown to the user once.
+func (a *Accounts) IssueToken(user string) string {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		panic("unable to generate API token: " + err.Error())
+	}
+	token := hex.EncodeToString(raw)
+
+	a.Lock()
+	defer a.Unlock()
+
+	a.tokens[tokenHash(token)] = user
+	pairfile.Write(a.tokensPath, a.tokens)
+	return token
+}
+
+// Tier returns the service tier assigned to user, or "" if none was.
+func (a *Accounts) Tier(user string) string {
+	a.Lock()
+	defer a.Unlock()
+	return a.tiers[user]
+}
+
+// SetTier assigns user a service tier; an empty tier removes the
+// assignment. The caller decides which tier names are valid.
+func (a *Accounts) SetTier(user, tier string) error {
+	a.Lock()
+	defer a.Unlock()
+
+	if _, exists := a.passwords[user]; !exists {
+		return ErrNoSuchUser
+	}
+	if tier == "" {
+		delete(a.tiers, user)
+	} else {
+		a.tiers[user] = tier
+	}
+	pairfile.Write(a.tiersPath, a.tiers)
+	return nil
+}
+
+// Errors returned by Register, Delete, CreateInvite, SetTier, SetRole and
+// SetGitHubToken.
+var (
+	ErrInvalidUserName    = errors.New("invalid user name")
+	ErrEmptyPassword      = errors.New("password must not be empty")
+	ErrUserExists         = errors.New("user name is already taken")
+	ErrNoSuchUser         = errors.New("no such user")
+	ErrInvalidInvite      = errors.New("a valid, unused invite code is required")
+	ErrInviteBudget       = errors.New("invite budget used up")
+	ErrInvalidRole        = errors.New("role must be admin, moderator or empty")
+	ErrInvalidGitHubToken = errors.New("GitHub token must not be empty or contain spaces")
+)
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ValidUserName reports whether name can be used as a user name.
+func ValidUserName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, " /\n")
+}
+
+func hashPassword(password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		panic("unable to hash password: " + err.Error())
+	}
+	return string(hash)
+}
+
+// legacySaltedHash matches the "salt:sha256(salt+password)" entries written
+// before passwords were hashed with bcrypt.
+var legacySaltedHash = regexp.MustCompile(`^[0-9a-f]{32}:[0-9a-f]{64}$`)
+
+// checkPassword verifies password against a stored entry. outdated reports
+// an entry that should be rehashed with bcrypt now that the password is known.
+func checkPassword(stored, password string) (ok, outdated bool) {
+	switch {
+	case strings.HasPrefix(stored, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil, false
+	case legacySaltedHash.MatchString(stored):
+		salt, _, _ := strings.Cut(stored, ":")
+		sum := sha256.Sum256([]byte(salt + password))
+		expected := salt + ":" + hex.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(expected)) == 1, true
+	default:
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1, true
+	}
+}
+
+// migratePlaintextPasswords hashes entries that were stored in the clear.
+// Legacy salted hashes cannot be converted without the password and are
+// upgraded on the user's next successful login instead.
+func (a *Accounts) migratePlaintextPasswords() {
+	migrated := 0
+	for user, stored := range a.passwords {
+		if strings.HasPrefix(stored, "$2") || legacySaltedHash.MatchString(stored) {
+			continue
+		}
+		a.passwords[user] = hashPassword(stored)
+		migrated++
+	}
+	if migrated > 0 {
+		pairfile.Write(a.passwordsPath, a.passwords)
+		slog.Info("Hashed plaintext passwords", "count", migrated)
+	}
+}
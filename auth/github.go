@@ -0,0 +1,66 @@
+// Package auth implements GitHub tokens, which users give pb so that it can
+// mirror their pastes to Gists on their behalf. Unlike passwords and API
+// tokens they have to be kept usable, so github.txt holds them as given,
+// with whether to mirror every paste or only those pushed explicitly, and
+// is written readable by its owner only.
+package auth
+
+import (
+	"strings"
+
+	"pb/internal/atomicfile"
+	"pb/internal/pairfile"
+)
+
+// SetGitHubToken gives user's GitHub token, and whether their pastes are
+// mirrored as they are created and updated.
+func (a *Accounts) SetGitHubToken(user, token string, mirror bool) error {
+	if token == "" || strings.ContainsAny(token, " \r\n") {
+		return ErrInvalidGitHubToken
+	}
+	a.Lock()
+	defer a.Unlock()
+
+	if _, exists := a.passwords[user]; !exists {
+		return ErrNoSuchUser
+	}
+	flag := "0"
+	if mirror {
+		flag = "1"
+	}
+	a.github[user] = flag + " " + token
+	a.saveGitHub()
+	return nil
+}
+
+// GitHubToken returns user's GitHub token and whether to mirror all their
+// pastes, and false if they gave none.
+func (a *Accounts) GitHubToken(user string) (token string, mirror, ok bool) {
+	a.Lock()
+	defer a.Unlock()
+
+	flag, token, ok := strings.Cut(a.github[user], " ")
+	return token, flag == "1", ok
+}
+
+// RemoveGitHubToken forgets user's GitHub token, reporting whether they
+// had given one.
+func (a *Accounts) RemoveGitHubToken(user string) bool {
+	a.Lock()
+	defer a.Unlock()
+
+	if _, ok := a.github[user]; !ok {
+		return false
+	}
+	delete(a.github, user)
+	a.saveGitHub()
+	return true
+}
+
+// saveGitHub writes github.txt, failing as pairfile.Write does; callers
+// hold the lock.
+func (a *Accounts) saveGitHub() {
+	if err := atomicfile.Write(a.githubPath, pairfile.Encode(a.github), 0600); err != nil {
+		panic("unable to write " + a.githubPath + ": " + err.Error())
+	}
+}
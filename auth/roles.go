@@ -0,0 +1,70 @@
+// Package auth implements roles, which grant users the admin endpoints on
+// top of what every account can do. Admins may do everything there, and
+// moderators what keeping abuse down takes: listing and deleting pastes,
+// reviewing flagged ones and banning addresses. Roles are kept in
+// roles.txt.
+package auth
+
+import (
+	"sort"
+
+	"pb/internal/pairfile"
+)
+
+// Roles a user can be granted.
+const (
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+)
+
+// Role returns the role granted to user, or "" if none was.
+func (a *Accounts) Role(user string) string {
+	a.Lock()
+	defer a.Unlock()
+	return a.roles[user]
+}
+
+// SetRole grants user role; an empty role revokes the grant.
+func (a *Accounts) SetRole(user, role string) error {
+	if role != "" && role != RoleAdmin && role != RoleModerator {
+		return ErrInvalidRole
+	}
+	a.Lock()
+	defer a.Unlock()
+
+	if _, exists := a.passwords[user]; !exists {
+		return ErrNoSuchUser
+	}
+	if role == "" {
+		delete(a.roles, user)
+	} else {
+		a.roles[user] = role
+	}
+	pairfile.Write(a.rolesPath, a.roles)
+	return nil
+}
+
+// Roles returns the users granted a role, mapped to it.
+func (a *Accounts) Roles() map[string]string {
+	a.Lock()
+	defer a.Unlock()
+
+	roles := make(map[string]string, len(a.roles))
+	for user, role := range a.roles {
+		roles[user] = role
+	}
+	return roles
+}
+
+// Users returns the names of all users, sorted.
+func (a *Accounts) Users() []string {
+	a.Lock()
+	defer a.Unlock()
+
+	users := make([]string, 0, len(a.passwords))
+	for user := range a.passwords {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	return users
+}
@@ -0,0 +1,86 @@
+// Package auth implements SSH public keys as credentials: users register
+// their keys over HTTP, and the SSH upload server looks up who a key
+// belongs to. Keys are kept by SHA256 fingerprint in sshkeys.txt.
+package auth
+
+import (
+	"context"
+	"errors"
+	"sort"
+
+	"golang.org/x/crypto/ssh"
+
+	"pb/internal/pairfile"
+)
+
+// ErrInvalidSSHKey is returned by AddSSHKey for lines that are not an
+// authorized_keys entry.
+var ErrInvalidSSHKey = errors.New("not an SSH public key in authorized_keys format")
+
+// ErrSSHKeyTaken is returned by AddSSHKey for a key another user added.
+var ErrSSHKeyTaken = errors.New("SSH key belongs to another user")
+
+type userKey struct{}
+
+// WithUser returns a copy of ctx marking requests made with it as user's.
+// Authenticate trusts it over any credentials, so it is only for requests
+// built in-process for a user authenticated some other way, e.g. over SSH.
+func WithUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// AddSSHKey registers the public key in authorizedKey, a line in
+// authorized_keys format, as user's, and returns its fingerprint.
+func (a *Accounts) AddSSHKey(user, authorizedKey string) (string, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+	if err != nil {
+		return "", ErrInvalidSSHKey
+	}
+	fingerprint := ssh.FingerprintSHA256(key)
+
+	a.Lock()
+	defer a.Unlock()
+
+	if owner, exists := a.sshKeys[fingerprint]; exists && owner != user {
+		return "", ErrSSHKeyTaken
+	}
+	a.sshKeys[fingerprint] = user
+	pairfile.Write(a.sshKeysPath, a.sshKeys)
+	return fingerprint, nil
+}
+
+// RemoveSSHKey removes one of user's keys by fingerprint, reporting whether
+// it was theirs.
+func (a *Accounts) RemoveSSHKey(user, fingerprint string) bool {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.sshKeys[fingerprint] != user {
+		return false
+	}
+	delete(a.sshKeys, fingerprint)
+	pairfile.Write(a.sshKeysPath, a.sshKeys)
+	return true
+}
+
+// SSHKeys returns the fingerprints of user's keys, sorted.
+func (a *Accounts) SSHKeys(user string) []string {
+	a.Lock()
+	defer a.Unlock()
+
+	var fingerprints []string
+	for fingerprint, owner := range a.sshKeys {
+		if owner == user {
+			fingerprints = append(fingerprints, fingerprint)
+		}
+	}
+	sort.Strings(fingerprints)
+	return fingerprints
+}
+
+// SSHUser returns the user key belongs to, or "" for unknown keys.
+func (a *Accounts) SSHUser(key ssh.PublicKey) string {
+	a.Lock()
+	defer a.Unlock()
+	return a.sshKeys[ssh.FingerprintSHA256(key)]
+}
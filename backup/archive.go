@@ -0,0 +1,167 @@
+// Package backup implements archives: a whole backup in one tar.gz file,
+// taken on demand rather than shipped as changes happen. An archive holds
+// the backup layout with a single snapshot, the journal up to it and the
+// blobs it refers to, so restoring one is restoring that backup. Given a
+// keyring, the archive is encrypted as a whole with its current key, which
+// also covers the index and the account files, stored in the clear
+// otherwise.
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"pb/store"
+)
+
+// WriteArchive writes an archive of st to w, with the account files, or
+// any other files, named by files. It returns the change the archive
+// restores to. Snippets whose content is gone by the time the archive
+// reaches them are left out, as a restore reports.
+func WriteArchive(w io.Writer, st *store.Store, files []string, keys *store.Keyring) (uint64, error) {
+	out := w
+	var sealed io.WriteCloser
+	if keys != nil {
+		var err error
+		if sealed, err = keys.SealStream(w); err != nil {
+			return 0, err
+		}
+		out = sealed
+	}
+	zw := gzip.NewWriter(out)
+	tw := tar.NewWriter(zw)
+
+	// The journal is read after the snapshot, so it reaches at least as far.
+	seq, snapshot := st.Snapshot()
+	now := time.Now()
+	add := func(name string, r io.Reader, size int64) error {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, ModTime: now}); err != nil {
+			return err
+		}
+		_, err := io.Copy(tw, r)
+		return err
+	}
+
+	var journal bytes.Buffer
+	var first uint64
+	for _, e := range st.BackupEntries(0) {
+		if e.Seq > seq {
+			break
+		}
+		if first == 0 {
+			first = e.Seq
+		}
+		journal.WriteString(e.Encode())
+	}
+	if journal.Len() > 0 {
+		if err := add(segmentName(first, seq), &journal, int64(journal.Len())); err != nil {
+			return 0, err
+		}
+	}
+	names := make([]string, 0, len(snapshot))
+	for name := range snapshot {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := add(snapshotDir(seq)+"/"+name, bytes.NewReader(snapshot[name]), int64(len(snapshot[name]))); err != nil {
+			return 0, err
+		}
+	}
+	for _, fileName := range files {
+		content, err := os.ReadFile(fileName)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if err := add("files/"+filepath.Base(fileName), bytes.NewReader(content), int64(len(content))); err != nil {
+			return 0, err
+		}
+	}
+	added := make(map[string]bool)
+	for _, line := range strings.Split(string(snapshot["index.txt"]), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || added[fields[1]] {
+			continue
+		}
+		id, hash := fields[0], fields[1]
+		r, size, ok := st.OpenBlob(id, hash)
+		if !ok {
+			continue
+		}
+		err := add("blobs/"+hash, r, size)
+		r.Close()
+		if err != nil {
+			return 0, err
+		}
+		added[hash] = true
+	}
+
+	if err := tw.Close(); err != nil {
+		return 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+	if sealed != nil {
+		if err := sealed.Close(); err != nil {
+			return 0, err
+		}
+	}
+	return seq, nil
+}
+
+// RestoreArchive writes the store archived in r into dir, as Restore does
+// for a backup. keys decrypts an encrypted archive.
+func RestoreArchive(ctx context.Context, r io.Reader, dir string, keys *store.Keyring) (RestoreResult, error) {
+	br := bufio.NewReader(r)
+	r = br
+	if magic, _ := br.Peek(len("pbstr1")); store.IsSealedStream(magic) {
+		var err error
+		if r, err = keys.OpenStream(br); err != nil {
+			return RestoreResult{}, err
+		}
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return RestoreResult{}, fmt.Errorf("not an archive: %w", err)
+	}
+
+	tmp, err := os.MkdirTemp("", "pb-archive-")
+	if err != nil {
+		return RestoreResult{}, err
+	}
+	defer os.RemoveAll(tmp)
+	target := dirTarget(tmp)
+	tr := tar.NewReader(zr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return RestoreResult{}, err
+		}
+		if h.Typeflag != tar.TypeReg || path.Clean(h.Name) != h.Name || strings.HasPrefix(h.Name, "../") {
+			return RestoreResult{}, fmt.Errorf("unexpected %s in archive", h.Name)
+		}
+		if err := target.Put(ctx, h.Name, tr, h.Size); err != nil {
+			return RestoreResult{}, err
+		}
+	}
+	return Restore(ctx, target, dir, 0)
+}
@@ -0,0 +1,114 @@
+// Package backup implements restoring: rebuilding a store directory from a
+// backup as of its latest change or an earlier one.
+package backup
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"pb/store"
+)
+
+// RestoreResult describes a restore.
+type RestoreResult struct {
+	// Snapshot is the snapshot restored from and Seq the last change
+	// replayed on top of it.
+	Snapshot, Seq uint64
+	// Missing are the snippets left out because the backup lacks their
+	// content.
+	Missing []string
+}
+
+// Restore writes the store backed up in target into dir as of change upto,
+// or the latest change for 0. dir should hold no store yet.
+func Restore(ctx context.Context, target Target, dir string, upto uint64) (RestoreResult, error) {
+	names, err := target.List(ctx, "")
+	if err != nil {
+		return RestoreResult{}, err
+	}
+	var snapshots []uint64
+	var segments []string
+	var latest uint64
+	for _, name := range names {
+		if _, last, ok := parseSegmentName(name); ok {
+			segments = append(segments, name)
+			latest = max(latest, last)
+		} else if strings.HasPrefix(name, "snapshots/") && path.Base(name) == "index.txt" {
+			if seq, err := strconv.ParseUint(path.Base(path.Dir(name)), 10, 64); err == nil {
+				snapshots = append(snapshots, seq)
+				latest = max(latest, seq)
+			}
+		}
+	}
+	if upto == 0 || upto > latest {
+		upto = latest
+	}
+	var result RestoreResult
+	found := false
+	for _, seq := range snapshots {
+		if seq <= upto && (!found || seq > result.Snapshot) {
+			result.Snapshot, found = seq, true
+		}
+	}
+	if !found {
+		return RestoreResult{}, fmt.Errorf("backup has no snapshot at or before change %d", upto)
+	}
+
+	files := make(map[string][]byte)
+	for _, name := range names {
+		if dir, file := path.Split(name); dir == snapshotDir(result.Snapshot)+"/" || dir == "files/" {
+			if files[file], err = readAll(ctx, target, name); err != nil {
+				return RestoreResult{}, err
+			}
+		}
+	}
+
+	// Segments overlap where a segment reached the target but its round
+	// failed anyway and was retried; each change counts once.
+	slices.Sort(segments)
+	var journal []store.BackupEntry
+	var next uint64 = 1
+	for _, name := range segments {
+		if first, _, _ := parseSegmentName(name); first > upto {
+			break
+		}
+		content, err := readAll(ctx, target, name)
+		if err != nil {
+			return RestoreResult{}, err
+		}
+		scanner := bufio.NewScanner(strings.NewReader(string(content)))
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			e, err := store.DecodeBackupEntry(scanner.Text())
+			if err != nil {
+				return RestoreResult{}, fmt.Errorf("%s: %w", name, err)
+			}
+			if e.Seq >= next && e.Seq <= upto {
+				journal = append(journal, e)
+				next = e.Seq + 1
+			}
+		}
+	}
+	result.Seq = max(result.Snapshot, next-1)
+
+	blob := func(hash string) (io.ReadCloser, error) {
+		return target.Get(ctx, "blobs/"+hash)
+	}
+	result.Missing, err = store.Restore(dir, result.Snapshot, files, journal, upto, blob)
+	return result, err
+}
+
+func readAll(ctx context.Context, target Target, name string) ([]byte, error) {
+	r, err := target.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
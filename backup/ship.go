@@ -0,0 +1,198 @@
+// Package backup implements shipping: a loop that sends the store's new
+// journal entries every interval, with the contents they refer to, and a
+// snapshot every so often.
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"pb/internal/clock"
+	"pb/store"
+)
+
+// ShipOptions configures Ship.
+type ShipOptions struct {
+	// Interval is how often new changes are shipped.
+	Interval time.Duration
+	// SnapshotEvery is how often a snapshot is taken, if there have been
+	// changes since the last one. Restores replay the journal from the
+	// last snapshot, so this bounds how much they replay.
+	SnapshotEvery time.Duration
+	// Files are further files, by path, shipped whenever they change and
+	// copied back into the store directory by Restore, as last shipped
+	// whatever change it restores to. The accounts are such files.
+	Files []string
+	// Clock times snapshots; nil means the system clock.
+	Clock clock.Clock
+}
+
+// segmentName names the journal segment holding changes first to last.
+// The numbers are padded so that names sort in order.
+func segmentName(first, last uint64) string {
+	return fmt.Sprintf("journal/%020d-%020d.txt", first, last)
+}
+
+func parseSegmentName(name string) (first, last uint64, ok bool) {
+	base, ok := strings.CutSuffix(strings.TrimPrefix(name, "journal/"), ".txt")
+	a, b, cut := strings.Cut(base, "-")
+	first, errA := strconv.ParseUint(a, 10, 64)
+	last, errB := strconv.ParseUint(b, 10, 64)
+	return first, last, ok && cut && errA == nil && errB == nil && first <= last
+}
+
+func snapshotDir(seq uint64) string {
+	return fmt.Sprintf("snapshots/%020d", seq)
+}
+
+// shipper is the state of Ship between rounds.
+type shipper struct {
+	st     *store.Store
+	target Target
+	opts   ShipOptions
+	// shipped is the last change shipped and snapshotted the last change
+	// snapshotted, if haveSnapshot, at lastSnapshot.
+	shipped, snapshotted uint64
+	haveSnapshot         bool
+	lastSnapshot         time.Time
+	// blobs are the contents the target holds, and files the content of
+	// each of opts.Files as last shipped.
+	blobs map[string]bool
+	files map[string]string
+}
+
+// Ship sends st's changes to target until ctx is done, picking up after
+// the last change the target holds. It refuses to ship to a target holding
+// changes st hasn't got, such as the backup of another store or one st was
+// restored from to an earlier change; such a store needs a new target.
+func Ship(ctx context.Context, st *store.Store, target Target, opts ShipOptions) error {
+	if opts.Clock == nil {
+		opts.Clock = clock.System
+	}
+	s := &shipper{st: st, target: target, opts: opts, blobs: make(map[string]bool), files: make(map[string]string)}
+	if err := s.resume(ctx); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+	for {
+		if err := s.round(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("Backup failed; retrying", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// resume learns what the target already holds.
+func (s *shipper) resume(ctx context.Context) error {
+	names, err := s.target.List(ctx, "")
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		switch {
+		case strings.HasPrefix(name, "blobs/"):
+			s.blobs[strings.TrimPrefix(name, "blobs/")] = true
+		case strings.HasPrefix(name, "journal/"):
+			if _, last, ok := parseSegmentName(name); ok {
+				s.shipped = max(s.shipped, last)
+			}
+		case strings.HasPrefix(name, "snapshots/") && path.Base(name) == "index.txt":
+			if seq, err := strconv.ParseUint(path.Base(path.Dir(name)), 10, 64); err == nil {
+				s.snapshotted, s.haveSnapshot = max(s.snapshotted, seq), true
+			}
+		}
+	}
+	if seq, _ := s.st.Snapshot(); s.shipped > seq {
+		return fmt.Errorf("backup holds changes up to %d but the store only has %d; back it up to a new destination", s.shipped, seq)
+	}
+	return nil
+}
+
+// round ships the changes since the last round, and a snapshot if one is due.
+func (s *shipper) round(ctx context.Context) error {
+	entries := s.st.BackupEntries(s.shipped)
+	if len(entries) > 0 {
+		var segment bytes.Buffer
+		for _, e := range entries {
+			if err := s.shipBlob(ctx, e.Line); err != nil {
+				return err
+			}
+			segment.WriteString(e.Encode())
+		}
+		first, last := entries[0].Seq, entries[len(entries)-1].Seq
+		if err := s.target.Put(ctx, segmentName(first, last), bytes.NewReader(segment.Bytes()), int64(segment.Len())); err != nil {
+			return err
+		}
+		s.shipped = last
+	}
+	for _, fileName := range s.opts.Files {
+		content, err := os.ReadFile(fileName)
+		if err != nil || string(content) == s.files[fileName] {
+			continue
+		}
+		if err := s.target.Put(ctx, "files/"+filepath.Base(fileName), bytes.NewReader(content), int64(len(content))); err != nil {
+			return err
+		}
+		s.files[fileName] = string(content)
+	}
+
+	now := s.opts.Clock.Now()
+	if s.haveSnapshot && s.snapshotted >= s.shipped || now.Sub(s.lastSnapshot) < s.opts.SnapshotEvery {
+		return nil
+	}
+	seq, files := s.st.Snapshot()
+	for _, line := range strings.Split(string(files["index.txt"]), "\n") {
+		if err := s.shipBlob(ctx, line); err != nil {
+			return err
+		}
+	}
+	// index.txt goes last: a snapshot without one is incomplete and
+	// Restore ignores it.
+	index := files["index.txt"]
+	delete(files, "index.txt")
+	for name, content := range files {
+		if err := s.target.Put(ctx, snapshotDir(seq)+"/"+name, bytes.NewReader(content), int64(len(content))); err != nil {
+			return err
+		}
+	}
+	if err := s.target.Put(ctx, snapshotDir(seq)+"/index.txt", bytes.NewReader(index), int64(len(index))); err != nil {
+		return err
+	}
+	s.snapshotted, s.haveSnapshot, s.lastSnapshot = seq, true, now
+	slog.Info("Backed up snapshot", "seq", seq)
+	return nil
+}
+
+// shipBlob ships the content of the snippet whose index line is line,
+// unless the target already has it. Content gone from the store since
+// can't be shipped, and restores leave its snippet out.
+func (s *shipper) shipBlob(ctx context.Context, line string) error {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || s.blobs[fields[1]] {
+		return nil
+	}
+	id, hash := fields[0], fields[1]
+	r, size, ok := s.st.OpenBlob(id, hash)
+	if !ok {
+		return nil
+	}
+	defer r.Close()
+	if err := s.target.Put(ctx, "blobs/"+hash, r, size); err != nil {
+		return err
+	}
+	s.blobs[hash] = true
+	return nil
+}
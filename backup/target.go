@@ -0,0 +1,113 @@
+// Package backup implements continuous backups of a pb store to another
+// directory, typically on another disk or host, or to an S3 bucket. A
+// backup holds the store's change journal, shipped in segments as changes
+// happen, periodic snapshots of its index, and every snippet content the
+// journal or a snapshot refers to, named by hash. Restoring replays the
+// journal on top of the last snapshot before the wanted change, so a store
+// can be brought back as of any change shipped.
+//
+// The layout of a backup is:
+//
+//	blobs/{hash}                  snippet content, as stored (encrypted with -key-file)
+//	journal/{first}-{last}.txt    the changes numbered first to last
+//	snapshots/{seq}/{file}        index.txt and comments.txt as of change seq
+//	files/{file}                  the account files, as last changed
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"pb/internal/atomicfile"
+)
+
+// ErrNotFound is returned by Target.Get for a name the target doesn't hold.
+var ErrNotFound = errors.New("not found")
+
+// Target is where backups are kept. Names are slash-separated paths.
+type Target interface {
+	// Put stores size bytes read from r as name, replacing what was there.
+	Put(ctx context.Context, name string, r io.Reader, size int64) error
+	// Get opens name, or returns ErrNotFound.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	// List returns the names starting with prefix, in no particular order.
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// Open returns the target at dest: "s3://bucket/prefix" for an S3 bucket,
+// configured from the environment as described for NewS3, or otherwise the
+// path of a directory, created if missing.
+func Open(dest string) (Target, error) {
+	if rest, ok := strings.CutPrefix(dest, "s3://"); ok {
+		bucket, prefix, _ := strings.Cut(rest, "/")
+		if bucket == "" {
+			return nil, fmt.Errorf("%s: no bucket", dest)
+		}
+		return NewS3(bucket, prefix)
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return nil, err
+	}
+	return dirTarget(dest), nil
+}
+
+// dirTarget keeps a backup in a local directory.
+type dirTarget string
+
+func (d dirTarget) path(name string) string {
+	return filepath.Join(string(d), filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (d dirTarget) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	fileName := d.path(name)
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(fileName), "."+filepath.Base(fileName)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // fails harmlessly once renamed
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return atomicfile.Rename(f.Name(), fileName)
+}
+
+func (d dirTarget) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	f, err := os.Open(d.path(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+func (d dirTarget) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	err := filepath.WalkDir(string(d), func(p string, e fs.DirEntry, err error) error {
+		if err != nil || e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			return err
+		}
+		rel, err := filepath.Rel(string(d), p)
+		if name := filepath.ToSlash(rel); err == nil && strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return err
+	})
+	return names, err
+}
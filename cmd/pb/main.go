@@ -0,0 +1,389 @@
+// Command pb is the command line client for a pb server. It uploads a file
+// or standard input as the multipart form the server accepts (the content
+// in field "f:1", options in "ext:1", "read:1", "ttl:1" and "view_pass"),
+// updates or deletes pastes, and authenticates with the server's entry in
+// ~/.netrc. When a server under attack asks anonymous uploads for proof of
+// work, it solves the challenge and retries. If $PB_SIGNING_KEY is set to "<key ID>:<base64 secret>", uploads,
+// updates and deletes are signed for servers run with -signing-keys.
+//
+//	pb [-f file] [-e ext] [-r reads] [-x ttl] [-p password] [-private] [-encrypt]
+//	pb -u id [-t token] [-f file]
+//	pb -d id [-t token]
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/bits"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "pb:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	defaultServer := os.Getenv("PB_SERVER")
+	if defaultServer == "" {
+		defaultServer = "http://localhost:8080"
+	}
+	fs := flag.NewFlagSet("pb", flag.ContinueOnError)
+	server := fs.String("server", defaultServer, "pb server to talk to (default $PB_SERVER)")
+	file := fs.String("f", "", "file to paste instead of standard input")
+	ext := fs.String("e", "", "language to highlight the paste as, e.g. go (default the file's extension)")
+	reads := fs.Int("r", 0, "delete the paste after this many reads")
+	ttl := fs.String("x", "", "delete the paste after this long, in seconds or e.g. 90m or 7d")
+	viewPass := fs.String("p", "", "password readers must give to view the paste")
+	update := fs.String("u", "", "replace the content of paste `id`")
+	del := fs.String("d", "", "delete paste `id`")
+	token := fs.String("t", os.Getenv("PB_TOKEN"), "edit token of the anonymous paste to update or delete (default $PB_TOKEN)")
+	encrypt := fs.Bool("encrypt", false, "encrypt before uploading; the key is only in the printed URL's #fragment")
+	private := fs.Bool("private", false, "keep the paste out of the public listing")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q; use -f to paste a file", fs.Arg(0))
+	}
+	if *update != "" && *del != "" {
+		return errors.New("-u and -d are mutually exclusive")
+	}
+
+	base, err := url.Parse(*server)
+	if err != nil {
+		return err
+	}
+	if *del != "" {
+		req, err := http.NewRequest(http.MethodDelete, base.JoinPath(*del).String(), nil)
+		if err != nil {
+			return err
+		}
+		if *token != "" {
+			req.Header.Set("X-Paste-Token", *token)
+		}
+		_, _, err = send(req, http.StatusOK)
+		return err
+	}
+
+	var in io.Reader = os.Stdin
+	name := "-"
+	if *file != "" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in, name = f, filepath.Base(*file)
+	}
+	content, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+
+	if *update != "" {
+		body, contentType, err := form(name, content, nil)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequest(http.MethodPut, base.JoinPath(*update).String(), body)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", contentType)
+		if *token != "" {
+			req.Header.Set("X-Paste-Token", *token)
+		}
+		pasteURL, _, err := send(req, http.StatusOK)
+		if err != nil {
+			return err
+		}
+		fmt.Println(pasteURL)
+		return nil
+	}
+
+	fields := map[string]string{"ext:1": *ext, "ttl:1": *ttl, "view_pass": *viewPass}
+	if *reads > 0 {
+		fields["read:1"] = strconv.Itoa(*reads)
+	}
+	query := url.Values{}
+	if *private {
+		query.Set("private", "1")
+	}
+	var key []byte
+	if *encrypt {
+		if key, content, err = sealPaste(content); err != nil {
+			return err
+		}
+		query.Set("encrypted", "1")
+	}
+	body, contentType, err := form(name, content, fields)
+	if err != nil {
+		return err
+	}
+	target := *base
+	target.RawQuery = query.Encode()
+	req, err := http.NewRequest(http.MethodPost, target.String(), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if _, _, ok := netrcAuth(base.Hostname()); !ok {
+		solveAhead(req, base)
+	}
+	pasteURL, header, err := send(req, http.StatusCreated)
+	var challenge *challengeError
+	if errors.As(err, &challenge) {
+		fmt.Fprintf(os.Stderr, "pb: server is under load, solving a %d-bit proof of work\n", challenge.difficulty)
+		retry := req.Clone(req.Context())
+		if retry.Body, err = req.GetBody(); err != nil {
+			return err
+		}
+		retry.Header.Set("X-PoW-Challenge", challenge.challenge)
+		retry.Header.Set("X-PoW-Nonce", challenge.solve())
+		pasteURL, header, err = send(retry, http.StatusCreated)
+	}
+	if err != nil {
+		return err
+	}
+	if t := header.Get("X-Paste-Token"); t != "" {
+		fmt.Fprintln(os.Stderr, "edit token:", t)
+	}
+	if key != nil {
+		pasteURL += "#" + base64.RawURLEncoding.EncodeToString(key)
+	}
+	fmt.Println(pasteURL)
+	return nil
+}
+
+// form encodes content as the file in field "f:1", followed by the non-empty
+// fields.
+func form(name string, content []byte, fields map[string]string) (io.Reader, string, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, err := mw.CreateFormFile("f:1", name)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := fw.Write(content); err != nil {
+		return nil, "", err
+	}
+	for field, value := range fields {
+		if value == "" {
+			continue
+		}
+		if err := mw.WriteField(field, value); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, "", err
+	}
+	return &buf, mw.FormDataContentType(), nil
+}
+
+// send makes req with the server's netrc credentials, if any, and returns
+// the trimmed response body and the headers if the status is want.
+func send(req *http.Request, want int) (string, http.Header, error) {
+	if login, password, ok := netrcAuth(req.URL.Hostname()); ok {
+		req.SetBasicAuth(login, password)
+	}
+	if err := sign(req); err != nil {
+		return "", nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", nil, err
+	}
+	if c := resp.Header.Get("X-PoW-Challenge"); resp.StatusCode == http.StatusPreconditionRequired && c != "" {
+		difficulty, _ := strconv.Atoi(resp.Header.Get("X-PoW-Difficulty"))
+		return "", nil, &challengeError{challenge: c, difficulty: difficulty}
+	}
+	if resp.StatusCode != want {
+		return "", nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return strings.TrimSpace(string(body)), resp.Header, nil
+}
+
+// solveAhead asks the server whether anonymous uploads need proof of work
+// and, if they do, solves a challenge for req, so that it isn't refused
+// and sent again. Servers that don't know of proof of work are left be.
+func solveAhead(req *http.Request, base *url.URL) {
+	resp, err := http.Get(base.JoinPath("api/v1/pow").String())
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	var pow struct {
+		Required   bool   `json:"required"`
+		Challenge  string `json:"challenge"`
+		Difficulty int    `json:"difficulty"`
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&pow) != nil || !pow.Required {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "pb: server is under load, solving a %d-bit proof of work\n", pow.Difficulty)
+	challenge := &challengeError{challenge: pow.Challenge, difficulty: pow.Difficulty}
+	req.Header.Set("X-PoW-Challenge", challenge.challenge)
+	req.Header.Set("X-PoW-Nonce", challenge.solve())
+}
+
+// challengeError is a proof-of-work challenge the server answered with.
+type challengeError struct {
+	challenge  string
+	difficulty int
+}
+
+func (e *challengeError) Error() string {
+	return fmt.Sprintf("server requires a %d-bit proof of work", e.difficulty)
+}
+
+// solve finds a nonce such that the SHA-256 of the challenge followed by
+// it starts with difficulty zero bits.
+func (e *challengeError) solve() string {
+	for n := 0; ; n++ {
+		nonce := strconv.Itoa(n)
+		sum := sha256.Sum256([]byte(e.challenge + nonce))
+		zeros := 0
+		for _, b := range sum {
+			zeros += bits.LeadingZeros8(b)
+			if b != 0 {
+				break
+			}
+		}
+		if zeros >= e.difficulty {
+			return nonce
+		}
+	}
+}
+
+// sign adds an HMAC signature to req with the key in $PB_SIGNING_KEY, if
+// any, as the server's -signing-keys option requires.
+func sign(req *http.Request) error {
+	spec := os.Getenv("PB_SIGNING_KEY")
+	if spec == "" {
+		return nil
+	}
+	keyID, encoded, ok := strings.Cut(spec, ":")
+	secret, err := base64.StdEncoding.DecodeString(encoded)
+	if !ok || err != nil {
+		return errors.New("PB_SIGNING_KEY must be <key ID>:<base64 secret>")
+	}
+	var body []byte
+	if req.GetBody != nil {
+		rc, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+		if body, err = io.ReadAll(rc); err != nil {
+			return err
+		}
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s\n", req.Method, req.URL.RequestURI(), timestamp, hex.EncodeToString(nonce), hex.EncodeToString(bodyHash[:]))
+	req.Header.Set("X-Pb-Key", keyID)
+	req.Header.Set("X-Pb-Timestamp", timestamp)
+	req.Header.Set("X-Pb-Nonce", hex.EncodeToString(nonce))
+	req.Header.Set("X-Pb-Signature", hex.EncodeToString(mac.Sum(nil)))
+	return nil
+}
+
+// netrcAuth looks up the login and password for host in $NETRC, by default
+// ~/.netrc, falling back to its default entry.
+func netrcAuth(host string) (login, password string, ok bool) {
+	path := os.Getenv("NETRC")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", "", false
+		}
+		path = filepath.Join(home, ".netrc")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", false
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Split(bufio.ScanWords)
+	next := func() string {
+		sc.Scan()
+		return sc.Text()
+	}
+	// Entries run from one "machine" or "default" token to the next.
+	for sc.Scan() {
+		switch sc.Text() {
+		case "machine", "default":
+			if ok {
+				return login, password, true
+			}
+			ok = sc.Text() == "default" || next() == host
+		case "login":
+			if v := next(); ok {
+				login = v
+			}
+		case "password":
+			if v := next(); ok {
+				password = v
+			}
+		}
+	}
+	return login, password, ok
+}
+
+// sealPaste encrypts content with a fresh AES-256-GCM key, in the format
+// the browser viewer expects: base64 of the 12-byte nonce followed by the
+// ciphertext.
+func sealPaste(content []byte) (key, sealed []byte, err error) {
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	raw := aead.Seal(nonce, nonce, content, nil)
+	return key, []byte(base64.StdEncoding.EncodeToString(raw)), nil
+}
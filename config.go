@@ -0,0 +1,360 @@
+// Package main implements the command line configuration of the server.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"pb/auth"
+	"pb/httpapi"
+	"pb/internal/clock"
+	"pb/store"
+)
+
+// In -deterministic mode the clock stays at deterministicTime and IDs are
+// drawn from a generator seeded with deterministicSeed.
+var deterministicTime = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+const deterministicSeed = 1
+
+type config struct {
+	plugins       stringList
+	policyFile    string
+	blocklist     string
+	contentFilter string
+	dedup         store.DedupPolicy
+	disposal      store.DisposalPolicy
+	dir           string
+	database      string
+	admins        stringList
+	// disabled lists the features switched off at startup.
+	disabled   stringList
+	webhooks   stringList
+	inviteOnly bool
+
+	maxPasteSize       byteSize
+	maxBinarySize      byteSize
+	maxMultipartMemory byteSize
+
+	rateLimit float64
+	rateBurst int
+	ipFilter  string
+	// powDifficulty is how many leading zero bits proof-of-work
+	// challenges take; zero never challenges.
+	powDifficulty int
+
+	primary         *url.URL
+	replicaInterval time.Duration
+	// redis, if set, is the Redis that servers share read limits and rate
+	// limits through, and redisURL the flag it was parsed from.
+	redis    *redis.Options
+	redisURL string
+
+	// shadowTo, if set, is where shadowPercent of reads are also sent.
+	shadowTo      *url.URL
+	shadowPercent float64
+
+	backupTo            string
+	backupInterval      time.Duration
+	backupSnapshotEvery time.Duration
+
+	concurrency   httpapi.ConcurrencyLimits
+	memoryLimit   byteSize
+	anomalyWindow time.Duration
+
+	statsEpsilon   float64
+	statsThreshold int
+
+	robots  string
+	sitemap bool
+
+	updateCheck time.Duration
+	updateURL   string
+	githubAPI   string
+
+	logFormat   string
+	keys        *store.Keyring
+	signingKeys map[string][]byte
+
+	sshAddr    string
+	sshHostKey string
+	urlHost    string
+
+	dnsAddr    string
+	dnsZone    string
+	dnsMaxSize byteSize
+
+	addr          string
+	redirectAddr  string
+	tlsCert       string
+	tlsKey        string
+	autocertHosts []string
+	autocertEmail string
+	clientCA      string
+	certUsers     map[string]string
+
+	trustedProxies []netip.Prefix
+
+	// clock is set, to a stopped one, in -deterministic mode.
+	clock clock.Clock
+	// validateConfig checks the configuration and exits instead of serving.
+	validateConfig bool
+	// fsckOnStart checks the store, without repairing it, before serving.
+	fsckOnStart bool
+
+	// flagArgs are the arguments that set the flags above and command is
+	// whatever followed them.
+	flagArgs []string
+	command  []string
+}
+
+// stringList is a flag that may be given more than once.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// byteSize is a flag holding a size in bytes, with an optional KiB, MiB or
+// GiB suffix.
+type byteSize int64
+
+func (b *byteSize) String() string { return strconv.FormatInt(int64(*b), 10) }
+
+func (b *byteSize) Set(value string) error {
+	multiplier := int64(1)
+	for suffix, m := range map[string]int64{"KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30} {
+		if strings.HasSuffix(value, suffix) {
+			value, multiplier = strings.TrimSuffix(value, suffix), m
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("invalid size %q", value)
+	}
+	*b = byteSize(n * multiplier)
+	return nil
+}
+
+func parseConfig(args []string) (*config, error) {
+	cfg := &config{}
+	fs := flag.NewFlagSet("pb", flag.ContinueOnError)
+	fs.Var(&cfg.plugins, "plugin", "path to a plugin executable (repeatable)")
+	fs.StringVar(&cfg.policyFile, "policy", "", "path to a file of create/read policy rules")
+	fs.StringVar(&cfg.contentFilter, "content-filter", "", "path to a file of content filters that reject or quarantine pastes on create and update")
+	fs.StringVar(&cfg.blocklist, "blocklist", "", "path to a moderation blocklist; matching public snippets are held for review")
+	fs.Var(&cfg.webhooks, "webhook", "URL to POST snippet events to as JSON (repeatable)")
+	fs.Var(&cfg.admins, "admin", "user name allowed to use the admin endpoints (repeatable)")
+	fs.Var(&cfg.disabled, "disable", "start with a feature switched off: search, renders, comments, ssh or collab (repeatable; admins switch them at /admin/features)")
+	fs.BoolVar(&cfg.inviteOnly, "invite-only", false, "require an invite code to register instead of claiming names on first use")
+	cfg.maxPasteSize = 1 << 20
+	cfg.maxMultipartMemory = 256 << 10
+	fs.Var(&cfg.maxPasteSize, "max-size", "largest accepted paste, e.g. 512KiB or 2MiB")
+	fs.Var(&cfg.maxBinarySize, "max-binary-size", "largest accepted binary paste, such as an image (default -max-size)")
+	fs.Var(&cfg.maxMultipartMemory, "max-multipart-memory", "memory held per multipart upload before spilling to disk")
+	fs.Float64Var(&cfg.rateLimit, "rate-limit", 30, "creates, updates and deletes per minute per IP (0 disables)")
+	fs.IntVar(&cfg.rateBurst, "rate-burst", 10, "mutations an IP may make back to back before -rate-limit applies")
+	fs.IntVar(&cfg.powDifficulty, "pow-difficulty", 0, "leading zero bits of proof of work anonymous creates must do while the rate limiter sees an attack, e.g. 20 (default 0, never)")
+	fs.StringVar(&cfg.ipFilter, "ip-filter", "", "file of \"allow PREFIX\" and \"deny PREFIX\" lines deciding which addresses may create and update pastes, over HTTP or SSH; reloaded on SIGHUP")
+	fs.IntVar(&cfg.concurrency.Creates, "max-concurrent-creates", 16, "creates and updates handled at once (0 for no limit)")
+	fs.IntVar(&cfg.concurrency.Renders, "max-concurrent-renders", 8, "highlighted and other rendered views produced at once (0 for no limit)")
+	fs.IntVar(&cfg.concurrency.Queue, "queue", 32, "requests per limited class that wait for a slot before being refused with 503")
+	fs.DurationVar(&cfg.concurrency.QueueTimeout, "queue-timeout", 10*time.Second, "how long a queued request waits for a slot")
+	fs.Var(&cfg.memoryLimit, "memory-limit", "memory use beyond which large pastes and rendered views are refused, e.g. 400MiB (default no limit)")
+	fs.DurationVar(&cfg.anomalyWindow, "anomaly-window", time.Minute, "window over which creations, failures and storage growth are compared with their baseline to raise alerts (0 disables)")
+	fs.Float64Var(&cfg.statsEpsilon, "stats-epsilon", 0, "privacy budget for public counts: add Laplace noise of scale 1/epsilon, e.g. 0.5 (default 0, exact counts)")
+	fs.IntVar(&cfg.statsThreshold, "stats-threshold", 0, "withhold public counts below this, after any noise")
+	fs.StringVar(&cfg.robots, "robots", "", "file to serve as /robots.txt (default: keep crawlers out of /api/ and /admin/ and point them at the sitemap)")
+	fs.BoolVar(&cfg.sitemap, "sitemap", true, "serve /sitemap.xml listing public pastes for search engines")
+	fs.DurationVar(&cfg.updateCheck, "update-check", 0, "look for a newer pb release this often, logging it and showing it in /version, e.g. 24h (default 0, never: nothing is fetched)")
+	fs.StringVar(&cfg.updateURL, "update-url", httpapi.DefaultReleasesURL, "where -update-check asks for the latest release, a GitHub-style releases API URL answering with tag_name")
+	fs.StringVar(&cfg.githubAPI, "github-api", httpapi.DefaultGitHubAPI, "GitHub API that users' pastes are mirrored to gists through, e.g. a GitHub Enterprise server's https://ghe.example.com/api/v3")
+	fs.StringVar(&cfg.logFormat, "log-format", "text", "log as text (key=value) or json")
+	keyFile := fs.String("key-file", "", "file of base64 AES-256 keys, current first, to encrypt snippet files with")
+	signingKeys := fs.String("signing-keys", "", "file of \"<key ID> <base64 secret>\" lines; if set, POST, PUT and DELETE requests must be HMAC-signed and uploads over SSH are refused")
+	fs.StringVar(&cfg.sshAddr, "ssh-addr", "", "accept uploads over SSH on this address, e.g. :2222 (default off)")
+	fs.StringVar(&cfg.sshHostKey, "ssh-host-key", "", "SSH host key file, created if missing (default ssh_host_ed25519_key in -dir)")
+	fs.StringVar(&cfg.urlHost, "url-host", "localhost:8080", "host, and port if any, of the URLs handed out over SSH")
+	fs.StringVar(&cfg.dnsAddr, "dns-addr", "", "experimental: serve pastes created with dns=1 as TXT records on this UDP address, e.g. :53 (default off)")
+	fs.StringVar(&cfg.dnsZone, "dns-zone", "", "domain the DNS responder serves pastes under, e.g. p.pb.example")
+	cfg.dnsMaxSize = 16 << 10
+	fs.Var(&cfg.dnsMaxSize, "dns-max-size", "largest paste that may be served over DNS, e.g. 8KiB")
+	fs.StringVar(&cfg.addr, "addr", ":8080", "address to serve HTTP, or HTTPS with -tls-cert or -autocert, on")
+	fs.StringVar(&cfg.redirectAddr, "redirect-addr", "", "also listen on this address, e.g. :80, redirecting plain HTTP to HTTPS (needs -tls-cert or -autocert)")
+	fs.StringVar(&cfg.tlsCert, "tls-cert", "", "PEM certificate to serve HTTPS with (needs -tls-key)")
+	fs.StringVar(&cfg.tlsKey, "tls-key", "", "PEM private key for -tls-cert")
+	autocertHosts := fs.String("autocert", "", "comma-separated host names to get Let's Encrypt certificates for and serve HTTPS with")
+	fs.StringVar(&cfg.autocertEmail, "autocert-email", "", "contact address given to Let's Encrypt with -autocert")
+	fs.StringVar(&cfg.clientCA, "client-ca", "", "PEM bundle of CAs whose client certificates HTTPS requests may present")
+	certUsers := fs.String("cert-users", "", "file of \"<certificate CN or SAN> <user>\" lines mapping client certificates to users (needs -client-ca)")
+	var trustedProxies stringList
+	fs.Var(&trustedProxies, "trusted-proxy", "address or CIDR range of a reverse proxy whose X-Forwarded-For, -Proto and -Host headers are believed (repeatable)")
+	fs.StringVar(&cfg.dir, "dir", ".", "directory holding the index, accounts and snippet data")
+	fs.StringVar(&cfg.database, "database", "", "keep snippets in this PostgreSQL database, e.g. postgres://pb@db/pb, instead of -dir (accounts and other state stay in -dir); take the password from PGPASSWORD or ~/.pgpass")
+	primary := fs.String("primary", "", "run as a read replica of the pb at this URL")
+	fs.DurationVar(&cfg.replicaInterval, "replica-interval", 5*time.Second, "how often a replica polls the primary for changes")
+	shadowTo := fs.String("shadow-to", "", "also send -shadow-percent of reads to the pb at this URL, discarding its answers, to load test it (default off)")
+	fs.Float64Var(&cfg.shadowPercent, "shadow-percent", 10, "percentage of GET and HEAD requests -shadow-to receives")
+	fs.StringVar(&cfg.redisURL, "redis", "", "share burn-after-read counts and rate limits with other pb servers, such as replicas and a standby, through this Redis, e.g. redis://redis.example.com:6379/0")
+	fs.StringVar(&cfg.backupTo, "backup-to", "", "continuously back up to this directory or s3://bucket/prefix (default off)")
+	fs.DurationVar(&cfg.backupInterval, "backup-interval", time.Minute, "how often changes are shipped to -backup-to")
+	fs.DurationVar(&cfg.backupSnapshotEvery, "backup-snapshot-every", 24*time.Hour, "how often a snapshot of the index is shipped to -backup-to")
+	deterministic := fs.Bool("deterministic", false, "for tests and staging: stop the clock at "+deterministicTime.Format(time.RFC3339)+" and generate IDs in a fixed order")
+	fs.BoolVar(&cfg.fsckOnStart, "fsck-on-start", false, "check every snippet file against the index before serving, logging what pb fsck would report")
+	fs.BoolVar(&cfg.validateConfig, "validate-config", false, "check the configuration (writable paths, TLS files, policies, filters, plugins, primary, redis and backup target) and exit with a report instead of serving")
+	dedup := fs.String("dedup", "owner", "reuse snippets with identical content: owner, global or none")
+	disposal := fs.String("deleted-account-pastes", "orphan", "what becomes of a deleted account's pastes: orphan (keep them, ownerless), delete, or transfer:NAME to hand them to account NAME")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg.command = fs.Args()
+	cfg.flagArgs = args[:len(args)-len(cfg.command)]
+
+	var err error
+	if *primary != "" {
+		if cfg.primary, err = url.Parse(*primary); err != nil || cfg.primary.Host == "" {
+			err = fmt.Errorf("invalid -primary URL %q", *primary)
+			fmt.Fprintln(fs.Output(), err)
+			return nil, err
+		}
+	}
+	if *shadowTo != "" {
+		if cfg.shadowTo, err = url.Parse(*shadowTo); err != nil || cfg.shadowTo.Host == "" {
+			err = fmt.Errorf("invalid -shadow-to URL %q", *shadowTo)
+			fmt.Fprintln(fs.Output(), err)
+			return nil, err
+		}
+	}
+	if cfg.shadowPercent < 0 || cfg.shadowPercent > 100 {
+		err = errors.New("-shadow-percent must be between 0 and 100")
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+	if cfg.redisURL != "" {
+		if cfg.redis, err = redis.ParseURL(cfg.redisURL); err != nil {
+			err = fmt.Errorf("invalid -redis URL: %w", err)
+			fmt.Fprintln(fs.Output(), err)
+			return nil, err
+		}
+	}
+	if cfg.logFormat != "text" && cfg.logFormat != "json" {
+		err = fmt.Errorf("unknown log format %q (want text or json)", cfg.logFormat)
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+	if *keyFile != "" {
+		if cfg.keys, err = store.LoadKeyring(*keyFile); err != nil {
+			fmt.Fprintln(fs.Output(), err)
+			return nil, err
+		}
+	}
+	if *signingKeys != "" {
+		if cfg.signingKeys, err = httpapi.LoadSigningKeys(*signingKeys); err != nil {
+			fmt.Fprintln(fs.Output(), err)
+			return nil, err
+		}
+	}
+	if cfg.dnsAddr != "" && cfg.dnsZone == "" {
+		err = errors.New("-dns-addr needs -dns-zone")
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+	if (cfg.tlsCert == "") != (cfg.tlsKey == "") {
+		err = errors.New("-tls-cert and -tls-key must be given together")
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+	if *autocertHosts != "" {
+		if cfg.tlsCert != "" {
+			err = errors.New("-autocert and -tls-cert cannot be combined")
+			fmt.Fprintln(fs.Output(), err)
+			return nil, err
+		}
+		for _, host := range strings.Split(*autocertHosts, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				cfg.autocertHosts = append(cfg.autocertHosts, host)
+			}
+		}
+	}
+	servesTLS := cfg.tlsCert != "" || len(cfg.autocertHosts) > 0
+	if cfg.redirectAddr != "" && !servesTLS {
+		err = errors.New("-redirect-addr needs -tls-cert and -tls-key or -autocert")
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+	if cfg.clientCA != "" && !servesTLS {
+		err = errors.New("-client-ca needs -tls-cert and -tls-key or -autocert")
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+	if *certUsers != "" {
+		if cfg.clientCA == "" {
+			err = errors.New("-cert-users needs -client-ca")
+			fmt.Fprintln(fs.Output(), err)
+			return nil, err
+		}
+		if cfg.certUsers, err = auth.LoadCertUsers(*certUsers); err != nil {
+			fmt.Fprintln(fs.Output(), err)
+			return nil, err
+		}
+	}
+	for _, proxy := range trustedProxies {
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(proxy)
+			if addrErr != nil {
+				err = fmt.Errorf("invalid -trusted-proxy %q, want an address or CIDR range", proxy)
+				fmt.Fprintln(fs.Output(), err)
+				return nil, err
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		cfg.trustedProxies = append(cfg.trustedProxies, prefix.Masked())
+	}
+	if *deterministic {
+		cfg.clock = clock.Fixed(deterministicTime)
+	}
+	if cfg.dedup, err = store.ParseDedupPolicy(*dedup); err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+	if cfg.disposal, err = store.ParseDisposalPolicy(*disposal); err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+	if err = httpapi.CheckFeatures(cfg.disabled); err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// now is the current time by cfg's clock.
+func (cfg *config) now() time.Time {
+	if cfg.clock != nil {
+		return cfg.clock.Now()
+	}
+	return clock.System.Now()
+}
+
+// storeOptions returns the options to open the store with.
+func (cfg *config) storeOptions() store.Options {
+	opts := store.Options{Dedup: cfg.dedup, Keys: cfg.keys, Clock: cfg.clock, Database: cfg.database}
+	if cfg.clock != nil {
+		opts.Seed = deterministicSeed
+	}
+	return opts
+}
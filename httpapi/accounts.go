@@ -0,0 +1,104 @@
+// Package httpapi implements account removal: users can delete their own
+// account with DELETE /api/v1/me, and admins anyone's with DELETE
+// /admin/users/{name}. The account's pastes are disposed of as the instance's
+// Options.Disposal says, orphaned by default, before the name is freed, so
+// that whoever registers it next doesn't inherit them.
+package httpapi
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"pb/auth"
+	"pb/store"
+)
+
+// errNoTransferTarget is returned by deleteAccount when the account pastes
+// are transferred to doesn't exist, or is the one being deleted.
+var errNoTransferTarget = errors.New("the account pastes are transferred to doesn't exist")
+
+// deleteAccount removes user's account after disposing of their pastes,
+// on behalf of by, and returns the pastes disposed of.
+func (s *Server) deleteAccount(r *http.Request, user, by string) ([]string, error) {
+	users := s.users.Users()
+	if !slices.Contains(users, user) {
+		return nil, auth.ErrNoSuchUser
+	}
+	if s.disposal.Disposal == store.DisposeTransfer && (s.disposal.To == user || !slices.Contains(users, s.disposal.To)) {
+		return nil, errNoTransferTarget
+	}
+	ids := s.store().Dispose(user, s.disposal)
+	if err := s.users.Delete(user); err != nil {
+		return ids, err
+	}
+	// Pastes created while the first pass ran.
+	ids = append(ids, s.store().Dispose(user, s.disposal)...)
+
+	slog.Info("Deleted account", "user", user, "pastes", len(ids), "policy", s.disposal.String(), "by", by, "request_id", RequestID(r.Context()))
+	if s.disposal.Disposal == store.DisposeDelete {
+		for _, id := range ids {
+			s.events.publish(event{kind: eventDelete, id: id, url: constructURL(r, id), user: by, requestID: RequestID(r.Context())})
+		}
+	}
+	return ids, nil
+}
+
+// answerAccountDeletion reports how deleteAccount went.
+func (s *Server) answerAccountDeletion(w http.ResponseWriter, user string, ids []string, err error) {
+	switch {
+	case errors.Is(err, auth.ErrNoSuchUser):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errNoTransferTarget):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		fmt.Fprintf(w, "deleted %s; %d pastes %s\n", user, len(ids), disposalVerb(s.disposal))
+	}
+}
+
+// disposalVerb says what policy did to pastes.
+func disposalVerb(policy store.DisposalPolicy) string {
+	switch policy.Disposal {
+	case store.DisposeDelete:
+		return "deleted"
+	case store.DisposeTransfer:
+		return "transferred to " + policy.To
+	}
+	return "orphaned"
+}
+
+// serveMe deletes the caller's own account on DELETE.
+func (s *Server) serveMe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := s.users.Authenticate(r)
+	if !ok || user == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="pb"`)
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	ids, err := s.deleteAccount(r, user, user)
+	s.answerAccountDeletion(w, user, ids, err)
+}
+
+// serveAdminUser deletes the account /admin/users/{name} on DELETE.
+func (s *Server) serveAdminUser(w http.ResponseWriter, r *http.Request) {
+	by, ok := s.requireRole(w, r, auth.RoleAdmin)
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user := strings.TrimPrefix(r.URL.Path, "/admin/users/")
+	ids, err := s.deleteAccount(r, user, by)
+	s.answerAccountDeletion(w, user, ids, err)
+}
@@ -0,0 +1,121 @@
+// Package httpapi implements an address filter for writes as middleware.
+// Operators list the addresses and CIDR ranges that may or may not create
+// and update pastes in a file, one "allow PREFIX" or "deny PREFIX" line
+// each, and POST and PUT requests from outside them are refused with 403.
+// Reads pass straight through. The file can be reloaded while serving.
+package httpapi
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// addressRules are the parsed contents of an address filter file.
+type addressRules struct {
+	allow, deny []netip.Prefix
+}
+
+// loadAddressRules parses fileName. Blank lines and lines starting with #
+// are skipped.
+func loadAddressRules(fileName string) (*addressRules, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rules := &addressRules{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kind, arg, _ := strings.Cut(line, " ")
+		if kind != "allow" && kind != "deny" {
+			return nil, fmt.Errorf("%s:%d: expected allow or deny", fileName, n)
+		}
+		prefix, err := parseBanPrefix(strings.TrimSpace(arg))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", fileName, n, err)
+		}
+		if kind == "allow" {
+			rules.allow = append(rules.allow, prefix)
+		} else {
+			rules.deny = append(rules.deny, prefix)
+		}
+	}
+	return rules, scanner.Err()
+}
+
+// permits reports whether the client address ip may write. A deny rule
+// always wins; once there is any allow rule, only the ranges allowed may
+// write at all.
+func (rules *addressRules) permits(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return len(rules.allow) == 0
+	}
+	addr = addr.Unmap()
+	for _, p := range rules.deny {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	if len(rules.allow) == 0 {
+		return true
+	}
+	for _, p := range rules.allow {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddressFilter is the middleware returned by FilterAddresses.
+type AddressFilter struct {
+	next     http.Handler
+	fileName string
+	rules    atomic.Pointer[addressRules]
+}
+
+// FilterAddresses wraps next so that POST and PUT requests, and WebSocket
+// editing sessions, from addresses the rules in fileName don't permit get
+// 403 Forbidden. Put it inside
+// TrustProxies, so that it sees the client's address rather than the
+// proxy's, and hand it to ServeSSH too, so that uploads over SSH are
+// filtered by the session's address.
+func FilterAddresses(next http.Handler, fileName string) (*AddressFilter, error) {
+	f := &AddressFilter{next: next, fileName: fileName}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads the rules file again. If it can't be read or parsed the
+// rules in force are kept.
+func (f *AddressFilter) Reload() error {
+	rules, err := loadAddressRules(f.fileName)
+	if err != nil {
+		return err
+	}
+	f.rules.Store(rules)
+	return nil
+}
+
+func (f *AddressFilter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost || r.Method == http.MethodPut || webSocketUpgrade(r) {
+		if !f.rules.Load().permits(clientIP(r)) {
+			http.Error(w, "Creating and updating pastes from this address is not allowed", http.StatusForbidden)
+			return
+		}
+	}
+	f.next.ServeHTTP(w, r)
+}
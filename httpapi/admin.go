@@ -0,0 +1,373 @@
+// Package httpapi implements the admin endpoints under /admin/. The users
+// named in Options.Admins and those granted the admin role may use all of
+// them; moderators may list, review and delete pastes, ban addresses and
+// see the stats and dashboard.
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"pb/auth"
+	"pb/backup"
+	"pb/importer"
+	"pb/store"
+)
+
+// adminListingSize is how many pastes a page of /admin/pastes holds.
+const adminListingSize = 100
+
+// maxImportSize caps the exports /admin/import takes.
+const maxImportSize = 64 << 20
+
+// roleOf returns user's role: admin for the users named in Options.Admins,
+// and otherwise whatever the accounts grant.
+func (s *Server) roleOf(user string) string {
+	if s.admins[user] {
+		return auth.RoleAdmin
+	}
+	return s.users.Role(user)
+}
+
+// requireRole answers the request itself and returns false unless it comes
+// from a user with role, or an admin, and otherwise returns the user.
+func (s *Server) requireRole(w http.ResponseWriter, r *http.Request, role string) (string, bool) {
+	user, ok := s.users.Authenticate(r)
+	if !ok || user == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="pb"`)
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return "", false
+	}
+	if got := s.roleOf(user); got != auth.RoleAdmin && got != role {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return "", false
+	}
+	return user, true
+}
+
+// requireAdmin answers the request itself and returns false unless it comes
+// from an admin.
+func (s *Server) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	_, ok := s.requireRole(w, r, auth.RoleAdmin)
+	return ok
+}
+
+// serveDataDir switches the server to the store in the dir form field, for
+// blue/green migrations: a migration prepares a new data directory, and once
+// it opens and verifies cleanly it replaces the current store atomically.
+// Requests already running finish against the old store.
+func (s *Server) serveDataDir(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireAdmin(w, r) {
+		return
+	}
+	if !s.parseForm(w, r) {
+		return
+	}
+	dir := r.FormValue("dir")
+	if dir == "" {
+		http.Error(w, "Missing dir", http.StatusBadRequest)
+		return
+	}
+	opts := s.store().Options()
+	if opts.Database != "" {
+		http.Error(w, "The store is in a database, not a data directory", http.StatusConflict)
+		return
+	}
+
+	next, err := store.New(dir, opts)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to open %s: %v", dir, err), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := next.Verify(); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to verify %s: %v", dir, err), http.StatusUnprocessableEntity)
+		return
+	}
+	next.Reserve(reservedIDs...)
+	s.current.Store(next)
+
+	slog.Info("Switched data directory", "dir", dir, "request_id", RequestID(r.Context()))
+	fmt.Fprintf(w, "switched to %s (%d snippets)\n", dir, next.Len())
+}
+
+// serveBackup takes a backup archive of the store and the account files
+// and sends it as it is written, encrypted if the store is. A failure part
+// way through can only cut the download short, which the archive's gzip or
+// encryption trailer then gives away.
+func (s *Server) serveBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := s.requireRole(w, r, auth.RoleAdmin)
+	if !ok {
+		return
+	}
+	st := s.store()
+	keys := st.Options().Keys
+	fileName := "pb-" + s.clock.Now().UTC().Format("20060102-150405") + ".tar.gz"
+	if keys != nil {
+		fileName += ".enc"
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+	seq, err := backup.WriteArchive(w, st, s.backupFiles, keys)
+	if err != nil {
+		slog.Error("Backup archive failed", "err", err, "request_id", RequestID(r.Context()))
+		return
+	}
+	slog.Info("Sent backup archive", "seq", seq, "by", user, "request_id", RequestID(r.Context()))
+}
+
+// serveImport brings in the Gist JSON or pastebin.com XML export in the
+// request body, as pb import does. ?owner= names the pb user owning its
+// pastes, and each ?map=from=to the pb user owning those the export gives
+// to from instead. It answers with the count imported and a line for each
+// paste skipped.
+func (s *Server) serveImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := s.requireRole(w, r, auth.RoleAdmin)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	opts := importer.Options{Owner: query.Get("owner"), Owners: make(map[string]string), Now: s.clock.Now()}
+	for _, m := range query["map"] {
+		from, to, ok := strings.Cut(m, "=")
+		if !ok {
+			http.Error(w, "map must be from=to", http.StatusBadRequest)
+			return
+		}
+		opts.Owners[from] = to
+	}
+	result, err := importer.Reader(s.store(), http.MaxBytesReader(w, r.Body, maxImportSize), opts)
+	if err != nil && result.Imported == 0 {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	slog.Info("Imported pastes", "format", result.Format, "count", result.Imported, "skipped", len(result.Skipped), "by", user, "request_id", RequestID(r.Context()))
+	fmt.Fprintf(w, "imported %d pastes from a %s export\n", result.Imported, result.Format)
+	for _, skipped := range result.Skipped {
+		fmt.Fprintln(w, "skipped", skipped)
+	}
+	if err != nil {
+		fmt.Fprintln(w, "stopped:", err)
+	}
+}
+
+// adminPasteEntry is a paste as /admin/pastes lists it: everything the
+// index records, the owner included.
+type adminPasteEntry struct {
+	metaResponse
+	URL        string `json:"url"`
+	Private    bool   `json:"private,omitempty"`
+	Flagged    bool   `json:"flagged,omitempty"`
+	Honeytoken bool   `json:"honeytoken,omitempty"`
+	Protected  bool   `json:"password_protected,omitempty"`
+}
+
+// adminListing is a page of /admin/pastes.
+type adminListing struct {
+	Page    int               `json:"page"`
+	Pages   int               `json:"pages"`
+	Total   int               `json:"total"`
+	Entries []adminPasteEntry `json:"pastes"`
+}
+
+func newAdminPasteEntry(r *http.Request, info store.Info) adminPasteEntry {
+	entry := adminPasteEntry{
+		metaResponse: newMetaResponse(info),
+		URL:          constructURL(r, info.ID),
+		Private:      info.Private,
+		Flagged:      info.Flagged,
+		Honeytoken:   info.Honeytoken,
+		Protected:    info.HasViewPassword,
+	}
+	entry.Owner, entry.Slug = info.Owner, info.Slug
+	return entry
+}
+
+// serveAdminPastes lists every paste, newest first, with its metadata on
+// GET /admin/pastes: as JSON a page at a time (?page=), or all of them as
+// NDJSON for clients sending Accept: application/x-ndjson. ?owner= lists
+// one user's pastes and ?flagged=1 only flagged ones. GET
+// /admin/pastes/{id} shows one paste and DELETE deletes it.
+func (s *Server) serveAdminPastes(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.requireRole(w, r, auth.RoleModerator)
+	if !ok {
+		return
+	}
+	if id := strings.TrimPrefix(r.URL.Path, "/admin/pastes/"); id != r.URL.Path && id != "" {
+		s.serveAdminPaste(w, r, id, user)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	var ids []string
+	if owner := query.Get("owner"); owner != "" {
+		ids = s.store().ListIDsByOwner(owner)
+	} else if query.Get("flagged") == "1" {
+		ids = s.store().FlaggedIDs()
+	} else {
+		ids = s.store().ListIDs()
+	}
+	all := func(store.Info) bool { return true }
+
+	if wantsNDJSON(r) {
+		w.Header().Set("Content-Type", ndjsonType)
+		rc := http.NewResponseController(w)
+		enc := json.NewEncoder(w)
+		n := 0
+		s.eachListed(r, ids, all, func(info store.Info) bool {
+			if err := enc.Encode(newAdminPasteEntry(r, info)); err != nil {
+				return false
+			}
+			if n++; n%flushEvery == 0 {
+				rc.Flush()
+			}
+			return true
+		})
+		return
+	}
+
+	page := 1
+	if p, err := strconv.Atoi(query.Get("page")); err == nil && p > 1 {
+		page = p
+	}
+	entries := []adminPasteEntry{}
+	n := 0
+	s.eachListed(r, ids, all, func(info store.Info) bool {
+		if n >= (page-1)*adminListingSize && n < page*adminListingSize {
+			entries = append(entries, newAdminPasteEntry(r, info))
+		}
+		n++
+		return true
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(adminListing{page, max((n+adminListingSize-1)/adminListingSize, 1), n, entries})
+}
+
+// serveAdminPaste shows or deletes paste id for the moderator user.
+func (s *Server) serveAdminPaste(w http.ResponseWriter, r *http.Request, id, user string) {
+	info, ok := s.store().Meta(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newAdminPasteEntry(r, info))
+
+	case http.MethodDelete:
+		if s.store().Delete(id) {
+			slog.Info("Deleted paste", "id", id, "owner", info.Owner, "by", user, "request_id", RequestID(r.Context()))
+			s.events.publish(event{kind: eventDelete, id: id, url: constructURL(r, id), user: user, requestID: RequestID(r.Context())})
+		}
+		fmt.Fprintf(w, "deleted %s\n", id)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// statsResponse is what GET /admin/stats reports.
+type statsResponse struct {
+	Pastes      int    `json:"pastes"`
+	Bytes       int64  `json:"bytes"`
+	Users       int    `json:"users"`
+	Flagged     int    `json:"flagged"`
+	Bans        int    `json:"bans"`
+	Deliveries  int    `json:"webhook_deliveries_queued"`
+	MemoryBytes int64  `json:"memory_bytes"`
+	Uptime      string `json:"uptime"`
+}
+
+func (s *Server) stats() statsResponse {
+	st := s.store()
+	stats := statsResponse{
+		Pastes:      st.Len(),
+		Bytes:       st.Size(),
+		Users:       len(s.users.Users()),
+		Flagged:     len(st.FlaggedIDs()),
+		Bans:        s.bans.len(),
+		MemoryBytes: memoryInUse(),
+		Uptime:      s.clock.Now().Sub(s.started).Round(time.Second).String(),
+	}
+	if s.deliveries != nil {
+		stats.Deliveries = len(s.deliveries.list())
+	}
+	return stats
+}
+
+// serveStats reports counts of what the server holds as JSON.
+func (s *Server) serveStats(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, auth.RoleModerator); !ok {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.stats())
+}
+
+// serveRoles lists the users granted roles on GET, one "user role" per
+// line, and on POST grants the role form field to the user form field; an
+// empty role revokes it.
+func (s *Server) serveRoles(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.requireRole(w, r, auth.RoleAdmin)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		roles := s.users.Roles()
+		for _, name := range s.users.Users() {
+			if role := roles[name]; role != "" {
+				fmt.Fprintln(w, name, role)
+			}
+		}
+
+	case http.MethodPost:
+		if !s.parseForm(w, r) {
+			return
+		}
+		target, role := r.FormValue("user"), r.FormValue("role")
+		if err := s.users.SetRole(target, role); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, auth.ErrNoSuchUser) {
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		slog.Info("Set role", "user", target, "role", role, "by", user, "request_id", RequestID(r.Context()))
+		if role == "" {
+			fmt.Fprintf(w, "%s has no role now\n", target)
+			return
+		}
+		fmt.Fprintf(w, "%s now has the %s role\n", target, role)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,144 @@
+// Package httpapi implements anomaly alerts. The server counts creations,
+// failed requests and storage growth over fixed windows and keeps a moving
+// baseline of each; a window far above its baseline raises an alert,
+// logged and sent to the webhooks as an "anomaly" event, so that abuse or
+// a client stuck retrying gets noticed before the disk fills. An alert is
+// raised once per excursion and cleared when the metric is back in range.
+package httpapi
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// anomalyWarmup is how many windows make a baseline worth comparing
+	// against.
+	anomalyWarmup = 30
+	// anomalyWeight is how much each window moves the baseline, so that
+	// it reflects about the last 1/anomalyWeight windows.
+	anomalyWeight = 0.05
+	// A window is anomalous once it is both anomalyDeviations standard
+	// deviations and anomalyFactor times above the baseline.
+	anomalyDeviations = 4
+	anomalyFactor     = 3
+	// anomalyMinRequests is how many requests a window needs for its
+	// failure rate to count.
+	anomalyMinRequests = 20
+)
+
+// anomaly is an alert, as sent to the webhooks.
+type anomaly struct {
+	Metric   string  `json:"metric"`
+	Value    float64 `json:"value"`
+	Baseline float64 `json:"baseline"`
+	// Window is the length of the window Value was measured over.
+	Window string `json:"window"`
+}
+
+// baseline tracks a metric's exponentially weighted mean and variance.
+type baseline struct {
+	mean, variance float64
+	samples        int
+	alerting       bool
+}
+
+// observe folds value into b and reports whether it was anomalous, given
+// floor, the least value worth an alert whatever the baseline.
+func (b *baseline) observe(value, floor float64) bool {
+	anomalous := b.samples >= anomalyWarmup && value >= floor &&
+		value > b.mean+anomalyDeviations*math.Sqrt(b.variance) && value > anomalyFactor*b.mean
+	if b.samples == 0 {
+		b.mean = value
+	} else {
+		diff := value - b.mean
+		b.mean += anomalyWeight * diff
+		b.variance = (1 - anomalyWeight) * (b.variance + anomalyWeight*diff*diff)
+	}
+	b.samples++
+	return anomalous
+}
+
+// anomalyDetector counts the current window's activity.
+type anomalyDetector struct {
+	window   time.Duration
+	creates  atomic.Int64
+	requests atomic.Int64
+	failures atomic.Int64
+}
+
+// countResponse counts a response with status towards the failure rate.
+// Not Found isn't a failure: readers mistype IDs, and scanners guess them
+// all day.
+func (d *anomalyDetector) countResponse(status int) {
+	d.requests.Add(1)
+	if status >= 400 && status != http.StatusNotFound {
+		d.failures.Add(1)
+	}
+}
+
+// WatchAnomalies closes a window of activity every Options.AnomalyWindow
+// until ctx is done, comparing creations, the share of requests failing
+// and storage growth with their baselines. It returns immediately if no
+// window is set.
+func (s *Server) WatchAnomalies(ctx context.Context) {
+	d := s.anomalies
+	if d == nil {
+		return
+	}
+	metrics := []struct {
+		name string
+		// floor is the least value worth an alert.
+		floor float64
+		b     baseline
+	}{
+		{name: "creates", floor: 20},
+		{name: "failure_rate", floor: 0.2},
+		{name: "storage_growth", floor: 1 << 20},
+	}
+	st := s.store()
+	size := st.Size()
+	ticker := time.NewTicker(d.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		creates, requests, failures := d.creates.Swap(0), d.requests.Swap(0), d.failures.Swap(0)
+		values := []float64{float64(creates), math.NaN(), math.NaN()}
+		if requests >= anomalyMinRequests {
+			values[1] = float64(failures) / float64(requests)
+		}
+		// The admin API can swap stores, and growth across the swap
+		// means nothing.
+		if current := s.store(); current == st {
+			newSize := st.Size()
+			values[2], size = float64(newSize-size), newSize
+		} else {
+			st, size = current, current.Size()
+		}
+
+		for i := range metrics {
+			m := &metrics[i]
+			if math.IsNaN(values[i]) {
+				continue
+			}
+			mean := m.b.mean
+			switch anomalous := m.b.observe(values[i], m.floor); {
+			case anomalous && !m.b.alerting:
+				m.b.alerting = true
+				slog.Warn("Anomaly detected", "metric", m.name, "value", values[i], "baseline", mean, "window", d.window)
+				s.events.publish(event{kind: eventAnomaly, anomaly: &anomaly{Metric: m.name, Value: values[i], Baseline: mean, Window: d.window.String()}})
+			case !anomalous && m.b.alerting:
+				m.b.alerting = false
+				slog.Info("Anomaly over", "metric", m.name, "value", values[i], "baseline", m.b.mean)
+			}
+		}
+	}
+}
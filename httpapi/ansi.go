@@ -0,0 +1,244 @@
+// Package httpapi implements the console renderer, which shows terminal
+// output with its ANSI colours. SGR escape sequences (ESC [ ... m) become
+// styled spans server-side; other control sequences, such as cursor
+// movement and window titles, are dropped. GET /{id}+ is short for
+// /{id}/console.
+package httpapi
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ansiPalette holds the 16 standard colours, as xterm shows them.
+var ansiPalette = [16]string{
+	"#000000", "#cd0000", "#00cd00", "#cdcd00", "#0000ee", "#cd00cd", "#00cdcd", "#e5e5e5",
+	"#7f7f7f", "#ff0000", "#00ff00", "#ffff00", "#5c5cff", "#ff00ff", "#00ffff", "#ffffff",
+}
+
+// ansiColor256 returns the CSS colour of an entry in the 256-colour table.
+func ansiColor256(n int) string {
+	switch {
+	case n < 16:
+		return ansiPalette[n]
+	case n < 232:
+		n -= 16
+		level := func(c int) int {
+			if c == 0 {
+				return 0
+			}
+			return 55 + 40*c
+		}
+		return fmt.Sprintf("#%02x%02x%02x", level(n/36), level(n/6%6), level(n%6))
+	default:
+		gray := 8 + 10*(n-232)
+		return fmt.Sprintf("#%02x%02x%02x", gray, gray, gray)
+	}
+}
+
+// sgrState is the text style set by SGR sequences so far.
+type sgrState struct {
+	fg, bg                            string
+	bold, dim, italic, underline      bool
+	inverse, strikethrough, concealed bool
+}
+
+// css returns the style attribute value for s, "" for plain text.
+func (s sgrState) css() string {
+	fg, bg := s.fg, s.bg
+	if s.inverse {
+		fg, bg = bg, fg
+		if fg == "" {
+			fg = "#1e1e1e"
+		}
+		if bg == "" {
+			bg = "#e5e5e5"
+		}
+	}
+	var css []string
+	if fg != "" {
+		css = append(css, "color:"+fg)
+	}
+	if bg != "" {
+		css = append(css, "background:"+bg)
+	}
+	if s.bold {
+		css = append(css, "font-weight:bold")
+	}
+	if s.dim {
+		css = append(css, "opacity:0.6")
+	}
+	if s.italic {
+		css = append(css, "font-style:italic")
+	}
+	switch {
+	case s.underline && s.strikethrough:
+		css = append(css, "text-decoration:underline line-through")
+	case s.underline:
+		css = append(css, "text-decoration:underline")
+	case s.strikethrough:
+		css = append(css, "text-decoration:line-through")
+	}
+	if s.concealed {
+		css = append(css, "visibility:hidden")
+	}
+	return strings.Join(css, ";")
+}
+
+// apply updates s with the parameters of one SGR sequence.
+func (s *sgrState) apply(params string) {
+	if params == "" {
+		params = "0"
+	}
+	var codes []int
+	for _, p := range strings.Split(strings.ReplaceAll(params, ":", ";"), ";") {
+		n, _ := strconv.Atoi(p)
+		codes = append(codes, n)
+	}
+	for i := 0; i < len(codes); i++ {
+		switch code := codes[i]; {
+		case code == 0:
+			*s = sgrState{}
+		case code == 1:
+			s.bold = true
+		case code == 2:
+			s.dim = true
+		case code == 3:
+			s.italic = true
+		case code == 4:
+			s.underline = true
+		case code == 7:
+			s.inverse = true
+		case code == 8:
+			s.concealed = true
+		case code == 9:
+			s.strikethrough = true
+		case code == 22:
+			s.bold, s.dim = false, false
+		case code == 23:
+			s.italic = false
+		case code == 24:
+			s.underline = false
+		case code == 27:
+			s.inverse = false
+		case code == 28:
+			s.concealed = false
+		case code == 29:
+			s.strikethrough = false
+		case code >= 30 && code <= 37:
+			s.fg = ansiPalette[code-30]
+		case code >= 40 && code <= 47:
+			s.bg = ansiPalette[code-40]
+		case code >= 90 && code <= 97:
+			s.fg = ansiPalette[code-90+8]
+		case code >= 100 && code <= 107:
+			s.bg = ansiPalette[code-100+8]
+		case code == 39:
+			s.fg = ""
+		case code == 49:
+			s.bg = ""
+		case code == 38 || code == 48:
+			var color string
+			switch {
+			case i+2 < len(codes) && codes[i+1] == 5:
+				color = ansiColor256(min(max(codes[i+2], 0), 255))
+				i += 2
+			case i+4 < len(codes) && codes[i+1] == 2:
+				color = fmt.Sprintf("#%02x%02x%02x", codes[i+2]&0xff, codes[i+3]&0xff, codes[i+4]&0xff)
+				i += 4
+			default:
+				return
+			}
+			if code == 38 {
+				s.fg = color
+			} else {
+				s.bg = color
+			}
+		}
+	}
+}
+
+// ansiToHTML converts terminal output to HTML, escaping the text and turning
+// SGR sequences into spans.
+func ansiToHTML(content string) string {
+	var sb strings.Builder
+	var state sgrState
+	open := false
+	flush := func(text string) {
+		sb.WriteString(template.HTMLEscapeString(text))
+	}
+	restyle := func() {
+		if open {
+			sb.WriteString("</span>")
+			open = false
+		}
+		if css := state.css(); css != "" {
+			fmt.Fprintf(&sb, `<span style="%s">`, css)
+			open = true
+		}
+	}
+
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	for {
+		esc := strings.IndexByte(content, 0x1b)
+		if esc < 0 {
+			flush(content)
+			break
+		}
+		flush(content[:esc])
+		content = content[esc+1:]
+		if content == "" {
+			break
+		}
+		switch content[0] {
+		case '[':
+			// CSI: parameter and intermediate bytes, then a final byte.
+			end := 1
+			for end < len(content) && (content[end] < 0x40 || content[end] > 0x7e) {
+				end++
+			}
+			if end == len(content) {
+				content = ""
+				continue
+			}
+			if content[end] == 'm' {
+				state.apply(content[1:end])
+				restyle()
+			}
+			content = content[end+1:]
+		case ']':
+			// OSC, e.g. a window title: runs to BEL or ST (ESC \).
+			end := strings.IndexAny(content, "\a\x1b")
+			if end < 0 {
+				content = ""
+				continue
+			}
+			if content[end] == 0x1b && end+1 < len(content) && content[end+1] == '\\' {
+				end++
+			}
+			content = content[end+1:]
+		default:
+			// Two-byte sequences such as ESC = or ESC 7.
+			content = content[1:]
+		}
+	}
+	if open {
+		sb.WriteString("</span>")
+	}
+	return sb.String()
+}
+
+var consoleStyle = stylesheet("console.css")
+
+// consoleRenderer shows terminal output with its colours.
+type consoleRenderer struct{}
+
+func (consoleRenderer) mediaType(view) string { return "text/html; charset=utf-8" }
+
+func (consoleRenderer) render(w io.Writer, v view) error {
+	body := `<pre class="console">` + ansiToHTML(v.content) + `</pre>`
+	return pageTemplate.Execute(w, page{Title: v.id, OpenGraph: v.og, Theme: v.theme, Head: consoleStyle, Body: template.HTML(body)})
+}
@@ -0,0 +1,144 @@
+// Package httpapi implements the static assets: the stylesheets and
+// scripts of pb's own pages, compiled into the binary from assets/. Each
+// is minified and fingerprinted once, when the package initializes, and
+// served as /static/{name}.{hash}.{ext} with a year-long immutable cache
+// lifetime: a changed asset gets a new URL, so browsers never keep a stale
+// copy, and an unchanged one is never fetched again. Pages link them with
+// an integrity attribute, so a tampering proxy or cache is caught too.
+package httpapi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"embed"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+//go:embed assets
+var assetFiles embed.FS
+
+// assetCacheControl lets browsers and caches keep an asset for a year
+// without revalidating it; its URL changes with its content.
+const assetCacheControl = "public, max-age=31536000, immutable"
+
+// asset is one static asset, ready to serve.
+type asset struct {
+	// url is where the asset is served, with its fingerprint.
+	url string
+	// integrity is its Subresource Integrity digest.
+	integrity string
+	data      []byte
+}
+
+// assets are the static assets by source name, and servedAssets by the
+// path they are served under.
+var assets, servedAssets = loadAssets()
+
+// loadAssets minifies and fingerprints every file in assets/.
+func loadAssets() (map[string]*asset, map[string]*asset) {
+	entries, err := assetFiles.ReadDir("assets")
+	if err != nil {
+		panic("unable to read embedded assets: " + err.Error())
+	}
+	byName := make(map[string]*asset, len(entries))
+	byPath := make(map[string]*asset, len(entries))
+	for _, e := range entries {
+		src, err := assetFiles.ReadFile("assets/" + e.Name())
+		if err != nil {
+			panic("unable to read embedded asset: " + err.Error())
+		}
+		ext := path.Ext(e.Name())
+		data := minify(ext, src)
+		sum := sha256.Sum256(data)
+		integrity := sha512.Sum384(data)
+		a := &asset{
+			url:       "/static/" + strings.TrimSuffix(e.Name(), ext) + "." + hex.EncodeToString(sum[:5]) + ext,
+			integrity: "sha384-" + base64.StdEncoding.EncodeToString(integrity[:]),
+			data:      data,
+		}
+		byName[e.Name()], byPath[a.url] = a, a
+	}
+	return byName, byPath
+}
+
+var (
+	cssComment    = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	cssSpace      = regexp.MustCompile(`\s+`)
+	cssPunctSpace = regexp.MustCompile(`\s*([{};])\s*|(:)\s+`)
+)
+
+// minify shrinks a stylesheet or script. It only removes what can't
+// matter: comments and spacing in CSS, and indentation, blank lines and
+// whole-line comments in JavaScript, whose line breaks are kept since
+// semicolon insertion may depend on them.
+func minify(ext string, src []byte) []byte {
+	switch ext {
+	case ".css":
+		css := cssComment.ReplaceAll(src, nil)
+		css = cssSpace.ReplaceAll(css, []byte(" "))
+		css = cssPunctSpace.ReplaceAll(css, []byte("$1$2"))
+		return bytes.TrimSpace(bytes.ReplaceAll(css, []byte(";}"), []byte("}")))
+	case ".js":
+		var out bytes.Buffer
+		for _, line := range strings.Split(string(src), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "//") {
+				continue
+			}
+			out.WriteString(line)
+			out.WriteByte('\n')
+		}
+		return out.Bytes()
+	}
+	return src
+}
+
+// mustAsset returns the asset named name, which must exist.
+func mustAsset(name string) *asset {
+	a, ok := assets[name]
+	if !ok {
+		panic("no static asset " + name)
+	}
+	return a
+}
+
+// stylesheet links the stylesheet named name.
+func stylesheet(name string) template.HTML {
+	a := mustAsset(name)
+	return template.HTML(fmt.Sprintf(`<link rel="stylesheet" href="%s" integrity="%s">`, a.url, a.integrity))
+}
+
+// script loads the script named name.
+func script(name string) template.HTML {
+	a := mustAsset(name)
+	return template.HTML(fmt.Sprintf(`<script src="%s" integrity="%s"></script>`, a.url, a.integrity))
+}
+
+// serveStatic serves the static assets under /static/. Only fingerprinted
+// paths exist, so an outdated page asking for an old version gets 404
+// rather than a mismatched file.
+func serveStatic(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	a, ok := servedAssets[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", mime.TypeByExtension(path.Ext(a.url)))
+	w.Header().Set("Cache-Control", assetCacheControl)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(a.data))
+}
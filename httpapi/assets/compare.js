@@ -0,0 +1,13 @@
+const panes = document.querySelectorAll(".pane");
+let leader = null;
+panes.forEach(pane => pane.addEventListener("scroll", () => {
+	if (leader && leader !== pane) return;
+	leader = pane;
+	panes.forEach(other => {
+		if (other !== pane) {
+			other.scrollTop = pane.scrollTop;
+			other.scrollLeft = pane.scrollLeft;
+		}
+	});
+	requestAnimationFrame(() => { leader = null; });
+}));
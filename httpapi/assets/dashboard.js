@@ -0,0 +1,14 @@
+async function act(url, opts) {
+  const resp = await fetch(url, opts);
+  if (!resp.ok) { alert(await resp.text()); return; }
+  location.reload();
+}
+document.addEventListener('click', e => {
+  const del = e.target.dataset.delete, unban = e.target.dataset.unban;
+  if (del && confirm('Delete ' + del + '?')) act('/admin/pastes/' + encodeURIComponent(del), {method: 'DELETE'});
+  if (unban) act('/admin/bans?addr=' + encodeURIComponent(unban), {method: 'DELETE'});
+});
+document.getElementById('ban').addEventListener('submit', e => {
+  e.preventDefault();
+  act('/admin/bans', {method: 'POST', body: new URLSearchParams(new FormData(e.target))});
+});
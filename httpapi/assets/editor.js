@@ -0,0 +1,88 @@
+(function() {
+  var form = document.querySelector(".paste-form");
+  var status = form.querySelector(".status");
+  var cm = CodeMirror.fromTextArea(form.querySelector("textarea"), {
+    lineNumbers: true,
+    mode: form.dataset.mode || null,
+    indentUnit: 4,
+    viewportMargin: Infinity
+  });
+  function save() {
+    status.textContent = "Saving…";
+    var headers = {"Content-Type": "text/plain; charset=utf-8"};
+    if (form.dataset.token) headers["X-Paste-Token"] = form.dataset.token;
+    fetch("/" + form.dataset.id, {method: "PUT", headers: headers, body: cm.getValue(), credentials: "same-origin"})
+      .then(function(resp) {
+        return resp.text().then(function(text) {
+          status.textContent = resp.ok ? "Saved at " + new Date().toLocaleTimeString() : text.trim();
+          if (resp.ok) cm.markClean();
+        });
+      })
+      .catch(function(err) { status.textContent = "Failed to save: " + err.message; });
+  }
+  form.addEventListener("submit", function(e) { e.preventDefault(); save(); });
+  cm.setOption("extraKeys", {"Ctrl-S": save, "Cmd-S": save});
+  window.addEventListener("beforeunload", function(e) {
+    if (!cm.isClean()) e.preventDefault();
+  });
+
+  // Edit together with everyone else who has the page open; the server
+  // saves the session as it goes.
+  var ws = null, version = 0, remote = false;
+  function replace(content) {
+    if (cm.getValue() === content) return;
+    var cursor = cm.getCursor();
+    remote = true;
+    cm.setValue(content);
+    remote = false;
+    cm.setCursor(cursor);
+  }
+  function connect() {
+    var scheme = location.protocol === "https:" ? "wss://" : "ws://";
+    ws = new WebSocket(scheme + location.host + "/" + form.dataset.id + "/ws");
+    ws.onmessage = function(e) {
+      var msg = JSON.parse(e.data);
+      switch (msg.type) {
+      case "init":
+      case "sync":
+        version = msg.version;
+        replace(msg.content || "");
+        if (msg.by) status.textContent = "Updated by " + msg.by;
+        break;
+      case "patch":
+        version = msg.version;
+        remote = true;
+        cm.replaceRange(msg.text || "", cm.posFromIndex(msg.from), cm.posFromIndex(msg.to), "remote");
+        remote = false;
+        status.textContent = "Edited by " + (msg.by || "someone");
+        break;
+      case "ack":
+        version = msg.version;
+        break;
+      case "saved":
+        status.textContent = "Saved at " + new Date().toLocaleTimeString();
+        if (msg.version === version) cm.markClean();
+        break;
+      case "error":
+      case "closed":
+        status.textContent = msg.message;
+        break;
+      }
+    };
+    ws.onclose = function() { ws = null; };
+  }
+  // Patches are sent as they are made, each counted as the next version,
+  // so that typing doesn't wait on the server.
+  cm.on("beforeChange", function(cm, change) {
+    if (remote || !ws || ws.readyState !== WebSocket.OPEN) return;
+    ws.send(JSON.stringify({
+      type: "patch",
+      version: version,
+      from: cm.indexFromPos(change.from),
+      to: cm.indexFromPos(change.to),
+      text: change.text.join("\n")
+    }));
+    version++;
+  });
+  if (window.WebSocket) connect();
+})();
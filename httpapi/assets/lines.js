@@ -0,0 +1,23 @@
+(function() {
+  var lines = document.querySelector(".lines"), anchor = null;
+  function mark() {
+    var m = /^#L(\d+)(?:-L(\d+))?$/.exec(location.hash);
+    if (!m) { lines.style.backgroundImage = ""; return; }
+    var a = +m[1], b = +(m[2] || m[1]);
+    if (a > b) { var t = a; a = b; b = t; }
+    var top = (a - 1) * 20 + "px", bottom = b * 20 + "px";
+    lines.style.backgroundImage = "linear-gradient(to bottom, transparent " + top +
+      ", #fff3b0 " + top + ", #fff3b0 " + bottom + ", transparent " + bottom + ")";
+    var start = document.getElementById("L" + a);
+    if (start) start.scrollIntoView({block: "center"});
+  }
+  document.querySelector(".gutter").addEventListener("click", function(e) {
+    if (!e.target.id) return;
+    e.preventDefault();
+    var n = +e.target.id.slice(1);
+    location.hash = e.shiftKey && anchor ? "#L" + Math.min(anchor, n) + "-L" + Math.max(anchor, n) : "#L" + n;
+    anchor = e.shiftKey && anchor ? anchor : n;
+  });
+  window.addEventListener("hashchange", mark);
+  mark();
+})();
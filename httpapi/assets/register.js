@@ -0,0 +1,6 @@
+if ('serviceWorker' in navigator) {
+  navigator.serviceWorker.register('/sw.js').catch(() => {});
+  navigator.serviceWorker.addEventListener('message', e => {
+    if (e.data && e.data.created) alert('Your queued paste is up at ' + e.data.created);
+  });
+}
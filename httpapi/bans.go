@@ -0,0 +1,191 @@
+// Package httpapi implements address bans. Moderators ban a client address,
+// or a range of them in CIDR notation, through /admin/bans, and every HTTP
+// request from a banned address is refused with 403 until the ban is
+// lifted. Bans are kept in the file named by Options.Bans, one
+// "prefix unix-time moderator reason" line each.
+package httpapi
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"pb/auth"
+	"pb/internal/pairfile"
+)
+
+// ban is one banned address or range.
+type ban struct {
+	Prefix netip.Prefix
+	At     time.Time
+	By     string
+	Reason string
+}
+
+// banList holds the bans. It is safe for concurrent use.
+type banList struct {
+	sync.RWMutex
+	// fileName is where bans are kept; "" keeps them in memory only.
+	fileName string
+	bans     map[netip.Prefix]ban
+}
+
+func loadBans(fileName string) *banList {
+	l := &banList{fileName: fileName, bans: make(map[netip.Prefix]ban)}
+	if fileName == "" {
+		return l
+	}
+	for key, value := range pairfile.Read(fileName) {
+		prefix, err := netip.ParsePrefix(key)
+		fields := strings.SplitN(value, " ", 3)
+		if err != nil || len(fields) < 2 {
+			slog.Warn("Ignoring malformed ban", "prefix", key)
+			continue
+		}
+		b := ban{Prefix: prefix, By: fields[1]}
+		if sec, err := strconv.ParseInt(fields[0], 10, 64); err == nil {
+			b.At = time.Unix(sec, 0)
+		}
+		if len(fields) == 3 {
+			b.Reason = fields[2]
+		}
+		l.bans[prefix] = b
+	}
+	return l
+}
+
+// save writes the bans out; callers hold the lock.
+func (l *banList) save() {
+	if l.fileName == "" {
+		return
+	}
+	pairs := make(map[string]string, len(l.bans))
+	for prefix, b := range l.bans {
+		pairs[prefix.String()] = fmt.Sprintf("%d %s %s", b.At.Unix(), b.By, b.Reason)
+	}
+	pairfile.Write(l.fileName, pairs)
+}
+
+// parseBanPrefix parses an address or CIDR range, as bans name them.
+func parseBanPrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
+
+func (l *banList) add(b ban) {
+	l.Lock()
+	defer l.Unlock()
+	l.bans[b.Prefix] = b
+	l.save()
+}
+
+// remove lifts the ban on prefix, reporting whether there was one.
+func (l *banList) remove(prefix netip.Prefix) bool {
+	l.Lock()
+	defer l.Unlock()
+	if _, exists := l.bans[prefix]; !exists {
+		return false
+	}
+	delete(l.bans, prefix)
+	l.save()
+	return true
+}
+
+// banned reports whether the client address ip is banned.
+func (l *banList) banned(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	l.RLock()
+	defer l.RUnlock()
+	for prefix := range l.bans {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns the bans, most recent first.
+func (l *banList) list() []ban {
+	l.RLock()
+	defer l.RUnlock()
+	bans := make([]ban, 0, len(l.bans))
+	for _, b := range l.bans {
+		bans = append(bans, b)
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		if !bans[i].At.Equal(bans[j].At) {
+			return bans[i].At.After(bans[j].At)
+		}
+		return bans[i].Prefix.String() < bans[j].Prefix.String()
+	})
+	return bans
+}
+
+func (l *banList) len() int {
+	l.RLock()
+	defer l.RUnlock()
+	return len(l.bans)
+}
+
+// serveBans lists the bans on GET, one "prefix time moderator reason" per
+// line; on POST bans the addr form field, an address or CIDR range, for
+// the reason form field; and on DELETE lifts the ban on ?addr=.
+func (s *Server) serveBans(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.requireRole(w, r, auth.RoleModerator)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		for _, b := range s.bans.list() {
+			fmt.Fprintln(w, b.Prefix, b.At.UTC().Format(time.RFC3339), b.By, b.Reason)
+		}
+
+	case http.MethodPost:
+		if !s.parseForm(w, r) {
+			return
+		}
+		prefix, err := parseBanPrefix(r.FormValue("addr"))
+		if err != nil {
+			http.Error(w, "addr must be an IP address or CIDR range", http.StatusBadRequest)
+			return
+		}
+		reason := strings.Join(strings.Fields(r.FormValue("reason")), " ")
+		s.bans.add(ban{Prefix: prefix, At: s.clock.Now(), By: user, Reason: reason})
+		slog.Info("Banned address", "prefix", prefix, "by", user, "reason", reason, "request_id", RequestID(r.Context()))
+		fmt.Fprintf(w, "banned %s\n", prefix)
+
+	case http.MethodDelete:
+		prefix, err := parseBanPrefix(r.URL.Query().Get("addr"))
+		if err != nil {
+			http.Error(w, "addr must be an IP address or CIDR range", http.StatusBadRequest)
+			return
+		}
+		if !s.bans.remove(prefix) {
+			http.NotFound(w, r)
+			return
+		}
+		slog.Info("Lifted ban", "prefix", prefix, "by", user, "request_id", RequestID(r.Context()))
+		fmt.Fprintf(w, "lifted ban on %s\n", prefix)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
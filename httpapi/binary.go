@@ -0,0 +1,47 @@
+// Package httpapi implements binary pastes. The store records the detected
+// MIME type of content that isn't text, and such pastes are served as
+// themselves with that type whatever the view asked for, since the text
+// renderers have nothing to offer them. Images display inline; anything
+// else downloads. Binary pastes have their own size cap.
+package httpapi
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"pb/store"
+)
+
+// bodyLimit is the most a paste's request body may hold: the larger of the
+// text and binary caps, as which applies is only known once it is read.
+func (s *Server) bodyLimit() int64 {
+	return max(s.maxPasteSize, s.maxBinarySize)
+}
+
+// checkPasteSize answers the request and returns false if body exceeds the
+// cap for its kind.
+func (s *Server) checkPasteSize(w http.ResponseWriter, body []byte, encrypted bool) bool {
+	limit, kind := s.maxPasteSize, "Paste"
+	if store.DetectMediaType(string(body), encrypted) != "" {
+		limit, kind = s.maxBinarySize, "Binary paste"
+	}
+	if int64(len(body)) > limit {
+		http.Error(w, fmt.Sprintf("%s too large: the limit is %s", kind, formatSize(limit)), http.StatusRequestEntityTooLarge)
+		return false
+	}
+	return true
+}
+
+// serveBinary writes a binary paste with its media type.
+func serveBinary(w http.ResponseWriter, content io.Reader, id, mediaType string) {
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if strings.HasPrefix(mediaType, "image/") {
+		w.Header().Set("Content-Disposition", "inline")
+	} else {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", id))
+	}
+	io.Copy(w, content)
+}
@@ -0,0 +1,153 @@
+// Package httpapi implements telling apart the ways a create or update can
+// carry its paste: a multipart form, a URL-encoded form as sprunge and
+// ix.io clients send with curl --data-urlencode 'f:1=...', a JSON object,
+// or the body itself. Content-Type alone can't decide it, since curl -d
+// and --data-binary label any body URL-encoded, so forms and JSON objects
+// are only taken as such when they look like one, and are stored as
+// they came otherwise.
+package httpapi
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// bodyKind is how a request carries its paste.
+type bodyKind int
+
+const (
+	// bodyRaw bodies are the paste itself.
+	bodyRaw bodyKind = iota
+	// bodyMultipart bodies are a multipart form with the paste in "f:1".
+	bodyMultipart
+	// bodyForm bodies look like a URL-encoded form with the paste in
+	// "f:1", or "sprunge".
+	bodyForm
+	// bodyJSON bodies look like a JSON object with the paste in
+	// "content".
+	bodyJSON
+)
+
+// bodySniffSize is how much of a body is looked at to tell its kind.
+const bodySniffSize = 512
+
+// formFieldNames are the fields a URL-encoded form may start with; see
+// readPaste.
+var formFieldNames = map[string]bool{
+	"f:1": true, "ext:1": true, "read:1": true, "ttl:1": true, "view_pass": true,
+	"lang": true, "dns": true, "draft": true, "id": true, "slug": true, "u": true,
+	"search": true, "noindex": true, "nounfurl": true, "sprunge": true,
+}
+
+// pasteFields are the form fields a paste may come in: "f:1" as ix.io
+// took it, and "sprunge" as sprunge did, so their shell aliases work.
+var pasteFields = []string{"f:1", "sprunge"}
+
+// sniffedBody is a request body whose start has been looked at.
+type sniffedBody struct {
+	*bufio.Reader
+	io.Closer
+	kind bodyKind
+}
+
+// detectBody tells how r carries its paste. It peeks at URL-encoded and
+// JSON bodies, replacing r.Body with one that still reads from the start,
+// and remembers the answer there for later calls.
+func detectBody(r *http.Request) bodyKind {
+	if sb, ok := r.Body.(*sniffedBody); ok {
+		return sb.kind
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "multipart/form-data":
+		return bodyMultipart
+	case "application/x-www-form-urlencoded", "application/json":
+	default:
+		return bodyRaw
+	}
+	sb := &sniffedBody{Reader: bufio.NewReaderSize(r.Body, bodySniffSize), Closer: r.Body}
+	r.Body = sb
+	head, _ := sb.Peek(bodySniffSize)
+	if mediaType == "application/json" {
+		if trimmed := strings.TrimSpace(string(head)); strings.HasPrefix(trimmed, "{") {
+			sb.kind = bodyJSON
+		}
+		return sb.kind
+	}
+	name, _, found := strings.Cut(string(head), "=")
+	if name, err := url.QueryUnescape(name); found && err == nil && formFieldNames[name] {
+		sb.kind = bodyForm
+	}
+	return sb.kind
+}
+
+// rawBody reports whether the request body is the paste itself rather than
+// a form or JSON object carrying it.
+func rawBody(r *http.Request) bool {
+	return detectBody(r) == bodyRaw
+}
+
+// parseFormBody returns the paste and fields of a URL-encoded form, or
+// false if body isn't a form with the paste in one of pasteFields after
+// all.
+func parseFormBody(body []byte) (string, url.Values, bool) {
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return "", nil, false
+	}
+	for _, name := range pasteFields {
+		if values.Has(name) {
+			return values.Get(name), values, true
+		}
+	}
+	return "", nil, false
+}
+
+// langHint returns the language named by a bare query string, as in
+// sprunge's /{id}?py, or "".
+func langHint(r *http.Request) string {
+	if r.Method != http.MethodGet || strings.ContainsAny(r.URL.RawQuery, "=&") {
+		return ""
+	}
+	lang, ok := normalizeLang(r.URL.RawQuery)
+	if !ok {
+		return ""
+	}
+	return lang
+}
+
+// parseJSONBody returns the paste and fields of a JSON object such as
+// {"content": "...", "lang": "go", "ttl": "1h"}, or false if body isn't an
+// object with a string "content". The fields take their query string
+// names; true stands for "1".
+func parseJSONBody(body []byte) (string, url.Values, bool) {
+	var object map[string]any
+	if json.Unmarshal(body, &object) != nil {
+		return "", nil, false
+	}
+	content, ok := object["content"].(string)
+	if !ok {
+		return "", nil, false
+	}
+	fields := url.Values{}
+	for name, value := range object {
+		switch v := value.(type) {
+		case string:
+			fields.Set(name, v)
+		case float64:
+			fields.Set(name, strconv.FormatFloat(v, 'f', -1, 64))
+		case bool:
+			if v {
+				fields.Set(name, "1")
+			}
+		}
+	}
+	fields.Del("content")
+	return content, fields, true
+}
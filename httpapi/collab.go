@@ -0,0 +1,367 @@
+// Package httpapi implements live collaborative editing over a WebSocket at
+// /{id}/ws, which the editor of /{id}/edit joins. Everyone editing a paste
+// shares one session: each change is sent as a patch replacing a range of
+// the text, applied in the order the server gets them and passed on to the
+// others. Concurrent changes aren't merged: a patch made against an older
+// version is dropped, and its writer is sent the text as it now is. A
+// changed session saves the paste every collabSaveInterval, and again when
+// the last editor leaves.
+//
+// Messages are JSON objects with a type. Clients send "patch" with the
+// version they patched, from, to and text; ranges count UTF-16 code units,
+// as JavaScript does. The server sends "init" and "sync" with the whole
+// content, "patch" with someone else's change, "ack" for one's own,
+// "saved", "error", and "closed" when the paste is deleted.
+package httpapi
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/net/websocket"
+)
+
+// collabSaveInterval is how often a changed session saves its paste.
+const collabSaveInterval = 5 * time.Second
+
+// collabWriteTimeout bounds sending one message to an editor, so a stalled
+// one can't hold up the session.
+const collabWriteTimeout = 5 * time.Second
+
+// collabMessage is a message of the session protocol.
+type collabMessage struct {
+	Type    string `json:"type"`
+	Version int    `json:"version"`
+	From    int    `json:"from"`
+	To      int    `json:"to"`
+	Text    string `json:"text,omitempty"`
+	Content string `json:"content,omitempty"`
+	By      string `json:"by,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// collabSession is the shared state of everyone editing one paste.
+type collabSession struct {
+	sync.Mutex
+	id      string
+	content string
+	version int
+	// saved is the content last loaded or saved, by which the session
+	// tells its own updates from others'.
+	saved string
+	dirty bool
+	// user and req are the last writer and their request, for the content
+	// filters and the update event.
+	user    string
+	req     *http.Request
+	clients map[*websocket.Conn]bool
+	closed  bool
+	stop    chan struct{}
+	// saving makes saves one at a time.
+	saving sync.Mutex
+}
+
+// send sends msg to conn; the caller holds the session's lock.
+func (cs *collabSession) send(conn *websocket.Conn, msg collabMessage) {
+	conn.SetWriteDeadline(time.Now().Add(collabWriteTimeout))
+	if err := websocket.JSON.Send(conn, msg); err != nil {
+		conn.Close()
+	}
+}
+
+// broadcast sends msg to every editor but except, if any; the caller holds
+// the session's lock.
+func (cs *collabSession) broadcast(msg collabMessage, except *websocket.Conn) {
+	for conn := range cs.clients {
+		if conn != except {
+			cs.send(conn, msg)
+		}
+	}
+}
+
+// collabHub holds the open sessions by paste ID.
+type collabHub struct {
+	sync.Mutex
+	sessions map[string]*collabSession
+}
+
+func newCollabHub() *collabHub {
+	return &collabHub{sessions: make(map[string]*collabSession)}
+}
+
+func (h *collabHub) get(id string) *collabSession {
+	h.Lock()
+	defer h.Unlock()
+	return h.sessions[id]
+}
+
+// joinCollab adds conn to the session of paste id, starting one with content if
+// there is none, and sends it the session's text.
+func (s *Server) joinCollab(id, content string, conn *websocket.Conn) *collabSession {
+	h := s.collab
+	h.Lock()
+	defer h.Unlock()
+	cs, ok := h.sessions[id]
+	if !ok {
+		cs = &collabSession{id: id, content: content, saved: content, clients: make(map[*websocket.Conn]bool), stop: make(chan struct{})}
+		h.sessions[id] = cs
+		go s.runCollab(cs)
+	}
+	cs.Lock()
+	defer cs.Unlock()
+	cs.clients[conn] = true
+	cs.send(conn, collabMessage{Type: "init", Version: cs.version, Content: cs.content})
+	return cs
+}
+
+// leaveCollab takes conn out of cs, ending the session and saving it if it
+// was the last editor.
+func (s *Server) leaveCollab(cs *collabSession, conn *websocket.Conn) {
+	h := s.collab
+	h.Lock()
+	cs.Lock()
+	delete(cs.clients, conn)
+	last := len(cs.clients) == 0
+	if last && h.sessions[cs.id] == cs {
+		delete(h.sessions, cs.id)
+		close(cs.stop)
+	}
+	cs.Unlock()
+	h.Unlock()
+	if last {
+		s.saveCollab(cs)
+	}
+}
+
+// runCollab saves cs every collabSaveInterval until it ends.
+func (s *Server) runCollab(cs *collabSession) {
+	ticker := time.NewTicker(collabSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.saveCollab(cs)
+		case <-cs.stop:
+			return
+		}
+	}
+}
+
+// saveCollab saves the paste of cs if it changed since the last save,
+// running the content filters as an update would.
+func (s *Server) saveCollab(cs *collabSession) {
+	cs.saving.Lock()
+	defer cs.saving.Unlock()
+
+	cs.Lock()
+	if !cs.dirty || cs.closed {
+		cs.Unlock()
+		return
+	}
+	content, version, user, r := cs.content, cs.version, cs.user, cs.req
+	cs.dirty = false
+	cs.saved = content
+	cs.Unlock()
+
+	verdict, reason := s.filterContent(r, content, user, false)
+	if verdict == Reject {
+		slog.Info("Rejected paste", "id", cs.id, "reason", reason, "user", user, "request_id", RequestID(r.Context()))
+		stored, _ := s.store().Get(cs.id)
+		cs.Lock()
+		cs.content, cs.saved = stored, stored
+		cs.version++
+		cs.broadcast(collabMessage{Type: "error", Message: "Paste rejected: " + reason}, nil)
+		cs.broadcast(collabMessage{Type: "sync", Version: cs.version, Content: cs.content}, nil)
+		cs.Unlock()
+		return
+	}
+	if !s.store().Update(cs.id, content) {
+		return
+	}
+	if verdict == Quarantine {
+		s.quarantine(r, cs.id, reason)
+	}
+	info, _ := s.store().Meta(cs.id)
+	url := constructURL(r, cs.id)
+	if info.Slug != "" {
+		url = constructURL(r, slugPath(info.Owner, info.Slug))
+	}
+	if !info.Draft {
+		s.events.publish(event{kind: eventUpdate, id: cs.id, url: url, user: user, requestID: RequestID(r.Context())})
+	}
+	cs.Lock()
+	cs.broadcast(collabMessage{Type: "saved", Version: version}, nil)
+	cs.Unlock()
+}
+
+// flushCollab saves every open session.
+func (s *Server) flushCollab() {
+	s.collab.Lock()
+	sessions := make([]*collabSession, 0, len(s.collab.sessions))
+	for _, cs := range s.collab.sessions {
+		sessions = append(sessions, cs)
+	}
+	s.collab.Unlock()
+	for _, cs := range sessions {
+		s.saveCollab(cs)
+	}
+}
+
+// collabChanged brings the session of a paste changed elsewhere up to date:
+// an update made other than by the session replaces its text, and a
+// deleted or expired paste ends it.
+func (s *Server) collabChanged(e event) {
+	cs := s.collab.get(e.id)
+	if cs == nil {
+		return
+	}
+	if e.kind == eventUpdate {
+		stored, ok := s.store().Get(e.id)
+		cs.Lock()
+		if ok && stored != cs.saved {
+			cs.content, cs.saved, cs.dirty = stored, stored, false
+			cs.version++
+			cs.broadcast(collabMessage{Type: "sync", Version: cs.version, Content: cs.content, By: e.user}, nil)
+		}
+		cs.Unlock()
+		return
+	}
+	cs.Lock()
+	cs.closed = true
+	cs.broadcast(collabMessage{Type: "closed", Message: "The paste was deleted"}, nil)
+	for conn := range cs.clients {
+		conn.Close()
+	}
+	cs.Unlock()
+}
+
+// hijacker hands the connection under w to the websocket package, which
+// looks for http.Hijacker on w itself rather than through the writers
+// requests are wrapped in.
+type hijacker struct{ http.ResponseWriter }
+
+func (h hijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(h.ResponseWriter).Hijack()
+}
+
+// webSocketUpgrade reports whether r opens a WebSocket, which, though a
+// GET, edits the paste as a PUT would: the middleware guarding writes
+// treats it as one.
+func webSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+// applyPatch replaces the UTF-16 code units from to to of content with
+// text, clamping the range to the content, and returns the result and the
+// range replaced.
+func applyPatch(content string, from, to int, text string) (string, int, int) {
+	units := utf16.Encode([]rune(content))
+	to = min(max(to, 0), len(units))
+	from = min(max(from, 0), to)
+	patched := make([]uint16, 0, len(units)-(to-from)+len(text))
+	patched = append(patched, units[:from]...)
+	patched = append(patched, utf16.Encode([]rune(text))...)
+	patched = append(patched, units[to:]...)
+	return string(utf16.Decode(patched)), from, to
+}
+
+// serveCollab joins the caller, who must be allowed to update paste id, to
+// its editing session.
+func (s *Server) serveCollab(w http.ResponseWriter, r *http.Request, id, user string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !sameOrigin(r) {
+		http.Error(w, "Cross-site WebSocket rejected", http.StatusForbidden)
+		return
+	}
+	// Sessions save to the store, so on a replica they belong to the
+	// primary.
+	if s.forward(w, r) {
+		return
+	}
+	editTokenFromCookie(r)
+	if !s.authorize(w, r, id, user) {
+		return
+	}
+	info, _ := s.store().Meta(id)
+	if info.Encrypted || info.MediaType != "" || info.Redirect {
+		http.Error(w, "Only text snippets can be edited together", http.StatusBadRequest)
+		return
+	}
+	if !s.requireFeature(w, FeatureCollab, "Collaborative editing is disabled for now") {
+		return
+	}
+	content, ok := s.store().Get(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	limit := s.maxPasteSize
+	if _, tier := s.tierOf(user); tier.MaxPasteSize > 0 && tier.MaxPasteSize < limit {
+		limit = tier.MaxPasteSize
+	}
+	// Filters and the update event outlive the request that last wrote.
+	req := r.WithContext(context.WithoutCancel(r.Context()))
+
+	handler := func(conn *websocket.Conn) {
+		conn.MaxPayloadBytes = int(limit) + 1024
+		cs := s.joinCollab(id, content, conn)
+		defer s.leaveCollab(cs, conn)
+		slog.Info("Joined editing session", "id", id, "user", user, "request_id", RequestID(r.Context()))
+		for {
+			var msg collabMessage
+			if err := websocket.JSON.Receive(conn, &msg); err != nil {
+				if !errors.Is(err, websocket.ErrFrameTooLarge) {
+					return
+				}
+				cs.Lock()
+				cs.send(conn, collabMessage{Type: "error", Message: "Patch too large"})
+				cs.Unlock()
+				continue
+			}
+			if msg.Type != "patch" {
+				continue
+			}
+			cs.Lock()
+			if cs.closed {
+				cs.Unlock()
+				return
+			}
+			// A patch made against an older version has offsets into
+			// text that has since changed, so it is dropped and the
+			// writer brought up to date instead.
+			if msg.Version != cs.version {
+				cs.send(conn, collabMessage{Type: "sync", Version: cs.version, Content: cs.content})
+				cs.Unlock()
+				continue
+			}
+			patched, from, to := applyPatch(cs.content, msg.From, msg.To, msg.Text)
+			if int64(len(patched)) > limit {
+				cs.send(conn, collabMessage{Type: "error", Message: "Paste too large: the limit is " + formatSize(limit)})
+				cs.send(conn, collabMessage{Type: "sync", Version: cs.version, Content: cs.content})
+				cs.Unlock()
+				continue
+			}
+			cs.content = patched
+			cs.version++
+			cs.dirty = true
+			cs.user, cs.req = user, req
+			cs.broadcast(collabMessage{Type: "patch", Version: cs.version, From: from, To: to, Text: msg.Text, By: user}, conn)
+			cs.send(conn, collabMessage{Type: "ack", Version: cs.version})
+			cs.Unlock()
+		}
+	}
+	// Origins were checked above, and clients without one are let in.
+	websocket.Server{Handler: handler, Handshake: func(*websocket.Config, *http.Request) error { return nil }}.ServeHTTP(hijacker{w}, r)
+}
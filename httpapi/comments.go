@@ -0,0 +1,172 @@
+// Package httpapi implements line comments, for using pb as a scratchpad
+// for code review. At /{id}/comments, GET lists a snippet's comments as
+// JSON, POST adds one from the line and body form fields, and DELETE
+// removes the one given as ?id=. Anyone who can read a snippet can read
+// its comments; commenting needs an account, and comments can be deleted
+// by their author or the snippet's owner. The code view marks commented
+// lines in its gutter and shows their comments on hover.
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"pb/store"
+)
+
+// maxCommentSize caps the body of one comment.
+const maxCommentSize = 4 << 10
+
+// commentResponse is a comment as the API shows it. Outdated is set for
+// comments made on an earlier version of the snippet, whose lines may
+// have moved since.
+type commentResponse struct {
+	ID       int       `json:"id"`
+	Line     int       `json:"line"`
+	Author   string    `json:"author"`
+	Body     string    `json:"body"`
+	Created  time.Time `json:"created"`
+	Outdated bool      `json:"outdated,omitempty"`
+}
+
+func newCommentResponse(c store.Comment, info store.Info) commentResponse {
+	return commentResponse{
+		ID:       c.ID,
+		Line:     c.Line,
+		Author:   c.Author,
+		Body:     c.Body,
+		Created:  c.Created,
+		Outdated: c.Hash != info.Hash,
+	}
+}
+
+// serveComments serves /{id}/comments for user.
+func (s *Server) serveComments(w http.ResponseWriter, r *http.Request, id, user string) {
+	// Comments aren't replicated, so replicas leave them to the primary.
+	if s.forward(w, r) {
+		return
+	}
+	info, ok := s.store().Meta(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !s.checkPrivate(w, r, id, user) || !s.checkReadPolicies(w, r, id, user) {
+		return
+	}
+	s.checkHoneytoken(r, id, user)
+	if !s.checkViewPassword(w, r, id, user) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		comments := []commentResponse{}
+		for _, c := range s.store().Comments(id) {
+			comments = append(comments, newCommentResponse(c, info))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(comments)
+
+	case http.MethodPost:
+		if user == "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="pb"`)
+			http.Error(w, "Log in to comment", http.StatusUnauthorized)
+			return
+		}
+		if info.Encrypted || info.MediaType != "" {
+			http.Error(w, "Only text snippets can be commented on", http.StatusBadRequest)
+			return
+		}
+		if !s.parseForm(w, r) {
+			return
+		}
+		body := strings.TrimSpace(r.FormValue("body"))
+		if body == "" {
+			http.Error(w, "Send the comment as the body field", http.StatusBadRequest)
+			return
+		}
+		if len(body) > maxCommentSize {
+			http.Error(w, "Comment too long: the limit is "+formatSize(maxCommentSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		content, ok := s.store().Get(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		line, err := strconv.Atoi(r.FormValue("line"))
+		if lines := len(splitLines(content)); err != nil || line < 1 || line > max(lines, 1) {
+			http.Error(w, fmt.Sprintf("line must be a line number from 1 to %d", max(lines, 1)), http.StatusBadRequest)
+			return
+		}
+		c, ok := s.store().AddComment(id, line, user, body)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		slog.Info("Added comment", "id", id, "comment", c.ID, "line", line, "user", user, "request_id", RequestID(r.Context()))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(newCommentResponse(c, info))
+
+	case http.MethodDelete:
+		commentID, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, "Name the comment to delete as ?id=", http.StatusBadRequest)
+			return
+		}
+		var author string
+		for _, c := range s.store().Comments(id) {
+			if c.ID == commentID {
+				author = c.Author
+			}
+		}
+		if author == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if user == "" || (user != author && user != info.Owner && !s.admins[user]) {
+			http.Error(w, "Only the comment's author or the paste's owner can delete it", http.StatusForbidden)
+			return
+		}
+		if !s.store().DeleteComment(id, commentID) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// commentMarkers returns the gutter markers for comments, by line: a mark
+// that shows the line's comments when hovered or focused.
+func commentMarkers(comments []store.Comment) map[int]string {
+	byLine := make(map[int][]store.Comment)
+	for _, c := range comments {
+		byLine[c.Line] = append(byLine[c.Line], c)
+	}
+	markers := make(map[int]string, len(byLine))
+	for line, list := range byLine {
+		var sb strings.Builder
+		fmt.Fprintf(&sb, `<span class="marker" tabindex="0" title="%d comment(s)">●<span class="popover">`, len(list))
+		for _, c := range list {
+			fmt.Fprintf(&sb, `<span class="comment"><b>%s</b> <time>%s</time><br>%s</span>`,
+				template.HTMLEscapeString(c.Author), c.Created.Format(time.DateOnly),
+				strings.ReplaceAll(template.HTMLEscapeString(c.Body), "\n", "<br>"))
+		}
+		sb.WriteString("</span></span>")
+		markers[line] = sb.String()
+	}
+	return markers
+}
+
+var commentStyle = stylesheet("comments.css")
@@ -0,0 +1,219 @@
+// Package httpapi implements GET /compare?a=<id>&b=<id>, or the shorter
+// GET /diff/<id>/<id>, comparing two snippets: browsers get them side by
+// side, with changed lines lined up, the changed part of each highlighted
+// and the two columns scrolling together; curl and other clients get a
+// unified diff. Both snippets must be readable by the caller, exactly as
+// for GET /{id}.
+package httpapi
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// compareCell is one side of a row of the side-by-side view. Num is 0 for
+// the filler opposite a line only the other side has.
+type compareCell struct {
+	Num  int
+	Kind string
+	HTML template.HTML
+}
+
+type compareRow struct {
+	Left, Right compareCell
+}
+
+// compareRows lines up the two texts for the side-by-side view. Within a
+// run of changes, removed and added lines are paired in order and their
+// differences highlighted.
+func compareRows(a, b []string, ops []diffOp) []compareRow {
+	var rows []compareRow
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			op := ops[i]
+			rows = append(rows, compareRow{
+				Left:  compareCell{Num: op.a + 1, HTML: template.HTML(template.HTMLEscapeString(a[op.a]))},
+				Right: compareCell{Num: op.b + 1, HTML: template.HTML(template.HTMLEscapeString(b[op.b]))},
+			})
+			i++
+			continue
+		}
+		var removed, added []diffOp
+		for ; i < len(ops) && ops[i].kind != ' '; i++ {
+			if ops[i].kind == '-' {
+				removed = append(removed, ops[i])
+			} else {
+				added = append(added, ops[i])
+			}
+		}
+		for j := 0; j < max(len(removed), len(added)); j++ {
+			var row compareRow
+			switch {
+			case j < len(removed) && j < len(added):
+				left, right := highlightChange(a[removed[j].a], b[added[j].b])
+				row.Left = compareCell{Num: removed[j].a + 1, Kind: "del", HTML: left}
+				row.Right = compareCell{Num: added[j].b + 1, Kind: "add", HTML: right}
+			case j < len(removed):
+				row.Left = compareCell{Num: removed[j].a + 1, Kind: "del", HTML: template.HTML(template.HTMLEscapeString(a[removed[j].a]))}
+				row.Right = compareCell{Kind: "empty"}
+			default:
+				row.Left = compareCell{Kind: "empty"}
+				row.Right = compareCell{Num: added[j].b + 1, Kind: "add", HTML: template.HTML(template.HTMLEscapeString(b[added[j].b]))}
+			}
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// highlightChange escapes a changed line and its replacement, marking the
+// part between what they have in common at either end.
+func highlightChange(before, after string) (template.HTML, template.HTML) {
+	prefix := 0
+	for prefix < len(before) && prefix < len(after) && before[prefix] == after[prefix] {
+		prefix++
+	}
+	// Don't split a multi-byte character.
+	for prefix > 0 && prefix < len(before) && !utf8.RuneStart(before[prefix]) {
+		prefix--
+	}
+	suffix := 0
+	for suffix < len(before)-prefix && suffix < len(after)-prefix &&
+		before[len(before)-1-suffix] == after[len(after)-1-suffix] {
+		suffix++
+	}
+	for suffix > 0 && !utf8.RuneStart(before[len(before)-suffix]) {
+		suffix--
+	}
+	mark := func(s string) template.HTML {
+		middle := s[prefix : len(s)-suffix]
+		html := template.HTMLEscapeString(s[:prefix])
+		if middle != "" {
+			html += `<span class="chg">` + template.HTMLEscapeString(middle) + `</span>`
+		}
+		return template.HTML(html + template.HTMLEscapeString(s[len(s)-suffix:]))
+	}
+	return mark(before), mark(after)
+}
+
+var compareTemplate = template.Must(template.New("compare").Parse(`<div class="names"><a href="/{{.A}}">{{.A}}</a><a href="/{{.B}}">{{.B}}</a></div>
+<div class="compare">
+<div class="pane"><table>
+{{- range .Rows}}
+<tr class="{{.Left.Kind}}"><td class="num">{{if .Left.Num}}{{.Left.Num}}{{end}}</td><td class="line">{{.Left.HTML}}</td></tr>
+{{- end}}
+</table></div>
+<div class="pane"><table>
+{{- range .Rows}}
+<tr class="{{.Right.Kind}}"><td class="num">{{if .Right.Num}}{{.Right.Num}}{{end}}</td><td class="line">{{.Right.HTML}}</td></tr>
+{{- end}}
+</table></div>
+</div>
+` + string(script("compare.js"))))
+
+var compareStyle = stylesheet("compare.css")
+
+// serveCompare compares the snippets given as ?a= and ?b=.
+func (s *Server) serveCompare(w http.ResponseWriter, r *http.Request) {
+	idA, idB := r.URL.Query().Get("a"), r.URL.Query().Get("b")
+	if idA == "" || idB == "" {
+		http.Error(w, "Name the snippets to compare as ?a=<id>&b=<id>", http.StatusBadRequest)
+		return
+	}
+	s.compare(w, r, idA, idB)
+}
+
+// serveDiff compares the snippets named in the path of GET /diff/{a}/{b},
+// a shorter link to share than /compare's.
+func (s *Server) serveDiff(w http.ResponseWriter, r *http.Request) {
+	idA, idB, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/diff/"), "/")
+	if !ok || idA == "" || idB == "" || strings.Contains(idB, "/") {
+		http.Error(w, "Name the snippets to compare as /diff/<id>/<id>", http.StatusBadRequest)
+		return
+	}
+	s.compare(w, r, idA, idB)
+}
+
+// compare answers r with a comparison of snippets idA and idB.
+func (s *Server) compare(w http.ResponseWriter, r *http.Request, idA, idB string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := s.users.Authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="pb"`)
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	for _, id := range []string{idA, idB} {
+		info, ok := s.store().Meta(id)
+		if !ok {
+			if s.forward(w, r) {
+				return
+			}
+			http.NotFound(w, r)
+			return
+		}
+		if !s.checkPrivate(w, r, id, user) || !s.checkReadPolicies(w, r, id, user) {
+			return
+		}
+		s.checkHoneytoken(r, id, user)
+		if !s.checkViewPassword(w, r, id, user) {
+			return
+		}
+		if info.Encrypted || info.MediaType != "" {
+			http.Error(w, "Only text snippets can be compared, and "+id+" is not one", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if s.memory.pressured() {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Server is low on memory; comparisons are disabled for now", http.StatusServiceUnavailable)
+		return
+	}
+	if !s.renders.acquire(w, r) {
+		return
+	}
+	defer s.renders.release()
+
+	contentA, okA := s.store().Get(idA)
+	contentB, okB := s.store().Get(idB)
+	if !okA || !okB {
+		http.NotFound(w, r)
+		return
+	}
+	for _, id := range []string{idA, idB} {
+		if !s.claimRead(w, r, id) {
+			return
+		}
+	}
+	for _, id := range []string{idA, idB} {
+		s.events.publish(event{kind: eventRead, id: id, url: constructURL(r, id), user: user, requestID: RequestID(r.Context())})
+	}
+
+	a, b := splitLines(contentA), splitLines(contentB)
+	ops := diffLines(a, b)
+	w.Header().Add("Vary", "Accept")
+	if !prefersHTML(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(unifiedDiff("a/"+idA, "b/"+idB, a, b, ops)))
+		return
+	}
+	var body bytes.Buffer
+	err := compareTemplate.Execute(&body, struct {
+		A, B string
+		Rows []compareRow
+	}{idA, idB, compareRows(a, b, ops)})
+	if err != nil {
+		http.Error(w, "Failed to render comparison", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	pageTemplate.Execute(w, page{Title: idA + " vs " + idB, Head: compareStyle, Body: template.HTML(body.String())})
+}
@@ -0,0 +1,108 @@
+// Package httpapi implements conditional GETs. Snippet responses carry an
+// ETag, made from the content hash the store already keeps, and
+// Last-Modified; a client sending either back as If-None-Match or
+// If-Modified-Since gets 304 Not Modified without the body while the
+// snippet is unchanged.
+package httpapi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"pb/store"
+)
+
+// snippetETag returns the entity tag of the representation of info served
+// for suffix. Views negotiated from the Accept header differ for browsers,
+// so they get tags of their own, and line comments change the code view,
+// so they count too.
+func snippetETag(r *http.Request, info store.Info, suffix string, comments []store.Comment) string {
+	tag := info.Hash
+	if len(tag) > 32 {
+		tag = tag[:32]
+	}
+	if len(comments) > 0 {
+		h := sha256.New()
+		for _, c := range comments {
+			fmt.Fprintf(h, "%d %d %q\n", c.ID, c.Line, c.Body)
+		}
+		tag += "-" + hex.EncodeToString(h.Sum(nil))[:8]
+	}
+	if suffix != "" {
+		tag += "-" + suffix
+	}
+	if (suffix == "" || suffix == "man") && prefersHTML(r) {
+		tag += "-html"
+	}
+	return `"` + tag + `"`
+}
+
+// lastModified returns when info's content, or its comments, last changed.
+func lastModified(info store.Info, comments []store.Comment) time.Time {
+	latest := info.Created
+	if info.Updated.After(latest) {
+		latest = info.Updated
+	}
+	for _, c := range comments {
+		if c.Created.After(latest) {
+			latest = c.Created
+		}
+	}
+	return latest
+}
+
+// checkNotModified sets the validators for info and, if the request's
+// preconditions show the client already has this representation, answers
+// 304 and returns true. Snippets limited to a number of reads get no
+// validators: a 304 would let a client keep reading without using any up.
+func checkNotModified(w http.ResponseWriter, r *http.Request, info store.Info, suffix string, comments []store.Comment) bool {
+	if info.MaxReads > 0 || info.Hash == "" {
+		return false
+	}
+	etag := snippetETag(r, info, suffix, comments)
+	modified := lastModified(info, comments).UTC().Truncate(time.Second)
+	w.Header().Set("ETag", etag)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+	}
+
+	// If-None-Match takes precedence, and If-Modified-Since is ignored
+	// whenever it is present (RFC 9110, section 13.2.2).
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if !etagMatches(inm, etag) {
+			return false
+		}
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" && !modified.IsZero() {
+		t, err := http.ParseTime(ims)
+		if err != nil || modified.After(t) {
+			return false
+		}
+	} else {
+		return false
+	}
+	// A 304 carries no body, so the content headers set so far go.
+	for _, header := range []string{"Content-Type", "Content-Length"} {
+		w.Header().Del(header)
+	}
+	if suffix == "" || suffix == "man" {
+		w.Header().Add("Vary", "Accept")
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches reports whether an If-None-Match list names etag, comparing
+// weakly as the header calls for.
+func etagMatches(list, etag string) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
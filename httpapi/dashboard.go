@@ -0,0 +1,80 @@
+// Package httpapi implements the admin dashboard at /admin/: the stats,
+// the newest pastes with buttons to delete them, and the bans with a form
+// to add one, for moderators working from a browser. Everything on it goes
+// through the same /admin/ endpoints the JSON and text clients use.
+package httpapi
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+
+	"pb/auth"
+	"pb/store"
+)
+
+// dashboardPastes is how many of the newest pastes the dashboard shows.
+const dashboardPastes = 50
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<h1>pb admin</h1>
+<p>Signed in as {{.User}} ({{.Role}}).</p>
+<h2>Stats</h2>
+<table>
+<tr><td>pastes</td><td>{{.Stats.Pastes}}</td></tr>
+<tr><td>stored</td><td>{{.Stats.Bytes}} bytes</td></tr>
+<tr><td>users</td><td>{{.Stats.Users}}</td></tr>
+<tr><td>flagged</td><td><a href="/admin/pastes?flagged=1">{{.Stats.Flagged}}</a></td></tr>
+<tr><td>webhook deliveries queued</td><td>{{.Stats.Deliveries}}</td></tr>
+<tr><td>memory</td><td>{{.Stats.MemoryBytes}} bytes</td></tr>
+<tr><td>uptime</td><td>{{.Stats.Uptime}}</td></tr>
+</table>
+<h2>Newest pastes</h2>
+<p>All of them: <a href="/admin/pastes">/admin/pastes</a></p>
+<table>
+<tr><th>id</th><th>owner</th><th>created</th><th>size</th><th></th><th></th></tr>
+{{range .Pastes}}<tr><td><a href="{{.URL}}">{{.ID}}</a></td><td>{{.Owner}}</td><td>{{.Created.Format "2006-01-02 15:04"}}</td><td>{{.Size}}</td><td>{{if .Private}}private {{end}}{{if .Flagged}}flagged {{end}}{{if .Honeytoken}}honeytoken{{end}}</td><td><button data-delete="{{.ID}}">delete</button></td></tr>
+{{end}}</table>
+<h2>Bans</h2>
+<form id="ban"><input name="addr" placeholder="address or CIDR range" required> <input name="reason" placeholder="reason"> <button>ban</button></form>
+<table>
+{{range .Bans}}<tr><td>{{.Prefix}}</td><td>{{.At.Format "2006-01-02 15:04"}}</td><td>{{.By}}</td><td>{{.Reason}}</td><td><button data-unban="{{.Prefix}}">lift</button></td></tr>
+{{end}}</table>
+` + string(script("dashboard.js")) + `
+`))
+
+// serveDashboard serves the dashboard on GET /admin/.
+func (s *Server) serveDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/admin/" {
+		http.NotFound(w, r)
+		return
+	}
+	user, ok := s.requireRole(w, r, auth.RoleModerator)
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var pastes []adminPasteEntry
+	all := func(store.Info) bool { return true }
+	s.eachListed(r, s.store().ListIDs(), all, func(info store.Info) bool {
+		pastes = append(pastes, newAdminPasteEntry(r, info))
+		return len(pastes) < dashboardPastes
+	})
+	var body strings.Builder
+	err := dashboardTemplate.Execute(&body, struct {
+		User, Role string
+		Stats      statsResponse
+		Pastes     []adminPasteEntry
+		Bans       []ban
+	}{user, s.roleOf(user), s.stats(), pastes, s.bans.list()})
+	if err != nil {
+		http.Error(w, "Failed to render dashboard", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	pageTemplate.Execute(w, page{Title: "pb admin", Body: template.HTML(body.String())})
+}
@@ -0,0 +1,197 @@
+// Package httpapi implements line diffs between snippets, using Myers'
+// algorithm, and their output as a unified diff.
+package httpapi
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxDiffEdits bounds the work and memory of a diff, which grow with the
+// square of the number of edits. Past it, the differing middle of the two
+// texts is shown as replaced wholesale.
+const maxDiffEdits = 1000
+
+// diffContext is how many unchanged lines surround each unified hunk.
+const diffContext = 3
+
+// diffOp is one line of an edit script: kept (' '), removed from a ('-') or
+// added from b ('+'). a and b index the line in each text; only the one(s)
+// the kind uses are meaningful.
+type diffOp struct {
+	kind byte
+	a, b int
+}
+
+// splitLines splits content into lines, without the final newline's empty
+// line.
+func splitLines(content string) []string {
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	if content == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+}
+
+// diffLines returns the edit script turning a into b.
+func diffLines(a, b []string) []diffOp {
+	// Lines common to both ends cost nothing to set aside first.
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var ops []diffOp
+	for i := 0; i < prefix; i++ {
+		ops = append(ops, diffOp{' ', i, i})
+	}
+	middle, ok := myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])
+	if !ok {
+		middle = nil
+		for i := prefix; i < len(a)-suffix; i++ {
+			middle = append(middle, diffOp{'-', i - prefix, 0})
+		}
+		for j := prefix; j < len(b)-suffix; j++ {
+			middle = append(middle, diffOp{'+', len(a) - suffix - prefix, j - prefix})
+		}
+	}
+	for _, op := range middle {
+		ops = append(ops, diffOp{op.kind, op.a + prefix, op.b + prefix})
+	}
+	for i := 0; i < suffix; i++ {
+		ops = append(ops, diffOp{' ', len(a) - suffix + i, len(b) - suffix + i})
+	}
+	return ops
+}
+
+// myers finds a shortest edit script turning a into b, or returns false if
+// it takes more than maxDiffEdits edits.
+func myers(a, b []string) ([]diffOp, bool) {
+	n, m := len(a), len(b)
+	offset := n + m + 1
+	v := make([]int, 2*offset+1)
+	// trace[d] holds v[-d..d] as it was after round d, for backtracking.
+	var trace [][]int
+	x, y := 0, 0
+search:
+	for d := 0; d <= n+m; d++ {
+		if d > maxDiffEdits {
+			return nil, false
+		}
+		for k := -d; k <= d; k += 2 {
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y = x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+				break search
+			}
+		}
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+	}
+
+	var ops []diffOp
+	for d := len(trace) - 1; d > 0; d-- {
+		prev := trace[d-1]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && prev[k-1+d-1] < prev[k+1+d-1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := prev[prevK+d-1]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			ops = append(ops, diffOp{' ', x, y})
+		}
+		if x == prevX {
+			ops = append(ops, diffOp{'+', x, prevY})
+		} else {
+			ops = append(ops, diffOp{'-', prevX, y})
+		}
+		x, y = prevX, prevY
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		ops = append(ops, diffOp{' ', x, y})
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops, true
+}
+
+// unifiedDiff formats ops as a unified diff of a into b, as diff -u would.
+func unifiedDiff(nameA, nameB string, a, b []string, ops []diffOp) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", nameA, nameB)
+	for start := 0; start < len(ops); {
+		// Find the next change and the extent of its hunk: changes closer
+		// than twice the context share one.
+		first := start
+		for first < len(ops) && ops[first].kind == ' ' {
+			first++
+		}
+		if first == len(ops) {
+			break
+		}
+		end := first
+		for i := first; i < len(ops); i++ {
+			if ops[i].kind != ' ' {
+				end = i + 1
+			} else if i-end >= 2*diffContext {
+				break
+			}
+		}
+		lo, hi := max(first-diffContext, start), min(end+diffContext, len(ops))
+
+		var body strings.Builder
+		countA, countB := 0, 0
+		for _, op := range ops[lo:hi] {
+			switch op.kind {
+			case ' ':
+				body.WriteString(" " + a[op.a] + "\n")
+				countA++
+				countB++
+			case '-':
+				body.WriteString("-" + a[op.a] + "\n")
+				countA++
+			case '+':
+				body.WriteString("+" + b[op.b] + "\n")
+				countB++
+			}
+		}
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(ops[lo].a, countA), hunkRange(ops[lo].b, countB))
+		sb.WriteString(body.String())
+		start = hi
+	}
+	return sb.String()
+}
+
+// hunkRange formats the line range of one side of a hunk starting at
+// index, which diff gives as the line before when the range is empty.
+func hunkRange(index, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", index)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", index+1)
+	}
+	return fmt.Sprintf("%d,%d", index+1, count)
+}
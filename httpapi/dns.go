@@ -0,0 +1,207 @@
+// Package httpapi implements an experimental DNS responder that serves small
+// snippets as TXT records, for networks where DNS is all that gets out.
+// Snippets opt in with dns=1 when created and must fit the size cap. Under
+// the responder's zone, e.g. p.pb.example,
+//
+//	<id>.p.pb.example      TXT "v=pb1 chunks=<n> size=<bytes> sha256=<hex>"
+//	<i>.<id>.p.pb.example  TXT chunk i, counting from 0, in base64
+//
+// so a client fetches the header, then each chunk, and checks the hash.
+// Only UDP is served; every answer fits in 512 bytes.
+package httpapi
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"pb/store"
+)
+
+// dnsChunkSize is how many snippet bytes go in one TXT record: base64
+// makes 240 characters of them, within a TXT string's 255.
+const dnsChunkSize = 180
+
+// DNSOptions configures ServeDNS.
+type DNSOptions struct {
+	// Addr is the UDP address to listen on, e.g. ":53".
+	Addr string
+	// Zone is the domain snippets are served under, e.g. "p.pb.example".
+	Zone string
+}
+
+// checkDNS answers the request and returns false unless a snippet of size
+// bytes may be served over DNS.
+func (s *Server) checkDNS(w http.ResponseWriter, size int) bool {
+	if s.dnsMaxSize <= 0 {
+		http.Error(w, "Retrieval over DNS is not enabled here", http.StatusBadRequest)
+		return false
+	}
+	if int64(size) > s.dnsMaxSize {
+		http.Error(w, "Paste too large for DNS: the limit is "+formatSize(s.dnsMaxSize), http.StatusRequestEntityTooLarge)
+		return false
+	}
+	return true
+}
+
+// ServeDNS answers DNS queries for snippets until ctx is done.
+func (s *Server) ServeDNS(ctx context.Context, opts DNSOptions) error {
+	if strings.Trim(opts.Zone, ".") == "" {
+		return errors.New("the DNS responder needs a zone")
+	}
+	conn, err := net.ListenPacket("udp", opts.Addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	zone := strings.ToLower(strings.Trim(opts.Zone, ".")) + "."
+	slog.Info("DNS retrieval is enabled", "addr", opts.Addr, "zone", zone)
+
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if resp, ok := s.answerDNS(buf[:n], zone); ok {
+			conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+// answerDNS builds the response to one query packet. ok is false for
+// packets not worth answering at all.
+func (s *Server) answerDNS(packet []byte, zone string) (resp []byte, ok bool) {
+	var p dnsmessage.Parser
+	header, err := p.Start(packet)
+	if err != nil || header.Response {
+		return nil, false
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, false
+	}
+
+	header.Response = true
+	header.Authoritative = true
+	header.RecursionAvailable = false
+	var txt string
+	switch name := q.Name.String(); {
+	case header.OpCode != 0:
+		header.RCode = dnsmessage.RCodeNotImplemented
+	case !strings.HasSuffix(strings.ToLower(name), "."+zone):
+		header.RCode = dnsmessage.RCodeRefused
+	default:
+		var found bool
+		if txt, found = s.dnsRecord(name[:len(name)-len(zone)-1]); !found {
+			header.RCode = dnsmessage.RCodeNameError
+		} else if q.Type != dnsmessage.TypeTXT {
+			// The name exists, just without records of that type.
+			txt = ""
+		}
+	}
+
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), header)
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, false
+	}
+	if err := b.Question(q); err != nil {
+		return nil, false
+	}
+	if txt != "" {
+		if err := b.StartAnswers(); err != nil {
+			return nil, false
+		}
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}
+		if err := b.TXTResource(rh, dnsmessage.TXTResource{TXT: []string{txt}}); err != nil {
+			return nil, false
+		}
+	}
+	resp, err = b.Finish()
+	return resp, err == nil
+}
+
+// dnsRecord returns the TXT record for a name below the zone: "<id>" or
+// "<chunk>.<id>".
+func (s *Server) dnsRecord(name string) (string, bool) {
+	chunkLabel, id, isChunk := strings.Cut(name, ".")
+	if !isChunk {
+		id = chunkLabel
+	}
+	info, ok := s.dnsSnippet(id)
+	if !ok {
+		return "", false
+	}
+	content, ok := s.store().Get(info.ID)
+	if !ok {
+		return "", false
+	}
+	chunks := (len(content) + dnsChunkSize - 1) / dnsChunkSize
+	if !isChunk {
+		return fmt.Sprintf("v=pb1 chunks=%d size=%d sha256=%s", chunks, len(content), info.Hash), true
+	}
+	i, err := strconv.Atoi(chunkLabel)
+	if err != nil || i < 0 || i >= chunks {
+		return "", false
+	}
+	chunk := content[i*dnsChunkSize : min((i+1)*dnsChunkSize, len(content))]
+	return base64.StdEncoding.EncodeToString([]byte(chunk)), true
+}
+
+// dnsSnippet looks up a snippet that may be served over DNS. Resolvers may
+// change the case of names (DNS 0x20), so if id doesn't match exactly, a
+// snippet whose ID matches it case-insensitively is used if there is just
+// one.
+func (s *Server) dnsSnippet(id string) (store.Info, bool) {
+	info, ok := s.store().Meta(id)
+	if !ok {
+		var matches []store.Info
+		for _, candidate := range s.store().All() {
+			if candidate.DNS && strings.EqualFold(candidate.ID, id) {
+				matches = append(matches, candidate)
+			}
+		}
+		if len(matches) != 1 {
+			return store.Info{}, false
+		}
+		info = matches[0]
+	}
+	if !info.DNS || info.Private || info.Flagged || info.Honeytoken || info.HasViewPassword || info.MaxReads > 0 || info.Draft ||
+		int64(info.Size) > s.dnsMaxSize {
+		return store.Info{}, false
+	}
+	decisions, err := s.policies.evaluate("read", map[string]any{
+		"user":      "",
+		"anonymous": true,
+		"owner":     info.Owner,
+		"private":   info.Private,
+		"size":      int64(info.Size),
+		"reads":     int64(info.Reads),
+		"id":        info.ID,
+	})
+	if err != nil {
+		slog.Error("Read policy failed", "err", err)
+		return store.Info{}, false
+	}
+	for _, d := range decisions {
+		if d.action == "deny" {
+			return store.Info{}, false
+		}
+	}
+	return info, true
+}
@@ -0,0 +1,53 @@
+// Package httpapi implements draft snippets. POST /?draft=1 stores a
+// snippet that only its author can read or change, and that stays out of
+// listings, the changes feed and webhooks' create events, until POST
+// /{id}/publish makes it public. The author is the owner, or for anonymous
+// drafts whoever holds the edit token.
+package httpapi
+
+import (
+	"fmt"
+	"net/http"
+
+	"pb/store"
+)
+
+// checkDraft answers the request itself and returns false if the draft
+// described by info is not user's. Drafts are not found for anyone else, so
+// their URLs don't give away that they exist.
+func (s *Server) checkDraft(w http.ResponseWriter, r *http.Request, info store.Info, user string) bool {
+	switch {
+	case info.Owner != "" && info.Owner == user:
+		return true
+	case info.Owner == "" && s.store().CheckEditToken(info.ID, r.Header.Get(editTokenHeader)):
+		return true
+	}
+	http.NotFound(w, r)
+	return false
+}
+
+// servePublish publishes the draft id on POST /{id}/publish.
+func (s *Server) servePublish(w http.ResponseWriter, r *http.Request, id, user string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	info, ok := s.store().Meta(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if info.Draft && !s.checkDraft(w, r, info, user) {
+		return
+	}
+	if !s.authorize(w, r, id, user) {
+		return
+	}
+	if !info.Draft || !s.store().Publish(id) {
+		http.Error(w, "This paste is already published", http.StatusConflict)
+		return
+	}
+	url := constructURL(r, id)
+	s.events.publish(event{kind: eventPublish, id: id, url: url, user: user, requestID: RequestID(r.Context())})
+	fmt.Fprint(w, url)
+}
@@ -0,0 +1,91 @@
+// Package httpapi implements the in-browser editor of /{id}/edit: the edit
+// view's textarea becomes a CodeMirror editor, highlighting the paste's
+// language as you type, which saves with PUT /{id} under the browser's
+// credentials (or the edit token of a paste it created) and stays open for
+// the next fix. It also joins the paste's live session at /{id}/ws, so that
+// everyone with the editor open sees each other's changes as they type.
+// ?editor=plain, or a browser without JavaScript, gets the plain form
+// instead.
+package httpapi
+
+import (
+	"fmt"
+	"html/template"
+	"strings"
+)
+
+// codeMirrorBase is the CodeMirror build the editor loads.
+const codeMirrorBase = "https://cdnjs.cloudflare.com/ajax/libs/codemirror/5.65.16/"
+
+// codeMirrorMode is how the editor highlights a language: the scripts to
+// load, relative to codeMirrorBase, and the MIME type naming the mode.
+type codeMirrorMode struct {
+	scripts []string
+	mime    string
+}
+
+// codeMirrorModes are the modes of the languages in highlightLanguages
+// CodeMirror has one for, by their highlight.js names. Others are edited
+// as plain text.
+var codeMirrorModes = map[string]codeMirrorMode{
+	"bash":       {[]string{"mode/shell/shell.min.js"}, "text/x-sh"},
+	"c":          {[]string{"mode/clike/clike.min.js"}, "text/x-csrc"},
+	"cpp":        {[]string{"mode/clike/clike.min.js"}, "text/x-c++src"},
+	"csharp":     {[]string{"mode/clike/clike.min.js"}, "text/x-csharp"},
+	"css":        {[]string{"mode/css/css.min.js"}, "text/css"},
+	"diff":       {[]string{"mode/diff/diff.min.js"}, "text/x-diff"},
+	"go":         {[]string{"mode/go/go.min.js"}, "text/x-go"},
+	"ini":        {[]string{"mode/properties/properties.min.js"}, "text/x-properties"},
+	"java":       {[]string{"mode/clike/clike.min.js"}, "text/x-java"},
+	"javascript": {[]string{"mode/javascript/javascript.min.js"}, "text/javascript"},
+	"json":       {[]string{"mode/javascript/javascript.min.js"}, "application/json"},
+	"kotlin":     {[]string{"mode/clike/clike.min.js"}, "text/x-kotlin"},
+	"less":       {[]string{"mode/css/css.min.js"}, "text/x-less"},
+	"lua":        {[]string{"mode/lua/lua.min.js"}, "text/x-lua"},
+	"markdown":   {[]string{"mode/markdown/markdown.min.js"}, "text/x-markdown"},
+	"objectivec": {[]string{"mode/clike/clike.min.js"}, "text/x-objectivec"},
+	"perl":       {[]string{"mode/perl/perl.min.js"}, "text/x-perl"},
+	"python":     {[]string{"mode/python/python.min.js"}, "text/x-python"},
+	"r":          {[]string{"mode/r/r.min.js"}, "text/x-rsrc"},
+	"ruby":       {[]string{"mode/ruby/ruby.min.js"}, "text/x-ruby"},
+	"rust":       {[]string{"addon/mode/simple.min.js", "mode/rust/rust.min.js"}, "text/x-rustsrc"},
+	"scss":       {[]string{"mode/css/css.min.js"}, "text/x-scss"},
+	"shell":      {[]string{"mode/shell/shell.min.js"}, "text/x-sh"},
+	"sql":        {[]string{"mode/sql/sql.min.js"}, "text/x-sql"},
+	"swift":      {[]string{"mode/swift/swift.min.js"}, "text/x-swift"},
+	"typescript": {[]string{"mode/javascript/javascript.min.js"}, "application/typescript"},
+	"xml":        {[]string{"mode/xml/xml.min.js"}, "application/xml"},
+	"yaml":       {[]string{"mode/yaml/yaml.min.js"}, "text/x-yaml"},
+}
+
+var editorScript = script("editor.js")
+
+// editorMode returns the mode of lang, a highlight.js name or one of its
+// aliases, and false if CodeMirror has none.
+func editorMode(lang string) (codeMirrorMode, bool) {
+	for _, l := range highlightLanguages {
+		if l.Name == lang {
+			break
+		}
+		for _, alias := range l.Aliases {
+			if alias == lang {
+				lang = l.Name
+			}
+		}
+	}
+	mode, ok := codeMirrorModes[lang]
+	return mode, ok
+}
+
+// editorHead loads CodeMirror and the mode of lang, if it has one.
+func editorHead(lang string) template.HTML {
+	var head strings.Builder
+	fmt.Fprintf(&head, `<link rel="stylesheet" href="%scodemirror.min.css">`+"\n", codeMirrorBase)
+	fmt.Fprintf(&head, `<script src="%scodemirror.min.js"></script>`+"\n", codeMirrorBase)
+	if mode, ok := editorMode(lang); ok {
+		for _, s := range mode.scripts {
+			fmt.Fprintf(&head, `<script src="%s%s"></script>`+"\n", codeMirrorBase, s)
+		}
+	}
+	return template.HTML(head.String())
+}
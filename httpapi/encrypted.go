@@ -0,0 +1,65 @@
+// Package httpapi implements the viewer for client-side encrypted snippets.
+// The client encrypts with AES-256-GCM before uploading and stores the
+// base64 of nonce and ciphertext; the key only ever travels in the URL
+// fragment (https://host/{id}#key), which browsers never send, and the
+// viewer page decrypts with WebCrypto.
+package httpapi
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+// wantsEncryptedViewer reports whether a GET of an encrypted snippet should
+// get the decrypting viewer. Server-side renderers can't do anything useful
+// with ciphertext, so every class but raw and plain text gets it.
+func wantsEncryptedViewer(r *http.Request, suffix string) bool {
+	switch suffix {
+	case "raw", "text":
+		return false
+	case "":
+		return prefersHTML(r)
+	}
+	return true
+}
+
+var encryptedViewer = template.Must(template.New("encrypted").Parse(`<pre id="content">Decrypting…</pre>
+<script>
+(async () => {
+  const out = document.getElementById("content");
+  const key = location.hash.slice(1);
+  if (!key) {
+    out.textContent = "This paste is encrypted. Its key goes after the # in the URL.";
+    return;
+  }
+  const bytes = s => Uint8Array.from(atob(s.trim().replace(/-/g, "+").replace(/_/g, "/")), c => c.charCodeAt(0));
+  try {
+    const k = await crypto.subtle.importKey("raw", bytes(key), "AES-GCM", false, ["decrypt"]);
+    const resp = await fetch({{.}});
+    const sealed = bytes(await resp.text());
+    const plain = await crypto.subtle.decrypt({name: "AES-GCM", iv: sealed.slice(0, 12)}, k, sealed.slice(12));
+    out.textContent = new TextDecoder().decode(plain);
+  } catch (e) {
+    out.textContent = "Could not decrypt this paste: the key is wrong or incomplete.";
+  }
+})();
+</script>
+`))
+
+// serveEncryptedViewer serves the viewer for id, requested as /{id} or
+// /{id}/{suffix}. The ciphertext is fetched by a relative URL so the page
+// works wherever the server is mounted.
+func serveEncryptedViewer(w http.ResponseWriter, id, suffix string) {
+	rawURL := id + "/raw"
+	if suffix != "" {
+		rawURL = "raw"
+	}
+	var body strings.Builder
+	if err := encryptedViewer.Execute(&body, rawURL); err != nil {
+		http.Error(w, "Failed to render viewer", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	pageTemplate.Execute(w, page{Title: id, Body: template.HTML(body.String())})
+}
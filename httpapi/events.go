@@ -0,0 +1,124 @@
+// Package httpapi implements a small in-process event bus. Handlers publish what
+// happened to a snippet and subsystems such as the audit log subscribe to the
+// kinds they care about, instead of each handler calling them directly.
+package httpapi
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"pb/internal/clock"
+)
+
+type eventKind int
+
+const (
+	eventCreate eventKind = iota
+	eventRead
+	eventUpdate
+	eventDelete
+	eventExpire
+	// eventHoneytoken is a read of a honeytoken, carrying who made it.
+	eventHoneytoken
+	// eventPublish is a draft being made public.
+	eventPublish
+	// eventAnomaly is an anomaly alert, about the server rather than a
+	// snippet, so subscribing to every kind leaves it out.
+	eventAnomaly
+)
+
+func (k eventKind) String() string {
+	switch k {
+	case eventCreate:
+		return "create"
+	case eventRead:
+		return "read"
+	case eventUpdate:
+		return "update"
+	case eventDelete:
+		return "delete"
+	case eventExpire:
+		return "expire"
+	case eventHoneytoken:
+		return "honeytoken"
+	case eventPublish:
+		return "publish"
+	case eventAnomaly:
+		return "anomaly"
+	}
+	return "unknown"
+}
+
+type event struct {
+	kind eventKind
+	id   string
+	url  string
+	user string
+	at   time.Time
+	// requestID is the ID of the request that caused the event, if any.
+	requestID string
+	// requester describes who made the request, for honeytoken alerts.
+	requester *requester
+	// anomaly describes an anomaly alert.
+	anomaly *anomaly
+}
+
+type eventBus struct {
+	sync.RWMutex
+	subscribers map[eventKind][]func(event)
+	// clock stamps events published without a time.
+	clock clock.Clock
+}
+
+func newEventBus(c clock.Clock) *eventBus {
+	return &eventBus{
+		subscribers: make(map[eventKind][]func(event)),
+		clock:       c,
+	}
+}
+
+// subscribe registers fn for the given kinds, or for every snippet event
+// kind if none are given.
+func (b *eventBus) subscribe(fn func(event), kinds ...eventKind) {
+	if len(kinds) == 0 {
+		kinds = []eventKind{eventCreate, eventRead, eventUpdate, eventDelete, eventExpire, eventHoneytoken, eventPublish}
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	for _, kind := range kinds {
+		b.subscribers[kind] = append(b.subscribers[kind], fn)
+	}
+}
+
+// publish delivers e to its subscribers in the order they subscribed.
+// Delivery is synchronous, so subscribers doing slow work should hand it off.
+func (b *eventBus) publish(e event) {
+	if e.at.IsZero() {
+		e.at = b.clock.Now()
+	}
+
+	b.RLock()
+	subscribers := b.subscribers[e.kind]
+	b.RUnlock()
+
+	for _, fn := range subscribers {
+		fn(e)
+	}
+}
+
+// logEvent is the audit log subscriber.
+func logEvent(e event) {
+	attrs := []any{"event", e.kind.String(), "id", e.id}
+	if e.url != "" {
+		attrs = append(attrs, "url", e.url)
+	}
+	if e.user != "" {
+		attrs = append(attrs, "user", e.user)
+	}
+	if e.requestID != "" {
+		attrs = append(attrs, "request_id", e.requestID)
+	}
+	slog.Info("Snippet "+e.kind.String(), attrs...)
+}
@@ -0,0 +1,71 @@
+// Package httpapi implements snippet expiry: snippets created with a TTL
+// or a read limit are hidden by the store as soon as they run out, and
+// deleted here with an expire event.
+package httpapi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExpireSnippets deletes expired snippets every interval until ctx is done.
+func (s *Server) ExpireSnippets(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, id := range s.store().Expired(s.clock.Now()) {
+			s.expire(id)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) expire(id string) {
+	if s.store().Delete(id) {
+		s.events.publish(event{kind: eventExpire, id: id})
+	}
+}
+
+// burnAfterReading is the read subscriber that deletes a snippet once its
+// last allowed read, taken by claimRead, has been served.
+func (s *Server) burnAfterReading(e event) {
+	if _, ok := s.store().Meta(e.id); !ok {
+		s.expire(e.id)
+	}
+}
+
+// claimRead takes one of the reads of id, once its content is in hand and
+// before it is served, answering 404 itself and returning false if another
+// reader took the last one.
+func (s *Server) claimRead(w http.ResponseWriter, r *http.Request, id string) bool {
+	if s.store().ClaimRead(id) {
+		return true
+	}
+	http.NotFound(w, r)
+	return false
+}
+
+// parseTTL reads a TTL given as seconds or as a Go duration such as "90m";
+// a "d" suffix counts days.
+func parseTTL(value string) (time.Duration, error) {
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second, nil
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n > 0 {
+			return time.Duration(n) * 24 * time.Hour, nil
+		}
+	}
+	if d, err := time.ParseDuration(value); err == nil && d > 0 {
+		return d, nil
+	}
+	return 0, fmt.Errorf("invalid TTL %q, want seconds or a duration like 90m or 7d", value)
+}
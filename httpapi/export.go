@@ -0,0 +1,72 @@
+// Package httpapi implements the static export: every public snippet written
+// as a raw file and a pre-rendered HTML page, plus an index page, so the
+// result can be served by any web server or browsed from disk.
+package httpapi
+
+import (
+	"html/template"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"pb/store"
+)
+
+// ExportStatic writes the public snippets of st to dir and returns how many
+// were exported. Ones with a read limit are left out, as a copy would
+// outlive them.
+func ExportStatic(st *store.Store, dir string) (int, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+
+	l := listing{User: "pb", Page: 1, Pages: 1}
+	for _, info := range st.All() {
+		if info.Private || info.Flagged || info.Honeytoken || info.HasViewPassword || info.Draft || info.MaxReads > 0 {
+			continue
+		}
+		content, ok := st.Get(info.ID)
+		if !ok {
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(dir, info.ID+".txt"), []byte(content), 0644); err != nil {
+			return 0, err
+		}
+		if err := exportPage(filepath.Join(dir, info.ID+".html"), view{id: info.ID, content: content, lang: info.Lang}); err != nil {
+			return 0, err
+		}
+		l.Entries = append(l.Entries, listingEntry{
+			ID:      info.ID,
+			URL:     info.ID + ".html",
+			Created: info.Created,
+			Size:    info.Size,
+			Lang:    info.Lang,
+		})
+	}
+
+	var body strings.Builder
+	if err := listingTemplate.Execute(&body, l); err != nil {
+		return 0, err
+	}
+	f, err := os.Create(filepath.Join(dir, "index.html"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if err := pageTemplate.Execute(f, page{Title: l.User, Body: template.HTML(body.String())}); err != nil {
+		return 0, err
+	}
+	return len(l.Entries), f.Close()
+}
+
+func exportPage(fileName string, v view) error {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := renderers["code"].render(f, v); err != nil {
+		return err
+	}
+	return f.Close()
+}
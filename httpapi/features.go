@@ -0,0 +1,198 @@
+// Package httpapi implements feature flags: switches for the endpoints that
+// are heavy or new enough to misbehave (search, rendered views, comments,
+// SSH uploads and collaborative editing), so that operators can turn one on gradually or kill it
+// without a restart. Options.Disabled gives their state at startup; admins
+// flip them at /admin/features, and those overrides are kept in the file
+// named by Options.Features, one "name true|false" line each, until lifted.
+package httpapi
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"pb/auth"
+	"pb/internal/pairfile"
+)
+
+// Features that can be switched off.
+const (
+	FeatureSearch   = "search"
+	FeatureRenders  = "renders"
+	FeatureComments = "comments"
+	FeatureSSH      = "ssh"
+	FeatureCollab   = "collab"
+)
+
+// Features lists the features that can be switched off, in the order
+// /admin/features shows them.
+var Features = []string{FeatureSearch, FeatureRenders, FeatureComments, FeatureSSH, FeatureCollab}
+
+// featureFlags holds which features are on. It is safe for concurrent use.
+type featureFlags struct {
+	sync.RWMutex
+	// fileName is where overrides are kept; "" keeps them in memory only.
+	fileName string
+	// configured is each feature's state as the flags set it, and
+	// overrides the ones admins have flipped since.
+	configured map[string]bool
+	overrides  map[string]bool
+}
+
+// loadFeatures returns the flags with disabled switched off, and the
+// overrides kept in fileName applied.
+func loadFeatures(fileName string, disabled []string) *featureFlags {
+	f := &featureFlags{fileName: fileName, configured: make(map[string]bool), overrides: make(map[string]bool)}
+	for _, name := range Features {
+		f.configured[name] = true
+	}
+	for _, name := range disabled {
+		f.configured[name] = false
+	}
+	if fileName == "" {
+		return f
+	}
+	for name, value := range pairfile.Read(fileName) {
+		on, err := strconv.ParseBool(value)
+		if _, known := f.configured[name]; !known || err != nil {
+			slog.Warn("Ignoring malformed feature override", "feature", name)
+			continue
+		}
+		f.overrides[name] = on
+	}
+	return f
+}
+
+// CheckFeatures reports an error naming the first of names that is not a
+// feature.
+func CheckFeatures(names []string) error {
+	for _, name := range names {
+		if !isFeature(name) {
+			return fmt.Errorf("unknown feature %q (want one of %s)", name, strings.Join(Features, ", "))
+		}
+	}
+	return nil
+}
+
+func isFeature(name string) bool {
+	for _, f := range Features {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// enabled reports whether feature name is on.
+func (f *featureFlags) enabled(name string) bool {
+	f.RLock()
+	defer f.RUnlock()
+	if on, ok := f.overrides[name]; ok {
+		return on
+	}
+	return f.configured[name]
+}
+
+// set overrides the state of feature name.
+func (f *featureFlags) set(name string, on bool) {
+	f.Lock()
+	defer f.Unlock()
+	f.overrides[name] = on
+	f.save()
+}
+
+// reset drops the override of feature name, reporting whether it had one.
+func (f *featureFlags) reset(name string) bool {
+	f.Lock()
+	defer f.Unlock()
+	if _, ok := f.overrides[name]; !ok {
+		return false
+	}
+	delete(f.overrides, name)
+	f.save()
+	return true
+}
+
+// save writes the overrides out; callers hold the lock.
+func (f *featureFlags) save() {
+	if f.fileName == "" {
+		return
+	}
+	pairs := make(map[string]string, len(f.overrides))
+	for name, on := range f.overrides {
+		pairs[name] = strconv.FormatBool(on)
+	}
+	pairfile.Write(f.fileName, pairs)
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// requireFeature answers the request with 503 and returns false if feature
+// name is off.
+func (s *Server) requireFeature(w http.ResponseWriter, name, message string) bool {
+	if s.features.enabled(name) {
+		return true
+	}
+	http.Error(w, message, http.StatusServiceUnavailable)
+	return false
+}
+
+// serveFeatures lists the features and whether they are on, marking those
+// an admin has overridden, and on POST switches the one in the name form
+// field on=1 or on=0. DELETE ?name= goes back to the configured state.
+func (s *Server) serveFeatures(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.requireRole(w, r, auth.RoleAdmin)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		s.features.RLock()
+		for _, name := range Features {
+			on, overridden := s.features.overrides[name]
+			if !overridden {
+				on = s.features.configured[name]
+			}
+			state := onOff(on)
+			if overridden {
+				state += " (overridden)"
+			}
+			fmt.Fprintln(w, name, state)
+		}
+		s.features.RUnlock()
+
+	case http.MethodPost:
+		if !s.parseForm(w, r) {
+			return
+		}
+		name := r.FormValue("name")
+		on, err := strconv.ParseBool(r.FormValue("on"))
+		if !isFeature(name) || err != nil {
+			http.Error(w, "name must be one of "+strings.Join(Features, ", ")+" and on 1 or 0", http.StatusBadRequest)
+			return
+		}
+		s.features.set(name, on)
+		slog.Warn("Feature switched", "feature", name, "on", on, "by", user, "request_id", RequestID(r.Context()))
+		fmt.Fprintf(w, "%s is %s\n", name, onOff(on))
+
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		if !s.features.reset(name) {
+			http.NotFound(w, r)
+			return
+		}
+		slog.Warn("Feature override lifted", "feature", name, "by", user, "request_id", RequestID(r.Context()))
+		fmt.Fprintf(w, "%s is back to its configured state\n", name)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,224 @@
+// Package httpapi implements content filters, which judge every paste on
+// create and update before it is stored. A filter lets the paste through,
+// quarantines it (stores it flagged, held back from listings for review at
+// /admin/flagged like blocklist matches) or rejects it with 422. Operators
+// set up the built-in filters in the file named by -content-filter, one per
+// line:
+//
+//	reject regex <pattern>      content matching a Go regular expression
+//	quarantine regex <pattern>
+//	reject urls <n>             content holding more than n URLs
+//	quarantine urls <n>
+//	webhook <url>               POST the paste to url and take its verdict
+//
+// and embedders can pass their own ContentFilter in Options.
+package httpapi
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"pb/store"
+)
+
+// filterWebhookTimeout is how long a webhook filter has to answer.
+const filterWebhookTimeout = 5 * time.Second
+
+// Verdict is a content filter's decision on a paste.
+type Verdict int
+
+// Verdicts, from the mildest.
+const (
+	Allow Verdict = iota
+	Quarantine
+	Reject
+)
+
+var verdictNames = map[string]Verdict{"allow": Allow, "quarantine": Quarantine, "reject": Reject}
+
+// ContentFilter judges pastes as they are created or updated.
+type ContentFilter interface {
+	// Check returns the verdict on content, uploaded by user ("" when
+	// anonymous), and for anything but Allow the reason, which is shown
+	// to the uploader.
+	Check(ctx context.Context, content, user string) (Verdict, string)
+}
+
+// regexFilter gives its verdict on content matching re.
+type regexFilter struct {
+	verdict Verdict
+	re      *regexp.Regexp
+}
+
+func (f regexFilter) Check(_ context.Context, content, _ string) (Verdict, string) {
+	if f.re.MatchString(content) {
+		return f.verdict, "content matches a filtered pattern"
+	}
+	return Allow, ""
+}
+
+// urlPattern matches the URLs the URL count filter counts.
+var urlPattern = regexp.MustCompile(`(?i)\b(?:https?|ftp)://[^\s<>"]+`)
+
+// urlCountFilter gives its verdict on content holding more than max URLs,
+// the mark of link spam.
+type urlCountFilter struct {
+	verdict Verdict
+	max     int
+}
+
+func (f urlCountFilter) Check(_ context.Context, content, _ string) (Verdict, string) {
+	if n := len(urlPattern.FindAllStringIndex(content, f.max+1)); n > f.max {
+		return f.verdict, fmt.Sprintf("more than %d URLs", f.max)
+	}
+	return Allow, ""
+}
+
+// webhookFilter asks an external service. It POSTs
+// {"content": ..., "user": ...} and expects {"verdict": "allow",
+// "quarantine" or "reject", "reason": ...} back. A service that fails to
+// answer does not block the paste.
+type webhookFilter struct {
+	url    string
+	client *http.Client
+}
+
+func (f webhookFilter) Check(ctx context.Context, content, user string) (Verdict, string) {
+	payload, _ := json.Marshal(struct {
+		Content string `json:"content"`
+		User    string `json:"user,omitempty"`
+	}{content, user})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.url, bytes.NewReader(payload))
+	if err != nil {
+		slog.Error("Content filter failed", "url", f.url, "err", err)
+		return Allow, ""
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		slog.Error("Content filter failed", "url", f.url, "err", err)
+		return Allow, ""
+	}
+	defer resp.Body.Close()
+	var reply struct {
+		Verdict string `json:"verdict"`
+		Reason  string `json:"reason"`
+	}
+	verdict, known := Allow, false
+	if resp.StatusCode == http.StatusOK && json.NewDecoder(resp.Body).Decode(&reply) == nil {
+		verdict, known = verdictNames[reply.Verdict]
+	}
+	if !known {
+		slog.Error("Content filter gave no verdict", "url", f.url, "status", resp.StatusCode, "verdict", reply.Verdict)
+		return Allow, ""
+	}
+	if reply.Reason == "" {
+		reply.Reason = "flagged by the content filter"
+	}
+	return verdict, reply.Reason
+}
+
+// LoadContentFilters reads the filters set up in fileName. An empty name
+// yields none.
+func LoadContentFilters(fileName string) ([]ContentFilter, error) {
+	if fileName == "" {
+		return nil, nil
+	}
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var filters []ContentFilter
+	client := &http.Client{Timeout: filterWebhookTimeout}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		action, rest, _ := strings.Cut(line, " ")
+		kind, arg, _ := strings.Cut(strings.TrimSpace(rest), " ")
+		arg = strings.TrimSpace(arg)
+		if action == "webhook" {
+			if !strings.HasPrefix(rest, "http://") && !strings.HasPrefix(rest, "https://") {
+				return nil, fmt.Errorf("%s:%d: expected webhook <http or https URL>", fileName, n)
+			}
+			filters = append(filters, webhookFilter{url: strings.TrimSpace(rest), client: client})
+			continue
+		}
+		verdict, ok := verdictNames[action]
+		if !ok || verdict == Allow {
+			return nil, fmt.Errorf("%s:%d: expected reject, quarantine or webhook", fileName, n)
+		}
+		switch kind {
+		case "regex":
+			re, err := regexp.Compile(arg)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", fileName, n, err)
+			}
+			filters = append(filters, regexFilter{verdict: verdict, re: re})
+		case "urls":
+			limit, err := strconv.Atoi(arg)
+			if err != nil || limit < 0 {
+				return nil, fmt.Errorf("%s:%d: expected %s urls <count>", fileName, n, action)
+			}
+			filters = append(filters, urlCountFilter{verdict: verdict, max: limit})
+		default:
+			return nil, fmt.Errorf("%s:%d: expected %s regex or %s urls", fileName, n, action, action)
+		}
+	}
+	return filters, scanner.Err()
+}
+
+// filterContent runs the content filters on content, uploaded by user,
+// and returns the harshest verdict with its reason. Encrypted and binary
+// pastes aren't filtered, there being no text to judge.
+func (s *Server) filterContent(r *http.Request, content, user string, encrypted bool) (Verdict, string) {
+	if encrypted || store.DetectMediaType(content, false) != "" {
+		return Allow, ""
+	}
+	verdict, reason := Allow, ""
+	for _, f := range s.filters {
+		if v, why := f.Check(r.Context(), content, user); v > verdict {
+			verdict, reason = v, why
+			if verdict == Reject {
+				break
+			}
+		}
+	}
+	return verdict, reason
+}
+
+// checkContent runs the content filters on content, answering the request
+// with 422 if it is rejected. It reports whether the paste may be stored
+// and, if it is to be quarantined, why.
+func (s *Server) checkContent(w http.ResponseWriter, r *http.Request, content, user string, encrypted bool) (quarantine string, ok bool) {
+	verdict, reason := s.filterContent(r, content, user, encrypted)
+	switch verdict {
+	case Reject:
+		slog.Info("Rejected paste", "reason", reason, "user", user, "request_id", RequestID(r.Context()))
+		http.Error(w, "Paste rejected: "+reason, http.StatusUnprocessableEntity)
+		return "", false
+	case Quarantine:
+		return reason, true
+	}
+	return "", true
+}
+
+// quarantine flags id for review, as a content filter asked for reason.
+func (s *Server) quarantine(r *http.Request, id, reason string) {
+	s.store().SetFlagged(id, true)
+	slog.Info("Quarantined snippet for review", "id", id, "reason", reason, "request_id", RequestID(r.Context()))
+}
@@ -0,0 +1,353 @@
+// Package httpapi implements mirroring to GitHub Gists. Users give pb a
+// GitHub token at /api/v1/me/github, with which POST /{id}/gist pushes one
+// of their pastes to a gist, and, if they ask for it, every paste they
+// create or update is pushed as it happens. A paste pushed again updates
+// its gist, so each paste has at most one; which one is kept in the file
+// named by Options.Gists. Private pastes become secret gists, which are
+// unlisted on GitHub but readable by anyone with the link.
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"pb/auth"
+	"pb/internal/pairfile"
+	"pb/store"
+)
+
+// DefaultGitHubAPI is the GitHub API gists are pushed to unless
+// Options.GitHubAPI names another, such as a GitHub Enterprise server's.
+const DefaultGitHubAPI = "https://api.github.com"
+
+// gistTimeout bounds one request to the GitHub API.
+const gistTimeout = 10 * time.Second
+
+// errGistGone is returned by gistMirror.request for a gist that no longer
+// exists.
+var errGistGone = errors.New("gist not found")
+
+// gistMirror pushes pastes to gists. It is safe for concurrent use; pushes
+// happen one at a time, so that a paste updated while its first push is
+// under way doesn't end up with two gists.
+type gistMirror struct {
+	sync.Mutex
+	api      string
+	fileName string
+	client   *http.Client
+	// gists maps a paste ID to "<gist ID> <file name> <owner>": its gist,
+	// the name of its file there and whose token pushed it.
+	gists map[string]string
+}
+
+func newGistMirror(api, fileName string) *gistMirror {
+	if api == "" {
+		api = DefaultGitHubAPI
+	}
+	g := &gistMirror{api: strings.TrimSuffix(api, "/"), fileName: fileName, client: &http.Client{Timeout: gistTimeout}}
+	if fileName != "" {
+		g.gists = pairfile.Read(fileName)
+	} else {
+		g.gists = make(map[string]string)
+	}
+	return g
+}
+
+func (g *gistMirror) save() {
+	if g.fileName != "" {
+		pairfile.Write(g.fileName, g.gists)
+	}
+}
+
+// gistFile is a file of a gist as the API takes and returns it.
+type gistFile struct {
+	Filename string `json:"filename,omitempty"`
+	Content  string `json:"content"`
+}
+
+type gistRequest struct {
+	Description string              `json:"description"`
+	Public      *bool               `json:"public,omitempty"`
+	Files       map[string]gistFile `json:"files"`
+}
+
+type gistResponse struct {
+	ID      string `json:"id"`
+	HTMLURL string `json:"html_url"`
+}
+
+// push creates or updates the gist of paste info, holding content, with
+// token, and returns the gist's URL. url is the paste's own URL.
+func (g *gistMirror) push(ctx context.Context, token string, info store.Info, content, url string) (string, error) {
+	g.Lock()
+	defer g.Unlock()
+
+	name := archiveName(info)
+	body := gistRequest{Description: "Mirrored from " + url, Files: map[string]gistFile{name: {Content: content}}}
+	if fields := strings.Fields(g.gists[info.ID]); len(fields) == 3 {
+		gistID, oldName := fields[0], fields[1]
+		// A file renamed by a language change is updated under its old name.
+		body.Files = map[string]gistFile{oldName: {Filename: name, Content: content}}
+		var resp gistResponse
+		err := g.request(ctx, token, http.MethodPatch, "/gists/"+gistID, body, &resp)
+		if err == nil {
+			g.gists[info.ID] = gistID + " " + name + " " + info.Owner
+			g.save()
+			return resp.HTMLURL, nil
+		}
+		if !errors.Is(err, errGistGone) {
+			return "", err
+		}
+		body.Files = map[string]gistFile{name: {Content: content}}
+	}
+	public := !info.Private
+	body.Public = &public
+	var resp gistResponse
+	if err := g.request(ctx, token, http.MethodPost, "/gists", body, &resp); err != nil {
+		return "", err
+	}
+	g.gists[info.ID] = resp.ID + " " + name + " " + info.Owner
+	g.save()
+	return resp.HTMLURL, nil
+}
+
+// owner returns the user whose token pushed the gist of paste id, and
+// false if it has none.
+func (g *gistMirror) owner(id string) (string, bool) {
+	g.Lock()
+	defer g.Unlock()
+
+	fields := strings.Fields(g.gists[id])
+	if len(fields) != 3 {
+		return "", false
+	}
+	return fields[2], true
+}
+
+// remove deletes the gist of paste id with token, if it has one, and
+// forgets it either way.
+func (g *gistMirror) remove(ctx context.Context, token, id string) error {
+	g.Lock()
+	defer g.Unlock()
+
+	fields := strings.Fields(g.gists[id])
+	if len(fields) != 3 {
+		return nil
+	}
+	gistID := fields[0]
+	delete(g.gists, id)
+	g.save()
+	if token == "" {
+		return nil
+	}
+	if err := g.request(ctx, token, http.MethodDelete, "/gists/"+gistID, nil, nil); err != nil && !errors.Is(err, errGistGone) {
+		return err
+	}
+	return nil
+}
+
+// request sends body, if any, to path of the API and decodes the answer
+// into result, if any.
+func (g *gistMirror) request(ctx context.Context, token, method, path string, body, result any) error {
+	var reader *bytes.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, g.api+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return errGistGone
+	case resp.StatusCode >= 300:
+		var apiError struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiError)
+		return fmt.Errorf("GitHub answered %s: %s", resp.Status, apiError.Message)
+	case result != nil:
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+	return nil
+}
+
+// gistable returns why paste info can't be mirrored, or "".
+func gistable(info store.Info) string {
+	switch {
+	case info.MediaType != "":
+		return "Binary pastes can't be pushed to a gist"
+	case info.Encrypted, info.HasViewPassword:
+		return "Encrypted and password-protected pastes can't be pushed to a gist"
+	case info.Draft:
+		return "Publish the draft before pushing it to a gist"
+	case info.Honeytoken:
+		return "Honeytokens can't be pushed to a gist"
+	case info.Flagged:
+		return "Quarantined pastes can't be pushed to a gist"
+	case info.MaxReads > 0:
+		return "Pastes with a read limit can't be pushed to a gist"
+	}
+	return ""
+}
+
+// serveGist pushes the paste id, which user must own, to a gist with
+// their GitHub token, and answers with the gist's URL.
+func (s *Server) serveGist(w http.ResponseWriter, r *http.Request, id, user string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	info, ok := s.store().Meta(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if user == "" || info.Owner != user {
+		http.Error(w, "Only the paste's owner can push it to a gist", http.StatusForbidden)
+		return
+	}
+	token, _, ok := s.users.GitHubToken(user)
+	if !ok {
+		http.Error(w, "Give pb a GitHub token at /api/v1/me/github first", http.StatusConflict)
+		return
+	}
+	if reason := gistable(info); reason != "" {
+		http.Error(w, reason, http.StatusUnprocessableEntity)
+		return
+	}
+	content, ok := s.store().Get(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	gistURL, err := s.gists.push(r.Context(), token, info, content, constructURL(r, id))
+	if err != nil {
+		slog.Warn("Failed to push gist", "id", id, "user", user, "err", err, "request_id", RequestID(r.Context()))
+		http.Error(w, "Failed to push gist: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	slog.Info("Pushed gist", "id", id, "user", user, "gist", gistURL, "request_id", RequestID(r.Context()))
+	fmt.Fprintln(w, gistURL)
+}
+
+// mirrorGist pushes the paste of e in the background if its user mirrors
+// all their pastes.
+func (s *Server) mirrorGist(e event) {
+	token, mirror, ok := s.users.GitHubToken(e.user)
+	if !ok || !mirror {
+		return
+	}
+	info, exists := s.store().Meta(e.id)
+	if !exists || info.Owner != e.user || gistable(info) != "" {
+		return
+	}
+	content, exists := s.store().Get(e.id)
+	if !exists {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*gistTimeout)
+		defer cancel()
+		if _, err := s.gists.push(ctx, token, info, content, e.url); err != nil {
+			slog.Warn("Failed to mirror gist", "id", e.id, "user", e.user, "err", err, "request_id", e.requestID)
+		}
+	}()
+}
+
+// unmirrorGist deletes the gist of a deleted or expired paste if its owner
+// mirrors all their pastes, and forgets it either way.
+func (s *Server) unmirrorGist(e event) {
+	owner, ok := s.gists.owner(e.id)
+	if !ok {
+		return
+	}
+	token, mirror, _ := s.users.GitHubToken(owner)
+	if !mirror {
+		token = ""
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), gistTimeout)
+		defer cancel()
+		if err := s.gists.remove(ctx, token, e.id); err != nil {
+			slog.Warn("Failed to delete mirrored gist", "id", e.id, "user", owner, "err", err, "request_id", e.requestID)
+		}
+	}()
+}
+
+// serveGitHub shows whether the caller gave pb a GitHub token, and on PUT
+// sets it from the token form field, mirroring every paste with mirror=1.
+// DELETE forgets it.
+func (s *Server) serveGitHub(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.users.Authenticate(r)
+	if !ok || user == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="pb"`)
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		_, mirror, ok := s.users.GitHubToken(user)
+		switch {
+		case !ok:
+			fmt.Fprintln(w, "no token")
+		case mirror:
+			fmt.Fprintln(w, "token set, mirroring every paste")
+		default:
+			fmt.Fprintln(w, "token set, pushing pastes with POST /{id}/gist")
+		}
+
+	case http.MethodPut:
+		if !s.parseForm(w, r) {
+			return
+		}
+		mirror, _ := strconv.ParseBool(r.FormValue("mirror"))
+		if err := s.users.SetGitHubToken(user, r.FormValue("token"), mirror); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, auth.ErrNoSuchUser) {
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		slog.Info("Set GitHub token", "user", user, "mirror", mirror, "request_id", RequestID(r.Context()))
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		if !s.users.RemoveGitHubToken(user) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
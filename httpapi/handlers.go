@@ -0,0 +1,1428 @@
+// Package httpapi implements the HTTP handlers: snippet CRUD at the root path,
+// per-user listings under /user/{name} and the recent anonymous snippets
+// at /user/.
+package httpapi
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"pb/auth"
+	"pb/internal/clock"
+	"pb/store"
+)
+
+const (
+	listingPageSize = 50
+	recentAnonymous = 100
+	changesPageSize = 100
+
+	defaultMaxPasteSize       = 1 << 20
+	defaultMaxMultipartMemory = 256 << 10
+)
+
+// reservedIDs are the route names snippet IDs must not collide with.
+var reservedIDs = []string{"user", "register", "token", "invite", "sshkeys", "api", "admin", "compare", "diff", "search", "static", "metrics", "health", "version"}
+
+// Options configures a Server. Store and Accounts are required; Plugins,
+// Policies and Blocklist may be nil.
+type Options struct {
+	Store    *store.Store
+	Accounts *auth.Accounts
+	Plugins  *Plugins
+	Policies *Policies
+	// Blocklist flags matching public snippets for review.
+	Blocklist *Blocklist
+	// Admins are the user names allowed to use the /admin/ endpoints, on
+	// top of the users granted the admin role.
+	Admins []string
+	// Bans is the file banned addresses are kept in. If empty they are
+	// kept in memory only.
+	Bans string
+	// Disabled lists the Features switched off at startup, and Features is
+	// the file admins' overrides are kept in; if empty they are kept in
+	// memory only.
+	Disabled []string
+	Features string
+	// GitHubAPI is the GitHub API pastes are mirrored to gists through,
+	// DefaultGitHubAPI if empty, and Gists the file which gist mirrors
+	// which paste is kept in; if empty it is kept in memory only.
+	GitHubAPI string
+	Gists     string
+	// BackupFiles are further files /admin/backup archives with the store,
+	// such as the accounts.
+	BackupFiles []string
+	// MaxPasteSize caps text pastes and other request bodies, 1 MiB if
+	// zero.
+	MaxPasteSize int64
+	// MaxBinarySize caps binary pastes, such as images; MaxPasteSize if
+	// zero.
+	MaxBinarySize int64
+	// MaxMultipartMemory is how much of a multipart form is held in memory
+	// before spilling to temporary files, 256 KiB if zero.
+	MaxMultipartMemory int64
+	// Primary, if set, makes the server a read replica of the pb at that
+	// URL: see Replicate.
+	Primary *url.URL
+	// Concurrency caps expensive requests; the zero value caps nothing.
+	Concurrency ConcurrencyLimits
+	// MemoryLimit, if set, is the memory use beyond which the server sheds
+	// load: see MonitorMemory.
+	MemoryLimit int64
+	// Webhooks are URLs that snippet creates, updates, deletes and expiries,
+	// and alerts, are POSTed to: see DeliverWebhooks.
+	Webhooks []string
+	// DeliveryQueue is the file undelivered webhook payloads are kept in.
+	// If empty they are kept in memory only.
+	DeliveryQueue string
+	// Usage is the ledger monthly usage is counted in; if nil, usage is
+	// counted in memory only.
+	Usage *UsageLedger
+	// Tiers are the service tiers accounts can be assigned, by name; nil
+	// means DefaultTiers.
+	Tiers map[string]Tier
+	// DNSMaxSize is the largest snippet that may opt in to retrieval over
+	// DNS; zero refuses them all. See ServeDNS.
+	DNSMaxSize int64
+	// AnomalyWindow, if set, is the window over which activity is
+	// compared with its baseline for anomaly alerts: see WatchAnomalies.
+	AnomalyWindow time.Duration
+	// StatsEpsilon, if set, is the privacy budget public counts are
+	// released with, adding Laplace noise of scale 1/StatsEpsilon; zero
+	// publishes them exactly. StatsThreshold withholds counts below it.
+	StatsEpsilon   float64
+	StatsThreshold int
+	// ContentFilters judge every paste on create and update.
+	ContentFilters []ContentFilter
+	// Disposal decides what becomes of a deleted account's pastes; the
+	// zero value orphans them.
+	Disposal store.DisposalPolicy
+	// Robots, if set, is served as robots.txt in place of the default.
+	Robots []byte
+	// Sitemap serves /sitemap.xml and points the default robots.txt at it.
+	Sitemap bool
+	// ProofOfWork, if set, decides when anonymous creates need a solved
+	// challenge; it should be the rate limiter's too.
+	ProofOfWork *ProofOfWork
+	// Clock, if set, is where expiry times, event times and the current
+	// usage month come from in place of the system clock. It should be
+	// the Store's.
+	Clock clock.Clock
+}
+
+// Server serves the pb HTTP API for one store. It is an http.Handler, so it
+// can be mounted in another mux, e.g. under http.StripPrefix.
+type Server struct {
+	// current is the store being served; the admin API can swap it.
+	current  atomic.Pointer[store.Store]
+	users    *auth.Accounts
+	admins   map[string]bool
+	events   *eventBus
+	plugins  *Plugins
+	policies *Policies
+	mux      *http.ServeMux
+
+	maxPasteSize       int64
+	maxBinarySize      int64
+	maxMultipartMemory int64
+
+	// primary and proxy are set on read replicas.
+	primary *url.URL
+	proxy   *httputil.ReverseProxy
+
+	creates   *routeLimit
+	renders   *routeLimit
+	memory    *memoryMonitor
+	anomalies *anomalyDetector
+
+	webhooks   []string
+	deliveries *deliveryQueue
+
+	usage *UsageLedger
+	tiers map[string]Tier
+
+	blocklist *Blocklist
+	filters   []ContentFilter
+	bans      *banList
+	features  *featureFlags
+
+	backupFiles []string
+	gists       *gistMirror
+	collab      *collabHub
+
+	statsPrivacy *statsPrivacy
+	pow          *ProofOfWork
+
+	dnsMaxSize int64
+	// sshHandler is what SSH uploads go through; see ServeSSH.
+	sshHandler http.Handler
+
+	robots  []byte
+	sitemap bool
+
+	disposal store.DisposalPolicy
+
+	// latest is the newest pb release CheckForUpdates found, if it runs.
+	latest atomic.Pointer[latestRelease]
+
+	clock clock.Clock
+	// started is when the server was created, for the stats.
+	started time.Time
+}
+
+// New returns a Server for the given options.
+func New(opts Options) *Server {
+	c := opts.Clock
+	if c == nil {
+		c = clock.System
+	}
+	s := &Server{
+		users:    opts.Accounts,
+		admins:   make(map[string]bool),
+		events:   newEventBus(c),
+		plugins:  opts.Plugins,
+		policies: opts.Policies,
+
+		maxPasteSize:       opts.MaxPasteSize,
+		maxBinarySize:      opts.MaxBinarySize,
+		maxMultipartMemory: opts.MaxMultipartMemory,
+
+		creates: newRouteLimit("uploads", opts.Concurrency.Creates, opts.Concurrency),
+		renders: newRouteLimit("renders", opts.Concurrency.Renders, opts.Concurrency),
+		memory:  newMemoryMonitor(opts.MemoryLimit),
+
+		webhooks: opts.Webhooks,
+		usage:    opts.Usage,
+		tiers:    opts.Tiers,
+
+		blocklist: opts.Blocklist,
+		filters:   opts.ContentFilters,
+
+		dnsMaxSize: opts.DNSMaxSize,
+
+		robots:  opts.Robots,
+		sitemap: opts.Sitemap,
+
+		disposal: opts.Disposal,
+
+		bans:         loadBans(opts.Bans),
+		features:     loadFeatures(opts.Features, opts.Disabled),
+		backupFiles:  opts.BackupFiles,
+		gists:        newGistMirror(opts.GitHubAPI, opts.Gists),
+		collab:       newCollabHub(),
+		statsPrivacy: newStatsPrivacy(opts.StatsEpsilon, opts.StatsThreshold, c),
+		pow:          opts.ProofOfWork,
+
+		clock:   c,
+		started: c.Now(),
+	}
+	if s.tiers == nil {
+		s.tiers = DefaultTiers()
+	}
+	if s.usage == nil {
+		s.usage = LoadUsageLedger("")
+	}
+	if s.maxPasteSize == 0 {
+		s.maxPasteSize = defaultMaxPasteSize
+	}
+	if s.maxBinarySize == 0 {
+		s.maxBinarySize = s.maxPasteSize
+	}
+	if s.maxMultipartMemory == 0 {
+		s.maxMultipartMemory = defaultMaxMultipartMemory
+	}
+	if opts.AnomalyWindow > 0 {
+		s.anomalies = &anomalyDetector{window: opts.AnomalyWindow}
+	}
+	if opts.Primary != nil {
+		s.primary = opts.Primary
+		s.proxy = newPrimaryProxy(opts.Primary)
+	}
+	for _, admin := range opts.Admins {
+		s.admins[admin] = true
+	}
+	opts.Store.Reserve(reservedIDs...)
+	s.current.Store(opts.Store)
+	s.events.subscribe(logEvent)
+	s.events.subscribe(s.plugins.notifyCreated, eventCreate)
+	if len(s.webhooks) > 0 {
+		s.deliveries = newDeliveryQueue(opts.DeliveryQueue)
+		s.events.subscribe(s.queueWebhooks, eventCreate, eventUpdate, eventDelete, eventExpire, eventHoneytoken, eventPublish, eventAnomaly)
+	}
+	if s.anomalies != nil {
+		s.events.subscribe(func(event) { s.anomalies.creates.Add(1) }, eventCreate)
+	}
+	s.events.subscribe(func(e event) { s.store().RecordRead(e.id) }, eventRead)
+	s.events.subscribe(s.recordUsage, eventCreate, eventRead)
+	s.events.subscribe(s.burnAfterReading, eventRead)
+	s.events.subscribe(s.mirrorGist, eventCreate, eventUpdate, eventPublish)
+	s.events.subscribe(s.unmirrorGist, eventDelete, eventExpire)
+	s.events.subscribe(s.collabChanged, eventUpdate, eventDelete, eventExpire)
+	if s.blocklist != nil {
+		s.events.subscribe(s.moderate, eventCreate, eventUpdate, eventPublish)
+	}
+	s.mux = s.routes()
+	return s
+}
+
+// Flush saves state kept in memory, such as read and view counts. Call it
+// once the server has stopped taking requests.
+func (s *Server) Flush() {
+	s.flushCollab()
+	s.store().Flush()
+	s.usage.Save()
+}
+
+// Close releases the store being served, such as its database
+// connections. Call it last, after Flush.
+func (s *Server) Close() error {
+	return s.store().Close()
+}
+
+// store returns the store currently being served.
+func (s *Server) store() *store.Store {
+	return s.current.Load()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if wantsProblems(r) {
+		pw := &problemWriter{ResponseWriter: w}
+		defer pw.finish()
+		w = pw
+	}
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		limit := s.bodyLimit()
+		if s.memory.pressured() && limit > pressureMaxPasteSize {
+			limit = pressureMaxPasteSize
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+	// Staff can still reach the admin endpoints from a banned address,
+	// e.g. to lift a ban they hit themselves.
+	if !strings.HasPrefix(r.URL.Path, "/admin/") && s.bans.banned(clientIP(r)) {
+		http.Error(w, "Requests from this address are banned", http.StatusForbidden)
+		return
+	}
+	if s.anomalies != nil {
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		defer func() { s.anomalies.countResponse(rec.status) }()
+		w = rec
+	}
+	// Replicas only answer reads; the admin API stays local since it
+	// manages this instance.
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && !strings.HasPrefix(r.URL.Path, "/admin/") && s.forward(w, r) {
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// readBody reads the request body, answering the request itself and
+// returning false if it is too large or cannot be read.
+func (s *Server) readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.bodyError(w, err)
+		return nil, false
+	}
+	return body, true
+}
+
+// readPaste reads a paste's content and creation fields. A multipart or
+// URL-encoded form carries the content in field "f:1" and the fields as
+// "ext:1", "read:1", "ttl:1", "lang", "dns", "noindex", "nounfurl" and
+// "view_pass"; a JSON object carries it in "content" and the fields by
+// their query string names; any other body is the content itself, with the
+// fields in the query string as ext, read, ttl, lang, dns, noindex,
+// nounfurl and view_pass. The view password may also come as
+// X-Paste-Password. Like readBody it answers failures.
+func (s *Server) readPaste(w http.ResponseWriter, r *http.Request) ([]byte, url.Values, bool) {
+	kind := detectBody(r)
+	if kind == bodyRaw || kind == bodyForm || kind == bodyJSON {
+		body, ok := s.readBody(w, r)
+		if !ok {
+			return nil, nil, false
+		}
+		var content string
+		var fields url.Values
+		parsed := false
+		switch kind {
+		case bodyForm:
+			content, fields, parsed = parseFormBody(body)
+			fields = formFields(r, fields)
+		case bodyJSON:
+			content, fields, parsed = parseJSONBody(body)
+		}
+		// Anything else, including what only looked like a form or an
+		// object, is the paste itself.
+		if parsed {
+			body = []byte(content)
+		} else {
+			fields = r.URL.Query()
+		}
+		if pass := r.Header.Get(viewPasswordHeader); pass != "" && fields.Get("view_pass") == "" {
+			fields.Set("view_pass", pass)
+		}
+		return body, fields, true
+	}
+	if !s.parseForm(w, r) {
+		return nil, nil, false
+	}
+	form := r.MultipartForm
+	fields := formFields(r, form.Value)
+	if fields.Get("view_pass") == "" {
+		if pass := r.Header.Get(viewPasswordHeader); pass != "" {
+			fields.Set("view_pass", pass)
+		}
+	}
+	var files []*multipart.FileHeader
+	for _, name := range pasteFields {
+		if v := form.Value[name]; len(v) > 0 {
+			return []byte(v[0]), fields, true
+		}
+		if files = form.File[name]; len(files) > 0 {
+			break
+		}
+	}
+	if len(files) == 0 {
+		http.Error(w, `Missing paste content: send it in form field "f:1"`, http.StatusBadRequest)
+		return nil, nil, false
+	}
+	f, err := files[0].Open()
+	if err != nil {
+		s.bodyError(w, err)
+		return nil, nil, false
+	}
+	defer f.Close()
+	body, err := io.ReadAll(f)
+	if err != nil {
+		s.bodyError(w, err)
+		return nil, nil, false
+	}
+	if ext, ok := normalizeLang(strings.TrimPrefix(path.Ext(files[0].Filename), ".")); ok && fields.Get("ext") == "" {
+		fields.Set("ext", ext)
+	}
+	return body, fields, true
+}
+
+// formFields returns the creation fields of a multipart or URL-encoded
+// form, by their query string names. ID and slug may come in r's query
+// string instead.
+func formFields(r *http.Request, form url.Values) url.Values {
+	fields := url.Values{}
+	for _, name := range []string{"ext", "read", "ttl"} {
+		if v := form[name+":1"]; len(v) > 0 {
+			fields.Set(name, v[0])
+		}
+	}
+	for _, name := range []string{"lang", "dns", "draft", "id", "slug", "u", "search", "noindex", "nounfurl", "view_pass", "unpack"} {
+		if v := form[name]; len(v) > 0 {
+			fields.Set(name, v[0])
+		}
+	}
+	for _, name := range []string{"id", "slug"} {
+		if v := r.URL.Query().Get(name); v != "" && fields.Get(name) == "" {
+			fields.Set(name, v)
+		}
+	}
+	return fields
+}
+
+// applyCreateFields sets the ID, slug, language, expiry, read limit and view
+// password asked for in fields, answering the request itself and returning
+// false if they are invalid or exceed user's tier.
+func (s *Server) applyCreateFields(w http.ResponseWriter, user string, fields url.Values, opts *store.CreateOptions) bool {
+	if id := fields.Get("id"); id != "" {
+		if !s.checkCustomID(w, user, id) {
+			return false
+		}
+		opts.ID = id
+	}
+	if slug := fields.Get("slug"); slug != "" {
+		if !s.checkSlug(w, user, slug) {
+			return false
+		}
+		opts.Slug = slug
+	}
+	lang := fields.Get("lang")
+	if lang == "" {
+		lang = fields.Get("ext")
+	}
+	var ok bool
+	if opts.Lang, ok = normalizeLang(lang); !ok {
+		http.Error(w, fmt.Sprintf("Invalid language %q", lang), http.StatusBadRequest)
+		return false
+	}
+	opts.ViewPassword = fields.Get("view_pass")
+	opts.Searchable = fields.Get("search") == "1"
+	opts.NoIndex = fields.Get("noindex") == "1"
+	opts.NoUnfurl = fields.Get("nounfurl") == "1"
+	if v := fields.Get("read"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid read limit, want a positive number", http.StatusBadRequest)
+			return false
+		}
+		opts.MaxReads = n
+	}
+	if v := fields.Get("ttl"); v != "" {
+		ttl, err := parseTTL(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return false
+		}
+		if name, tier := s.tierOf(user); tier.MaxTTL > 0 && ttl > tier.MaxTTL {
+			http.Error(w, fmt.Sprintf("TTL too long: the %s tier allows up to %s", name, tier.MaxTTL), http.StatusBadRequest)
+			return false
+		}
+		opts.Expires = s.clock.Now().Add(ttl)
+	}
+	return true
+}
+
+// checkCustomID answers the request itself and returns false if user may
+// not create a snippet with the chosen ID id. Choosing IDs takes an account
+// on a tier with custom aliases. A taken ID is caught here when it can be,
+// before the upload, and by the store otherwise.
+func (s *Server) checkCustomID(w http.ResponseWriter, user, id string) bool {
+	if user == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="pb"`)
+		http.Error(w, "Log in to choose a paste ID", http.StatusUnauthorized)
+		return false
+	}
+	if name, tier := s.tierOf(user); !tier.CustomAliases {
+		http.Error(w, fmt.Sprintf("Custom IDs are not part of the %s tier", name), http.StatusForbidden)
+		return false
+	}
+	if !store.ValidID(id) {
+		http.Error(w, fmt.Sprintf("Invalid ID %q: use up to 64 letters, digits, - and _", id), http.StatusBadRequest)
+		return false
+	}
+	if _, taken := s.store().Meta(id); taken || slices.Contains(reservedIDs, id) {
+		http.Error(w, fmt.Sprintf("The ID %q is taken", id), http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// parseForm parses a urlencoded or multipart form, keeping at most
+// maxMultipartMemory of it in memory. Like readBody it answers failures.
+func (s *Server) parseForm(w http.ResponseWriter, r *http.Request) bool {
+	err := r.ParseMultipartForm(s.maxMultipartMemory)
+	if err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		s.bodyError(w, err)
+		return false
+	}
+	return true
+}
+
+func (s *Server) bodyError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) && tooLarge.Limit < s.bodyLimit() {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, fmt.Sprintf("Server is low on memory; pastes over %s are refused for now", formatSize(tooLarge.Limit)), http.StatusServiceUnavailable)
+		return
+	}
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("Paste too large: the limit is %s", formatSize(tooLarge.Limit)), http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, "Failed to read request body", http.StatusBadRequest)
+}
+
+// formatSize renders a byte count in binary units, e.g. "1 MiB".
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d bytes", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	size := strings.TrimSuffix(strconv.FormatFloat(float64(n)/float64(div), 'f', 1, 64), ".0")
+	return size + " " + string("KMGTPE"[exp]) + "iB"
+}
+
+func (s *Server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/user/", s.serveUserListing)
+	mux.HandleFunc("/register", s.serveRegister)
+	mux.HandleFunc("/token", s.serveToken)
+	mux.HandleFunc("/invite", s.serveInvite)
+	mux.HandleFunc("/sshkeys", s.serveSSHKeys)
+	mux.HandleFunc("/compare", s.serveCompare)
+	mux.HandleFunc("/diff/", s.serveDiff)
+	mux.HandleFunc("/search", s.serveSearch)
+	mux.HandleFunc("/static/", serveStatic)
+	mux.HandleFunc("/sw.js", serveServiceWorker)
+	mux.HandleFunc("/robots.txt", s.serveRobots)
+	mux.HandleFunc("/sitemap.xml", s.serveSitemap)
+	mux.HandleFunc("/version", s.serveVersion)
+	mux.HandleFunc("/openapi.json", s.serveOpenAPI)
+	mux.HandleFunc("/api/docs", serveAPIDocs)
+	mux.HandleFunc("/api/v1/changes", s.serveChanges)
+	mux.HandleFunc("/api/v1/me", s.serveMe)
+	mux.HandleFunc("/api/v1/me/usage", s.serveMyUsage)
+	mux.HandleFunc("/api/v1/me/export.ndjson", s.serveMyExport)
+	mux.HandleFunc("/api/v1/me/github", s.serveGitHub)
+	mux.HandleFunc("/api/v1/info", s.serveInfo)
+	mux.HandleFunc("/api/v1/pow", s.serveProofOfWork)
+	mux.HandleFunc("/api/v1/languages", s.serveLanguages)
+	mux.HandleFunc("/api/v1/languages/", s.serveLanguages)
+	mux.HandleFunc("/api/v1/themes", s.serveThemes)
+	mux.HandleFunc("/admin/datadir", s.serveDataDir)
+	mux.HandleFunc("/admin/backup", s.serveBackup)
+	mux.HandleFunc("/admin/import", s.serveImport)
+	mux.HandleFunc("/admin/deliveries", s.serveDeliveries)
+	mux.HandleFunc("/admin/tier", s.serveTier)
+	mux.HandleFunc("/admin/flagged", s.serveFlagged)
+	mux.HandleFunc("/admin/honeytoken", s.serveHoneytoken)
+	mux.HandleFunc("/admin/pastes", s.serveAdminPastes)
+	mux.HandleFunc("/admin/pastes/", s.serveAdminPastes)
+	mux.HandleFunc("/admin/stats", s.serveStats)
+	mux.HandleFunc("/admin/bans", s.serveBans)
+	mux.HandleFunc("/admin/features", s.serveFeatures)
+	mux.HandleFunc("/admin/roles", s.serveRoles)
+	mux.HandleFunc("/admin/users/", s.serveAdminUser)
+	mux.HandleFunc("/admin/", s.serveDashboard)
+	mux.HandleFunc("/", s.serveSnippets)
+	return mux
+}
+
+func (s *Server) serveSnippets(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/~") {
+		s.serveSlug(w, r)
+		return
+	}
+	id, suffix := splitSnippetPath(r.URL.Path[1:])
+	// /{id}?py is /{id}/py to sprunge users.
+	if lang := langHint(r); suffix == "" && lang != "" {
+		suffix = lang
+	}
+	user, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+	s.routeSnippet(w, r, id, suffix, user)
+}
+
+// splitSnippetPath splits the path of a snippet route, less its leading
+// slash, into the snippet and the suffix after it.
+func splitSnippetPath(p string) (id, suffix string) {
+	id, suffix, _ = strings.Cut(p, "/")
+	// GET /{id}+ is short for /{id}/console.
+	if trimmed, ok := strings.CutSuffix(id, "+"); ok && suffix == "" {
+		id, suffix = trimmed, "console"
+	}
+	return id, suffix
+}
+
+// authenticate returns the user r comes from, "" for anonymous requests,
+// answering the request itself and returning false if its credentials
+// are invalid.
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	user, ok := s.users.Authenticate(r)
+	if !ok {
+		// Accounts live on the primary; a replica lets it judge.
+		if s.forward(w, r) {
+			return "", false
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="pb"`)
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return "", false
+	}
+	return user, true
+}
+
+// routeSnippet serves suffix of snippet id, or creates one on POST, for
+// user.
+func (s *Server) routeSnippet(w http.ResponseWriter, r *http.Request, id, suffix, user string) {
+	switch suffix {
+	case "comments":
+		if s.requireFeature(w, FeatureComments, "Comments are disabled for now") {
+			s.serveComments(w, r, id, user)
+		}
+		return
+	case "publish":
+		s.servePublish(w, r, id, user)
+		return
+	case "fill":
+		s.serveFill(w, r, id, user)
+		return
+	case "gist":
+		s.serveGist(w, r, id, user)
+		return
+	case "edit":
+		s.serveEdit(w, r, id, user)
+		return
+	case "unlock":
+		s.serveUnlock(w, r, id)
+		return
+	case "ws":
+		s.serveCollab(w, r, id, user)
+		return
+	}
+	if id == "" && suffix == "" && r.Method == http.MethodGet && prefersHTML(r) {
+		s.serveCreateForm(w, r)
+		return
+	}
+	if isHistoryRoute(suffix) {
+		s.serveHistory(w, r, id, suffix, user)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		if user == "" && !s.checkProofOfWork(w, r) {
+			return
+		}
+		if !s.creates.acquire(w, r) {
+			return
+		}
+		defer s.creates.release()
+		// POST /{name} is short for POST /?id={name}.
+		if id != "" && suffix == "" {
+			query := r.URL.Query()
+			query.Set("id", id)
+			r.URL.RawQuery = query.Encode()
+		}
+		create := s.createBuffered
+		if s.streamsCreate(r) {
+			create = s.createStreamed
+		}
+		id, opts, ok := create(w, r, user)
+		if !ok {
+			return
+		}
+		url := constructURL(r, id)
+		if opts.Slug != "" {
+			url = constructURL(r, slugPath(user, opts.Slug))
+		}
+		// Drafts are announced when they are published.
+		if !opts.Draft {
+			s.events.publish(event{kind: eventCreate, id: id, url: url, user: user, requestID: RequestID(r.Context())})
+		}
+		if browserForm(r) {
+			s.serveCreated(w, r, id, url, opts)
+			return
+		}
+		w.Header().Set("Location", url)
+		if wantsJSON(r) {
+			writePaste(w, http.StatusCreated, id, url, opts.Expires, false)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, url)
+
+	case http.MethodPut:
+		if !s.authorize(w, r, id, user) {
+			return
+		}
+		if !s.creates.acquire(w, r) {
+			return
+		}
+		defer s.creates.release()
+		exists, ok := s.updatePaste(w, r, id, user)
+		if !ok {
+			return
+		}
+		if exists {
+			info, _ := s.store().Meta(id)
+			url := constructURL(r, id)
+			if info.Slug != "" {
+				url = constructURL(r, slugPath(info.Owner, info.Slug))
+			}
+			if wantsJSON(r) {
+				writePaste(w, http.StatusOK, id, url, info.Expires, false)
+			} else {
+				fmt.Fprint(w, url)
+			}
+			// Drafts are saved often and announced once, on publish.
+			if !info.Draft {
+				s.events.publish(event{kind: eventUpdate, id: id, url: url, user: user, requestID: RequestID(r.Context())})
+			}
+		} else {
+			http.NotFound(w, r)
+		}
+
+	case http.MethodGet:
+		// Private snippets and those not replicated yet are only on the
+		// primary.
+		if _, ok := s.store().Meta(id); !ok && s.forward(w, r) {
+			return
+		}
+		if !s.checkPrivate(w, r, id, user) || !s.checkReadPolicies(w, r, id, user) {
+			return
+		}
+		s.checkHoneytoken(r, id, user)
+		if !s.checkViewPassword(w, r, id, user) {
+			return
+		}
+		info, _ := s.store().Meta(id)
+		if info.NoIndex {
+			w.Header().Set("X-Robots-Tag", "noindex")
+		}
+		if suffix == "meta" {
+			s.serveMeta(w, r, id)
+			return
+		}
+		// Pastes that run out of reads, or are behind a password, aren't
+		// to be kept, by the offline viewer or anything else.
+		if info.MaxReads > 0 || info.HasViewPassword {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		if info.Redirect && suffix == "" {
+			s.serveShortlink(w, r, id, user)
+			return
+		}
+		if info.Encrypted && wantsEncryptedViewer(r, suffix) {
+			serveEncryptedViewer(w, id, suffix)
+			return
+		}
+		if suffix == "" && wantsJSON(r) {
+			if s.serveSnippetJSON(w, r, info) {
+				s.events.publish(event{kind: eventRead, id: id, url: constructURL(r, id), user: user, requestID: RequestID(r.Context())})
+			}
+			return
+		}
+		comments := s.store().Comments(id)
+		if checkNotModified(w, r, info, suffix, comments) {
+			return
+		}
+		if info.MediaType == "" && isHeavyRender(r, suffix) {
+			if !s.requireFeature(w, FeatureRenders, "Rendered views are disabled for now, try /"+id+"/raw") {
+				return
+			}
+			if s.memory.pressured() {
+				w.Header().Set("Retry-After", "60")
+				http.Error(w, "Server is low on memory; rendered views are disabled for now, try /"+id+"/raw", http.StatusServiceUnavailable)
+				return
+			}
+			if !s.renders.acquire(w, r) {
+				return
+			}
+			defer s.renders.release()
+		}
+		if info.MediaType != "" || !isHeavyRender(r, suffix) {
+			// Served as stored, so straight from disk.
+			content, ok := s.store().Open(id)
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			defer content.Close()
+			if !s.claimRead(w, r, id) {
+				return
+			}
+			if info.MediaType != "" {
+				serveBinary(w, content, id, info.MediaType)
+			} else {
+				serveText(w, content, suffix)
+			}
+			s.events.publish(event{kind: eventRead, id: id, url: constructURL(r, id), user: user, requestID: RequestID(r.Context())})
+			return
+		}
+		if content, ok := s.store().Get(id); ok {
+			if !s.claimRead(w, r, id) {
+				return
+			}
+			serveSnippet(w, r, content, id, suffix, info.Lang, !info.NoUnfurl, comments)
+			s.events.publish(event{kind: eventRead, id: id, url: constructURL(r, id), user: user, requestID: RequestID(r.Context())})
+		} else {
+			http.NotFound(w, r)
+		}
+
+	case http.MethodDelete:
+		if !s.authorize(w, r, id, user) {
+			return
+		}
+		if s.store().Delete(id) {
+			url := constructURL(r, id)
+			if wantsJSON(r) {
+				writePaste(w, http.StatusOK, id, url, time.Time{}, true)
+			} else {
+				fmt.Fprint(w, url)
+			}
+			s.events.publish(event{kind: eventDelete, id: id, url: url, user: user, requestID: RequestID(r.Context())})
+		} else {
+			http.NotFound(w, r)
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// updatePaste replaces the content of id with the paste in r, streaming a
+// raw body to disk, and reports whether id exists. Like readBody it answers
+// failures.
+func (s *Server) updatePaste(w http.ResponseWriter, r *http.Request, id, user string) (bool, bool) {
+	info, _ := s.store().Meta(id)
+	// Shortlinks are read whole, to check the new URL, and everything is
+	// when content filters need to see it.
+	if rawBody(r) && !info.Redirect && len(s.filters) == 0 {
+		exists, err := s.store().UpdateFrom(id, s.limitPaste(r.Body, info.Encrypted, user))
+		if err != nil {
+			s.pasteError(w, err)
+			return false, false
+		}
+		return exists, true
+	}
+	body, _, ok := s.readPaste(w, r)
+	body = browserText(r, body)
+	if !ok || !s.checkPasteSize(w, body, info.Encrypted) || !s.checkTierLimits(w, user, len(body), false) {
+		return false, false
+	}
+	if info.Redirect && !checkShortlink(w, body) {
+		return false, false
+	}
+	quarantine, ok := s.checkContent(w, r, string(body), user, info.Encrypted)
+	if !ok {
+		return false, false
+	}
+	exists := s.store().Update(id, string(body))
+	if exists && quarantine != "" {
+		s.quarantine(r, id, quarantine)
+	}
+	return exists, true
+}
+
+// createBuffered creates a paste from r read whole, for when plugins,
+// policies or DNS need its content first, answering failures itself.
+func (s *Server) createBuffered(w http.ResponseWriter, r *http.Request, user string) (string, store.CreateOptions, bool) {
+	body, fields, ok := s.readPaste(w, r)
+	if !ok {
+		return "", store.CreateOptions{}, false
+	}
+	if fields.Get("unpack") == "1" {
+		return s.createUnpacked(w, r, user, body, fields)
+	}
+	return s.createPaste(w, r, user, browserText(r, body), fields)
+}
+
+// createPaste creates a paste of body with the creation fields in fields,
+// running the same checks as POST /. Like createBuffered it answers
+// failures.
+func (s *Server) createPaste(w http.ResponseWriter, r *http.Request, user string, body []byte, fields url.Values) (string, store.CreateOptions, bool) {
+	var opts store.CreateOptions
+	if !s.checkPasteSize(w, body, r.URL.Query().Get("encrypted") == "1") {
+		return "", opts, false
+	}
+	if !s.checkTierLimits(w, user, len(body), true) {
+		return "", opts, false
+	}
+	if err := s.plugins.validate(string(body), user); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return "", opts, false
+	}
+	quarantine, ok := s.checkContent(w, r, string(body), user, r.URL.Query().Get("encrypted") == "1")
+	if !ok {
+		return "", opts, false
+	}
+	opts = store.CreateOptions{
+		Owner:     user,
+		Private:   r.URL.Query().Get("private") == "1",
+		Encrypted: r.URL.Query().Get("encrypted") == "1",
+		Draft:     fields.Get("draft") == "1",
+	}
+	if !s.applyCreateFields(w, user, fields, &opts) {
+		return "", opts, false
+	}
+	if fields.Get("u") == "1" {
+		if opts.Encrypted {
+			http.Error(w, "Shortlinks can't be encrypted", http.StatusBadRequest)
+			return "", opts, false
+		}
+		if !checkShortlink(w, body) {
+			return "", opts, false
+		}
+		opts.Redirect = true
+	}
+	if fields.Get("dns") == "1" {
+		if !s.checkDNS(w, len(body)) {
+			return "", opts, false
+		}
+		opts.DNS = true
+	}
+	// Anonymous pastes get an edit token in place of an owner, the one
+	// already answered with if several are created at once.
+	if user == "" {
+		opts.EditToken = w.Header().Get(editTokenHeader)
+		if opts.EditToken == "" {
+			opts.EditToken = newEditToken()
+			w.Header().Set(editTokenHeader, opts.EditToken)
+		}
+	}
+	if !s.applyCreatePolicies(w, string(body), &opts) {
+		return "", opts, false
+	}
+	id := s.store().Create(string(body), opts)
+	if id == "" {
+		http.Error(w, takenMessage(opts), http.StatusConflict)
+		return "", opts, false
+	}
+	if quarantine != "" {
+		s.quarantine(r, id, quarantine)
+	}
+	return id, opts, true
+}
+
+// applyCreatePolicies runs the create policies, answering the request
+// itself and returning false if the snippet is rejected.
+func (s *Server) applyCreatePolicies(w http.ResponseWriter, content string, opts *store.CreateOptions) bool {
+	decisions, err := s.policies.evaluate("create", map[string]any{
+		"user":      opts.Owner,
+		"anonymous": opts.Owner == "",
+		"size":      int64(len(content)),
+		"content":   content,
+		"private":   opts.Private,
+	})
+	if err != nil {
+		slog.Error("Create policy failed", "err", err)
+		http.Error(w, "Policy evaluation failed", http.StatusInternalServerError)
+		return false
+	}
+	for _, d := range decisions {
+		switch d.action {
+		case "reject":
+			http.Error(w, d.message, http.StatusForbidden)
+			return false
+		case "private":
+			opts.Private = true
+		}
+	}
+	return true
+}
+
+// checkReadPolicies runs the read policies for id, answering the request
+// itself and returning false if the read is denied or id does not exist.
+func (s *Server) checkReadPolicies(w http.ResponseWriter, r *http.Request, id, user string) bool {
+	info, ok := s.store().Meta(id)
+	if !ok {
+		http.NotFound(w, r)
+		return false
+	}
+	decisions, err := s.policies.evaluate("read", map[string]any{
+		"user":      user,
+		"anonymous": user == "",
+		"owner":     info.Owner,
+		"private":   info.Private,
+		"size":      int64(info.Size),
+		"reads":     int64(info.Reads),
+		"id":        id,
+	})
+	if err != nil {
+		slog.Error("Read policy failed", "err", err, "request_id", RequestID(r.Context()))
+		http.Error(w, "Policy evaluation failed", http.StatusInternalServerError)
+		return false
+	}
+	for _, d := range decisions {
+		if d.action == "deny" {
+			http.Error(w, d.message, http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+// checkPrivate answers the request itself and returns false if id is a
+// private snippet user may not read. Private snippets are readable by their
+// owner only, or for anonymous ones by whoever holds the edit token.
+// Anonymous private snippets from before edit tokens only stay unlisted.
+// Drafts are not found for anyone but their author; see checkDraft.
+func (s *Server) checkPrivate(w http.ResponseWriter, r *http.Request, id, user string) bool {
+	info, ok := s.store().Meta(id)
+	if ok && info.Draft {
+		return s.checkDraft(w, r, info, user)
+	}
+	if !ok || !info.Private {
+		return true
+	}
+	switch {
+	case info.Owner != "" && info.Owner == user:
+		return true
+	case info.Owner == "" && !info.HasEditToken:
+		return true
+	case info.Owner == "" && s.store().CheckEditToken(id, r.Header.Get(editTokenHeader)):
+		return true
+	}
+	http.Error(w, "This paste is private", http.StatusForbidden)
+	return false
+}
+
+// authorize checks that user may modify id. Snippets with an owner can only
+// be changed by that owner, and anonymous ones by whoever holds their edit
+// token, sent as X-Paste-Token. Anonymous snippets from before edit tokens
+// stay open to everyone. Honeytokens can only be changed by admins.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, id, user string) bool {
+	info, exists := s.store().Meta(id)
+	if !exists {
+		http.NotFound(w, r)
+		return false
+	}
+	if info.Honeytoken {
+		s.checkHoneytoken(r, id, user)
+		if !s.admins[user] {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return false
+		}
+		return true
+	}
+	if token := r.Header.Get(editTokenHeader); token != "" || (info.Owner == "" && info.HasEditToken) {
+		if s.store().CheckEditToken(id, token) {
+			return true
+		}
+		http.Error(w, "Invalid or missing paste token", http.StatusForbidden)
+		return false
+	}
+	if owner := info.Owner; owner != "" && owner != user {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// editTokenHeader carries an anonymous snippet's edit token, returned on
+// create and sent back to update or delete it.
+const editTokenHeader = "X-Paste-Token"
+
+// newEditToken returns a random edit token.
+func newEditToken() string {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		panic("unable to generate edit token: " + err.Error())
+	}
+	return hex.EncodeToString(raw)
+}
+
+// serveRegister creates an account from basic credentials, or the user and
+// password form fields, and answers with a first API token. Invite-only
+// instances also need the invite form field.
+func (s *Server) serveRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.parseForm(w, r) {
+		return
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		user, password = r.FormValue("user"), r.FormValue("password")
+	}
+
+	err := s.users.Register(user, password, r.FormValue("invite"))
+	switch {
+	case errors.Is(err, auth.ErrUserExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, auth.ErrInvalidInvite):
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	slog.Info("Registered", "user", user, "request_id", RequestID(r.Context()))
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintln(w, s.users.IssueToken(user))
+}
+
+// serveToken issues another API token to an authenticated user.
+func (s *Server) serveToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := s.users.Authenticate(r)
+	if !ok || user == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="pb"`)
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	fmt.Fprintln(w, s.users.IssueToken(user))
+}
+
+type changeEntry struct {
+	Seq  uint64    `json:"seq"`
+	Type string    `json:"type"`
+	ID   string    `json:"id"`
+	Hash string    `json:"hash,omitempty"`
+	At   time.Time `json:"at"`
+}
+
+type changesResponse struct {
+	Changes []changeEntry `json:"changes"`
+	// Next is the cursor to pass as since for the following page.
+	Next string `json:"next"`
+	More bool   `json:"more"`
+}
+
+// serveChanges pages through the change journal of public snippets, oldest
+// first, starting after the since cursor.
+func (s *Server) serveChanges(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var since uint64
+	if cursor := r.URL.Query().Get("since"); cursor != "" {
+		var err error
+		if since, err = strconv.ParseUint(cursor, 10, 64); err != nil {
+			http.Error(w, "Invalid since cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	changes, more := s.store().Changes(since, changesPageSize)
+	resp := changesResponse{Changes: make([]changeEntry, 0, len(changes)), Next: strconv.FormatUint(since, 10), More: more}
+	for _, c := range changes {
+		resp.Changes = append(resp.Changes, changeEntry{Seq: c.Seq, Type: c.Kind, ID: c.ID, Hash: c.Hash, At: c.At})
+		resp.Next = strconv.FormatUint(c.Seq, 10)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+type metaResponse struct {
+	ID      string     `json:"id"`
+	Size    int        `json:"size"`
+	SHA256  string     `json:"sha256"`
+	Created time.Time  `json:"created"`
+	Updated *time.Time `json:"updated,omitempty"`
+	Owner   string     `json:"owner,omitempty"`
+	Lang    string     `json:"lang,omitempty"`
+	Reads   int        `json:"reads"`
+	// Encrypted snippets are ciphertext only the holder of the key can read.
+	Encrypted bool       `json:"encrypted,omitempty"`
+	Expires   *time.Time `json:"expires"`
+	MaxReads  int        `json:"max_reads,omitempty"`
+	// DNS snippets can be fetched over the DNS responder.
+	DNS bool `json:"dns,omitempty"`
+	// MediaType is the detected type of binary snippets.
+	MediaType string `json:"media_type,omitempty"`
+	// Draft snippets are not published yet.
+	Draft bool `json:"draft,omitempty"`
+	// Slug names the snippet under its owner, as /~owner/slug.
+	Slug string `json:"slug,omitempty"`
+	// Redirect shortlinks send readers to the URL they hold.
+	Redirect bool `json:"redirect,omitempty"`
+	// Searchable snippets can be found by anyone through /search.
+	Searchable bool `json:"searchable,omitempty"`
+	// NoIndex and NoUnfurl snippets are kept out of search engines and
+	// link previews.
+	NoIndex  bool `json:"noindex,omitempty"`
+	NoUnfurl bool `json:"nounfurl,omitempty"`
+}
+
+// serveMeta describes a snippet as JSON. The owner of a private snippet is
+// not disclosed.
+func (s *Server) serveMeta(w http.ResponseWriter, r *http.Request, id string) {
+	info, ok := s.store().Meta(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newMetaResponse(info))
+}
+
+// newMetaResponse describes info, leaving out the owner of a private
+// snippet.
+func newMetaResponse(info store.Info) metaResponse {
+	resp := metaResponse{
+		ID:        info.ID,
+		Size:      info.Size,
+		SHA256:    info.Hash,
+		Created:   info.Created,
+		Lang:      info.Lang,
+		Reads:     info.Reads,
+		Encrypted: info.Encrypted,
+		MaxReads:  info.MaxReads,
+		DNS:       info.DNS,
+		MediaType: info.MediaType,
+		Draft:     info.Draft,
+		Redirect:  info.Redirect,
+
+		Searchable: info.Searchable,
+		NoIndex:    info.NoIndex,
+		NoUnfurl:   info.NoUnfurl,
+	}
+	if !info.Expires.IsZero() {
+		resp.Expires = &info.Expires
+	}
+	if !info.Updated.IsZero() {
+		resp.Updated = &info.Updated
+	}
+	if !info.Private {
+		resp.Owner = info.Owner
+		resp.Slug = info.Slug
+	}
+	return resp
+}
+
+type listingEntry struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Created time.Time `json:"created"`
+	Size    int       `json:"size"`
+	Lang    string    `json:"lang,omitempty"`
+	Draft   bool      `json:"draft,omitempty"`
+}
+
+type listing struct {
+	User    string         `json:"user"`
+	Page    int            `json:"page"`
+	Pages   int            `json:"pages"`
+	Entries []listingEntry `json:"pastes"`
+	// Stats sum up a user's pastes; the anonymous listing has none.
+	Stats *profileStats `json:"stats,omitempty"`
+}
+
+var listingTemplate = template.Must(template.New("listing").Parse(`<h1>{{.User}}</h1>
+{{with .Stats}}<p>{{.Pastes}} pastes, read {{.TotalViews}} times{{if .MostViewed}}; most read: <a href="{{.MostViewed.URL}}">{{.MostViewed.ID}}</a> ({{.MostViews}} times){{end}}</p>
+{{if .Languages}}<p>{{range $i, $l := .Languages}}{{if $i}}, {{end}}{{$l.Lang}} {{$l.Pastes}}{{end}}</p>
+{{end}}{{end}}<table>
+<tr><th>id</th><th>created</th><th>size</th><th>language</th></tr>
+{{range .Entries}}<tr><td><a href="{{.URL}}">{{.ID}}</a></td><td>{{.Created.Format "2006-01-02 15:04"}}</td><td>{{.Size}}</td><td>{{.Lang}}{{if .Draft}} (draft){{end}}</td></tr>
+{{end}}</table>
+<p>{{if gt .Page 1}}<a href="?page={{.Prev}}">newer</a> {{end}}page {{.Page}} of {{.Pages}}{{if lt .Page .Pages}} <a href="?page={{.Next}}">older</a>{{end}}</p>
+`))
+
+func (l listing) Prev() int { return l.Page - 1 }
+func (l listing) Next() int { return l.Page + 1 }
+
+// serveUserListing lists a user's snippets, newest first, as HTML or as JSON
+// for clients sending Accept: application/json, a page at a time, or all
+// of them as NDJSON for clients sending Accept: application/x-ndjson.
+// A user's listing comes with their profileStats. Without a name it lists
+// the most recent anonymous snippets that were not created private.
+// /user/{name}/export is the user's export archive.
+func (s *Server) serveUserListing(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/user/")
+	if user, ok := strings.CutSuffix(name, "/export"); ok && auth.ValidUserName(user) {
+		s.serveUserExport(w, r, user)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var ids []string
+	keep := func(store.Info) bool { return true }
+	title := name
+	switch {
+	case name == "":
+		for _, info := range s.store().ListRecentAnonymous(recentAnonymous) {
+			ids = append(ids, info.ID)
+		}
+		title = "anonymous"
+	case auth.ValidUserName(name):
+		viewer, _ := s.users.Authenticate(r)
+		ids = s.store().ListIDsByOwner(name)
+		keep = func(info store.Info) bool { return visibleTo(info, viewer) }
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if wantsNDJSON(r) {
+		s.streamListing(w, r, ids, keep)
+		return
+	}
+	l := listing{User: title, Page: 1}
+	if page, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && page > 1 {
+		l.Page = page
+	}
+	l.Entries, l.Pages = s.pageListing(r, ids, keep, l.Page, listingPageSize)
+	if l.Page > l.Pages {
+		http.NotFound(w, r)
+		return
+	}
+	if name != "" {
+		l.Stats = s.profileStats(r, ids, keep)
+	}
+
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(l)
+		return
+	}
+
+	var body strings.Builder
+	if err := listingTemplate.Execute(&body, l); err != nil {
+		http.Error(w, "Failed to render listing", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	pageTemplate.Execute(w, page{Title: title, Body: template.HTML(body.String())})
+}
+
+func constructURL(r *http.Request, id string) string {
+	return fmt.Sprintf("%s://%s/%s", requestScheme(r), r.Host, id)
+}
+
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// prefersHTML reports whether the client ranks text/html above text/plain.
+// Browsers do; curl and most CLI tools send */* and get plain text.
+func prefersHTML(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return acceptQuality(accept, "text/html") > acceptQuality(accept, "text/plain")
+}
+
+// acceptQuality returns the q-value an Accept header gives mediaType, taken
+// from the most specific media range that matches it.
+func acceptQuality(accept, mediaType string) float64 {
+	typ, _, _ := strings.Cut(mediaType, "/")
+	best, bestSpecificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		mediaRange := strings.ToLower(strings.TrimSpace(fields[0]))
+
+		specificity := -1
+		switch {
+		case mediaRange == mediaType:
+			specificity = 2
+		case mediaRange == typ+"/*":
+			specificity = 1
+		case mediaRange == "*/*":
+			specificity = 0
+		}
+		if specificity <= bestSpecificity {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range fields[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if name == "q" {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		best, bestSpecificity = q, specificity
+	}
+	return best
+}
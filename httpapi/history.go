@@ -0,0 +1,174 @@
+// Package httpapi implements paste history. Every update keeps the version
+// it replaces: GET /{id}/history lists a snippet's versions as JSON, GET
+// /{id}/v/{n} serves version n as it was, and GET /{id}/diff/{a}/{b}
+// compares two versions as /compare does two snippets. Version 1 is the
+// one the snippet was created with and the last is the current one.
+// Anyone who can read a snippet can read its history.
+package httpapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"pb/store"
+)
+
+// versionResponse is a version as GET /{id}/history lists it.
+type versionResponse struct {
+	N         int       `json:"n"`
+	URL       string    `json:"url"`
+	Created   time.Time `json:"created"`
+	Size      int       `json:"size"`
+	SHA256    string    `json:"sha256"`
+	MediaType string    `json:"media_type,omitempty"`
+}
+
+// isHistoryRoute reports whether suffix is served by serveHistory.
+func isHistoryRoute(suffix string) bool {
+	return suffix == "history" || strings.HasPrefix(suffix, "v/") || strings.HasPrefix(suffix, "diff/")
+}
+
+// serveHistory serves /{id}/history, /{id}/v/{n} and /{id}/diff/{a}/{b}
+// for user.
+func (s *Server) serveHistory(w http.ResponseWriter, r *http.Request, id, suffix, user string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// History isn't replicated, so replicas leave it to the primary.
+	if s.forward(w, r) {
+		return
+	}
+	info, ok := s.store().Meta(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !s.checkPrivate(w, r, id, user) || !s.checkReadPolicies(w, r, id, user) {
+		return
+	}
+	s.checkHoneytoken(r, id, user)
+	if !s.checkViewPassword(w, r, id, user) {
+		return
+	}
+	if info.MaxReads > 0 || info.HasViewPassword {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+
+	route, rest, _ := strings.Cut(suffix, "/")
+	switch route {
+	case "history":
+		versions, ok := s.store().History(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		resp := make([]versionResponse, 0, len(versions))
+		for _, v := range versions {
+			resp = append(resp, versionResponse{
+				N:         v.N,
+				URL:       constructURL(r, fmt.Sprintf("%s/v/%d", id, v.N)),
+				Created:   v.Created,
+				Size:      v.Size,
+				SHA256:    v.Hash,
+				MediaType: v.MediaType,
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+
+	case "v":
+		n, err := strconv.Atoi(rest)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		content, rev, ok := s.store().Revision(id, n)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if !s.claimRead(w, r, id) {
+			return
+		}
+		if rev.MediaType != "" {
+			serveBinary(w, strings.NewReader(content), fmt.Sprintf("%s-v%d", id, n), rev.MediaType)
+		} else {
+			serveText(w, strings.NewReader(content), "raw")
+		}
+		s.events.publish(event{kind: eventRead, id: id, url: constructURL(r, id), user: user, requestID: RequestID(r.Context())})
+
+	case "diff":
+		s.serveVersionDiff(w, r, id, rest, info, user)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveVersionDiff compares the versions of id named in versions, as
+// "{a}/{b}".
+func (s *Server) serveVersionDiff(w http.ResponseWriter, r *http.Request, id, versions string, info store.Info, user string) {
+	first, second, _ := strings.Cut(versions, "/")
+	na, errA := strconv.Atoi(first)
+	nb, errB := strconv.Atoi(second)
+	if errA != nil || errB != nil {
+		http.Error(w, "Name the versions to compare as /"+id+"/diff/{a}/{b}", http.StatusBadRequest)
+		return
+	}
+	if info.Encrypted {
+		http.Error(w, "Only text snippets can be compared, and "+id+" is not one", http.StatusBadRequest)
+		return
+	}
+	if s.memory.pressured() {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Server is low on memory; comparisons are disabled for now", http.StatusServiceUnavailable)
+		return
+	}
+	if !s.renders.acquire(w, r) {
+		return
+	}
+	defer s.renders.release()
+
+	contentA, revA, okA := s.store().Revision(id, na)
+	contentB, revB, okB := s.store().Revision(id, nb)
+	if !okA || !okB {
+		http.NotFound(w, r)
+		return
+	}
+	if revA.MediaType != "" || revB.MediaType != "" {
+		http.Error(w, "Only text versions can be compared", http.StatusBadRequest)
+		return
+	}
+	if !s.claimRead(w, r, id) {
+		return
+	}
+	s.events.publish(event{kind: eventRead, id: id, url: constructURL(r, id), user: user, requestID: RequestID(r.Context())})
+
+	nameA, nameB := fmt.Sprintf("%s/v/%d", id, na), fmt.Sprintf("%s/v/%d", id, nb)
+	a, b := splitLines(contentA), splitLines(contentB)
+	ops := diffLines(a, b)
+	w.Header().Add("Vary", "Accept")
+	if !prefersHTML(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(unifiedDiff("a/"+nameA, "b/"+nameB, a, b, ops)))
+		return
+	}
+	var body bytes.Buffer
+	err := compareTemplate.Execute(&body, struct {
+		A, B string
+		Rows []compareRow
+	}{nameA, nameB, compareRows(a, b, ops)})
+	if err != nil {
+		http.Error(w, "Failed to render comparison", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	pageTemplate.Execute(w, page{Title: fmt.Sprintf("%s v%d vs v%d", id, na, nb), Head: compareStyle, Body: template.HTML(body.String())})
+}
@@ -0,0 +1,81 @@
+// Package httpapi implements honeytokens: decoy snippets created by admins
+// whose IDs are never published anywhere, so any read of one means someone
+// is enumerating IDs or holds leaked data. Reads are served as usual, so as
+// not to tip the reader off, and raise a honeytoken event that is logged
+// and sent to the webhooks with details of the requester.
+package httpapi
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"pb/store"
+)
+
+// requester describes who made a request.
+type requester struct {
+	RemoteAddr    string `json:"remote_addr"`
+	ForwardedFor  string `json:"forwarded_for,omitempty"`
+	User          string `json:"user,omitempty"`
+	UserAgent     string `json:"user_agent,omitempty"`
+	Referer       string `json:"referer,omitempty"`
+	Method        string `json:"method"`
+	Path          string `json:"path"`
+	Authenticated bool   `json:"authenticated"`
+}
+
+// checkHoneytoken raises an alert if id is a honeytoken. Any request for
+// one counts, reads or attempted writes.
+func (s *Server) checkHoneytoken(r *http.Request, id, user string) {
+	if info, ok := s.store().Meta(id); !ok || !info.Honeytoken {
+		return
+	}
+	who := &requester{
+		RemoteAddr:    r.RemoteAddr,
+		ForwardedFor:  r.Header.Get("X-Forwarded-For"),
+		User:          user,
+		UserAgent:     r.UserAgent(),
+		Referer:       r.Referer(),
+		Method:        r.Method,
+		Path:          r.URL.Path,
+		Authenticated: user != "",
+	}
+	slog.Warn("Honeytoken accessed", "id", id, "remote_addr", who.RemoteAddr, "forwarded_for", who.ForwardedFor,
+		"user", who.User, "user_agent", who.UserAgent, "request_id", RequestID(r.Context()))
+	s.events.publish(event{kind: eventHoneytoken, id: id, url: constructURL(r, id), user: user, requestID: RequestID(r.Context()), requester: who})
+}
+
+// serveHoneytoken creates a honeytoken from the request body on POST and
+// answers with its URL; GET lists the honeytokens' IDs.
+func (s *Server) serveHoneytoken(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		for _, info := range s.store().All() {
+			if info.Honeytoken {
+				fmt.Fprintln(w, info.ID)
+			}
+		}
+
+	case http.MethodPost:
+		body, ok := s.readBody(w, r)
+		if !ok {
+			return
+		}
+		if len(body) == 0 {
+			http.Error(w, "Send the decoy content as the request body", http.StatusBadRequest)
+			return
+		}
+		// Honeytokens have no owner, so they show up in nobody's listing.
+		id := s.store().Create(string(body), store.CreateOptions{Honeytoken: true})
+		slog.Info("Created honeytoken", "id", id, "request_id", RequestID(r.Context()))
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, constructURL(r, id))
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
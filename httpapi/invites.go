@@ -0,0 +1,66 @@
+// Package httpapi implements invites for invite-only instances: account
+// holders issue single-use codes at /invite, up to their tier's budget
+// (admins have none), and new users register with one.
+package httpapi
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"pb/auth"
+)
+
+// serveInvite issues an invite code on POST and shows the caller's invites
+// on GET.
+func (s *Server) serveInvite(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.users.Authenticate(r)
+	if !ok || user == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="pb"`)
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	budget := s.inviteBudget(user)
+
+	switch r.Method {
+	case http.MethodGet:
+		issued, redeemed := s.users.Invites(user)
+		fmt.Fprintf(w, "issued %d, redeemed %d", issued, redeemed)
+		if budget > 0 {
+			fmt.Fprintf(w, ", %d left", max(budget-issued, 0))
+		}
+		fmt.Fprintln(w)
+
+	case http.MethodPost:
+		if budget < 0 {
+			http.Error(w, "Your tier can't issue invites", http.StatusForbidden)
+			return
+		}
+		code, err := s.users.CreateInvite(user, budget)
+		if errors.Is(err, auth.ErrInviteBudget) {
+			http.Error(w, fmt.Sprintf("All %d of your invites are issued", budget), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		slog.Info("Issued invite", "user", user, "request_id", RequestID(r.Context()))
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintln(w, code)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// inviteBudget is how many invites user may issue in all: zero for no limit,
+// negative for none.
+func (s *Server) inviteBudget(user string) int {
+	if s.admins[user] {
+		return 0
+	}
+	_, tier := s.tierOf(user)
+	return tier.Invites
+}
@@ -0,0 +1,125 @@
+// Package httpapi implements the JSON mode of the paste API, for clients
+// that send Accept: application/json. Creates and updates answer with
+// {"id", "url", "expires"} instead of the bare URL, GET /{id} with
+// {"content", "meta"}, and errors with an RFC 7807 problem document instead
+// of a line of text. Clients that don't ask, curl included, see no change.
+package httpapi
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"pb/store"
+)
+
+// pasteResponse is what creates, updates and deletes answer JSON clients
+// with.
+type pasteResponse struct {
+	ID      string     `json:"id"`
+	URL     string     `json:"url"`
+	Expires *time.Time `json:"expires"`
+	Deleted bool       `json:"deleted,omitempty"`
+}
+
+// snippetResponse is a paste as GET /{id} gives it to JSON clients. Binary
+// content is base64 encoded, as Encoding says.
+type snippetResponse struct {
+	Content  string       `json:"content"`
+	Encoding string       `json:"encoding,omitempty"`
+	Meta     metaResponse `json:"meta"`
+}
+
+// problem is an RFC 7807 problem document.
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// wantsProblems reports whether errors should be answered with problem
+// documents.
+func wantsProblems(r *http.Request) bool {
+	return wantsJSON(r) || strings.Contains(r.Header.Get("Accept"), "application/problem+json")
+}
+
+// writePaste answers a JSON client's create, update or delete of id, whose
+// URL is url.
+func writePaste(w http.ResponseWriter, status int, id, url string, expires time.Time, deleted bool) {
+	resp := pasteResponse{ID: id, URL: url, Deleted: deleted}
+	if !expires.IsZero() {
+		resp.Expires = &expires
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// serveSnippetJSON serves content and metadata of the paste info describes.
+func (s *Server) serveSnippetJSON(w http.ResponseWriter, r *http.Request, info store.Info) bool {
+	content, ok := s.store().Get(info.ID)
+	if !ok {
+		http.NotFound(w, r)
+		return false
+	}
+	if !s.claimRead(w, r, info.ID) {
+		return false
+	}
+	resp := snippetResponse{Content: content, Meta: newMetaResponse(info)}
+	if info.MediaType != "" {
+		resp.Content, resp.Encoding = base64.StdEncoding.EncodeToString([]byte(content)), "base64"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Add("Vary", "Accept")
+	json.NewEncoder(w).Encode(resp)
+	return true
+}
+
+// problemWriter turns the plain text errors http.Error writes into problem
+// documents. Other responses pass through untouched.
+type problemWriter struct {
+	http.ResponseWriter
+	// status is set once an error is being captured, and detail collects
+	// its message.
+	status int
+	detail bytes.Buffer
+}
+
+func (pw *problemWriter) WriteHeader(status int) {
+	h := pw.Header()
+	if status >= 400 && strings.HasPrefix(h.Get("Content-Type"), "text/plain") {
+		pw.status = status
+		h.Set("Content-Type", "application/problem+json")
+		h.Del("X-Content-Type-Options")
+	}
+	pw.ResponseWriter.WriteHeader(status)
+}
+
+func (pw *problemWriter) Write(p []byte) (int, error) {
+	if pw.status != 0 {
+		return pw.detail.Write(p)
+	}
+	return pw.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (pw *problemWriter) Unwrap() http.ResponseWriter {
+	return pw.ResponseWriter
+}
+
+// finish writes out the problem document of a captured error.
+func (pw *problemWriter) finish() {
+	if pw.status == 0 {
+		return
+	}
+	json.NewEncoder(pw.ResponseWriter).Encode(problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(pw.status),
+		Status: pw.status,
+		Detail: strings.TrimSpace(pw.detail.String()),
+	})
+}
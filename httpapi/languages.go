@@ -0,0 +1,107 @@
+// Package httpapi implements per-snippet default languages. A snippet may be
+// created with lang=python (or ext, the file extension the client saw), and
+// its code view is then highlighted as that language unless the URL names
+// another. The store indexes snippets by language for /api/v1/languages,
+// which also lists the languages pages can highlight.
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"pb/store"
+)
+
+const languageListingSize = 100
+
+// validLang matches the language names highlight.js and file extensions
+// use, e.g. go, c++, objective-c or f#.
+var validLang = regexp.MustCompile(`^[a-z0-9][a-z0-9+#._-]{0,31}$`)
+
+// highlightLanguage is a language the highlighter knows, by its name and
+// the aliases it also answers to.
+type highlightLanguage struct {
+	Name    string   `json:"name"`
+	Aliases []string `json:"aliases,omitempty"`
+}
+
+// highlightLanguages are the languages of the highlight.js build pages
+// load (highlightScript), its common set. Keep them in step when the
+// version changes.
+var highlightLanguages = []highlightLanguage{
+	{Name: "bash", Aliases: []string{"sh", "zsh"}},
+	{Name: "c", Aliases: []string{"h"}},
+	{Name: "cpp", Aliases: []string{"cc", "c++", "h++", "hpp", "hh", "hxx", "cxx"}},
+	{Name: "csharp", Aliases: []string{"cs", "c#"}},
+	{Name: "css"},
+	{Name: "diff", Aliases: []string{"patch"}},
+	{Name: "go", Aliases: []string{"golang"}},
+	{Name: "graphql", Aliases: []string{"gql"}},
+	{Name: "ini", Aliases: []string{"toml"}},
+	{Name: "java", Aliases: []string{"jsp"}},
+	{Name: "javascript", Aliases: []string{"js", "jsx", "mjs", "cjs"}},
+	{Name: "json", Aliases: []string{"jsonc"}},
+	{Name: "kotlin", Aliases: []string{"kt", "kts"}},
+	{Name: "less"},
+	{Name: "lua"},
+	{Name: "makefile", Aliases: []string{"mk", "mak", "make"}},
+	{Name: "markdown", Aliases: []string{"md", "mkdown", "mkd"}},
+	{Name: "objectivec", Aliases: []string{"mm", "objc", "obj-c", "obj-c++", "objective-c++"}},
+	{Name: "perl", Aliases: []string{"pl", "pm"}},
+	{Name: "php", Aliases: []string{"php3", "php4", "php5", "php6", "php7", "php8"}},
+	{Name: "php-template"},
+	{Name: "plaintext", Aliases: []string{"text", "txt"}},
+	{Name: "python", Aliases: []string{"py", "gyp", "ipython"}},
+	{Name: "python-repl", Aliases: []string{"pycon"}},
+	{Name: "r"},
+	{Name: "ruby", Aliases: []string{"rb", "gemspec", "podspec", "thor", "irb"}},
+	{Name: "rust", Aliases: []string{"rs"}},
+	{Name: "scss"},
+	{Name: "shell", Aliases: []string{"console", "shellsession"}},
+	{Name: "sql"},
+	{Name: "swift"},
+	{Name: "typescript", Aliases: []string{"ts", "tsx", "mts", "cts"}},
+	{Name: "vbnet", Aliases: []string{"vb"}},
+	{Name: "wasm"},
+	{Name: "xml", Aliases: []string{"html", "xhtml", "rss", "atom", "xjb", "xsd", "xsl", "plist", "wsf", "svg"}},
+	{Name: "yaml", Aliases: []string{"yml"}},
+}
+
+// normalizeLang lowercases lang and reports whether it is a valid name.
+func normalizeLang(lang string) (string, bool) {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	return lang, lang == "" || validLang.MatchString(lang)
+}
+
+// serveLanguages counts public snippets per language at
+// /api/v1/languages, or with supported=1 lists the languages pages can
+// highlight, and lists the newest snippets in one language at
+// /api/v1/languages/{lang}, or all of them as NDJSON.
+func (s *Server) serveLanguages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	lang := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/v1/languages"), "/")
+	if lang == "" {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("supported") == "1" {
+			json.NewEncoder(w).Encode(highlightLanguages)
+			return
+		}
+		json.NewEncoder(w).Encode(s.publicLanguages(s.store()))
+		return
+	}
+
+	ids := s.store().ListIDsByLang(lang)
+	keep := func(store.Info) bool { return true }
+	if wantsNDJSON(r) {
+		s.streamListing(w, r, ids, keep)
+		return
+	}
+	entries, _ := s.pageListing(r, ids, keep, 1, languageListingSize)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
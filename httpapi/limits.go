@@ -0,0 +1,95 @@
+// Package httpapi implements per-route-class concurrency limits, so that a
+// burst of expensive requests (creates, highlighted renders) queues behind a
+// fixed number of slots instead of starving cheap raw reads.
+package httpapi
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ConcurrencyLimits caps how many requests of each expensive class run at
+// once. A zero cap means unlimited.
+type ConcurrencyLimits struct {
+	// Creates covers POST and PUT.
+	Creates int
+	// Renders covers GETs of anything but plain text and /raw.
+	Renders int
+	// Queue is how many requests per class may wait for a slot; beyond it
+	// they are shed with 503.
+	Queue int
+	// QueueTimeout is how long a queued request waits before being shed,
+	// 10 seconds if zero.
+	QueueTimeout time.Duration
+}
+
+// routeLimit is a semaphore for one route class. A nil *routeLimit admits
+// everything.
+type routeLimit struct {
+	name     string
+	slots    chan struct{}
+	queued   atomic.Int32
+	maxQueue int32
+	timeout  time.Duration
+}
+
+func newRouteLimit(name string, concurrent int, limits ConcurrencyLimits) *routeLimit {
+	if concurrent <= 0 {
+		return nil
+	}
+	timeout := limits.QueueTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	return &routeLimit{
+		name:     name,
+		slots:    make(chan struct{}, concurrent),
+		maxQueue: int32(limits.Queue),
+		timeout:  timeout,
+	}
+}
+
+// acquire takes a slot, queueing for one if need be. If the queue is full
+// or the wait times out it answers 503 itself and returns false; otherwise
+// the caller must call release when done.
+func (l *routeLimit) acquire(w http.ResponseWriter, r *http.Request) bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if l.queued.Add(1) > l.maxQueue {
+		l.queued.Add(-1)
+		l.shed(w)
+		return false
+	}
+	defer l.queued.Add(-1)
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		l.shed(w)
+	case <-r.Context().Done():
+	}
+	return false
+}
+
+func (l *routeLimit) release() {
+	if l != nil {
+		<-l.slots
+	}
+}
+
+func (l *routeLimit) shed(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, fmt.Sprintf("Too many %s in progress, try again shortly", l.name), http.StatusServiceUnavailable)
+}
@@ -0,0 +1,86 @@
+// Package httpapi implements streamed listings. A listing takes the IDs of
+// its snippets from the store, a few bytes each, and looks the snippets up
+// one at a time as it writes them out, so an account with a hundred
+// thousand pastes costs a list of IDs rather than a response built whole.
+// Clients sending Accept: application/x-ndjson get every entry, one JSON
+// object per line, flushed as they go; writes wait on a slow reader, which
+// holds up no one but its own request.
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"pb/store"
+)
+
+const ndjsonType = "application/x-ndjson"
+
+// flushEvery is how many entries a streamed listing writes between flushes.
+const flushEvery = 100
+
+func wantsNDJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), ndjsonType)
+}
+
+func newListingEntry(r *http.Request, info store.Info) listingEntry {
+	return listingEntry{
+		ID:      info.ID,
+		URL:     constructURL(r, info.ID),
+		Created: info.Created,
+		Size:    info.Size,
+		Lang:    info.Lang,
+		Draft:   info.Draft,
+	}
+}
+
+// eachListed calls fn with each of ids still in the store that keep
+// accepts, in order, until fn returns false or the client goes away.
+func (s *Server) eachListed(r *http.Request, ids []string, keep func(store.Info) bool, fn func(store.Info) bool) {
+	for _, id := range ids {
+		if r.Context().Err() != nil {
+			return
+		}
+		info, ok := s.store().Meta(id)
+		if !ok || !keep(info) {
+			continue
+		}
+		if !fn(info) {
+			return
+		}
+	}
+}
+
+// streamListing writes the entries for ids that keep accepts as NDJSON.
+func (s *Server) streamListing(w http.ResponseWriter, r *http.Request, ids []string, keep func(store.Info) bool) {
+	w.Header().Set("Content-Type", ndjsonType)
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	n := 0
+	s.eachListed(r, ids, keep, func(info store.Info) bool {
+		if err := enc.Encode(newListingEntry(r, info)); err != nil {
+			return false
+		}
+		if n++; n%flushEvery == 0 {
+			rc.Flush()
+		}
+		return true
+	})
+}
+
+// pageListing returns page (from 1) of the entries for ids that keep
+// accepts, size to a page, and how many pages there are, at least 1.
+func (s *Server) pageListing(r *http.Request, ids []string, keep func(store.Info) bool, page, size int) ([]listingEntry, int) {
+	start := (page - 1) * size
+	entries := []listingEntry{}
+	n := 0
+	s.eachListed(r, ids, keep, func(info store.Info) bool {
+		if n >= start && n < start+size {
+			entries = append(entries, newListingEntry(r, info))
+		}
+		n++
+		return true
+	})
+	return entries, max((n+size-1)/size, 1)
+}
@@ -0,0 +1,555 @@
+// Package httpapi implements the man renderer, so that
+//
+//	curl https://pb.example/<id>/man | man -l -
+//
+// reads a snippet as a manual page. Snippets written in roff (their first
+// line is a request such as .TH) are served as they are; anything else is
+// taken as Markdown and converted, headings becoming sections. Browsers get
+// the page rendered as HTML instead, from the same roff, so both look alike.
+// Only the man macro package is understood, and not all of it.
+package httpapi
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/text"
+)
+
+// isRoff reports whether content looks like roff rather than Markdown: its
+// first non-blank line is a request or a comment.
+func isRoff(content string) bool {
+	for _, line := range strings.Split(content, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return line[0] == '.' || line[0] == '\''
+		}
+	}
+	return false
+}
+
+// roffWriter accumulates roff output, keeping track of whether the next
+// text starts a line, where a leading . or ' would be taken as a request.
+type roffWriter struct {
+	sb          strings.Builder
+	atLineStart bool
+}
+
+// request writes a request on a line of its own. Paragraph breaks in a row
+// are merged.
+func (rw *roffWriter) request(line string) {
+	if line == ".PP" && strings.HasSuffix(rw.sb.String(), ".PP\n") {
+		return
+	}
+	if !rw.atLineStart && rw.sb.Len() > 0 {
+		rw.sb.WriteByte('\n')
+	}
+	rw.sb.WriteString(line)
+	rw.sb.WriteByte('\n')
+	rw.atLineStart = true
+}
+
+// raw writes roff that is already escaped.
+func (rw *roffWriter) raw(s string) {
+	if s == "" {
+		return
+	}
+	rw.sb.WriteString(s)
+	rw.atLineStart = strings.HasSuffix(s, "\n")
+}
+
+// text writes s escaped, protecting each line from being read as a request.
+func (rw *roffWriter) text(s string) {
+	for i, line := range strings.Split(s, "\n") {
+		if i > 0 {
+			rw.raw("\n")
+		}
+		if line == "" {
+			continue
+		}
+		if rw.atLineStart {
+			line = strings.TrimLeft(line, " ")
+			if line != "" && (line[0] == '.' || line[0] == '\'') {
+				rw.raw(`\&`)
+			}
+		}
+		rw.raw(roffEscape(line))
+	}
+}
+
+// roffEscape escapes backslashes and marks hyphens as minus signs, which is
+// what option names in manuals need to copy and paste correctly.
+func roffEscape(s string) string {
+	return strings.NewReplacer(`\`, `\e`, "-", `\-`).Replace(s)
+}
+
+// markdownToRoff converts Markdown to a man page. A first-level heading
+// such as "pb(1)" at the top names the page; otherwise id does.
+func markdownToRoff(content, id string) string {
+	source := []byte(content)
+	doc := markdown.Parser().Parse(text.NewReader(source))
+
+	name, section := strings.ToUpper(id), "7"
+	if h, ok := doc.FirstChild().(*ast.Heading); ok && h.Level == 1 {
+		title := strings.TrimSpace(plainText(h, source))
+		name = strings.ToUpper(title)
+		if open := strings.LastIndexByte(title, '('); open > 0 && strings.HasSuffix(title, ")") {
+			name, section = strings.ToUpper(title[:open]), title[open+1:len(title)-1]
+		}
+		doc.RemoveChild(doc, h)
+	}
+	var rw roffWriter
+	rw.request(fmt.Sprintf(`.TH "%s" "%s"`, roffQuote(name), roffQuote(section)))
+
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		switch n := n.(type) {
+		case *ast.Heading:
+			if entering {
+				macro := ".SH"
+				if n.Level > 2 {
+					macro = ".SS"
+				}
+				title := plainText(n, source)
+				if n.Level <= 2 {
+					title = strings.ToUpper(title)
+				}
+				rw.request(fmt.Sprintf(`%s "%s"`, macro, roffQuote(title)))
+			}
+			return ast.WalkSkipChildren, nil
+		case *ast.Paragraph:
+			if entering {
+				if _, inItem := n.Parent().(*ast.ListItem); !inItem || n.PreviousSibling() != nil {
+					rw.request(".PP")
+				}
+			} else {
+				rw.raw("\n")
+			}
+		case *ast.TextBlock:
+			if !entering {
+				rw.raw("\n")
+			}
+		case *ast.ListItem:
+			if entering {
+				if list := n.Parent().(*ast.List); list.IsOrdered() {
+					index := list.Start
+					for sib := n.PreviousSibling(); sib != nil; sib = sib.PreviousSibling() {
+						index++
+					}
+					rw.request(fmt.Sprintf(".IP %d. 4", index))
+				} else {
+					rw.request(`.IP \(bu 2`)
+				}
+			}
+		case *ast.List:
+			if !entering {
+				rw.request(".PP")
+			}
+		case *ast.Blockquote:
+			if entering {
+				rw.request(".RS 4")
+			} else {
+				rw.request(".RE")
+			}
+		case *ast.FencedCodeBlock, *ast.CodeBlock:
+			if entering {
+				rw.request(".PP")
+				rw.request(".RS 4")
+				rw.request(".nf")
+				lines := n.Lines()
+				for i := 0; i < lines.Len(); i++ {
+					seg := lines.At(i)
+					rw.text(strings.TrimRight(string(seg.Value(source)), "\n"))
+					rw.raw("\n")
+				}
+				rw.request(".fi")
+				rw.request(".RE")
+			}
+			return ast.WalkSkipChildren, nil
+		case *ast.ThematicBreak:
+			if entering {
+				rw.request(".sp")
+			}
+		case *ast.HTMLBlock, *ast.RawHTML:
+			return ast.WalkSkipChildren, nil
+		case *ast.Emphasis:
+			font := `\fI`
+			if n.Level > 1 {
+				font = `\fB`
+			}
+			if !entering {
+				font = `\fR`
+			}
+			rw.raw(font)
+		case *ast.CodeSpan:
+			if entering {
+				rw.raw(`\fB`)
+			} else {
+				rw.raw(`\fR`)
+			}
+		case *ast.Link:
+			if !entering {
+				if dest := string(n.Destination); dest != plainText(n, source) {
+					rw.text(" <" + dest + ">")
+				}
+			}
+		case *ast.AutoLink:
+			if entering {
+				rw.text(string(n.URL(source)))
+			}
+			return ast.WalkSkipChildren, nil
+		case *ast.Text:
+			if entering {
+				rw.text(string(n.Segment.Value(source)))
+				if n.HardLineBreak() {
+					rw.request(".br")
+				} else if n.SoftLineBreak() {
+					rw.raw("\n")
+				}
+			}
+		case *ast.String:
+			if entering {
+				rw.text(string(n.Value))
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+	return rw.sb.String()
+}
+
+// plainText returns the text of n's inline children, without formatting.
+func plainText(n ast.Node, source []byte) string {
+	var sb strings.Builder
+	ast.Walk(n, func(c ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch c := c.(type) {
+		case *ast.Text:
+			sb.Write(c.Segment.Value(source))
+			if c.SoftLineBreak() {
+				sb.WriteByte(' ')
+			}
+		case *ast.String:
+			sb.Write(c.Value)
+		}
+		return ast.WalkContinue, nil
+	})
+	return sb.String()
+}
+
+// roffQuote makes s safe inside a double-quoted request argument.
+func roffQuote(s string) string {
+	return strings.ReplaceAll(roffEscape(s), `"`, `\(dq`)
+}
+
+// roffArgs splits the arguments of a request, honouring double quotes.
+func roffArgs(s string) []string {
+	var args []string
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			return args
+		}
+		if s[0] == '"' {
+			end := 1
+			for end < len(s) && (s[end] != '"' || (end+1 < len(s) && s[end+1] == '"')) {
+				if s[end] == '"' {
+					end++
+				}
+				end++
+			}
+			args = append(args, strings.ReplaceAll(s[1:min(end, len(s))], `""`, `"`))
+			s = s[min(end+1, len(s)):]
+			continue
+		}
+		end := strings.IndexAny(s, " \t")
+		if end < 0 {
+			end = len(s)
+		}
+		args = append(args, s[:end])
+		s = s[end:]
+	}
+}
+
+// roffSpecials maps the special characters (\(xx and \[xx]) that turn up in
+// manuals to their Unicode equivalents.
+var roffSpecials = map[string]string{
+	"em": "—", "en": "–", "hy": "-", "bu": "•", "co": "©", "rg": "®", "tm": "™",
+	"aq": "'", "dq": `"`, "lq": "“", "rq": "”", "oq": "‘", "cq": "’",
+	"ga": "`", "ti": "~", "ha": "^", "rs": `\`, "mi": "−", "->": "→", "<-": "←",
+	"de": "°", "mu": "×", "sc": "§", "ps": "¶",
+}
+
+// roffFonts maps font names to the HTML elements that show them.
+var roffFonts = map[string]string{"B": "b", "I": "i", "BI": "b", "CW": "code", "CB": "b", "CR": "code"}
+
+// roffInlineHTML converts a line of roff text to HTML, handling escapes and
+// font changes. Fonts are closed at the end of the line.
+func roffInlineHTML(s string) string {
+	var sb strings.Builder
+	font, prev := "", ""
+	setFont := func(name string) {
+		if name == "P" {
+			name = prev
+		}
+		if font != "" {
+			sb.WriteString("</" + font + ">")
+		}
+		prev = font
+		font = roffFonts[name]
+		if font != "" {
+			sb.WriteString("<" + font + ">")
+		}
+	}
+	for s != "" {
+		i := strings.IndexByte(s, '\\')
+		if i < 0 {
+			sb.WriteString(template.HTMLEscapeString(s))
+			break
+		}
+		sb.WriteString(template.HTMLEscapeString(s[:i]))
+		s = s[i+1:]
+		if s == "" {
+			break
+		}
+		c := s[0]
+		s = s[1:]
+		switch c {
+		case 'f':
+			var name string
+			switch {
+			case strings.HasPrefix(s, "("):
+				name, s = s[1:min(3, len(s))], s[min(3, len(s)):]
+			case strings.HasPrefix(s, "["):
+				end := strings.IndexByte(s, ']')
+				if end < 0 {
+					end = len(s) - 1
+				}
+				name, s = s[1:end], s[end+1:]
+			case s != "":
+				name, s = s[:1], s[1:]
+			}
+			if name == "R" || name == "" {
+				name = "R"
+			}
+			setFont(name)
+		case '(':
+			name := s[:min(2, len(s))]
+			s = s[len(name):]
+			sb.WriteString(template.HTMLEscapeString(roffSpecials[name]))
+		case '[':
+			end := strings.IndexByte(s, ']')
+			if end < 0 {
+				end = len(s) - 1
+			}
+			name := s[:max(end, 0)]
+			s = s[end+1:]
+			sb.WriteString(template.HTMLEscapeString(roffSpecials[name]))
+		case '"':
+			// A comment runs to the end of the line.
+			s = ""
+		case 'e', '\\':
+			sb.WriteString(`\`)
+		case '-':
+			sb.WriteString("-")
+		case ' ', '~':
+			sb.WriteString("&nbsp;")
+		case '&', 'c', '%', '|', '^', ',', '/':
+			// Zero-width marks and spacing hints.
+		default:
+			sb.WriteString(template.HTMLEscapeString(string(c)))
+		}
+	}
+	if font != "" {
+		sb.WriteString("</" + font + ">")
+	}
+	return sb.String()
+}
+
+// roffToHTML renders a man page as HTML.
+func roffToHTML(content string) (title string, body string) {
+	var sb strings.Builder
+	inPara, inPre, pendingTerm, nextLineFont := false, false, false, ""
+	depth := 0
+	closePara := func() {
+		if inPara {
+			sb.WriteString("</p>\n")
+			inPara = false
+		}
+	}
+	openPara := func(class string) {
+		closePara()
+		if class != "" {
+			fmt.Fprintf(&sb, `<p class="%s">`, class)
+		} else {
+			sb.WriteString("<p>")
+		}
+		inPara = true
+	}
+	// emit writes a line of text, in a paragraph unless preformatted.
+	emit := func(html string) {
+		switch {
+		case inPre:
+			sb.WriteString(html + "\n")
+		case pendingTerm:
+			closePara()
+			sb.WriteString(`<p class="term">` + html + "</p>\n")
+			openPara("indent")
+			pendingTerm = false
+		default:
+			if !inPara {
+				openPara("")
+			}
+			sb.WriteString(html + "\n")
+		}
+	}
+	// alternate renders the arguments of .BR and friends in alternating fonts.
+	alternate := func(fonts string, args []string) string {
+		var line strings.Builder
+		for i, arg := range args {
+			f := roffFonts[string(fonts[i%2])]
+			inner := roffInlineHTML(arg)
+			if f != "" {
+				inner = "<" + f + ">" + inner + "</" + f + ">"
+			}
+			line.WriteString(inner)
+		}
+		return line.String()
+	}
+
+	var header string
+	for _, line := range strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n") {
+		if line == "" || line[0] != '.' && line[0] != '\'' {
+			if line == "" && !inPre {
+				closePara()
+				continue
+			}
+			html := roffInlineHTML(line)
+			if nextLineFont != "" {
+				html = "<" + nextLineFont + ">" + html + "</" + nextLineFont + ">"
+				nextLineFont = ""
+			}
+			emit(html)
+			continue
+		}
+		name, rest, _ := strings.Cut(strings.TrimLeft(line[1:], " \t"), " ")
+		args := roffArgs(rest)
+		switch name {
+		case `\"`, "":
+		case "TH":
+			for len(args) < 5 {
+				args = append(args, "")
+			}
+			title = args[0] + "(" + args[1] + ")"
+			header = fmt.Sprintf(`<div class="th"><span>%s</span><span>%s</span><span>%s</span></div>`,
+				template.HTMLEscapeString(title), roffInlineHTML(args[4]), template.HTMLEscapeString(title))
+		case "SH", "SS":
+			closePara()
+			for ; depth > 0; depth-- {
+				sb.WriteString("</div>\n")
+			}
+			tag := "h2"
+			if name == "SS" {
+				tag = "h3"
+			}
+			fmt.Fprintf(&sb, "<%s>%s</%s>\n", tag, roffInlineHTML(strings.Join(args, " ")), tag)
+		case "PP", "P", "LP":
+			closePara()
+		case "TP":
+			closePara()
+			pendingTerm = true
+		case "IP":
+			openPara("indent")
+			if len(args) > 0 && args[0] != "" {
+				sb.WriteString(`<span class="tag">` + roffInlineHTML(args[0]) + "</span> ")
+			}
+		case "B", "I", "SB", "SM":
+			f := roffFonts[name]
+			if name == "SB" {
+				f = "b"
+			}
+			if len(args) == 0 {
+				nextLineFont = f
+				continue
+			}
+			html := roffInlineHTML(strings.Join(args, " "))
+			if f != "" {
+				html = "<" + f + ">" + html + "</" + f + ">"
+			}
+			emit(html)
+		case "BR", "BI", "IB", "IR", "RB", "RI":
+			emit(alternate(name, args))
+		case "br":
+			if inPara {
+				sb.WriteString("<br>\n")
+			}
+		case "sp":
+			closePara()
+			sb.WriteString("<br>\n")
+		case "nf", "EX":
+			closePara()
+			if !inPre {
+				sb.WriteString("<pre>")
+				inPre = true
+			}
+		case "fi", "EE":
+			if inPre {
+				sb.WriteString("</pre>\n")
+				inPre = false
+			}
+		case "RS":
+			closePara()
+			sb.WriteString(`<div class="rs">` + "\n")
+			depth++
+		case "RE":
+			closePara()
+			if depth > 0 {
+				sb.WriteString("</div>\n")
+				depth--
+			}
+		case "UR", "MT":
+			if len(args) > 0 {
+				emit(`<span class="url">` + template.HTMLEscapeString(args[0]) + "</span>")
+			}
+		}
+	}
+	closePara()
+	if inPre {
+		sb.WriteString("</pre>\n")
+	}
+	for ; depth > 0; depth-- {
+		sb.WriteString("</div>\n")
+	}
+	return title, header + "\n" + sb.String()
+}
+
+var manStyle = stylesheet("man.css")
+
+// manRenderer shows the snippet as a manual page: roff for man(1), or HTML
+// for browsers.
+type manRenderer struct{}
+
+func (manRenderer) mediaType(v view) string {
+	if v.html {
+		return "text/html; charset=utf-8"
+	}
+	return "text/troff; charset=utf-8"
+}
+
+func (manRenderer) render(w io.Writer, v view) error {
+	roff := v.content
+	if !isRoff(roff) {
+		roff = markdownToRoff(roff, v.id)
+	}
+	if !v.html {
+		_, err := io.WriteString(w, roff)
+		return err
+	}
+	title, body := roffToHTML(roff)
+	if title == "" {
+		title = v.id
+	}
+	return pageTemplate.Execute(w, page{Title: title, OpenGraph: v.og, Theme: v.theme, Head: manStyle, Body: template.HTML(body)})
+}
@@ -0,0 +1,229 @@
+// Package httpapi implements the moderation blocklist. Public snippets whose
+// first line matches it are flagged rather than deleted: they stay readable
+// by ID but are held back from listings and exports until an admin reviews
+// them at /admin/flagged. A blocklist file holds one entry per line:
+//
+//	word <word>      a whole word, matched case-insensitively
+//	regex <pattern>  a Go regular expression, matched against the line
+//	stem <lang>      stem the words that follow, and the line's words, with
+//	                 the stemmer for lang ("en") before comparing; "none"
+//	                 turns stemming off again
+//
+// so one file can hold word lists for several languages.
+package httpapi
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"pb/auth"
+	"pb/store"
+)
+
+// stemmers reduce a lowercase word to its stem, by language.
+var stemmers = map[string]func(string) string{
+	"en": stemEnglish,
+}
+
+type blockedWord struct {
+	word string
+	// stem is the stemmer the word was listed under, or nil.
+	stem func(string) string
+}
+
+// Blocklist is a compiled blocklist file. A nil *Blocklist matches nothing.
+type Blocklist struct {
+	words   []blockedWord
+	regexps []*regexp.Regexp
+}
+
+// LoadBlocklist compiles the blocklist in fileName. An empty name yields
+// nil.
+func LoadBlocklist(fileName string) (*Blocklist, error) {
+	if fileName == "" {
+		return nil, nil
+	}
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	bl := &Blocklist{}
+	var stem func(string) string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kind, arg, _ := strings.Cut(line, " ")
+		arg = strings.TrimSpace(arg)
+		switch {
+		case arg == "":
+			return nil, fmt.Errorf("%s:%d: expected %s <argument>", fileName, n, kind)
+		case kind == "word":
+			word := strings.ToLower(arg)
+			if stem != nil {
+				word = stem(word)
+			}
+			bl.words = append(bl.words, blockedWord{word: word, stem: stem})
+		case kind == "regex":
+			re, err := regexp.Compile(arg)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", fileName, n, err)
+			}
+			bl.regexps = append(bl.regexps, re)
+		case kind == "stem" && arg == "none":
+			stem = nil
+		case kind == "stem":
+			var ok bool
+			if stem, ok = stemmers[arg]; !ok {
+				return nil, fmt.Errorf("%s:%d: no stemmer for language %q", fileName, n, arg)
+			}
+		default:
+			return nil, fmt.Errorf("%s:%d: expected word, regex or stem", fileName, n)
+		}
+	}
+	return bl, scanner.Err()
+}
+
+// match returns the entry that line matches, or "".
+func (bl *Blocklist) match(line string) string {
+	if bl == nil {
+		return ""
+	}
+	for _, re := range bl.regexps {
+		if re.MatchString(line) {
+			return "regex " + re.String()
+		}
+	}
+	words := strings.FieldsFunc(strings.ToLower(line), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, blocked := range bl.words {
+		for _, word := range words {
+			if blocked.stem != nil {
+				word = blocked.stem(word)
+			}
+			if word == blocked.word {
+				return "word " + blocked.word
+			}
+		}
+	}
+	return ""
+}
+
+// stemEnglish strips common English inflections, so that "spamming" and
+// "spammed" match "spam". It is deliberately light: it only has to map a
+// word and its inflections to the same stem.
+func stemEnglish(word string) string {
+	for _, rule := range []struct{ suffix, replacement string }{
+		{"ies", "y"}, {"ied", "y"}, {"ingly", ""}, {"edly", ""},
+		{"ing", ""}, {"ers", ""}, {"er", ""}, {"ed", ""}, {"ly", ""}, {"s", ""},
+	} {
+		stem, ok := strings.CutSuffix(word, rule.suffix)
+		if !ok || len(stem) < 3 || strings.HasSuffix(word, "ss") {
+			continue
+		}
+		stem += rule.replacement
+		// "spamming" -> "spamm" -> "spam"
+		if n := len(stem); rule.replacement == "" && n >= 2 && stem[n-1] == stem[n-2] && !strings.ContainsRune("lsz", rune(stem[n-1])) {
+			stem = stem[:n-1]
+		}
+		return stem
+	}
+	return word
+}
+
+// moderate is the create, update and publish subscriber that flags public snippets
+// whose first line matches the blocklist.
+func (s *Server) moderate(e event) {
+	info, ok := s.store().Meta(e.id)
+	if !ok || info.Private || info.Encrypted {
+		return
+	}
+	content, ok := s.store().Get(e.id)
+	if !ok {
+		return
+	}
+	firstLine, _, _ := strings.Cut(content, "\n")
+	if entry := s.blocklist.match(firstLine); entry != "" {
+		s.store().SetFlagged(e.id, true)
+		slog.Info("Flagged snippet for review", "id", e.id, "match", entry, "request_id", e.requestID)
+	}
+}
+
+// serveFlagged lists the flagged snippets on GET, one "id first-line" per
+// line, streamed as the listings are, and on POST reviews the one in the id form field: action=approve
+// lists it again and action=delete deletes it.
+func (s *Server) serveFlagged(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.requireRole(w, r, auth.RoleModerator); !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		rc := http.NewResponseController(w)
+		for i, id := range s.store().FlaggedIDs() {
+			if r.Context().Err() != nil {
+				return
+			}
+			if _, err := fmt.Fprintln(w, id, s.firstLine(id)); err != nil {
+				return
+			}
+			if (i+1)%flushEvery == 0 {
+				rc.Flush()
+			}
+		}
+
+	case http.MethodPost:
+		if !s.parseForm(w, r) {
+			return
+		}
+		id := r.FormValue("id")
+		if info, ok := s.store().Meta(id); !ok || !info.Flagged {
+			http.NotFound(w, r)
+			return
+		}
+		switch r.FormValue("action") {
+		case "approve":
+			s.store().SetFlagged(id, false)
+		case "delete":
+			if s.store().Delete(id) {
+				user, _ := s.users.Authenticate(r)
+				s.events.publish(event{kind: eventDelete, id: id, url: constructURL(r, id), user: user, requestID: RequestID(r.Context())})
+			}
+		default:
+			http.Error(w, "action must be approve or delete", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintln(w, id)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// firstLine returns the first line of id, or as much of it as fits a read
+// buffer, reading no further.
+func (s *Server) firstLine(id string) string {
+	content, ok := s.store().Open(id)
+	if !ok {
+		return ""
+	}
+	defer content.Close()
+	line, _ := bufio.NewReader(content).ReadSlice('\n')
+	return strings.TrimSuffix(string(line), "\n")
+}
+
+// visibleTo reports whether info is listed for viewer: flagged, private,
+// draft and read-limited snippets are left out unless viewer owns them.
+func visibleTo(info store.Info, viewer string) bool {
+	return !(info.Flagged || info.Private || info.Draft || info.MaxReads > 0) || (viewer != "" && info.Owner == viewer)
+}
@@ -0,0 +1,135 @@
+// Package httpapi implements the offline viewer: a service worker, served
+// at /sw.js and registered by every HTML page, that keeps a copy of each
+// page and paste the browser fetches for reading offline, and queues
+// pastes created while offline (POST / and /{id}/fill) to send once the
+// connection is back. Responses marked no-store, such as those of pastes
+// with a read limit, are never kept.
+package httpapi
+
+import (
+	"io"
+	"net/http"
+)
+
+const serviceWorker = `const CACHE = 'pb-v1';
+const QUEUE = 'creates';
+// Pages that belong to an account or change on every visit aren't kept.
+const UNCACHED = /^\/(admin|api|token|register|invite|sshkeys)(\/|$)/;
+
+self.addEventListener('install', () => self.skipWaiting());
+self.addEventListener('activate', e => e.waitUntil(self.clients.claim().then(replay)));
+self.addEventListener('sync', e => {
+  if (e.tag === QUEUE) e.waitUntil(replay());
+});
+
+self.addEventListener('fetch', e => {
+  const req = e.request;
+  const url = new URL(req.url);
+  const local = url.origin === location.origin;
+  if (req.method === 'POST' && local && (url.pathname === '/' || url.pathname.endsWith('/fill'))) {
+    e.respondWith(createOrQueue(req));
+  } else if (req.method === 'GET' && ((local && !UNCACHED.test(url.pathname)) || url.hostname === 'cdnjs.cloudflare.com')) {
+    e.respondWith(networkFirst(req));
+  }
+});
+
+// networkFirst answers from the network, keeping a copy, and falls back on
+// the copy when offline.
+async function networkFirst(req) {
+  let resp;
+  try {
+    resp = await fetch(req);
+  } catch (err) {
+    const cached = await caches.match(req);
+    return cached || text('You are offline, and this page was not saved for reading offline.', 503);
+  }
+  const keep = (resp.ok || resp.type === 'opaque') && !/no-store/.test(resp.headers.get('Cache-Control') || '');
+  if (keep) {
+    const cache = await caches.open(CACHE);
+    await cache.put(req, resp.clone());
+  }
+  replay();
+  return resp;
+}
+
+// createOrQueue sends a new paste, or queues it if the network is down.
+async function createOrQueue(req) {
+  const body = await req.clone().arrayBuffer();
+  try {
+    return await fetch(req);
+  } catch (err) {
+    await store('readwrite', s => s.add({url: req.url, body, type: req.headers.get('Content-Type')}));
+    if (self.registration.sync) self.registration.sync.register(QUEUE).catch(() => {});
+    return text('You are offline. This paste is queued and will be created once you are back online.', 202);
+  }
+}
+
+let replaying = null;
+
+// replay sends the queued pastes in order, stopping at the first that
+// can't be sent yet, and tells open pages where the new ones are.
+function replay() {
+  replaying = replaying || drain().finally(() => { replaying = null; });
+  return replaying;
+}
+
+async function drain() {
+  for (const key of await store('readonly', s => s.getAllKeys())) {
+    const entry = await store('readonly', s => s.get(key));
+    let resp;
+    try {
+      resp = await fetch(entry.url, {
+        method: 'POST',
+        body: entry.body,
+        headers: entry.type ? {'Content-Type': entry.type} : {},
+        credentials: 'same-origin',
+      });
+    } catch (err) {
+      return;
+    }
+    // Server errors and rate limits may pass later; nothing else will.
+    if (resp.status >= 500 || resp.status === 429) return;
+    await store('readwrite', s => s.delete(key));
+    if (resp.status === 201) {
+      const created = (await resp.text()).trim();
+      for (const client of await self.clients.matchAll()) client.postMessage({created});
+    }
+  }
+}
+
+// store runs fn on the queue's object store and resolves with the result
+// of the request it returns.
+function store(mode, fn) {
+  return new Promise((resolve, reject) => {
+    const open = indexedDB.open('pb', 1);
+    open.onupgradeneeded = () => open.result.createObjectStore(QUEUE, {autoIncrement: true});
+    open.onerror = () => reject(open.error);
+    open.onsuccess = () => {
+      const tx = open.result.transaction(QUEUE, mode);
+      const req = fn(tx.objectStore(QUEUE));
+      tx.oncomplete = () => resolve(req.result);
+      tx.onerror = () => reject(tx.error);
+    };
+  });
+}
+
+function text(body, status) {
+  return new Response(body, {status, headers: {'Content-Type': 'text/plain; charset=utf-8'}});
+}
+`
+
+// registerScript registers the service worker from a page, and tells the
+// reader when a paste they queued offline has been created.
+var registerScript = script("register.js")
+
+// serveServiceWorker serves the offline viewer's service worker.
+func serveServiceWorker(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	// Browsers check for a new worker on every visit; make them look.
+	w.Header().Set("Cache-Control", "no-cache")
+	io.WriteString(w, serviceWorker)
+}
@@ -0,0 +1,337 @@
+// Package httpapi implements the OpenAPI description of the HTTP API,
+// served at /openapi.json, and a Swagger UI page for it at /api/docs. The
+// operations are listed in apiOperations next to the handlers' own names
+// for their parameters, and the schemas of their JSON responses are
+// generated from the very types the handlers encode, so a field added to a
+// response shows up in the document without anyone remembering to.
+package httpapi
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// apiAuth is whether an operation takes credentials.
+type apiAuth int
+
+const (
+	authNone apiAuth = iota
+	// authOptional operations act for the user if credentials are sent.
+	authOptional
+	authRequired
+)
+
+// apiParam is a query or header parameter of an operation. Path
+// parameters are taken from the operation's path.
+type apiParam struct {
+	name, in, description string
+}
+
+func queryParam(name, description string) apiParam  { return apiParam{name, "query", description} }
+func headerParam(name, description string) apiParam { return apiParam{name, "header", description} }
+
+// apiOperation is one operation of the HTTP API.
+type apiOperation struct {
+	method, path, summary string
+	auth                  apiAuth
+	params                []apiParam
+	// body lists the media types the request body may have, if any.
+	body []string
+	// result is a value of the type the operation answers with as JSON;
+	// nil means it answers with text.
+	result any
+}
+
+// createParams are the fields a create takes, in the query string of a
+// raw body or alongside the paste in a form or JSON object.
+var createParams = []apiParam{
+	queryParam("lang", "language to highlight the paste as by default, e.g. python"),
+	queryParam("ext", "the language as a file extension; lang wins if both are given"),
+	queryParam("ttl", "expire the paste after this long, e.g. 1h or 7d"),
+	queryParam("read", "expire the paste after this many reads"),
+	queryParam("private", "1 to keep the paste out of listings"),
+	queryParam("encrypted", "1 if the client encrypted the paste"),
+	queryParam("view_pass", "password needed to read the paste"),
+	queryParam("id", "ID to create the paste under, for tiers with custom aliases"),
+	queryParam("slug", "name of the paste within the owner's namespace, as /~owner/slug"),
+	queryParam("draft", "1 to create the paste unpublished"),
+	queryParam("u", "1 to create a shortlink to the URL sent"),
+	queryParam("search", "1 to let anyone find the paste through /search"),
+	queryParam("noindex", "1 to ask search engines not to index the paste"),
+	queryParam("nounfurl", "1 to keep the paste out of link previews"),
+	queryParam("dns", "1 to serve the paste over the DNS responder"),
+	queryParam("unpack", "1 to create a paste per file of a zip, tar or tar.gz sent, answering with an index of them"),
+	headerParam("X-PoW-Challenge", "a proof-of-work challenge, when the server asks for one"),
+	headerParam("X-PoW-Nonce", "the nonce solving X-PoW-Challenge"),
+}
+
+// createBodies are the ways a create can carry its paste; see readPaste.
+var createBodies = []string{"text/plain", "multipart/form-data", "application/x-www-form-urlencoded", "application/json"}
+
+// apiOperations is the HTTP API as the OpenAPI document describes it.
+var apiOperations = []apiOperation{
+	{method: "post", path: "/", summary: "Create a paste; answers with its URL", auth: authOptional, params: createParams, body: createBodies},
+	{method: "get", path: "/{id}", summary: "Read a paste: HTML for browsers, text otherwise",
+		params: []apiParam{
+			headerParam("X-Paste-Password", "the paste's view password, if it has one"),
+			queryParam("theme", "highlighting theme of HTML views, remembered in a cookie; auto forgets it"),
+			queryParam("scope", "paste to remember the theme for this paste only"),
+		}},
+	{method: "put", path: "/{id}", summary: "Update a paste", auth: authOptional, body: createBodies,
+		params: []apiParam{headerParam("X-Paste-Token", "the edit token handed out when the paste was created")}},
+	{method: "delete", path: "/{id}", summary: "Delete a paste", auth: authOptional,
+		params: []apiParam{headerParam("X-Paste-Token", "the edit token handed out when the paste was created")}},
+	{method: "get", path: "/{id}/edit", summary: "Edit a paste's content in the browser, saving with PUT /{id}", auth: authOptional,
+		params: []apiParam{queryParam("editor", "plain for a form without CodeMirror, posting back to this path")}},
+	{method: "get", path: "/{id}/ws", summary: "Edit a paste together with others over a WebSocket, saved as it goes", auth: authOptional,
+		params: []apiParam{headerParam("X-Paste-Token", "the edit token handed out when the paste was created")}},
+	{method: "post", path: "/{id}/unlock", summary: "Give a paste's view password from the browser form, kept in a cookie for the paste",
+		body: []string{"application/x-www-form-urlencoded"}},
+	{method: "get", path: "/{id}/raw", summary: "Read a paste as it was stored"},
+	{method: "get", path: "/{id}/meta", summary: "Describe a paste", result: metaResponse{}},
+	{method: "get", path: "/{id}/history", summary: "List a paste's versions", result: []versionResponse{}},
+	{method: "get", path: "/{id}/v/{n}", summary: "Read version n of a paste"},
+	{method: "get", path: "/{id}/comments", summary: "List a paste's line comments", result: []commentResponse{}},
+	{method: "post", path: "/{id}/comments", summary: "Comment on a line of a paste", auth: authRequired,
+		body: []string{"application/x-www-form-urlencoded"}},
+	{method: "post", path: "/{id}/publish", summary: "Publish a draft", auth: authOptional},
+	{method: "get", path: "/compare", summary: "Compare two pastes as a unified diff",
+		params: []apiParam{queryParam("a", "ID of the old paste"), queryParam("b", "ID of the new paste")}},
+	{method: "get", path: "/search", summary: "Find pastes holding all of the words", auth: authOptional,
+		params: []apiParam{queryParam("q", "the words to look for")}, result: []searchResult{}},
+	{method: "get", path: "/user/{name}", summary: "List a user's pastes, with their profile stats",
+		params: []apiParam{queryParam("page", "page to list, from 1")}, result: listing{}},
+	{method: "get", path: "/user/{name}/export", summary: "Download all of a user's pastes as files (the user or admins)", auth: authRequired,
+		params: []apiParam{queryParam("format", "zip (the default) or tar for a tar.gz")}},
+	{method: "post", path: "/register", summary: "Create an account", body: []string{"application/x-www-form-urlencoded"}},
+	{method: "post", path: "/token", summary: "Issue an API token for the Bearer scheme", auth: authRequired},
+	{method: "get", path: "/api/v1/info", summary: "Count public pastes and accounts", result: infoResponse{}},
+	{method: "get", path: "/api/v1/languages", summary: "Count public pastes per language, or list the languages pages highlight",
+		params: []apiParam{queryParam("supported", "1 to list the highlighted languages and their aliases instead")}, result: map[string]int{}},
+	{method: "get", path: "/api/v1/themes", summary: "List the highlighting themes HTML views take with ?theme=", result: []highlightTheme{}},
+	{method: "get", path: "/api/v1/languages/{lang}", summary: "List the newest public pastes in a language", result: []listingEntry{}},
+	{method: "get", path: "/api/v1/changes", summary: "Page through created, updated and deleted public pastes",
+		params: []apiParam{queryParam("since", "cursor from the previous page's next")}, result: changesResponse{}},
+	{method: "get", path: "/api/v1/pow", summary: "Tell whether anonymous creates need proof of work", result: powResponse{}},
+	{method: "get", path: "/version", summary: "Report the running build and, with -update-check, the latest release", result: buildResponse{}},
+	{method: "delete", path: "/api/v1/me", summary: "Delete your account; your pastes are disposed of as the instance decides", auth: authRequired},
+	{method: "get", path: "/api/v1/me/usage", summary: "Report your usage for a month", auth: authRequired,
+		params: []apiParam{queryParam("month", "the month as YYYY-MM, by default the current one")}, result: UsageReport{}},
+	{method: "get", path: "/api/v1/me/export.ndjson", summary: "Export all your pastes, one JSON object per line", auth: authRequired},
+	{method: "get", path: "/admin/pastes", summary: "List every paste (moderators)", auth: authRequired,
+		params: []apiParam{queryParam("page", "page to list, from 1")}, result: adminListing{}},
+	{method: "get", path: "/admin/pastes/{id}", summary: "Describe any paste (moderators)", auth: authRequired, result: adminPasteEntry{}},
+	{method: "delete", path: "/admin/pastes/{id}", summary: "Delete any paste (moderators)", auth: authRequired},
+	{method: "delete", path: "/admin/users/{name}", summary: "Delete an account (admins)", auth: authRequired},
+	{method: "get", path: "/admin/stats", summary: "Report instance stats (admins)", auth: authRequired, result: statsResponse{}},
+}
+
+// schemaBuilder generates JSON schemas from Go types, collecting named
+// struct types as components.
+type schemaBuilder struct {
+	components map[string]any
+}
+
+// schemaName is the component name of a named struct type: metaResponse
+// is Meta, listingEntry ListingEntry.
+func schemaName(t reflect.Type) string {
+	name := strings.TrimSuffix(t.Name(), "Response")
+	first, size := utf8.DecodeRuneInString(name)
+	return string(unicode.ToUpper(first)) + name[size:]
+}
+
+// schema returns the schema of values of t as encoding/json writes them.
+func (b *schemaBuilder) schema(t reflect.Type) map[string]any {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return b.schema(t.Elem())
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		name := schemaName(t)
+		if _, ok := b.components[name]; !ok {
+			b.components[name] = nil // in progress, for types that refer to themselves
+			b.components[name] = b.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]any{}
+}
+
+// object returns the schema of struct type t. Fields without omitempty
+// are required, unless they are pointers, which encode as null.
+func (b *schemaBuilder) object(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	required := []string{}
+	b.addFields(t, properties, &required)
+	object := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		object["required"] = required
+	}
+	return object
+}
+
+// addFields adds the fields of struct type t, including those promoted
+// from embedded structs, to properties.
+func (b *schemaBuilder) addFields(t reflect.Type, properties map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			b.addFields(f.Type, properties, required)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = b.schema(f.Type)
+		if !strings.Contains(options, "omitempty") && f.Type.Kind() != reflect.Pointer {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// openAPIDocument describes the API as served at base, e.g.
+// https://pb.example.
+func openAPIDocument(base string) map[string]any {
+	b := &schemaBuilder{components: map[string]any{}}
+	paths := map[string]map[string]any{}
+	for _, op := range apiOperations {
+		var params []any
+		for _, segment := range strings.Split(op.path, "/") {
+			if strings.HasPrefix(segment, "{") {
+				params = append(params, map[string]any{
+					"name": strings.Trim(segment, "{}"), "in": "path", "required": true,
+					"schema": map[string]any{"type": "string"},
+				})
+			}
+		}
+		for _, p := range op.params {
+			params = append(params, map[string]any{
+				"name": p.name, "in": p.in, "description": p.description,
+				"schema": map[string]any{"type": "string"},
+			})
+		}
+
+		content := map[string]any{"text/plain": map[string]any{"schema": map[string]any{"type": "string"}}}
+		if op.result != nil {
+			content = map[string]any{"application/json": map[string]any{"schema": b.schema(reflect.TypeOf(op.result))}}
+		}
+		operation := map[string]any{
+			"summary":   op.summary,
+			"responses": map[string]any{"200": map[string]any{"description": "OK", "content": content}},
+		}
+		if params != nil {
+			operation["parameters"] = params
+		}
+		if op.body != nil {
+			bodies := map[string]any{}
+			for _, mediaType := range op.body {
+				bodies[mediaType] = map[string]any{}
+			}
+			operation["requestBody"] = map[string]any{"content": bodies}
+		}
+		switch op.auth {
+		case authOptional:
+			operation["security"] = []any{map[string]any{}, map[string]any{"basic": []string{}}, map[string]any{"bearer": []string{}}}
+		case authRequired:
+			operation["security"] = []any{map[string]any{"basic": []string{}}, map[string]any{"bearer": []string{}}}
+		}
+
+		if paths[op.path] == nil {
+			paths[op.path] = map[string]any{}
+		}
+		paths[op.path][op.method] = operation
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "pb",
+			"description": "A personal paste bin in the style of ix.io.",
+			"version":     "1",
+		},
+		"servers": []any{map[string]any{"url": base}},
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas": b.components,
+			"securitySchemes": map[string]any{
+				"basic":  map[string]any{"type": "http", "scheme": "basic"},
+				"bearer": map[string]any{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+// serveOpenAPI serves the OpenAPI document.
+func (s *Server) serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(openAPIDocument(requestScheme(r) + "://" + r.Host))
+}
+
+// apiDocsPage loads Swagger UI and points it at the document, relative to
+// /api/docs so that it still works when the server is mounted under a
+// prefix.
+const apiDocsPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>pb API</title>
+<link rel="stylesheet" href="https://cdn.jsdelivr.net/npm/swagger-ui-dist@5.17.14/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://cdn.jsdelivr.net/npm/swagger-ui-dist@5.17.14/swagger-ui-bundle.js"></script>
+<script>
+SwaggerUIBundle({url: new URL("../openapi.json", location.href).href, dom_id: "#swagger-ui"});
+</script>
+</body>
+</html>
+`
+
+// serveAPIDocs serves the Swagger UI page.
+func serveAPIDocs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, apiDocsPage)
+}
@@ -0,0 +1,223 @@
+// Package httpapi implements out-of-process plugins. Each plugin is an executable
+// started at boot that serves JSON-RPC (net/rpc/jsonrpc) on its stdin and
+// stdout under the service name "Plugin". It reports which hooks it handles
+// from Plugin.Hooks and may then receive:
+//
+//   - Plugin.Validate before a snippet is created; a non-empty Error rejects it
+//   - Plugin.Created after a snippet is created
+//   - Plugin.Render for each renderer class it registered
+package httpapi
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/exec"
+	"time"
+)
+
+const pluginCallTimeout = 5 * time.Second
+
+type pluginHooksReply struct {
+	Validate bool
+	Created  bool
+	// Renderers maps a renderer class to the media type it produces.
+	Renderers map[string]string
+}
+
+type pluginValidateArgs struct {
+	Content string
+	Owner   string
+}
+
+type pluginValidateReply struct {
+	Error string
+}
+
+type pluginCreatedArgs struct {
+	ID    string
+	URL   string
+	Owner string
+}
+
+type pluginRenderArgs struct {
+	Class   string
+	ID      string
+	Content string
+	Lang    string
+}
+
+type pluginRenderReply struct {
+	Body string
+}
+
+type plugin struct {
+	path   string
+	cmd    *exec.Cmd
+	client *rpc.Client
+	hooks  pluginHooksReply
+}
+
+// Plugins is the set of running plugin processes. A nil *Plugins has no
+// plugins.
+type Plugins struct {
+	plugins []*plugin
+}
+
+// stdioConn joins a child's stdout and stdin into one connection.
+type stdioConn struct {
+	io.ReadCloser
+	io.WriteCloser
+}
+
+func (c stdioConn) Close() error {
+	return errors.Join(c.WriteCloser.Close(), c.ReadCloser.Close())
+}
+
+func startPlugin(path string) (*plugin, error) {
+	cmd := exec.Command(path)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	p := &plugin{
+		path:   path,
+		cmd:    cmd,
+		client: jsonrpc.NewClient(stdioConn{stdout, stdin}),
+	}
+	if err := p.call("Plugin.Hooks", struct{}{}, &p.hooks); err != nil {
+		p.stop()
+		return nil, fmt.Errorf("plugin %s: handshake failed: %w", path, err)
+	}
+	return p, nil
+}
+
+func (p *plugin) call(method string, args, reply any) error {
+	c := p.client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-c.Done:
+		return c.Error
+	case <-time.After(pluginCallTimeout):
+		return fmt.Errorf("%s timed out after %s", method, pluginCallTimeout)
+	}
+}
+
+func (p *plugin) stop() {
+	p.client.Close()
+	p.cmd.Process.Kill()
+	p.cmd.Wait()
+}
+
+// StartPlugins launches every plugin and registers its renderers. Callers
+// must Stop the returned Plugins when done.
+func StartPlugins(paths []string) (*Plugins, error) {
+	host := &Plugins{}
+	for _, path := range paths {
+		p, err := startPlugin(path)
+		if err != nil {
+			host.Stop()
+			return nil, err
+		}
+		for class, mediaType := range p.hooks.Renderers {
+			registerRenderer(class, pluginRenderer{p: p, class: class, media: mediaType})
+		}
+		host.plugins = append(host.plugins, p)
+		slog.Info("Loaded plugin", "path", path)
+	}
+	return host, nil
+}
+
+// validates reports whether any plugin has a validate hook, and so needs
+// to see new snippets before they are stored.
+func (h *Plugins) validates() bool {
+	if h == nil {
+		return false
+	}
+	for _, p := range h.plugins {
+		if p.hooks.Validate {
+			return true
+		}
+	}
+	return false
+}
+
+// validate asks each plugin with a validate hook whether content may be
+// stored. A plugin that fails to answer does not block the snippet.
+func (h *Plugins) validate(content, owner string) error {
+	if h == nil {
+		return nil
+	}
+	for _, p := range h.plugins {
+		if !p.hooks.Validate {
+			continue
+		}
+		var reply pluginValidateReply
+		if err := p.call("Plugin.Validate", pluginValidateArgs{Content: content, Owner: owner}, &reply); err != nil {
+			slog.Error("Plugin failed", "path", p.path, "method", "validate", "err", err)
+			continue
+		}
+		if reply.Error != "" {
+			return errors.New(reply.Error)
+		}
+	}
+	return nil
+}
+
+// notifyCreated is an event bus subscriber for create events.
+func (h *Plugins) notifyCreated(e event) {
+	if h == nil {
+		return
+	}
+	for _, p := range h.plugins {
+		if !p.hooks.Created {
+			continue
+		}
+		go func(p *plugin) {
+			args := pluginCreatedArgs{ID: e.id, URL: e.url, Owner: e.user}
+			if err := p.call("Plugin.Created", args, &struct{}{}); err != nil {
+				slog.Error("Plugin failed", "path", p.path, "method", "created", "err", err)
+			}
+		}(p)
+	}
+}
+
+// Stop kills the plugin processes.
+func (h *Plugins) Stop() {
+	if h == nil {
+		return
+	}
+	for _, p := range h.plugins {
+		p.stop()
+	}
+}
+
+type pluginRenderer struct {
+	p     *plugin
+	class string
+	media string
+}
+
+func (pr pluginRenderer) mediaType(view) string { return pr.media }
+
+func (pr pluginRenderer) render(w io.Writer, v view) error {
+	var reply pluginRenderReply
+	args := pluginRenderArgs{Class: pr.class, ID: v.id, Content: v.content, Lang: v.lang}
+	if err := pr.p.call("Plugin.Render", args, &reply); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, reply.Body)
+	return err
+}
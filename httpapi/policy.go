@@ -0,0 +1,584 @@
+// Package httpapi implements operator policies written in a small expression
+// language. A policy file holds one rule per line:
+//
+//	<phase> <action> ["message"] <expression>
+//
+// The create phase supports the reject and private actions and sees the
+// variables user, anonymous, size, content and private. The read phase
+// supports deny and sees user, anonymous, owner, private, size, reads and id.
+// Expressions combine literals (integers, "strings", `raw strings`, true,
+// false) and variables with ! && || == != < <= > >= contains and matches,
+// whose right-hand side must be a literal regular expression. Rules are
+// compiled once at startup, where a variable the phase doesn't have is an
+// error, and evaluated in order on each request. The decisions of a phase
+// are cached by the variables its rules use, content by its hash, so
+// rereading a paste or uploading the same one again doesn't run the regular
+// expressions anew.
+package httpapi
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// policyCacheSize bounds the decisions cached; the cache starts over when
+// it fills up.
+const policyCacheSize = 4096
+
+type policyRule struct {
+	line    int
+	phase   string
+	action  string
+	message string
+	expr    policyExpr
+	// uses are the variables expr reads.
+	uses map[string]bool
+}
+
+// Policies is a compiled policy file. A nil *Policies allows everything.
+type Policies struct {
+	rules []policyRule
+	// uses are the variables the rules of each phase read, which the
+	// decisions are cached by.
+	uses map[string]map[string]bool
+
+	mu    sync.Mutex
+	cache map[string][]decision
+}
+
+var policyActions = map[string]map[string]bool{
+	"create": {"reject": true, "private": true},
+	"read":   {"deny": true},
+}
+
+// policyVariables are the variables each phase sees.
+var policyVariables = map[string]map[string]bool{
+	"create": {"user": true, "anonymous": true, "size": true, "content": true, "private": true},
+	"read":   {"user": true, "anonymous": true, "owner": true, "private": true, "size": true, "reads": true, "id": true},
+}
+
+// has reports whether any rule applies to phase.
+func (ps *Policies) has(phase string) bool {
+	if ps == nil {
+		return false
+	}
+	for _, rule := range ps.rules {
+		if rule.phase == phase {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadPolicies compiles the rules in fileName. An empty name yields a set
+// with no rules.
+func LoadPolicies(fileName string) (*Policies, error) {
+	ps := &Policies{uses: make(map[string]map[string]bool), cache: make(map[string][]decision)}
+	if fileName == "" {
+		return ps, nil
+	}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parsePolicyRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", fileName, n, err)
+		}
+		rule.line = n
+		ps.rules = append(ps.rules, rule)
+		if ps.uses[rule.phase] == nil {
+			ps.uses[rule.phase] = make(map[string]bool)
+		}
+		for name := range rule.uses {
+			ps.uses[rule.phase][name] = true
+		}
+	}
+	return ps, scanner.Err()
+}
+
+func parsePolicyRule(line string) (policyRule, error) {
+	toks, err := tokenizePolicy(line)
+	if err != nil {
+		return policyRule{}, err
+	}
+	if len(toks) < 3 || toks[0].kind != tokIdent || toks[1].kind != tokIdent {
+		return policyRule{}, fmt.Errorf("expected <phase> <action> <expression>")
+	}
+
+	rule := policyRule{phase: toks[0].text, action: toks[1].text}
+	actions, ok := policyActions[rule.phase]
+	if !ok {
+		return policyRule{}, fmt.Errorf("unknown phase %q", rule.phase)
+	}
+	if !actions[rule.action] {
+		return policyRule{}, fmt.Errorf("unknown action %q for phase %s", rule.action, rule.phase)
+	}
+	toks = toks[2:]
+	if toks[0].kind == tokString {
+		rule.message = toks[0].text
+		toks = toks[1:]
+	}
+
+	p := &policyParser{toks: toks, phase: rule.phase, uses: make(map[string]bool)}
+	rule.expr, err = p.parseOr()
+	if err != nil {
+		return policyRule{}, err
+	}
+	if p.pos != len(p.toks) {
+		return policyRule{}, fmt.Errorf("unexpected %q", p.toks[p.pos].text)
+	}
+	rule.uses = p.uses
+	return rule, nil
+}
+
+// decision is the outcome of evaluating a phase.
+type decision struct {
+	action  string
+	message string
+}
+
+// evaluate runs the rules of a phase against vars, or returns the decisions
+// cached for them. Rules that reject or deny stop evaluation; other actions
+// accumulate. Rules that fail to evaluate are reported as errors so a broken
+// policy fails closed.
+func (ps *Policies) evaluate(phase string, vars map[string]any) ([]decision, error) {
+	if ps == nil || !ps.has(phase) {
+		return nil, nil
+	}
+	key := policyCacheKey(phase, ps.uses[phase], vars)
+	ps.mu.Lock()
+	decisions, ok := ps.cache[key]
+	ps.mu.Unlock()
+	if ok {
+		return decisions, nil
+	}
+	decisions, err := ps.run(phase, vars)
+	if err != nil {
+		return nil, err
+	}
+	ps.mu.Lock()
+	if len(ps.cache) >= policyCacheSize {
+		clear(ps.cache)
+	}
+	ps.cache[key] = decisions
+	ps.mu.Unlock()
+	return decisions, nil
+}
+
+// policyCacheKey identifies the variables of phase its rules use in the
+// cache, with content standing in by its hash.
+func policyCacheKey(phase string, uses map[string]bool, vars map[string]any) string {
+	names := make([]string, 0, len(uses))
+	for name := range uses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var key strings.Builder
+	key.WriteString(phase)
+	for _, name := range names {
+		v := vars[name]
+		if content, ok := v.(string); ok && name == "content" {
+			sum := sha256.Sum256([]byte(content))
+			v = hex.EncodeToString(sum[:])
+		}
+		fmt.Fprintf(&key, "\x00%s=%#v", name, v)
+	}
+	return key.String()
+}
+
+// run evaluates the rules of a phase against vars.
+func (ps *Policies) run(phase string, vars map[string]any) ([]decision, error) {
+	var decisions []decision
+	for _, rule := range ps.rules {
+		if rule.phase != phase {
+			continue
+		}
+		v, err := rule.expr.eval(vars)
+		if err != nil {
+			return nil, fmt.Errorf("policy line %d: %w", rule.line, err)
+		}
+		if matched, ok := v.(bool); !ok {
+			return nil, fmt.Errorf("policy line %d: expression is not boolean", rule.line)
+		} else if !matched {
+			continue
+		}
+
+		message := rule.message
+		if message == "" {
+			message = fmt.Sprintf("%s by policy", rule.action)
+		}
+		decisions = append(decisions, decision{action: rule.action, message: message})
+		if rule.action == "reject" || rule.action == "deny" {
+			break
+		}
+	}
+	return decisions, nil
+}
+
+type tokenKind int
+
+const (
+	tokIdent tokenKind = iota
+	tokInt
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func tokenizePolicy(s string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '"' || c == '`':
+			end := i + 1
+			for end < len(s) && s[end] != c {
+				if c == '"' && s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			text, err := strconv.Unquote(s[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("bad string %s: %w", s[i:end+1], err)
+			}
+			toks = append(toks, token{tokString, text})
+			i = end + 1
+		case c >= '0' && c <= '9':
+			end := i
+			for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+				end++
+			}
+			toks = append(toks, token{tokInt, s[i:end]})
+			i = end
+		case unicode.IsLetter(rune(c)) || c == '_':
+			end := i
+			for end < len(s) && (unicode.IsLetter(rune(s[end])) || unicode.IsDigit(rune(s[end])) || s[end] == '_') {
+				end++
+			}
+			toks = append(toks, token{tokIdent, s[i:end]})
+			i = end
+		default:
+			op := ""
+			for _, candidate := range []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")"} {
+				if strings.HasPrefix(s[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected character %q", c)
+			}
+			toks = append(toks, token{tokOp, op})
+			i += len(op)
+		}
+	}
+	return toks, nil
+}
+
+var comparisonOps = map[string]bool{
+	"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true,
+}
+
+type policyExpr interface {
+	eval(vars map[string]any) (any, error)
+}
+
+type policyParser struct {
+	toks []token
+	pos  int
+	// phase is the phase of the rule, whose variables it may use, and
+	// uses collects the ones it does.
+	phase string
+	uses  map[string]bool
+}
+
+func (p *policyParser) peek() (token, bool) {
+	if p.pos >= len(p.toks) {
+		return token{}, false
+	}
+	return p.toks[p.pos], true
+}
+
+func (p *policyParser) accept(kind tokenKind, text string) bool {
+	if t, ok := p.peek(); ok && t.kind == kind && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *policyParser) parseOr() (policyExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(tokOp, "||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalExpr{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *policyParser) parseAnd() (policyExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(tokOp, "&&") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalExpr{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *policyParser) parseUnary() (policyExpr, error) {
+	if p.accept(tokOp, "!") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *policyParser) parseComparison() (policyExpr, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	t, ok := p.peek()
+	if !ok {
+		return left, nil
+	}
+	switch {
+	case t.kind == tokIdent && t.text == "matches":
+		p.pos++
+		pattern, ok := p.peek()
+		if !ok || pattern.kind != tokString {
+			return nil, fmt.Errorf("matches needs a string literal pattern")
+		}
+		p.pos++
+		re, err := regexp.Compile(pattern.text)
+		if err != nil {
+			return nil, err
+		}
+		return matchExpr{left: left, re: re}, nil
+	case t.kind == tokIdent && t.text == "contains",
+		t.kind == tokOp && comparisonOps[t.text]:
+		p.pos++
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		return compareExpr{op: t.text, left: left, right: right}, nil
+	}
+	return left, nil
+}
+
+func (p *policyParser) parsePrimary() (policyExpr, error) {
+	t, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	p.pos++
+	switch t.kind {
+	case tokInt:
+		n, err := strconv.ParseInt(t.text, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return literalExpr{n}, nil
+	case tokString:
+		return literalExpr{t.text}, nil
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return literalExpr{true}, nil
+		case "false":
+			return literalExpr{false}, nil
+		}
+		if !policyVariables[p.phase][t.text] {
+			return nil, fmt.Errorf("unknown variable %s for phase %s", t.text, p.phase)
+		}
+		p.uses[t.text] = true
+		return varExpr(t.text), nil
+	case tokOp:
+		if t.text == "(" {
+			e, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if !p.accept(tokOp, ")") {
+				return nil, fmt.Errorf("missing )")
+			}
+			return e, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q", t.text)
+}
+
+type literalExpr struct{ v any }
+
+func (e literalExpr) eval(map[string]any) (any, error) { return e.v, nil }
+
+type varExpr string
+
+func (e varExpr) eval(vars map[string]any) (any, error) {
+	v, ok := vars[string(e)]
+	if !ok {
+		return nil, fmt.Errorf("unknown variable %s", string(e))
+	}
+	return v, nil
+}
+
+type notExpr struct{ operand policyExpr }
+
+func (e notExpr) eval(vars map[string]any) (any, error) {
+	v, err := evalBool(e.operand, vars)
+	return !v, err
+}
+
+type logicalExpr struct {
+	op          string
+	left, right policyExpr
+}
+
+func (e logicalExpr) eval(vars map[string]any) (any, error) {
+	left, err := evalBool(e.left, vars)
+	if err != nil {
+		return nil, err
+	}
+	if (e.op == "&&" && !left) || (e.op == "||" && left) {
+		return left, nil
+	}
+	return evalBool(e.right, vars)
+}
+
+func evalBool(e policyExpr, vars map[string]any) (bool, error) {
+	v, err := e.eval(vars)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expected boolean, got %v", v)
+	}
+	return b, nil
+}
+
+type matchExpr struct {
+	left policyExpr
+	re   *regexp.Regexp
+}
+
+func (e matchExpr) eval(vars map[string]any) (any, error) {
+	v, err := e.left.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("matches needs a string, got %v", v)
+	}
+	return e.re.MatchString(s), nil
+}
+
+type compareExpr struct {
+	op          string
+	left, right policyExpr
+}
+
+func (e compareExpr) eval(vars map[string]any) (any, error) {
+	left, err := e.left.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	right, err := e.right.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	switch l := left.(type) {
+	case int64:
+		r, ok := right.(int64)
+		if !ok {
+			break
+		}
+		switch e.op {
+		case "==":
+			return l == r, nil
+		case "!=":
+			return l != r, nil
+		case "<":
+			return l < r, nil
+		case "<=":
+			return l <= r, nil
+		case ">":
+			return l > r, nil
+		case ">=":
+			return l >= r, nil
+		}
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			break
+		}
+		switch e.op {
+		case "==":
+			return l == r, nil
+		case "!=":
+			return l != r, nil
+		case "contains":
+			return strings.Contains(l, r), nil
+		}
+	case bool:
+		r, ok := right.(bool)
+		if !ok {
+			break
+		}
+		switch e.op {
+		case "==":
+			return l == r, nil
+		case "!=":
+			return l != r, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot apply %s to %v and %v", e.op, left, right)
+}
@@ -0,0 +1,223 @@
+// Package httpapi implements proof-of-work challenges for anonymous
+// creates. When the rate limiter refuses many requests in a short time the
+// server is taken to be under attack, and for a while every create without
+// credentials must come with a solved challenge: the 428 response carries
+// X-PoW-Challenge and X-PoW-Difficulty, and the client retries with the
+// challenge and an X-PoW-Nonce such that the SHA-256 of the challenge
+// followed by the nonce starts with that many zero bits. Users who
+// authenticate are never challenged, so scripts with credentials carry on
+// as before.
+package httpapi
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"pb/internal/clock"
+)
+
+const (
+	// powTriggerRefusals rate limited requests within powTriggerWindow
+	// turn challenges on, for powCooldown after the last such window.
+	powTriggerRefusals = 20
+	powTriggerWindow   = time.Minute
+	powCooldown        = 10 * time.Minute
+	// powChallengeTTL is how long a challenge may be solved for.
+	powChallengeTTL = 5 * time.Minute
+)
+
+// Errors returned by ProofOfWork.check.
+var (
+	errPoWInvalid  = errors.New("invalid or expired challenge")
+	errPoWUsed     = errors.New("challenge already used")
+	errPoWUnsolved = errors.New("nonce does not solve the challenge")
+)
+
+// ProofOfWork issues and checks challenges, and decides when they are
+// required. A nil ProofOfWork never requires one. It is safe for
+// concurrent use.
+type ProofOfWork struct {
+	difficulty int
+	secret     []byte
+	// clock runs in real time even when the server's clock is stopped,
+	// or challenges would never expire.
+	clock clock.Clock
+
+	mu          sync.Mutex
+	windowStart time.Time
+	refusals    int
+	activeUntil time.Time
+	active      bool
+	// used holds solved challenges until they expire, so each is good
+	// for one create.
+	used map[string]time.Time
+}
+
+// NewProofOfWork returns a ProofOfWork whose challenges take difficulty
+// leading zero bits to solve, each bit doubling the work.
+func NewProofOfWork(difficulty int) *ProofOfWork {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return &ProofOfWork{difficulty: difficulty, secret: secret, clock: clock.System, used: make(map[string]time.Time)}
+}
+
+// noteRefusal counts a rate limited request, turning challenges on once
+// there are enough of them.
+func (p *ProofOfWork) noteRefusal() {
+	if p == nil {
+		return
+	}
+	now := p.clock.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if now.Sub(p.windowStart) >= powTriggerWindow {
+		p.windowStart, p.refusals = now, 0
+	}
+	p.refusals++
+	if p.refusals < powTriggerRefusals {
+		return
+	}
+	p.activeUntil = now.Add(powCooldown)
+	if !p.active {
+		p.active = true
+		slog.Warn("Requiring proof of work for anonymous creates", "refusals", p.refusals, "difficulty", p.difficulty)
+	}
+}
+
+// required reports whether anonymous creates need a solved challenge.
+func (p *ProofOfWork) required() bool {
+	if p == nil {
+		return false
+	}
+	now := p.clock.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.active && !now.Before(p.activeUntil) {
+		p.active = false
+		slog.Info("No longer requiring proof of work")
+	}
+	return p.active
+}
+
+// mac signs a challenge's fields.
+func (p *ProofOfWork) mac(fields string) string {
+	m := hmac.New(sha256.New, p.secret)
+	m.Write([]byte(fields))
+	return hex.EncodeToString(m.Sum(nil)[:16])
+}
+
+// challenge returns a new challenge, "difficulty.expiry.random.mac".
+func (p *ProofOfWork) challenge() string {
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	fields := fmt.Sprintf("%d.%d.%s", p.difficulty, p.clock.Now().Add(powChallengeTTL).Unix(), hex.EncodeToString(nonce))
+	return fields + "." + p.mac(fields)
+}
+
+// check verifies that nonce solves challenge, and uses the challenge up.
+func (p *ProofOfWork) check(challenge, nonce string) error {
+	i := strings.LastIndexByte(challenge, '.')
+	if i < 0 || !hmac.Equal([]byte(challenge[i+1:]), []byte(p.mac(challenge[:i]))) {
+		return errPoWInvalid
+	}
+	parts := strings.Split(challenge[:i], ".")
+	if len(parts) != 3 {
+		return errPoWInvalid
+	}
+	difficulty, err1 := strconv.Atoi(parts[0])
+	expiry, err2 := strconv.ParseInt(parts[1], 10, 64)
+	now := p.clock.Now()
+	if err1 != nil || err2 != nil || now.Unix() > expiry {
+		return errPoWInvalid
+	}
+	if powZeroBits(sha256.Sum256([]byte(challenge+nonce))) < difficulty {
+		return errPoWUnsolved
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for used, expires := range p.used {
+		if now.After(expires) {
+			delete(p.used, used)
+		}
+	}
+	if _, ok := p.used[challenge]; ok {
+		return errPoWUsed
+	}
+	p.used[challenge] = time.Unix(expiry, 0)
+	return nil
+}
+
+// powZeroBits counts the leading zero bits of sum.
+func powZeroBits(sum [sha256.Size]byte) int {
+	n := 0
+	for _, b := range sum {
+		n += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return n
+}
+
+// checkProofOfWork answers an anonymous create with 428 and a challenge
+// if one is required and r doesn't carry its solution, reporting whether
+// the create may go ahead.
+func (s *Server) checkProofOfWork(w http.ResponseWriter, r *http.Request) bool {
+	if !s.pow.required() {
+		return true
+	}
+	challenge := r.Header.Get("X-PoW-Challenge")
+	err := errPoWInvalid
+	if challenge != "" {
+		if err = s.pow.check(challenge, r.Header.Get("X-PoW-Nonce")); err == nil {
+			return true
+		}
+	}
+	w.Header().Set("X-PoW-Challenge", s.pow.challenge())
+	w.Header().Set("X-PoW-Difficulty", strconv.Itoa(s.pow.difficulty))
+	msg := "The server is under heavy load: authenticate, or solve the X-PoW-Challenge and retry with it and X-PoW-Nonce"
+	if challenge != "" {
+		msg += " (" + err.Error() + ")"
+	}
+	http.Error(w, msg, http.StatusPreconditionRequired)
+	return false
+}
+
+// powResponse is what /api/v1/pow answers.
+type powResponse struct {
+	Required   bool   `json:"required"`
+	Challenge  string `json:"challenge,omitempty"`
+	Difficulty int    `json:"difficulty,omitempty"`
+}
+
+// serveProofOfWork tells clients at /api/v1/pow whether anonymous creates
+// need a solved challenge right now and, if so, hands one out, so that a
+// large paste needn't be uploaded twice.
+func (s *Server) serveProofOfWork(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	resp := powResponse{Required: s.pow.required()}
+	if resp.Required {
+		resp.Challenge, resp.Difficulty = s.pow.challenge(), s.pow.difficulty
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,81 @@
+// Package httpapi implements load shedding under memory pressure: while the
+// process is over its memory limit, large uploads and rendered views are
+// refused with 503 so a small VPS sheds load instead of being OOM-killed.
+package httpapi
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// pressureMaxPasteSize is the largest paste accepted under memory pressure.
+const pressureMaxPasteSize = 64 << 10
+
+// memoryMonitor tracks whether the process is over its memory limit. A nil
+// *memoryMonitor never is.
+type memoryMonitor struct {
+	limit    int64
+	pressure atomic.Bool
+}
+
+func newMemoryMonitor(limit int64) *memoryMonitor {
+	if limit <= 0 {
+		return nil
+	}
+	return &memoryMonitor{limit: limit}
+}
+
+func (m *memoryMonitor) pressured() bool {
+	return m != nil && m.pressure.Load()
+}
+
+// MonitorMemory samples the process's memory use every interval until ctx
+// is done, shedding load while it is over Options.MemoryLimit. Pressure
+// ends once use drops below 90% of the limit, so the server doesn't flap
+// around the threshold. It returns immediately if no limit is set.
+func (s *Server) MonitorMemory(ctx context.Context, interval time.Duration) {
+	m := s.memory
+	if m == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		used := memoryInUse()
+		switch {
+		case !m.pressure.Load() && used >= m.limit:
+			m.pressure.Store(true)
+			slog.Warn("Memory use over limit, shedding load", "used", formatSize(used), "limit", formatSize(m.limit))
+		case m.pressure.Load() && used < m.limit/10*9:
+			m.pressure.Store(false)
+			slog.Info("Memory use back under limit, no longer shedding load", "used", formatSize(used))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// memoryInUse is the process's resident set size where /proc provides it,
+// and otherwise the memory the Go runtime holds for the heap and stacks.
+func memoryInUse() int64 {
+	if statm, err := os.ReadFile("/proc/self/statm"); err == nil {
+		fields := strings.Fields(string(statm))
+		if len(fields) > 1 {
+			if pages, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+				return pages * int64(os.Getpagesize())
+			}
+		}
+	}
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return int64(stats.HeapInuse + stats.StackInuse)
+}
@@ -0,0 +1,66 @@
+// Package httpapi implements the aggregates shown on a user's profile at
+// /user/{name}: how many pastes they have in each language, how often their
+// pastes have been read in all, and which was read most. They are worked
+// out from the snippets' metadata and the read counts the store keeps, over
+// the pastes the viewer could list anyway, so private pastes don't show
+// through them.
+package httpapi
+
+import (
+	"net/http"
+	"sort"
+
+	"pb/store"
+)
+
+// languageCount is how many of a user's pastes are in one language.
+type languageCount struct {
+	Lang   string `json:"lang"`
+	Pastes int    `json:"pastes"`
+}
+
+// profileStats are the aggregates on a user's profile.
+type profileStats struct {
+	Pastes int `json:"pastes"`
+	// Languages are by paste count, most first; pastes without a language
+	// are left out.
+	Languages  []languageCount `json:"languages"`
+	TotalViews int             `json:"total_views"`
+	// MostViewed is the paste read most, if any has been read.
+	MostViewed *listingEntry `json:"most_viewed,omitempty"`
+	MostViews  int           `json:"most_views,omitempty"`
+}
+
+// profileStats works out the aggregates for the snippets among ids that
+// keep accepts.
+func (s *Server) profileStats(r *http.Request, ids []string, keep func(store.Info) bool) *profileStats {
+	stats := &profileStats{Languages: []languageCount{}}
+	perLang := make(map[string]int)
+	var top store.Info
+	s.eachListed(r, ids, keep, func(info store.Info) bool {
+		stats.Pastes++
+		stats.TotalViews += info.Reads
+		if info.Lang != "" {
+			perLang[info.Lang]++
+		}
+		if info.Reads > top.Reads {
+			top = info
+		}
+		return true
+	})
+	for lang, n := range perLang {
+		stats.Languages = append(stats.Languages, languageCount{Lang: lang, Pastes: n})
+	}
+	sort.Slice(stats.Languages, func(i, j int) bool {
+		a, b := stats.Languages[i], stats.Languages[j]
+		if a.Pastes != b.Pastes {
+			return a.Pastes > b.Pastes
+		}
+		return a.Lang < b.Lang
+	})
+	if top.Reads > 0 {
+		entry := newListingEntry(r, top)
+		stats.MostViewed, stats.MostViews = &entry, top.Reads
+	}
+	return stats
+}
@@ -0,0 +1,104 @@
+// Package httpapi implements password-protected snippets. Reading one takes
+// its view password, sent by scripts as X-Paste-Password; browsers get a
+// small form instead, which posts it to /{id}/unlock. That keeps it in a
+// cookie for the paste and sends the browser back to the page, so the
+// password never shows up in a URL, and with it in history and logs.
+package httpapi
+
+import (
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+const viewPasswordHeader = "X-Paste-Password"
+
+// viewPasswordCookie prefixes the cookie a browser keeps the view password
+// of a paste in, base64-encoded. It is named after the paste's ID rather
+// than scoped to its path, so that it is sent for the paste's slug too.
+const viewPasswordCookie = "pb_view_"
+
+var passwordForm = template.Must(template.New("password").Parse(`<form method="post" action="/{{.ID}}/unlock">
+<p>{{if .Wrong}}Wrong password, try again.{{else}}This paste is password-protected.{{end}}</p>
+<input type="hidden" name="next" value="{{.Next}}">
+<input type="password" name="view_pass" autofocus> <input type="submit" value="View">
+</form>
+`))
+
+// checkViewPassword answers the request itself and returns false if id is
+// password-protected and r doesn't carry its password. Owners read their
+// own snippets without it.
+func (s *Server) checkViewPassword(w http.ResponseWriter, r *http.Request, id, user string) bool {
+	info, ok := s.store().Meta(id)
+	if !ok || !info.HasViewPassword || (info.Owner != "" && info.Owner == user) {
+		return true
+	}
+	pass := r.Header.Get(viewPasswordHeader)
+	if c, err := r.Cookie(viewPasswordCookie + id); err == nil && pass == "" {
+		if value, err := base64.RawURLEncoding.DecodeString(c.Value); err == nil {
+			pass = string(value)
+		}
+	}
+	if s.store().CheckViewPassword(id, pass) {
+		return true
+	}
+
+	status := http.StatusUnauthorized
+	if pass != "" {
+		status = http.StatusForbidden
+	}
+	w.Header().Add("Vary", "Accept")
+	if !prefersHTML(r) {
+		message := "Password required: send it as " + viewPasswordHeader
+		if pass != "" {
+			message = "Wrong password"
+		}
+		http.Error(w, message, status)
+		return false
+	}
+	servePasswordForm(w, id, r.URL.Path, pass != "", status)
+	return false
+}
+
+// servePasswordForm shows the password form of paste id, which sends the
+// browser back to next once unlocked.
+func servePasswordForm(w http.ResponseWriter, id, next string, wrong bool, status int) {
+	var body strings.Builder
+	if err := passwordForm.Execute(&body, map[string]any{"ID": id, "Next": next, "Wrong": wrong}); err != nil {
+		http.Error(w, "Failed to render password form", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	pageTemplate.Execute(w, page{Title: id, Body: template.HTML(body.String())})
+}
+
+// serveUnlock takes the view password of paste id from the password form
+// on POST /{id}/unlock. If it is right the browser keeps it in a cookie and
+// is sent back to the page it came from; if not it gets the form again.
+func (s *Server) serveUnlock(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !sameOrigin(r) {
+		http.Error(w, "Cross-site form rejected", http.StatusForbidden)
+		return
+	}
+	if _, ok := s.store().Meta(id); !ok {
+		http.NotFound(w, r)
+		return
+	}
+	pass, next := r.PostFormValue("view_pass"), r.PostFormValue("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		next = "/" + id
+	}
+	if !s.store().CheckViewPassword(id, pass) {
+		servePasswordForm(w, id, next, true, http.StatusForbidden)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: viewPasswordCookie + id, Value: base64.RawURLEncoding.EncodeToString([]byte(pass)), Path: "/", HttpOnly: true, SameSite: http.SameSiteStrictMode})
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
@@ -0,0 +1,97 @@
+// Package httpapi implements trusted reverse proxies. X-Forwarded-For,
+// X-Forwarded-Proto and X-Forwarded-Host are only believed on requests from
+// a configured proxy, so clients can't claim another address to get around
+// rate limits, or pick the host their paste URLs point at.
+package httpapi
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+type schemeKey struct{}
+
+// TrustProxies wraps next so that requests from one of proxies are taken to
+// come from the client they were forwarded for. The client's address, as
+// found in X-Forwarded-For, replaces RemoteAddr for logging and rate
+// limiting. X-Forwarded-Host replaces Host, and with X-Forwarded-Proto it
+// decides the URLs pastes are given. Put it outside everything else.
+func TrustProxies(next http.Handler, proxies []netip.Prefix) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !trusted(proxies, clientIP(r)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r = r.Clone(r.Context())
+		if client := forwardedClient(r, proxies); client != "" {
+			r.RemoteAddr = client
+		}
+		if host := firstForwarded(r, "X-Forwarded-Host"); host != "" {
+			r.Host = host
+		}
+		switch scheme := strings.ToLower(firstForwarded(r, "X-Forwarded-Proto")); scheme {
+		case "http", "https":
+			r = r.WithContext(context.WithValue(r.Context(), schemeKey{}, scheme))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// trusted reports whether ip is one of proxies.
+func trusted(proxies []netip.Prefix, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range proxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedClient returns the client address X-Forwarded-For names: the
+// nearest hop that isn't one of proxies. Anything before it may have been
+// made up by the client. If every hop is a proxy it is the first one, and
+// it is "" if the header is missing or garbled.
+func forwardedClient(r *http.Request, proxies []netip.Prefix) string {
+	var hops []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	client := ""
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			break
+		}
+		client = hops[i]
+		if !trusted(proxies, client) {
+			break
+		}
+	}
+	return client
+}
+
+// firstForwarded returns the first value of header, which the outermost
+// proxy set.
+func firstForwarded(r *http.Request, header string) string {
+	value, _, _ := strings.Cut(r.Header.Get(header), ",")
+	return strings.TrimSpace(value)
+}
+
+// requestScheme is "https" or "http", as the client sees the server: what
+// a trusted proxy forwarded, or else "https". A plain listener is taken to
+// be behind a proxy terminating TLS, as pb deployments long have been.
+func requestScheme(r *http.Request) string {
+	if scheme, ok := r.Context().Value(schemeKey{}).(string); ok {
+		return scheme
+	}
+	return "https"
+}
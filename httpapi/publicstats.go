@@ -0,0 +1,137 @@
+// Package httpapi implements the public instance stats at /api/v1/info and
+// the privacy protections public counts get. With Options.StatsEpsilon set,
+// every public count (the instance stats and the per-language counts at
+// /api/v1/languages) has Laplace noise of scale 1/epsilon added, so that
+// whether any one paste exists can't be told from them, and counts below
+// Options.StatsThreshold after noise are withheld. A noisy count is
+// released once per statsReleasePeriod and served unchanged until then, so
+// asking again and averaging doesn't wear the noise away.
+package httpapi
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"pb/internal/clock"
+	"pb/store"
+)
+
+// statsReleasePeriod is how long a noisy count is served before it is
+// drawn again.
+const statsReleasePeriod = time.Hour
+
+// release is a published count.
+type release struct {
+	at    time.Time
+	value int
+	// shown is false if the count fell below the threshold.
+	shown bool
+}
+
+// statsPrivacy releases public counts. It is safe for concurrent use.
+type statsPrivacy struct {
+	epsilon   float64
+	threshold int
+	clock     clock.Clock
+
+	mu       sync.Mutex
+	released map[string]release
+}
+
+func newStatsPrivacy(epsilon float64, threshold int, c clock.Clock) *statsPrivacy {
+	return &statsPrivacy{epsilon: epsilon, threshold: threshold, clock: c, released: make(map[string]release)}
+}
+
+// laplace draws from the Laplace distribution centred on zero with the
+// given scale.
+func laplace(scale float64) float64 {
+	u := rand.Float64() - 0.5
+	return -scale * math.Copysign(math.Log(1-2*math.Abs(u)), u)
+}
+
+// count returns the public value of the count named name whose true value
+// is n, and whether it may be shown at all.
+func (p *statsPrivacy) count(name string, n int) (int, bool) {
+	if p.epsilon <= 0 {
+		return n, n >= p.threshold
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.clock.Now()
+	if r, ok := p.released[name]; ok && now.Sub(r.at) < statsReleasePeriod {
+		return r.value, r.shown
+	}
+	noisy := max(int(math.Round(float64(n)+laplace(1/p.epsilon))), 0)
+	r := release{at: now, value: noisy, shown: noisy >= p.threshold}
+	p.released[name] = r
+	return r.value, r.shown
+}
+
+// counts releases each of counts, named prefix plus its key, dropping
+// those that may not be shown.
+func (p *statsPrivacy) counts(prefix string, counts map[string]int) map[string]int {
+	public := make(map[string]int, len(counts))
+	for key, n := range counts {
+		if v, ok := p.count(prefix+key, n); ok {
+			public[key] = v
+		}
+	}
+	return public
+}
+
+// infoResponse is the public instance stats. A count that may not be shown
+// is left out.
+type infoResponse struct {
+	Pastes        *int `json:"pastes,omitempty"`
+	PastesLastDay *int `json:"pastes_last_day,omitempty"`
+	Users         *int `json:"users,omitempty"`
+	// Epsilon is the privacy budget the counts were released with; zero
+	// means they are exact.
+	Epsilon float64 `json:"epsilon,omitempty"`
+}
+
+// serveInfo serves the public instance stats: public pastes, those created
+// in the last day, and accounts.
+func (s *Server) serveInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Replicas hold neither private pastes nor accounts.
+	if s.forward(w, r) {
+		return
+	}
+	var pastes, lastDay int
+	dayAgo := s.clock.Now().Add(-24 * time.Hour)
+	for _, info := range s.store().All() {
+		if !visibleTo(info, "") || info.Honeytoken {
+			continue
+		}
+		pastes++
+		if info.Created.After(dayAgo) {
+			lastDay++
+		}
+	}
+	resp := infoResponse{Epsilon: s.statsPrivacy.epsilon}
+	publish := func(name string, n int) *int {
+		if v, ok := s.statsPrivacy.count(name, n); ok {
+			return &v
+		}
+		return nil
+	}
+	resp.Pastes = publish("pastes", pastes)
+	resp.PastesLastDay = publish("pastes_last_day", lastDay)
+	resp.Users = publish("users", len(s.users.Users()))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// publicLanguages returns the per-language counts of public snippets in
+// st, as they may be published.
+func (s *Server) publicLanguages(st *store.Store) map[string]int {
+	return s.statsPrivacy.counts("lang:", st.Languages())
+}
@@ -0,0 +1,241 @@
+// Package httpapi implements per-IP rate limiting of mutating requests as
+// middleware, using a token bucket per client address. Buckets are kept in
+// memory, or in Redis when several servers share the limit; if Redis
+// fails, each server falls back to its own buckets until it answers again.
+package httpapi
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"pb/internal/clock"
+	"pb/internal/pairfile"
+)
+
+// minIdleBucketAge is the least time an idle bucket is kept before being
+// forgotten, and how often idle buckets are swept.
+const minIdleBucketAge = 10 * time.Minute
+
+// RateLimitOptions configures RateLimit.
+type RateLimitOptions struct {
+	// PerMinute is the sustained number of creates, updates and deletes a
+	// single IP may make.
+	PerMinute float64
+	// Burst is how many of them may be made back to back, at least 1.
+	Burst int
+	// ProofOfWork, if set, is told of refused requests so that it can
+	// require challenges while the server is under attack.
+	ProofOfWork *ProofOfWork
+	// Redis, if set, holds the buckets, so that servers sharing it share
+	// the limit.
+	Redis *redis.Client
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter is the middleware returned by RateLimit.
+type RateLimiter struct {
+	next  http.Handler
+	rate  float64 // tokens per second
+	burst float64
+	// idle is how long a bucket is kept after its last request: long
+	// enough to refill, so forgetting it gives nothing away.
+	idle  time.Duration
+	pow   *ProofOfWork
+	redis *redis.Client
+	// clock refills buckets. It runs in real time even when the server's
+	// clock is stopped, or buckets would never refill.
+	clock clock.Clock
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// RateLimit wraps next so that POST, PUT and DELETE requests, and WebSocket
+// editing sessions, beyond the configured rate get 429 Too Many Requests
+// with a Retry-After header. Reads pass straight through.
+func RateLimit(next http.Handler, opts RateLimitOptions) *RateLimiter {
+	burst := opts.Burst
+	if burst < 1 {
+		burst = 1
+	}
+	rate := opts.PerMinute / 60
+	idle := minIdleBucketAge
+	if rate > 0 {
+		idle = max(idle, time.Duration(float64(burst)/rate*float64(time.Second)))
+	}
+	return &RateLimiter{
+		next:    next,
+		rate:    rate,
+		burst:   float64(burst),
+		idle:    idle,
+		pow:     opts.ProofOfWork,
+		redis:   opts.Redis,
+		clock:   clock.System,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+func (l *RateLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost || r.Method == http.MethodPut || r.Method == http.MethodDelete || webSocketUpgrade(r) {
+		if wait := l.take(clientIP(r)); wait > 0 {
+			l.pow.noteRefusal()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Too many requests, slow down", http.StatusTooManyRequests)
+			return
+		}
+	}
+	l.next.ServeHTTP(w, r)
+}
+
+// take spends a token from ip's bucket. It returns zero on success, or how
+// long until a token will be available.
+func (l *RateLimiter) take(ip string) time.Duration {
+	if l.redis != nil {
+		wait, err := l.takeShared(ip)
+		if err == nil {
+			return wait
+		}
+		slog.Error("Shared rate limit failed, limiting locally", "err", err)
+	}
+	now := l.clock.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	if l.rate <= 0 {
+		return l.idle
+	}
+	return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// takeBucket is take for a bucket in Redis, a hash of its tokens and when
+// they were last counted, expiring once idle long enough to have refilled.
+// It runs on the Redis server's clock, which every server sharing it
+// agrees on. It returns the wait in seconds, as a string since Lua numbers
+// become integers in replies, or -1 if the bucket never refills.
+var takeBucket = redis.NewScript(`
+local rate, burst, idle = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) + tonumber(t[2]) / 1e6
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(b[1]) or burst
+local last = tonumber(b[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - last) * rate)
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+elseif rate <= 0 then
+	wait = -1
+else
+	wait = (1 - tokens) / rate
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'last', tostring(now))
+redis.call('EXPIRE', KEYS[1], idle)
+return tostring(wait)
+`)
+
+// takeShared is take for buckets kept in Redis.
+func (l *RateLimiter) takeShared(ip string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	reply, err := takeBucket.Run(ctx, l.redis, []string{"pb:ratelimit:" + ip},
+		l.rate, l.burst, int(math.Ceil(l.idle.Seconds()))).Text()
+	if err != nil {
+		return 0, err
+	}
+	wait, err := strconv.ParseFloat(reply, 64)
+	if err != nil {
+		return 0, err
+	}
+	if wait < 0 {
+		return l.idle, nil
+	}
+	return time.Duration(wait * float64(time.Second)), nil
+}
+
+// sweep drops buckets that have been idle long enough to have refilled, so
+// the map doesn't grow with every address ever seen.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < minIdleBucketAge {
+		return
+	}
+	l.lastSweep = now
+	for ip, b := range l.buckets {
+		if now.Sub(b.last) >= l.idle {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// Save writes the buckets of clients that have spent tokens to fileName,
+// so a restart doesn't hand every client a fresh burst.
+func (l *RateLimiter) Save(fileName string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	pairs := make(map[string]string, len(l.buckets))
+	for ip, b := range l.buckets {
+		if b.tokens < l.burst {
+			pairs[ip] = strconv.FormatFloat(b.tokens, 'f', -1, 64) + " " + strconv.FormatInt(b.last.UnixNano(), 10)
+		}
+	}
+	pairfile.Write(fileName, pairs)
+}
+
+// Load restores buckets written by Save. Malformed entries and buckets that
+// would have been swept by now are skipped.
+func (l *RateLimiter) Load(fileName string) {
+	now := l.clock.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for ip, value := range pairfile.Read(fileName) {
+		tokensField, lastField, _ := strings.Cut(value, " ")
+		tokens, err := strconv.ParseFloat(tokensField, 64)
+		if err != nil {
+			continue
+		}
+		nanos, err := strconv.ParseInt(lastField, 10, 64)
+		if err != nil {
+			continue
+		}
+		last := time.Unix(0, nanos)
+		if now.Sub(last) < l.idle {
+			l.buckets[ip] = &bucket{tokens: math.Min(tokens, l.burst), last: last}
+		}
+	}
+}
+
+// clientIP is the address the request came from, without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
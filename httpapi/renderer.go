@@ -0,0 +1,366 @@
+// Package httpapi implements a registry of renderers, each presenting a snippet
+// as one content class (plain text, highlighted code, CSV table, ...). The
+// class is chosen from the path suffix of GET /{id}/{class}, or negotiated
+// from the Accept header for a bare GET /{id}; new views only need to
+// register themselves here and never touch routing.
+package httpapi
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+
+	"pb/store"
+)
+
+// view is what a renderer gets to work with.
+type view struct {
+	id      string
+	content string
+	lang    string
+	// html is set when the client prefers HTML, for renderers that
+	// serve browsers differently.
+	html bool
+	// comments are the snippet's line comments, for views that show them.
+	comments []store.Comment
+	// og describes the snippet to link previews; nil keeps it from them.
+	og *openGraph
+	// theme is the highlighting theme picked; see selectTheme.
+	theme string
+}
+
+type renderer interface {
+	mediaType(v view) string
+	render(w io.Writer, v view) error
+}
+
+var renderers = map[string]renderer{}
+
+func registerRenderer(class string, rd renderer) {
+	if _, exists := renderers[class]; exists {
+		panic("renderer already registered for class " + class)
+	}
+	renderers[class] = rd
+}
+
+func init() {
+	registerRenderer("text", textRenderer{})
+	registerRenderer("raw", textRenderer{})
+	registerRenderer("code", codeRenderer{})
+	registerRenderer("csv", csvRenderer{})
+	registerRenderer("notebook", notebookRenderer{})
+	registerRenderer("asciicast", asciicastRenderer{})
+	registerRenderer("image", imageRenderer{})
+	registerRenderer("md", markdownRenderer{})
+	registerRenderer("console", consoleRenderer{})
+	registerRenderer("man", manRenderer{})
+}
+
+// selectRenderer picks the renderer for a GET request. A suffix naming a
+// registered class selects it and any other suffix is taken as a language
+// for the code renderer. Without a suffix, clients preferring HTML (browsers)
+// get the code view and everyone else (curl) gets plain text.
+func selectRenderer(r *http.Request, suffix string) (renderer, string) {
+	if suffix == "" {
+		if prefersHTML(r) {
+			return renderers["code"], ""
+		}
+		return renderers["text"], ""
+	}
+	if rd, ok := renderers[suffix]; ok {
+		return rd, ""
+	}
+	return renderers["code"], suffix
+}
+
+// isHeavyRender reports whether serving suffix to r means more than copying
+// the snippet out, i.e. it is subject to the render concurrency limit.
+func isHeavyRender(r *http.Request, suffix string) bool {
+	rd, _ := selectRenderer(r, suffix)
+	return rd != renderers["text"] && rd != renderers["raw"]
+}
+
+// serveSnippet renders content for suffix. defaultLang, the language the
+// snippet was created with, highlights the code view when suffix names none,
+// unfurl gives HTML views OpenGraph tags for link previews, and comments are
+// the snippet's line comments.
+func serveSnippet(w http.ResponseWriter, r *http.Request, content, id, suffix, defaultLang string, unfurl bool, comments []store.Comment) {
+	rd, lang := selectRenderer(r, suffix)
+	if lang == "" && rd == renderers["code"] {
+		lang = defaultLang
+		// Console output is shown with its colours rather than
+		// highlighted.
+		if lang == "console" {
+			rd = renderers["console"]
+		}
+	}
+	v := view{id: id, content: content, lang: lang, html: prefersHTML(r), comments: comments}
+	if unfurl {
+		v.og = newOpenGraph(r, id, content)
+	}
+	if strings.HasPrefix(rd.mediaType(v), "text/html") {
+		v.theme = selectTheme(w, r, id)
+		w.Header().Add("Vary", "Cookie")
+	}
+	if suffix == "" || rd == renderers["man"] {
+		w.Header().Add("Vary", "Accept")
+	}
+	w.Header().Set("Content-Type", rd.mediaType(v))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if err := rd.render(w, v); errors.Is(err, errNotImage) {
+		http.Error(w, "Snippet is not an image", http.StatusUnsupportedMediaType)
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to render snippet: %v", err), http.StatusUnprocessableEntity)
+	}
+}
+
+type textRenderer struct{}
+
+func (textRenderer) mediaType(view) string { return "text/plain; charset=utf-8" }
+
+func (textRenderer) render(w io.Writer, v view) error {
+	_, err := io.WriteString(w, v.content)
+	return err
+}
+
+var pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+{{with .OpenGraph}}<meta property="og:type" content="website">
+<meta property="og:site_name" content="pb">
+<meta property="og:title" content="{{.Title}}">
+<meta property="og:description" content="{{.Description}}">
+<meta property="og:url" content="{{.URL}}">
+<meta name="twitter:card" content="summary">
+{{end}}{{.ThemeLinks}}
+{{.Head}}
+</head>
+<body>
+{{.Body}}
+` + string(registerScript) + `
+</body>
+</html>
+`))
+
+type page struct {
+	Title string
+	Head  template.HTML
+	Body  template.HTML
+	// OpenGraph, if set, describes the page to link previews.
+	OpenGraph *openGraph
+	// Theme is the highlighting theme, "" following the color scheme.
+	Theme string
+}
+
+// ThemeLinks are the page's highlighting stylesheets.
+func (p page) ThemeLinks() template.HTML { return themeLinks(p.Theme) }
+
+// openGraphDescriptionSize caps the excerpt of a snippet link previews
+// show, in bytes.
+const openGraphDescriptionSize = 200
+
+// openGraph is what link previews (chat apps, social sites) show of a page.
+type openGraph struct {
+	Title       string
+	Description string
+	URL         string
+}
+
+// newOpenGraph describes snippet id, with content, to link previews: the
+// description is the start of its content, whitespace collapsed.
+func newOpenGraph(r *http.Request, id, content string) *openGraph {
+	description := strings.Join(strings.Fields(content), " ")
+	if len(description) > openGraphDescriptionSize {
+		description = strings.ToValidUTF8(description[:openGraphDescriptionSize], "") + "…"
+	}
+	return &openGraph{Title: id, Description: description, URL: constructURL(r, id)}
+}
+
+const highlightScript = `<script src="https://cdnjs.cloudflare.com/ajax/libs/highlight.js/11.9.0/highlight.min.js"></script>
+<script>hljs.highlightAll();</script>`
+
+// codeRenderer shows highlighted code with a gutter of line anchors. Linking
+// to #L42 or #L10-L20 shades those lines; shift-clicking a line number
+// extends the selection into a range.
+type codeRenderer struct{}
+
+func (codeRenderer) mediaType(view) string { return "text/html; charset=utf-8" }
+
+var codeStyle = stylesheet("code.css")
+
+var lineAnchorScript = script("lines.js")
+
+func (codeRenderer) render(w io.Writer, v view) error {
+	class := "nohighlight"
+	if v.lang != "" {
+		class = "language-" + v.lang
+	}
+
+	lineCount := strings.Count(v.content, "\n") + 1
+	if strings.HasSuffix(v.content, "\n") {
+		lineCount--
+	}
+	markers := commentMarkers(v.comments)
+	var gutter strings.Builder
+	for n := 1; n <= lineCount; n++ {
+		fmt.Fprintf(&gutter, "<a id=\"L%d\" href=\"#L%d\">%d</a>%s\n", n, n, n, markers[n])
+	}
+	head := template.HTML(codeStyle)
+	if len(markers) > 0 {
+		head += commentStyle
+	}
+
+	body := fmt.Sprintf(`<div class="code hljs"><pre class="gutter">%s</pre><pre class="lines"><code class="%s">%s</code></pre></div>`+"\n%s\n%s",
+		gutter.String(), template.HTMLEscapeString(class), template.HTMLEscapeString(v.content), highlightScript, lineAnchorScript)
+	return pageTemplate.Execute(w, page{Title: v.id, OpenGraph: v.og, Theme: v.theme, Head: head, Body: template.HTML(body)})
+}
+
+type csvRenderer struct{}
+
+func (csvRenderer) mediaType(view) string { return "text/html; charset=utf-8" }
+
+func (csvRenderer) render(w io.Writer, v view) error {
+	cr := csv.NewReader(strings.NewReader(v.content))
+	cr.FieldsPerRecord = -1
+	records, err := cr.ReadAll()
+	if err != nil {
+		return err
+	}
+
+	var sb strings.Builder
+	sb.WriteString("<table>\n")
+	for i, record := range records {
+		cell := "td"
+		if i == 0 {
+			cell = "th"
+		}
+		sb.WriteString("<tr>")
+		for _, field := range record {
+			fmt.Fprintf(&sb, "<%s>%s</%s>", cell, template.HTMLEscapeString(field), cell)
+		}
+		sb.WriteString("</tr>\n")
+	}
+	sb.WriteString("</table>")
+	return pageTemplate.Execute(w, page{Title: v.id, OpenGraph: v.og, Theme: v.theme, Body: template.HTML(sb.String())})
+}
+
+// notebookRenderer shows a Jupyter notebook as its sequence of cells.
+type notebookRenderer struct{}
+
+func (notebookRenderer) mediaType(view) string { return "text/html; charset=utf-8" }
+
+func (notebookRenderer) render(w io.Writer, v view) error {
+	var nb struct {
+		Cells []struct {
+			CellType string          `json:"cell_type"`
+			Source   json.RawMessage `json:"source"`
+		} `json:"cells"`
+		Metadata struct {
+			LanguageInfo struct {
+				Name string `json:"name"`
+			} `json:"language_info"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal([]byte(v.content), &nb); err != nil {
+		return err
+	}
+
+	lang := nb.Metadata.LanguageInfo.Name
+	var sb strings.Builder
+	for _, cell := range nb.Cells {
+		source := notebookSource(cell.Source)
+		if cell.CellType == "code" {
+			fmt.Fprintf(&sb, "<pre><code class=\"language-%s\">%s</code></pre>\n",
+				template.HTMLEscapeString(lang), template.HTMLEscapeString(source))
+		} else {
+			fmt.Fprintf(&sb, "<pre>%s</pre>\n", template.HTMLEscapeString(source))
+		}
+	}
+	sb.WriteString(highlightScript)
+	return pageTemplate.Execute(w, page{Title: v.id, OpenGraph: v.og, Theme: v.theme, Body: template.HTML(sb.String())})
+}
+
+// notebookSource flattens a cell source, which nbformat allows to be either a
+// string or a list of lines.
+func notebookSource(raw json.RawMessage) string {
+	var lines []string
+	if err := json.Unmarshal(raw, &lines); err == nil {
+		return strings.Join(lines, "")
+	}
+	var s string
+	json.Unmarshal(raw, &s)
+	return s
+}
+
+// asciicastRenderer plays back an asciinema recording in the browser.
+type asciicastRenderer struct{}
+
+func (asciicastRenderer) mediaType(view) string { return "text/html; charset=utf-8" }
+
+func (asciicastRenderer) render(w io.Writer, v view) error {
+	cast, err := json.Marshal(v.content)
+	if err != nil {
+		return err
+	}
+	head := `<link rel="stylesheet" href="https://cdn.jsdelivr.net/npm/asciinema-player@3.7.0/dist/bundle/asciinema-player.css">`
+	body := fmt.Sprintf(`<div id="player"></div>
+<script src="https://cdn.jsdelivr.net/npm/asciinema-player@3.7.0/dist/bundle/asciinema-player.min.js"></script>
+<script>AsciinemaPlayer.create({data: %s}, document.getElementById("player"));</script>`, cast)
+	return pageTemplate.Execute(w, page{Title: v.id, OpenGraph: v.og, Theme: v.theme, Head: template.HTML(head), Body: template.HTML(body)})
+}
+
+// markdown converts GitHub-flavoured Markdown. goldmark leaves raw HTML out
+// and drops javascript: and similar links unless told otherwise, which is
+// what keeps untrusted snippets from injecting script.
+var markdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+var markdownStyle = stylesheet("markdown.css")
+
+// markdownRenderer shows the snippet as formatted Markdown, highlighting
+// fenced code blocks like the code view does.
+type markdownRenderer struct{}
+
+func (markdownRenderer) mediaType(view) string { return "text/html; charset=utf-8" }
+
+func (markdownRenderer) render(w io.Writer, v view) error {
+	var body bytes.Buffer
+	if err := markdown.Convert([]byte(v.content), &body); err != nil {
+		return err
+	}
+	body.WriteString(highlightScript)
+	return pageTemplate.Execute(w, page{Title: v.id, OpenGraph: v.og, Theme: v.theme, Head: markdownStyle, Body: template.HTML(body.String())})
+}
+
+// imageRenderer serves the snippet bytes as-is so browsers display them
+// inline. Only content sniffed as an image is served; anything else, HTML
+// above all, would run as a page of this origin.
+type imageRenderer struct{}
+
+// errNotImage is returned by imageRenderer for content that isn't an image.
+var errNotImage = errors.New("not an image")
+
+func (imageRenderer) mediaType(v view) string {
+	if mediaType := http.DetectContentType([]byte(v.content)); strings.HasPrefix(mediaType, "image/") {
+		return mediaType
+	}
+	return "application/octet-stream"
+}
+
+func (ir imageRenderer) render(w io.Writer, v view) error {
+	if !strings.HasPrefix(ir.mediaType(v), "image/") {
+		return errNotImage
+	}
+	_, err := io.WriteString(w, v.content)
+	return err
+}
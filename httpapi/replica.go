@@ -0,0 +1,159 @@
+// Package httpapi implements read-replica mode: a Server given a primary
+// answers reads from its own store, which it keeps in step by following the
+// primary's change feed, and forwards everything else to the primary.
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"time"
+
+	"pb/store"
+)
+
+// forward proxies r to the primary, reporting false if this server is not
+// a replica and must answer r itself.
+func (s *Server) forward(w http.ResponseWriter, r *http.Request) bool {
+	if s.proxy == nil {
+		return false
+	}
+	s.proxy.ServeHTTP(w, r)
+	return true
+}
+
+// newPrimaryProxy returns a proxy to primary. It passes the client's Host
+// header through, so the URLs the primary hands out point at the replica.
+func newPrimaryProxy(primary *url.URL) *httputil.ReverseProxy {
+	return httputil.NewSingleHostReverseProxy(primary)
+}
+
+// Replicate follows the primary's change feed, copying public snippets into
+// the served store, until ctx is done. It polls every interval once caught
+// up. It returns immediately if the server is not a replica.
+func (s *Server) Replicate(ctx context.Context, interval time.Duration) {
+	if s.primary == nil {
+		return
+	}
+	var since uint64
+	for {
+		next, more, err := s.replicateOnce(ctx, since)
+		if err != nil {
+			slog.Error("Replication failed", "primary", s.primary.String(), "err", err)
+		}
+		since = next
+		if more && err == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// replicateOnce applies one page of changes after since, returning the
+// cursor to continue from.
+func (s *Server) replicateOnce(ctx context.Context, since uint64) (uint64, bool, error) {
+	var page changesResponse
+	query := url.Values{"since": {strconv.FormatUint(since, 10)}}
+	err := s.fetchPrimary(ctx, "/api/v1/changes", query, func(body io.Reader) error {
+		return json.NewDecoder(body).Decode(&page)
+	})
+	if err != nil {
+		return since, false, err
+	}
+
+	st := s.store()
+	for _, c := range page.Changes {
+		if c.Type == store.ChangeDeleted {
+			st.Delete(c.ID)
+		} else if err := s.replicateSnippet(ctx, st, c.ID); err != nil {
+			return since, false, fmt.Errorf("copying %s: %w", c.ID, err)
+		}
+		since = c.Seq
+	}
+	return since, page.More, nil
+}
+
+// replicateSnippet copies the current state of id from the primary. A
+// snippet deleted on the primary since the change was recorded is deleted
+// here too; its deletion follows later in the feed anyway.
+func (s *Server) replicateSnippet(ctx context.Context, st *store.Store, id string) error {
+	var meta metaResponse
+	err := s.fetchPrimary(ctx, "/"+id+"/meta", nil, func(body io.Reader) error {
+		return json.NewDecoder(body).Decode(&meta)
+	})
+	if err == errPrimaryNotFound {
+		st.Delete(id)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// Read limits are counted on the primary, so replicas forward reads
+	// of such snippets instead of mirroring them.
+	if meta.MaxReads > 0 {
+		st.Delete(id)
+		return nil
+	}
+	if current, ok := st.Meta(id); ok && current.Hash == meta.SHA256 {
+		return nil
+	}
+
+	var content []byte
+	err = s.fetchPrimary(ctx, "/"+id+"/raw", nil, func(body io.Reader) error {
+		content, err = io.ReadAll(body)
+		return err
+	})
+	if err == errPrimaryNotFound {
+		st.Delete(id)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	info := store.Info{Owner: meta.Owner, Created: meta.Created, Lang: meta.Lang, Reads: meta.Reads, Encrypted: meta.Encrypted, DNS: meta.DNS, Slug: meta.Slug, Redirect: meta.Redirect, Searchable: meta.Searchable, NoIndex: meta.NoIndex, NoUnfurl: meta.NoUnfurl}
+	if meta.Expires != nil {
+		info.Expires = *meta.Expires
+	}
+	if meta.Updated != nil {
+		info.Updated = *meta.Updated
+	}
+	st.Mirror(id, string(content), info)
+	return nil
+}
+
+var errPrimaryNotFound = errors.New("not found on primary")
+
+// fetchPrimary GETs path from the primary and hands a successful response
+// body to decode.
+func (s *Server) fetchPrimary(ctx context.Context, path string, query url.Values, decode func(io.Reader) error) error {
+	u := s.primary.JoinPath(path)
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return errPrimaryNotFound
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("GET %s: %s", req.URL, resp.Status)
+	}
+	return decode(resp.Body)
+}
@@ -0,0 +1,241 @@
+// Package httpapi implements file uploads over the SSH server, so that
+//
+//	scp -O main.go pb.example:   (the classic scp protocol)
+//	scp main.go pb.example:      (SFTP, the default in OpenSSH 9)
+//	sftp pb.example <<< "put main.go"
+//
+// each create a paste. Pastes have no names, so a file's extension becomes
+// its lang and the rest of its name is dropped. Classic scp prints the URLs
+// to stderr; SFTP has no way to show them, so it needs a key added at
+// /sshkeys and "ssh pb.example ls" lists them afterwards, as does listing
+// the SFTP root.
+package httpapi
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/sftp"
+)
+
+// uploadFields returns the creation fields of a file uploaded as name.
+func uploadFields(name string) url.Values {
+	fields := url.Values{}
+	if ext := strings.TrimPrefix(path.Ext(name), "."); ext != "" {
+		fields.Set("ext", ext)
+	}
+	return fields
+}
+
+// serveSCP is the sink side of the classic scp protocol (scp -t), creating a
+// paste per file received.
+func (s *Server) serveSCP(sess ssh.Session, user, host string, args []string) {
+	sink := false
+	for _, arg := range args {
+		switch {
+		case arg == "-t":
+			sink = true
+		case strings.HasPrefix(arg, "-") && strings.Contains(arg, "r"):
+			fmt.Fprintln(sess.Stderr(), "pb: directories are not supported")
+			sess.Exit(1)
+			return
+		}
+	}
+	if !sink {
+		fmt.Fprintln(sess.Stderr(), "pb: pastes can only be uploaded with scp, not downloaded")
+		sess.Exit(1)
+		return
+	}
+
+	in := bufio.NewReader(sess)
+	ack := func() { sess.Write([]byte{0}) }
+	ack()
+	for {
+		line, err := in.ReadString('\n')
+		if err != nil {
+			sess.Exit(0)
+			return
+		}
+		switch line[0] {
+		case 'T':
+			// Modification times, from scp -p.
+			ack()
+			continue
+		case 'C':
+		case 'D':
+			fmt.Fprint(sess, "\x02pb: directories are not supported\n")
+			sess.Exit(1)
+			return
+		default:
+			// The source reporting an error of its own.
+			sess.Exit(1)
+			return
+		}
+
+		// C<mode> <size> <name>
+		parts := strings.SplitN(strings.TrimSuffix(line[1:], "\n"), " ", 3)
+		var size int64 = -1
+		if len(parts) == 3 {
+			size, _ = strconv.ParseInt(parts[1], 10, 64)
+		}
+		if size < 0 {
+			fmt.Fprint(sess, "\x02pb: malformed scp header\n")
+			sess.Exit(1)
+			return
+		}
+		ack()
+		body := io.LimitReader(in, size)
+		rec := s.sshCreate(sess, user, host, body, uploadFields(parts[2]))
+		// Whatever the handler didn't read must go, to stay in step with
+		// the source; then comes its end-of-file byte.
+		io.Copy(io.Discard, body)
+		in.ReadByte()
+
+		if rec.Code != http.StatusCreated {
+			fmt.Fprintf(sess, "\x01pb: %s: %s\n", parts[2], strings.TrimSpace(rec.Body.String()))
+			continue
+		}
+		fmt.Fprintf(sess.Stderr(), "%s: %s\n", parts[2], rec.Body.String())
+		if token := rec.Header().Get(editTokenHeader); token != "" {
+			fmt.Fprintln(sess.Stderr(), "edit token:", token)
+		}
+		ack()
+	}
+}
+
+// serveSFTP serves the sftp subsystem: writing a file creates a paste and
+// listing the root lists the user's pastes.
+func (s *Server) serveSFTP(sess ssh.Session, host string) {
+	h := &sftpHandler{s: s, sess: sess, user: s.users.SSHUser(sess.PublicKey()), host: host}
+	server := sftp.NewRequestServer(sess, sftp.Handlers{FileGet: h, FilePut: h, FileCmd: h, FileList: h})
+	if err := server.Serve(); err != nil && err != io.EOF {
+		slog.Error("SFTP session failed", "user", h.user, "err", err)
+	}
+	// Exit closes the channel, which server.Close would do before the
+	// exit status could be sent.
+	sess.Exit(0)
+}
+
+type sftpHandler struct {
+	s    *Server
+	sess ssh.Session
+	user string
+	host string
+}
+
+func (h *sftpHandler) Fileread(*sftp.Request) (io.ReaderAt, error) {
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (h *sftpHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	if h.user == "" {
+		// Nothing could show an anonymous uploader the URL or edit token.
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	return &sftpUpload{h: h, name: path.Base(r.Filepath), limit: h.s.bodyLimit()}, nil
+}
+
+// Filecmd accepts only Setstat, which clients send to truncate a file and
+// to copy its times and mode; pastes are written whole and have neither.
+func (h *sftpHandler) Filecmd(r *sftp.Request) error {
+	if r.Method == "Setstat" {
+		return nil
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (h *sftpHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	root := r.Filepath == "/" || r.Filepath == "."
+	switch {
+	case r.Method == "Stat" && root:
+		return sftpListing{sftpFileInfo{name: "/", dir: true}}, nil
+	case r.Method == "List" && root:
+		var listing sftpListing
+		for _, info := range h.s.store().ListByOwner(h.user) {
+			name := info.ID
+			if info.Lang != "" {
+				name += "." + info.Lang
+			}
+			modTime := info.Updated
+			if modTime.IsZero() {
+				modTime = info.Created
+			}
+			listing = append(listing, sftpFileInfo{name: name, size: int64(info.Size), modTime: modTime})
+		}
+		return listing, nil
+	}
+	return nil, sftp.ErrSSHFxNoSuchFile
+}
+
+// sftpUpload collects a file written over SFTP and pastes it on close.
+type sftpUpload struct {
+	h     *sftpHandler
+	name  string
+	limit int64
+	buf   []byte
+}
+
+func (u *sftpUpload) WriteAt(p []byte, off int64) (int, error) {
+	end := off + int64(len(p))
+	if end > u.limit {
+		return 0, fmt.Errorf("paste too large: the limit is %s", formatSize(u.limit))
+	}
+	if end > int64(len(u.buf)) {
+		u.buf = append(u.buf, make([]byte, end-int64(len(u.buf)))...)
+	}
+	return copy(u.buf[off:], p), nil
+}
+
+func (u *sftpUpload) Close() error {
+	rec := u.h.s.sshCreate(u.h.sess, u.h.user, u.h.host, bytes.NewReader(u.buf), uploadFields(u.name))
+	if rec.Code != http.StatusCreated {
+		return errors.New(strings.TrimSpace(rec.Body.String()))
+	}
+	return nil
+}
+
+// sftpListing is a fixed directory listing.
+type sftpListing []os.FileInfo
+
+func (l sftpListing) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+type sftpFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi sftpFileInfo) Name() string       { return fi.name }
+func (fi sftpFileInfo) Size() int64        { return fi.size }
+func (fi sftpFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi sftpFileInfo) IsDir() bool        { return fi.dir }
+func (fi sftpFileInfo) Sys() any           { return nil }
+
+func (fi sftpFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
@@ -0,0 +1,104 @@
+// Package httpapi implements GET /search?q=, full-text search over pastes.
+// A paste can be found by anyone if it was created with search=1 and is
+// public, and by its owner in any case; results come newest first as JSON,
+// each with the line where the query's first term turns up.
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"pb/store"
+)
+
+// searchLimit caps the results of a search.
+const searchLimit = 50
+
+// searchContextSize caps the context shown with a result, in bytes.
+const searchContextSize = 160
+
+type searchResult struct {
+	listingEntry
+	Context string `json:"context"`
+}
+
+// searchableBy reports whether viewer may find info by searching.
+func searchableBy(info store.Info, viewer string) bool {
+	if viewer != "" && info.Owner == viewer {
+		return true
+	}
+	return info.Searchable && visibleTo(info, viewer) && !info.HasViewPassword
+}
+
+// searchContext returns the line of content where term first appears,
+// shortened to about searchContextSize bytes around it.
+func searchContext(content, term string) string {
+	for _, line := range strings.Split(content, "\n") {
+		lower := strings.ToLower(line)
+		i := strings.Index(lower, term)
+		if i < 0 {
+			continue
+		}
+		// Lowercasing changes the length of a few characters; show the
+		// lowercased line then rather than cut the original wrong.
+		if len(lower) != len(line) {
+			line = lower
+		}
+		start := max(0, i-searchContextSize/2)
+		end := min(len(line), start+searchContextSize)
+		excerpt := strings.ToValidUTF8(line[start:end], "")
+		if start > 0 {
+			excerpt = "…" + excerpt
+		}
+		if end < len(line) {
+			excerpt += "…"
+		}
+		return strings.TrimSpace(excerpt)
+	}
+	return ""
+}
+
+// serveSearch lists the pastes holding every term of q that the caller
+// may find.
+func (s *Server) serveSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireFeature(w, FeatureSearch, "Search is disabled for now") {
+		return
+	}
+	// Replicas hold only public pastes, so owners' searches go to the
+	// primary.
+	if s.forward(w, r) {
+		return
+	}
+	user, ok := s.users.Authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="pb"`)
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	terms := store.SearchTerms(r.URL.Query().Get("q"))
+	if len(terms) == 0 {
+		http.Error(w, "Search for at least one word of two or more letters or digits, as /search?q=word", http.StatusBadRequest)
+		return
+	}
+
+	results := []searchResult{}
+	keep := func(info store.Info) bool { return searchableBy(info, user) }
+	s.eachListed(r, s.store().Search(terms), keep, func(info store.Info) bool {
+		content, ok := s.store().Get(info.ID)
+		if !ok {
+			return true
+		}
+		results = append(results, searchResult{
+			listingEntry: newListingEntry(r, info),
+			Context:      searchContext(content, terms[0]),
+		})
+		return len(results) < searchLimit
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,132 @@
+// Package httpapi implements read shadowing for load testing: a share of
+// the GET and HEAD requests a server answers are sent again, in the
+// background, to a shadow instance whose answers are thrown away. Pointing
+// it at a pb running a new storage setup puts production-shaped load on
+// that setup before anyone depends on it. Clients never wait on the shadow,
+// and requests beyond what it keeps up with are dropped rather than queued.
+package httpapi
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// shadowTimeout bounds one shadowed request.
+	shadowTimeout = 10 * time.Second
+	// maxShadowInFlight caps the shadowed requests under way at once.
+	maxShadowInFlight = 64
+)
+
+// shadowHeader marks requests sent to a shadow, for its logs.
+const shadowHeader = "X-Pb-Shadow"
+
+// ShadowOptions configures ShadowReads.
+type ShadowOptions struct {
+	// Target is the base URL of the shadow instance.
+	Target *url.URL
+	// Percent is the share of reads sent to it, from 0 to 100.
+	Percent float64
+}
+
+// Shadow is the middleware returned by ShadowReads.
+type Shadow struct {
+	next    http.Handler
+	target  *url.URL
+	percent float64
+	client  *http.Client
+	slots   chan struct{}
+
+	sent, dropped, failed atomic.Int64
+}
+
+// ShadowReads wraps next so that opts.Percent of GET and HEAD requests are
+// also sent to opts.Target. Credentials are left out, so the shadow sees
+// what an anonymous reader would. Put it inside any filtering middleware,
+// so only requests that are answered get shadowed.
+func ShadowReads(next http.Handler, opts ShadowOptions) *Shadow {
+	return &Shadow{
+		next:    next,
+		target:  opts.Target,
+		percent: opts.Percent,
+		client: &http.Client{
+			Timeout: shadowTimeout,
+			// Redirects are part of the answer being thrown away.
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		slots: make(chan struct{}, maxShadowInFlight),
+	}
+}
+
+func (sh *Shadow) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && rand.Float64()*100 < sh.percent {
+		sh.send(r)
+	}
+	sh.next.ServeHTTP(w, r)
+}
+
+// send shadows r in the background, or drops it if the shadow already has
+// maxShadowInFlight requests to answer.
+func (sh *Shadow) send(r *http.Request) {
+	select {
+	case sh.slots <- struct{}{}:
+	default:
+		sh.dropped.Add(1)
+		return
+	}
+	u := sh.target.JoinPath(r.URL.Path)
+	u.RawQuery = r.URL.RawQuery
+	header := r.Header.Clone()
+	for _, name := range []string{"Authorization", "Cookie", "X-Paste-Token", viewPasswordHeader, "Connection", "Upgrade", "Te", "Trailer", "Keep-Alive", "Proxy-Authorization"} {
+		header.Del(name)
+	}
+	header.Set(shadowHeader, "1")
+	method := r.Method
+	go func() {
+		defer func() { <-sh.slots }()
+		ctx, cancel := context.WithTimeout(context.Background(), shadowTimeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+		if err != nil {
+			sh.failed.Add(1)
+			return
+		}
+		req.Header = header
+		resp, err := sh.client.Do(req)
+		if err != nil {
+			sh.failed.Add(1)
+			slog.Debug("Shadowed request failed", "path", u.Path, "err", err)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			sh.failed.Add(1)
+		}
+		sh.sent.Add(1)
+	}()
+}
+
+// ReportEvery logs how many requests were shadowed, dropped and failed
+// every interval until ctx is done, when there were any.
+func (sh *Shadow) ReportEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		sent, dropped, failed := sh.sent.Swap(0), sh.dropped.Swap(0), sh.failed.Swap(0)
+		if sent+dropped+failed > 0 {
+			slog.Info("Shadowed reads", "target", sh.target.String(), "sent", sent, "dropped", dropped, "failed", failed)
+		}
+	}
+}
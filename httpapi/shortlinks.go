@@ -0,0 +1,56 @@
+// Package httpapi implements shortlinks. A paste created with u=1 holds a
+// URL, and GET /{id} redirects to it with 301 Moved Permanently instead of
+// showing it; /{id}/raw and the other views still show the URL itself.
+package httpapi
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// maxShortlinkSize caps the URL a shortlink holds.
+const maxShortlinkSize = 8 << 10
+
+// shortlinkTarget returns the URL in content and whether it is one a
+// shortlink may hold: an absolute http or https URL, on its own.
+func shortlinkTarget(content string) (string, bool) {
+	target := strings.TrimSpace(content)
+	if len(target) > maxShortlinkSize || strings.ContainsAny(target, " \t\r\n") {
+		return "", false
+	}
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", false
+	}
+	return target, true
+}
+
+// checkShortlink answers the request itself and returns false unless body
+// is a URL a shortlink may hold.
+func checkShortlink(w http.ResponseWriter, body []byte) bool {
+	if _, ok := shortlinkTarget(string(body)); !ok {
+		http.Error(w, "A shortlink must be an http or https URL", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// serveShortlink sends the reader of shortlink id on to its URL.
+func (s *Server) serveShortlink(w http.ResponseWriter, r *http.Request, id, user string) {
+	content, ok := s.store().Get(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	target, ok := shortlinkTarget(content)
+	if !ok {
+		http.Error(w, "This shortlink's URL is invalid", http.StatusInternalServerError)
+		return
+	}
+	if !s.claimRead(w, r, id) {
+		return
+	}
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
+	s.events.publish(event{kind: eventRead, id: id, url: constructURL(r, id), user: user, requestID: RequestID(r.Context())})
+}
@@ -0,0 +1,207 @@
+// Package httpapi implements HMAC request signing for mutating requests, as
+// middleware for deployments on semi-trusted networks. Clients share a
+// secret with the server under a key ID and send
+//
+//	X-Pb-Key:       the key ID
+//	X-Pb-Timestamp: Unix seconds
+//	X-Pb-Nonce:     8 to 128 random characters, never reused
+//	X-Pb-Signature: hex HMAC-SHA256 of the string to sign
+//
+// where the string to sign is the method, the request URI (path and query),
+// the timestamp, the nonce and the hex SHA-256 of the body, each followed by
+// a newline. Requests outside the allowed clock skew or repeating a nonce
+// seen within it are refused, so a captured request can't be replayed.
+// Uploads over SSH and WebSocket editing sessions can't carry a signature,
+// so they are refused outright.
+package httpapi
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"pb/internal/clock"
+)
+
+const (
+	defaultMaxSkew      = 5 * time.Minute
+	minNonceLength      = 8
+	maxNonceLength      = 128
+	signatureHeader     = "X-Pb-Signature"
+	signingKeyHeader    = "X-Pb-Key"
+	signingTimeHeader   = "X-Pb-Timestamp"
+	signingNonceHeader  = "X-Pb-Nonce"
+	unsignedErrorPrefix = "Request signature required: "
+)
+
+// SigningOptions configures RequireSignatures.
+type SigningOptions struct {
+	// Keys are the shared secrets requests are signed with, by key ID.
+	Keys map[string][]byte
+	// MaxSkew is how far a request's timestamp may be from the server's
+	// clock, 5 minutes if zero.
+	MaxSkew time.Duration
+	// MaxBodySize caps the bodies read to check signatures, 1 MiB if zero.
+	MaxBodySize int64
+}
+
+// LoadSigningKeys reads a file of "<key ID> <base64 secret>" lines.
+func LoadSigningKeys(fileName string) (map[string][]byte, error) {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string][]byte)
+	for n, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, secret, _ := strings.Cut(line, " ")
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(secret))
+		if err != nil || len(raw) < 16 {
+			return nil, fmt.Errorf("%s:%d: want a key ID and a base64 secret of at least 16 bytes", fileName, n+1)
+		}
+		keys[id] = raw
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys", fileName)
+	}
+	return keys, nil
+}
+
+type signatureChecker struct {
+	next    http.Handler
+	keys    map[string][]byte
+	maxSkew time.Duration
+	maxBody int64
+	// clock checks timestamps against the clients' clocks, so it runs in
+	// real time even when the server's clock is stopped.
+	clock clock.Clock
+
+	mu sync.Mutex
+	// nonces maps key ID and nonce to when they stop mattering: once the
+	// timestamp they came with is outside the skew, so are replays.
+	nonces    map[string]time.Time
+	lastSweep time.Time
+}
+
+// RequireSignatures wraps next so that POST, PUT and DELETE requests must
+// be signed with one of opts.Keys. Reads pass straight through. Seen nonces
+// are kept in memory only.
+func RequireSignatures(next http.Handler, opts SigningOptions) http.Handler {
+	c := &signatureChecker{
+		next:    next,
+		keys:    opts.Keys,
+		maxSkew: opts.MaxSkew,
+		maxBody: opts.MaxBodySize,
+		clock:   clock.System,
+		nonces:  make(map[string]time.Time),
+	}
+	if c.maxSkew == 0 {
+		c.maxSkew = defaultMaxSkew
+	}
+	if c.maxBody == 0 {
+		c.maxBody = defaultMaxPasteSize
+	}
+	return c
+}
+
+func (c *signatureChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if webSocketUpgrade(r) {
+		http.Error(w, "Editing together is disabled, as this server only takes signed requests", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodPost, http.MethodPut, http.MethodDelete:
+	default:
+		c.next.ServeHTTP(w, r)
+		return
+	}
+	if overSSH(r) {
+		http.Error(w, "Uploads over SSH are disabled, as this server only takes signed requests", http.StatusForbidden)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, c.maxBody))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Paste too large: the limit is "+formatSize(tooLarge.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	if err := c.verify(r, body); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	c.next.ServeHTTP(w, r)
+}
+
+// verify checks r's signature over body and records its nonce.
+func (c *signatureChecker) verify(r *http.Request, body []byte) error {
+	keyID, timestamp := r.Header.Get(signingKeyHeader), r.Header.Get(signingTimeHeader)
+	nonce, signature := r.Header.Get(signingNonceHeader), r.Header.Get(signatureHeader)
+	if keyID == "" || timestamp == "" || nonce == "" || signature == "" {
+		return errors.New(unsignedErrorPrefix + "send " + signingKeyHeader + ", " + signingTimeHeader + ", " + signingNonceHeader + " and " + signatureHeader)
+	}
+	secret, ok := c.keys[keyID]
+	if !ok {
+		return errors.New("Unknown signing key")
+	}
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("Invalid signature timestamp")
+	}
+	now := c.clock.Now()
+	at := time.Unix(sec, 0)
+	if at.Before(now.Add(-c.maxSkew)) || at.After(now.Add(c.maxSkew)) {
+		return errors.New("Signature timestamp is too far from the server's clock")
+	}
+	if len(nonce) < minNonceLength || len(nonce) > maxNonceLength {
+		return fmt.Errorf("Nonce must be %d to %d characters", minNonceLength, maxNonceLength)
+	}
+	want := Sign(secret, r.Method, r.URL.RequestURI(), timestamp, nonce, body)
+	if !hmac.Equal([]byte(signature), []byte(want)) {
+		return errors.New("Invalid signature")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.lastSweep) > c.maxSkew {
+		for key, expires := range c.nonces {
+			if now.After(expires) {
+				delete(c.nonces, key)
+			}
+		}
+		c.lastSweep = now
+	}
+	key := keyID + " " + nonce
+	if expires, seen := c.nonces[key]; seen && !now.After(expires) {
+		return errors.New("Nonce already used")
+	}
+	c.nonces[key] = at.Add(c.maxSkew)
+	return nil
+}
+
+// Sign returns the hex signature of a request, as clients compute it.
+func Sign(secret []byte, method, requestURI, timestamp, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s\n", method, requestURI, timestamp, nonce, hex.EncodeToString(bodyHash[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
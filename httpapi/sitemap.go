@@ -0,0 +1,92 @@
+// Package httpapi implements /robots.txt and /sitemap.xml, through which
+// operators decide what search engines see. The sitemap lists the public
+// pastes that are meant to last: private, flagged, draft, decoy, password
+// protected, encrypted and expiring pastes and shortlinks are left out, and
+// so are those created with noindex. robots.txt is the operator's file as it stands, or
+// by default one keeping crawlers out of the API and admin pages and
+// pointing them at the sitemap.
+package httpapi
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"pb/store"
+)
+
+// sitemapMaxURLs is the most URLs one sitemap may hold.
+const sitemapMaxURLs = 50000
+
+// defaultRobots is served as robots.txt when Options.Robots is unset.
+const defaultRobots = `User-agent: *
+Disallow: /admin/
+Disallow: /api/
+Disallow: /search
+`
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod"`
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+// inSitemap reports whether search engines should be pointed at info.
+func inSitemap(info store.Info) bool {
+	return visibleTo(info, "") && !info.Honeytoken && !info.NoIndex &&
+		!info.HasViewPassword && !info.Encrypted && !info.Redirect && info.Expires.IsZero() && info.MaxReads == 0
+}
+
+// serveRobots serves robots.txt.
+func (s *Server) serveRobots(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if s.robots != nil {
+		w.Write(s.robots)
+		return
+	}
+	io.WriteString(w, defaultRobots)
+	if s.sitemap {
+		fmt.Fprintf(w, "Sitemap: %s\n", constructURL(r, "sitemap.xml"))
+	}
+}
+
+// serveSitemap serves the sitemap of public pastes, newest first.
+func (s *Server) serveSitemap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.sitemap {
+		http.NotFound(w, r)
+		return
+	}
+	set := sitemapURLSet{URLs: []sitemapURL{}}
+	for _, info := range s.store().All() {
+		if len(set.URLs) == sitemapMaxURLs {
+			break
+		}
+		if !inSitemap(info) {
+			continue
+		}
+		modified := info.Created
+		if info.Updated.After(modified) {
+			modified = info.Updated
+		}
+		set.URLs = append(set.URLs, sitemapURL{Loc: constructURL(r, info.ID), LastMod: modified.UTC().Format(time.RFC3339)})
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", " ")
+	enc.Encode(set)
+}
@@ -0,0 +1,105 @@
+// Package httpapi implements per-user paste names. Every account has a
+// namespace, /~{user}/, where it can give its pastes names of its own
+// choosing: PUT /~alice/notes creates alice's paste "notes" the first time
+// and replaces its content after that. A named paste is served at its name
+// as at its ID, suffixes included, and only its owner may change it.
+package httpapi
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"pb/store"
+)
+
+// slugPath is the path of user's paste named slug, less its leading slash.
+func slugPath(user, slug string) string {
+	return "~" + user + "/" + slug
+}
+
+// serveSlug serves /~{user}/{slug}, and what follows it, as the snippet it
+// names. PUT or POST to a name that is free creates the snippet, for its
+// owner only.
+func (s *Server) serveSlug(w http.ResponseWriter, r *http.Request) {
+	owner, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/~"), "/")
+	slug, suffix := splitSnippetPath(rest)
+	if owner == "" || !store.ValidID(slug) {
+		http.NotFound(w, r)
+		return
+	}
+	user, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	if id, ok := s.store().Slug(owner, slug); ok {
+		if r.Method == http.MethodPost && suffix == "" {
+			http.Error(w, fmt.Sprintf("~%s/%s is taken", owner, slug), http.StatusConflict)
+			return
+		}
+		r = r.Clone(r.Context())
+		r.URL.Path = "/" + id
+		if suffix != "" {
+			r.URL.Path += "/" + suffix
+		}
+		s.routeSnippet(w, r, id, suffix, user)
+		return
+	}
+
+	if suffix != "" || (r.Method != http.MethodPut && r.Method != http.MethodPost) {
+		// Named snippets not replicated yet are only on the primary.
+		if !s.forward(w, r) {
+			http.NotFound(w, r)
+		}
+		return
+	}
+	if user == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="pb"`)
+		http.Error(w, "Log in to name a paste", http.StatusUnauthorized)
+		return
+	}
+	if user != owner {
+		http.Error(w, fmt.Sprintf("Only %s can name pastes under ~%s", owner, owner), http.StatusForbidden)
+		return
+	}
+	r = r.Clone(r.Context())
+	r.Method = http.MethodPost
+	r.URL.Path = "/"
+	query := r.URL.Query()
+	query.Set("slug", slug)
+	r.URL.RawQuery = query.Encode()
+	s.routeSnippet(w, r, "", "", user)
+}
+
+// checkSlug answers the request itself and returns false if user may not
+// name a new snippet slug. Like checkCustomID it catches a name in use
+// before the upload when it can.
+func (s *Server) checkSlug(w http.ResponseWriter, user, slug string) bool {
+	if user == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="pb"`)
+		http.Error(w, "Log in to name a paste", http.StatusUnauthorized)
+		return false
+	}
+	if !store.ValidID(slug) {
+		http.Error(w, fmt.Sprintf("Invalid name %q: use up to 64 letters, digits, - and _", slug), http.StatusBadRequest)
+		return false
+	}
+	if _, taken := s.store().Slug(user, slug); taken {
+		http.Error(w, fmt.Sprintf("~%s/%s is taken", user, slug), http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// takenMessage explains a create with opts that the store turned down
+// because its ID or name was in use by then.
+func takenMessage(opts store.CreateOptions) string {
+	switch {
+	case opts.Slug == "":
+		return fmt.Sprintf("The ID %q is taken", opts.ID)
+	case opts.ID == "":
+		return fmt.Sprintf("~%s/%s is taken", opts.Owner, opts.Slug)
+	}
+	return fmt.Sprintf("The ID %q or ~%s/%s is taken", opts.ID, opts.Owner, opts.Slug)
+}
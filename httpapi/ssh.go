@@ -0,0 +1,261 @@
+// Package httpapi implements the SSH upload service, so that
+//
+//	echo hi | ssh -p 2222 pb.example
+//
+// creates a paste and prints its URL. Users add their public keys at
+// /sshkeys; pastes from keys nobody added are anonymous and come with an
+// edit token, as over HTTP. Arguments to the command are the creation
+// fields of a raw POST (ext=go, ttl=1h, read=1, lang=go, view_pass=...,
+// private), and the upload goes through the same handler, wrapped as the
+// HTTP listener's is, so rate limits, address filters, tiers, plugins,
+// policies and moderation all apply.
+package httpapi
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+
+	"pb/auth"
+)
+
+// SSHOptions configures ServeSSH.
+type SSHOptions struct {
+	// Addr is the address to listen on, e.g. ":2222".
+	Addr string
+	// HostKey is the file holding the server's private host key. It is
+	// created with a new Ed25519 key if missing.
+	HostKey string
+	// Host is the host, and port if any, of the URLs handed out.
+	Host string
+	// Handler is what uploads go through: the server wrapped in the same
+	// rate limiter, address filter and signature check as the HTTP
+	// listener. The server itself if nil.
+	Handler http.Handler
+}
+
+// ServeSSH accepts uploads over SSH until ctx is done.
+func (s *Server) ServeSSH(ctx context.Context, opts SSHOptions) error {
+	signer, err := loadHostKey(opts.HostKey)
+	if err != nil {
+		return err
+	}
+	s.sshHandler = opts.Handler
+	if s.sshHandler == nil {
+		s.sshHandler = s
+	}
+	srv := &ssh.Server{
+		Addr: opts.Addr,
+		Handler: func(sess ssh.Session) {
+			if s.requireSSH(sess) {
+				s.serveSSHSession(sess, opts.Host)
+			}
+		},
+		SubsystemHandlers: map[string]ssh.SubsystemHandler{
+			"sftp": func(sess ssh.Session) {
+				if s.requireSSH(sess) {
+					s.serveSFTP(sess, opts.Host)
+				}
+			},
+		},
+		// Every key gets in; only the ones added at /sshkeys get an owner.
+		PublicKeyHandler: func(ssh.Context, ssh.PublicKey) bool { return true },
+	}
+	srv.AddHostKey(signer)
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	slog.Info("SSH uploads are enabled", "addr", opts.Addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, ssh.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// requireSSH ends sess and returns false if SSH uploads are switched off.
+// The listener stays up, so they can be switched on again.
+func (s *Server) requireSSH(sess ssh.Session) bool {
+	if s.features.enabled(FeatureSSH) {
+		return true
+	}
+	fmt.Fprintln(sess.Stderr(), "SSH uploads are disabled for now")
+	sess.Exit(1)
+	return false
+}
+
+// loadHostKey reads the PEM private key in fileName, generating one first if
+// there is none.
+func loadHostKey(fileName string) (gossh.Signer, error) {
+	content, err := os.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		block, err := gossh.MarshalPrivateKey(key, "pb host key")
+		if err != nil {
+			return nil, err
+		}
+		content = pem.EncodeToMemory(block)
+		if err := os.WriteFile(fileName, content, 0600); err != nil {
+			return nil, err
+		}
+		slog.Info("Generated SSH host key", "file", fileName)
+	} else if err != nil {
+		return nil, err
+	}
+	return gossh.ParsePrivateKey(content)
+}
+
+// serveSSHSession creates a paste from the session's input and prints its
+// URL, or the error to stderr. The scp and ls commands are handed on.
+func (s *Server) serveSSHSession(sess ssh.Session, host string) {
+	user := s.users.SSHUser(sess.PublicKey())
+	switch cmd := sess.Command(); {
+	case len(cmd) > 0 && cmd[0] == "scp":
+		s.serveSCP(sess, user, host, cmd[1:])
+		return
+	case len(cmd) == 1 && cmd[0] == "ls":
+		s.serveSSHList(sess, user, host)
+		return
+	}
+
+	fields := url.Values{}
+	for _, arg := range sess.Command() {
+		key, value, found := strings.Cut(arg, "=")
+		if !found {
+			value = "1"
+		}
+		fields.Set(key, value)
+	}
+	rec := s.sshCreate(sess, user, host, sess, fields)
+	if rec.Code != http.StatusCreated {
+		fmt.Fprint(sess.Stderr(), rec.Body.String())
+		sess.Exit(1)
+		return
+	}
+	if token := rec.Header().Get(editTokenHeader); token != "" {
+		fmt.Fprintln(sess.Stderr(), "edit token:", token)
+	}
+	fmt.Fprintln(sess, rec.Body.String())
+	sess.Exit(0)
+}
+
+// sshKey marks the context of uploads made over SSH.
+type sshKey struct{}
+
+// overSSH reports whether r is an upload made over SSH.
+func overSSH(r *http.Request) bool {
+	return r.Context().Value(sshKey{}) != nil
+}
+
+// sshCreate runs a raw POST of body with fields through the handler of
+// ServeSSH on behalf of user, from the session's address, and returns the
+// recorded response.
+func (s *Server) sshCreate(sess ssh.Session, user, host string, body io.Reader, fields url.Values) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	ctx := context.WithValue(auth.WithUser(sess.Context(), user), requestIDKey{}, newRequestID())
+	// The URLs handed out are for the HTTPS front end.
+	ctx = context.WithValue(ctx, schemeKey{}, "https")
+	ctx = context.WithValue(ctx, sshKey{}, true)
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, "/?"+fields.Encode(), body)
+	if err != nil {
+		http.Error(rec, err.Error(), http.StatusBadRequest)
+		return rec
+	}
+	r.Host = host
+	r.RemoteAddr = sess.RemoteAddr().String()
+	r.Header.Set("Content-Type", "text/plain")
+	r.Header.Set("User-Agent", "ssh")
+
+	s.sshHandler.ServeHTTP(rec, r)
+	slog.Info("SSH upload", "user", user, "status", rec.Code, "remote", r.RemoteAddr, "request_id", RequestID(ctx))
+	return rec
+}
+
+// serveSSHList prints the URLs of the user's pastes, newest first, with
+// their size and language.
+func (s *Server) serveSSHList(sess ssh.Session, user, host string) {
+	if user == "" {
+		fmt.Fprintln(sess.Stderr(), "Add this key at /sshkeys to list your pastes")
+		sess.Exit(1)
+		return
+	}
+	for _, info := range s.store().ListByOwner(user) {
+		fmt.Fprintf(sess, "https://%s/%s\t%s\t%d\t%s\n", host, info.ID, info.Created.Format(time.DateTime), info.Size, info.Lang)
+	}
+	sess.Exit(0)
+}
+
+// serveSSHKeys manages the caller's SSH keys: GET lists their fingerprints,
+// POST adds the keys in the body, one authorized_keys line each, and DELETE
+// removes the one given as ?fingerprint=.
+func (s *Server) serveSSHKeys(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.users.Authenticate(r)
+	if !ok || user == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="pb"`)
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		for _, fingerprint := range s.users.SSHKeys(user) {
+			fmt.Fprintln(w, fingerprint)
+		}
+
+	case http.MethodPost:
+		body, ok := s.readBody(w, r)
+		if !ok {
+			return
+		}
+		var added []string
+		for _, line := range strings.Split(string(body), "\n") {
+			if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			fingerprint, err := s.users.AddSSHKey(user, line)
+			if errors.Is(err, auth.ErrSSHKeyTaken) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			added = append(added, fingerprint)
+		}
+		if len(added) == 0 {
+			http.Error(w, "Send public keys in authorized_keys format as the request body", http.StatusBadRequest)
+			return
+		}
+		slog.Info("Added SSH keys", "user", user, "count", len(added), "request_id", RequestID(r.Context()))
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintln(w, strings.Join(added, "\n"))
+
+	case http.MethodDelete:
+		if !s.users.RemoveSSHKey(user, r.URL.Query().Get("fingerprint")) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
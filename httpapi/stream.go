@@ -0,0 +1,129 @@
+// Package httpapi implements streamed pastes. Raw request bodies go
+// straight to disk as they arrive, and plain-text and binary responses are
+// copied from disk, so multi-megabyte pastes don't sit in memory. Uploads
+// that something must inspect first, namely plugins with a validate hook,
+// create policies, content filters, DNS opt-ins, shortlinks, forms and
+// JSON, are still read whole.
+package httpapi
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"pb/store"
+)
+
+// streamsCreate reports whether the paste created by r can be streamed to
+// disk, with nothing needing its content beforehand.
+func (s *Server) streamsCreate(r *http.Request) bool {
+	query := r.URL.Query()
+	return rawBody(r) && query.Get("dns") != "1" && query.Get("u") != "1" && query.Get("unpack") != "1" && !s.plugins.validates() && !s.policies.has("create") && len(s.filters) == 0
+}
+
+// pasteTooLargeError is what a limitPaste reader fails with past its cap.
+type pasteTooLargeError struct {
+	message string
+}
+
+func (e *pasteTooLargeError) Error() string { return e.message }
+
+// limitPaste caps body as checkPasteSize and checkTierLimits would: at the
+// text or binary limit, whichever applies to what the body starts with, or
+// at user's tier limit if that is lower.
+func (s *Server) limitPaste(body io.Reader, encrypted bool, user string) io.Reader {
+	br := bufio.NewReaderSize(body, 512)
+	// A failure here comes back on the first Read.
+	head, _ := br.Peek(512)
+	limit, kind := s.maxPasteSize, "Paste"
+	if store.DetectMediaType(string(head), encrypted) != "" {
+		limit, kind = s.maxBinarySize, "Binary paste"
+	}
+	err := &pasteTooLargeError{fmt.Sprintf("%s too large: the limit is %s", kind, formatSize(limit))}
+	if name, tier := s.tierOf(user); tier.MaxPasteSize > 0 && tier.MaxPasteSize < limit {
+		limit = tier.MaxPasteSize
+		err = &pasteTooLargeError{fmt.Sprintf("Paste too large: the %s tier allows up to %s", name, formatSize(limit))}
+	}
+	return &limitedPaste{r: br, remaining: limit, err: err}
+}
+
+// limitedPaste reads up to remaining bytes and fails with err if there are
+// more.
+type limitedPaste struct {
+	r         io.Reader
+	remaining int64
+	err       error
+}
+
+func (l *limitedPaste) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, l.err
+	}
+	// Read one byte past the limit to tell a body that ends there from
+	// one that goes on.
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n + int(l.remaining), l.err
+	}
+	return n, err
+}
+
+// pasteError answers a request whose streamed body could not be stored.
+func (s *Server) pasteError(w http.ResponseWriter, err error) {
+	var tooLarge *pasteTooLargeError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, tooLarge.message, http.StatusRequestEntityTooLarge)
+		return
+	}
+	s.bodyError(w, err)
+}
+
+// createStreamed creates a paste from the raw body of r as it arrives,
+// answering failures itself.
+func (s *Server) createStreamed(w http.ResponseWriter, r *http.Request, user string) (string, store.CreateOptions, bool) {
+	fields := r.URL.Query()
+	if pass := r.Header.Get(viewPasswordHeader); pass != "" {
+		fields.Set("view_pass", pass)
+	}
+	opts := store.CreateOptions{
+		Owner:     user,
+		Private:   fields.Get("private") == "1",
+		Encrypted: fields.Get("encrypted") == "1",
+		Draft:     fields.Get("draft") == "1",
+	}
+	// The size is checked as the body is read.
+	if !s.checkTierLimits(w, user, 0, true) || !s.applyCreateFields(w, user, fields, &opts) {
+		return "", opts, false
+	}
+	if user == "" {
+		opts.EditToken = newEditToken()
+	}
+	id, err := s.store().CreateFrom(s.limitPaste(r.Body, opts.Encrypted, user), opts)
+	if errors.Is(err, store.ErrIDTaken) {
+		http.Error(w, takenMessage(opts), http.StatusConflict)
+		return "", opts, false
+	}
+	if err != nil {
+		s.pasteError(w, err)
+		return "", opts, false
+	}
+	if opts.EditToken != "" {
+		w.Header().Set(editTokenHeader, opts.EditToken)
+	}
+	return id, opts, true
+}
+
+// serveText writes a text paste as it is, from disk.
+func serveText(w http.ResponseWriter, content io.Reader, suffix string) {
+	if suffix == "" {
+		w.Header().Add("Vary", "Accept")
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.Copy(w, content)
+}
@@ -0,0 +1,136 @@
+// Package httpapi implements paste templates. Any text snippet with
+// {{name}} placeholders is a template: GET /{id}/fill shows browsers a form
+// asking for each value, or lists the names for other clients, and POST
+// /{id}/fill with the values as form fields creates a new snippet with them
+// filled in, leaving the template as it was.
+package httpapi
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// placeholderPattern matches a placeholder such as {{host}} or
+// {{ incident title }}, capturing its name.
+var placeholderPattern = regexp.MustCompile(`\{\{\s*([\w.-]+(?: [\w.-]+)*)\s*\}\}`)
+
+// maxPlaceholders is the most distinct placeholders a template form asks
+// for; any beyond it are left as they are.
+const maxPlaceholders = 50
+
+var fillForm = template.Must(template.New("fill").Parse(`<form method="post">
+<p>Fill in this template to create a new paste from it.</p>
+{{range .}}<p><label>{{.}}<br><textarea name="{{.}}" rows="2" cols="60"></textarea></label></p>
+{{end}}<input type="submit" value="Create paste">
+</form>
+`))
+
+// placeholders returns the names of the placeholders in content, in the
+// order they first appear.
+func placeholders(content string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, m := range placeholderPattern.FindAllStringSubmatch(content, -1) {
+		if name := m[1]; !seen[name] && len(names) < maxPlaceholders {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// fillPlaceholders replaces the placeholders in content named in values,
+// leaving the others as they are.
+func fillPlaceholders(content string, values url.Values) string {
+	names := make(map[string]bool)
+	for _, name := range placeholders(content) {
+		names[name] = true
+	}
+	return placeholderPattern.ReplaceAllStringFunc(content, func(marker string) string {
+		name := placeholderPattern.FindStringSubmatch(marker)[1]
+		if !names[name] || !values.Has(name) {
+			return marker
+		}
+		return values.Get(name)
+	})
+}
+
+// serveFill shows the form for template id on GET /{id}/fill and creates
+// the filled-in snippet on POST.
+func (s *Server) serveFill(w http.ResponseWriter, r *http.Request, id, user string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	info, ok := s.store().Meta(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !s.checkPrivate(w, r, id, user) || !s.checkReadPolicies(w, r, id, user) {
+		return
+	}
+	s.checkHoneytoken(r, id, user)
+	if !s.checkViewPassword(w, r, id, user) {
+		return
+	}
+	if info.Encrypted || info.MediaType != "" {
+		http.Error(w, "Only text snippets can be templates", http.StatusBadRequest)
+		return
+	}
+	content, ok := s.store().Get(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	names := placeholders(content)
+
+	if r.Method == http.MethodGet {
+		w.Header().Add("Vary", "Accept")
+		if !prefersHTML(r) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			for _, name := range names {
+				fmt.Fprintln(w, name)
+			}
+			return
+		}
+		var body strings.Builder
+		if err := fillForm.Execute(&body, names); err != nil {
+			http.Error(w, "Failed to render template form", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		pageTemplate.Execute(w, page{Title: "Fill in " + id, Body: template.HTML(body.String())})
+		return
+	}
+
+	if !s.creates.acquire(w, r) {
+		return
+	}
+	defer s.creates.release()
+	if !s.parseForm(w, r) {
+		return
+	}
+	if !s.claimRead(w, r, id) {
+		return
+	}
+	fields := url.Values{"lang": {info.Lang}}
+	newID, _, ok := s.createPaste(w, r, user, []byte(fillPlaceholders(content, r.PostForm)), fields)
+	if !ok {
+		return
+	}
+	s.events.publish(event{kind: eventRead, id: id, url: constructURL(r, id), user: user, requestID: RequestID(r.Context())})
+	url := constructURL(r, newID)
+	s.events.publish(event{kind: eventCreate, id: newID, url: url, user: user, requestID: RequestID(r.Context())})
+	if prefersHTML(r) {
+		http.Redirect(w, r, url, http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Location", url)
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprint(w, url)
+}
@@ -0,0 +1,115 @@
+// Package httpapi implements highlighting themes. HTML views of a snippet
+// load the highlight.js stylesheet of the theme asked for with ?theme=, and
+// remember it in a cookie: for every snippet, or with scope=paste for that
+// snippet alone. Without one, pages follow the browser's
+// prefers-color-scheme, light or dark.
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+)
+
+// themeCookie holds the theme a reader picked.
+const themeCookie = "pb_theme"
+
+// themeCookieAge is how long a picked theme is remembered, in seconds.
+const themeCookieAge = 365 * 24 * 60 * 60
+
+// highlightTheme is a stylesheet of the highlight.js build pages load
+// (highlightScript), by the name ?theme= takes.
+type highlightTheme struct {
+	Name string `json:"name"`
+	Dark bool   `json:"dark"`
+	// file is the stylesheet's path under styles/ in the build.
+	file string
+}
+
+// highlightThemes are the themes readers can pick. The first light and
+// the first dark one are the defaults.
+var highlightThemes = []highlightTheme{
+	{Name: "default", file: "default"},
+	{Name: "atom-one-dark", Dark: true, file: "atom-one-dark"},
+	{Name: "atom-one-light", file: "atom-one-light"},
+	{Name: "github", file: "github"},
+	{Name: "github-dark", Dark: true, file: "github-dark"},
+	{Name: "github-dark-dimmed", Dark: true, file: "github-dark-dimmed"},
+	{Name: "monokai", Dark: true, file: "monokai"},
+	{Name: "nord", Dark: true, file: "nord"},
+	{Name: "solarized-light", file: "base16/solarized-light"},
+	{Name: "solarized-dark", Dark: true, file: "base16/solarized-dark"},
+	{Name: "tokyo-night-light", file: "tokyo-night-light"},
+	{Name: "tokyo-night-dark", Dark: true, file: "tokyo-night-dark"},
+	{Name: "vs", file: "vs"},
+	{Name: "vs2015", Dark: true, file: "vs2015"},
+}
+
+func findTheme(name string) (highlightTheme, bool) {
+	for _, t := range highlightThemes {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return highlightTheme{}, false
+}
+
+// themeLinks are the stylesheet links of theme name, or with "" those of
+// the default light and dark themes, each for its color scheme.
+func themeLinks(name string) template.HTML {
+	const link = `<link rel="stylesheet" href="https://cdnjs.cloudflare.com/ajax/libs/highlight.js/11.9.0/styles/%s.min.css"%s>`
+	if t, ok := findTheme(name); ok {
+		return template.HTML(fmt.Sprintf(link, t.file, ""))
+	}
+	var light, dark string
+	for _, t := range highlightThemes {
+		switch {
+		case t.Dark && dark == "":
+			dark = t.file
+		case !t.Dark && light == "":
+			light = t.file
+		}
+	}
+	return template.HTML(fmt.Sprintf(link, light, ` media="(prefers-color-scheme: light)"`) + "\n" +
+		fmt.Sprintf(link, dark, ` media="(prefers-color-scheme: dark)"`))
+}
+
+// selectTheme returns the theme HTML views of snippet id are shown in for
+// r, "" following the color scheme. A ?theme= naming one is remembered,
+// for id alone with scope=paste, and theme=auto forgets it again.
+func selectTheme(w http.ResponseWriter, r *http.Request, id string) string {
+	query := r.URL.Query()
+	name := query.Get("theme")
+	if name == "" {
+		if c, err := r.Cookie(themeCookie); err == nil {
+			if _, ok := findTheme(c.Value); ok {
+				return c.Value
+			}
+		}
+		return ""
+	}
+	if _, ok := findTheme(name); !ok && name != "auto" {
+		return ""
+	}
+	cookie := &http.Cookie{Name: themeCookie, Value: name, Path: "/", MaxAge: themeCookieAge, SameSite: http.SameSiteLaxMode}
+	if query.Get("scope") == "paste" {
+		cookie.Path = "/" + id
+	}
+	if name == "auto" {
+		cookie.Value, cookie.MaxAge = "", -1
+		name = ""
+	}
+	http.SetCookie(w, cookie)
+	return name
+}
+
+// serveThemes lists the themes ?theme= takes at /api/v1/themes.
+func (s *Server) serveThemes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(highlightThemes)
+}
@@ -0,0 +1,139 @@
+// Package httpapi implements service tiers: each account belongs to a tier
+// (free unless an admin assigns another) that sets its quotas and which
+// optional features it may use, so hosted instances can offer different
+// service levels.
+package httpapi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"pb/auth"
+)
+
+// defaultTier is the tier of anonymous users and of accounts without one.
+const defaultTier = "free"
+
+// Tier is the set of limits and features of a service level. Zero limits
+// are unlimited.
+type Tier struct {
+	// MaxPasteSize caps each paste below the server-wide -max-size; a
+	// higher cap is what "large files" means for a tier.
+	MaxPasteSize int64
+	// MaxPastes caps how many pastes an account may store at once.
+	MaxPastes int
+	// MaxTTL is the longest expiry the tier may ask for.
+	MaxTTL time.Duration
+	// CustomAliases allows choosing a paste's ID.
+	CustomAliases bool
+	// Invites caps how many invite codes an account may issue in all; a
+	// negative budget allows none.
+	Invites int
+}
+
+// DefaultTiers returns the tiers used when Options.Tiers is nil. Custom
+// tier sets should include "free", the default tier; without it the
+// default is unlimited.
+func DefaultTiers() map[string]Tier {
+	return map[string]Tier{
+		"free": {
+			MaxPasteSize: 256 << 10,
+			MaxPastes:    1000,
+			MaxTTL:       30 * 24 * time.Hour,
+			Invites:      3,
+		},
+		"supporter": {
+			MaxPastes:     10000,
+			MaxTTL:        365 * 24 * time.Hour,
+			CustomAliases: true,
+			Invites:       20,
+		},
+		"staff": {
+			CustomAliases: true,
+		},
+	}
+}
+
+// tierOf returns the name and limits of user's tier. Tiers assigned under
+// a name that is no longer configured fall back to the default.
+func (s *Server) tierOf(user string) (string, Tier) {
+	name := defaultTier
+	if user != "" {
+		if assigned := s.users.Tier(user); assigned != "" {
+			name = assigned
+		}
+	}
+	if tier, ok := s.tiers[name]; ok {
+		return name, tier
+	}
+	return defaultTier, s.tiers[defaultTier]
+}
+
+// checkTierLimits answers the request itself and returns false if user's
+// tier doesn't allow a paste of size bytes, or, when creating, another
+// paste at all.
+func (s *Server) checkTierLimits(w http.ResponseWriter, user string, size int, creating bool) bool {
+	name, tier := s.tierOf(user)
+	if tier.MaxPasteSize > 0 && int64(size) > tier.MaxPasteSize {
+		http.Error(w, fmt.Sprintf("Paste too large: the %s tier allows up to %s", name, formatSize(tier.MaxPasteSize)), http.StatusRequestEntityTooLarge)
+		return false
+	}
+	// Anonymous pastes share one owner, so they have no count quota.
+	if creating && user != "" && tier.MaxPastes > 0 && len(s.store().ListByOwner(user)) >= tier.MaxPastes {
+		http.Error(w, fmt.Sprintf("Quota reached: the %s tier stores up to %d pastes", name, tier.MaxPastes), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// serveTier shows a user's tier on GET /admin/tier?user=, and on POST
+// assigns the tier form field to the user form field; an empty tier puts
+// the user back on the default.
+func (s *Server) serveTier(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		user := r.URL.Query().Get("user")
+		if user == "" {
+			names := make([]string, 0, len(s.tiers))
+			for name := range s.tiers {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				fmt.Fprintln(w, name)
+			}
+			return
+		}
+		name, _ := s.tierOf(user)
+		fmt.Fprintln(w, name)
+
+	case http.MethodPost:
+		if !s.parseForm(w, r) {
+			return
+		}
+		user, tier := r.FormValue("user"), r.FormValue("tier")
+		if _, ok := s.tiers[tier]; tier != "" && !ok {
+			http.Error(w, fmt.Sprintf("Unknown tier %q", tier), http.StatusBadRequest)
+			return
+		}
+		if err := s.users.SetTier(user, tier); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, auth.ErrNoSuchUser) {
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		name, _ := s.tierOf(user)
+		fmt.Fprintf(w, "%s is now on the %s tier\n", user, name)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
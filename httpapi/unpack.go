@@ -0,0 +1,205 @@
+// Package httpapi implements unpacked uploads: a zip, tar or tar.gz sent
+// with unpack=1 becomes one paste per file in it, each going through the
+// same checks as a paste of its own, and an index paste listing them as
+// Markdown links, whose URL is the answer. That shares a small project tree
+// as one link. Either every file is stored or, if one is refused, none is.
+package httpapi
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+
+	"pb/store"
+)
+
+const (
+	// maxUnpackFiles caps the files an unpacked upload may hold.
+	maxUnpackFiles = 100
+	// maxUnpackedSize caps their total size once unpacked.
+	maxUnpackedSize = 16 << 20
+)
+
+// unpackedFile is a file read from an uploaded archive.
+type unpackedFile struct {
+	path    string
+	content []byte
+}
+
+// unpackArchive returns the regular files in the zip, tar or tar.gz
+// archive body, in archive order, leaving out directories, links and the
+// __MACOSX folders macOS adds to zips.
+func unpackArchive(body []byte) ([]unpackedFile, error) {
+	var files []unpackedFile
+	total := 0
+	add := func(name string, size int64, r io.Reader) error {
+		name = strings.TrimPrefix(path.Clean("/"+name), "/")
+		if name == "" || name == "." || strings.HasPrefix(name, "__MACOSX/") {
+			return nil
+		}
+		if len(files) == maxUnpackFiles {
+			return fmt.Errorf("archive holds more than %d files", maxUnpackFiles)
+		}
+		if size < 0 || int64(total)+size > maxUnpackedSize {
+			return fmt.Errorf("archive unpacks to more than %s", formatSize(maxUnpackedSize))
+		}
+		// Sizes in headers can lie; the content can't be longer than them.
+		content, err := io.ReadAll(io.LimitReader(r, size+1))
+		if err != nil {
+			return err
+		}
+		if int64(len(content)) > size {
+			return fmt.Errorf("%s is larger than the archive says", name)
+		}
+		total += len(content)
+		files = append(files, unpackedFile{path: name, content: content})
+		return nil
+	}
+
+	if bytes.HasPrefix(body, []byte("PK\x03\x04")) {
+		zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range zr.File {
+			if !f.Mode().IsRegular() {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			err = add(f.Name, int64(f.UncompressedSize64), rc)
+			rc.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		var r io.Reader = bytes.NewReader(body)
+		if bytes.HasPrefix(body, []byte{0x1f, 0x8b}) {
+			zr, err := gzip.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			r = zr
+		}
+		tr := tar.NewReader(r)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, errors.New("not a zip, tar or tar.gz archive")
+			}
+			if h.Typeflag != tar.TypeReg {
+				continue
+			}
+			if err := add(h.Name, h.Size, tr); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New("archive holds no files")
+	}
+	return files, nil
+}
+
+// createUnpacked creates a paste for each file in the archive body, with
+// the creation fields in fields, and the index paste listing them, and
+// returns the index. Like createBuffered it answers failures. Anonymous
+// uploads get one edit token for all of the pastes.
+func (s *Server) createUnpacked(w http.ResponseWriter, r *http.Request, user string, body []byte, fields url.Values) (string, store.CreateOptions, bool) {
+	if r.URL.Query().Get("encrypted") == "1" {
+		http.Error(w, "Encrypted uploads can't be unpacked", http.StatusBadRequest)
+		return "", store.CreateOptions{}, false
+	}
+	files, err := unpackArchive(body)
+	if err != nil {
+		http.Error(w, "Failed to unpack: "+err.Error(), http.StatusBadRequest)
+		return "", store.CreateOptions{}, false
+	}
+	if user == "" {
+		w.Header().Set(editTokenHeader, newEditToken())
+	}
+	// Every file gets the language of its own, and only the index the ID or
+	// slug asked for.
+	shared := url.Values{}
+	for name, values := range fields {
+		if name != "id" && name != "slug" && name != "lang" && name != "ext" && name != "unpack" {
+			shared[name] = values
+		}
+	}
+
+	// Dedup may hand back a paste that was there already, which a failure
+	// further on mustn't take with the ones created here. Anonymous
+	// uploads carry an edit token, which dedup passes over.
+	existed := make(map[string]bool)
+	if user != "" {
+		for _, id := range s.store().ListIDs() {
+			existed[id] = true
+		}
+	}
+	var created []string
+	rollback := func() {
+		for _, id := range created {
+			if !existed[id] {
+				s.store().Delete(id)
+			}
+		}
+	}
+	var index strings.Builder
+	for _, f := range files {
+		fileFields := url.Values{}
+		for name, values := range shared {
+			fileFields[name] = values
+		}
+		if ext, ok := normalizeLang(strings.TrimPrefix(path.Ext(f.path), ".")); ok {
+			fileFields.Set("ext", ext)
+		}
+		rec := httptest.NewRecorder()
+		rec.Header().Set(editTokenHeader, w.Header().Get(editTokenHeader))
+		id, _, ok := s.createPaste(rec, r, user, f.content, fileFields)
+		if !ok {
+			rollback()
+			w.Header().Del(editTokenHeader)
+			http.Error(w, f.path+": "+strings.TrimSpace(rec.Body.String()), rec.Code)
+			return "", store.CreateOptions{}, false
+		}
+		created = append(created, id)
+		fmt.Fprintf(&index, "- [%s](%s)\n", f.path, constructURL(r, id))
+	}
+
+	indexFields := url.Values{}
+	for name, values := range shared {
+		indexFields[name] = values
+	}
+	indexFields.Set("lang", "md")
+	for _, name := range []string{"id", "slug"} {
+		if v := fields.Get(name); v != "" {
+			indexFields.Set(name, v)
+		}
+	}
+	id, opts, ok := s.createPaste(w, r, user, []byte(index.String()), indexFields)
+	if !ok {
+		rollback()
+		return "", opts, false
+	}
+	if !opts.Draft {
+		for _, fileID := range created {
+			s.events.publish(event{kind: eventCreate, id: fileID, url: constructURL(r, fileID), user: user, requestID: RequestID(r.Context())})
+		}
+	}
+	return id, opts, true
+}
@@ -0,0 +1,179 @@
+// Package httpapi implements per-user monthly usage accounting: pastes
+// created, bytes uploaded and views received, kept in a ledger alongside the
+// store and reported at GET /api/v1/me/usage.
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"pb/internal/pairfile"
+	"pb/store"
+)
+
+const monthLayout = "2006-01"
+
+// usageCounts is one user's activity in one month.
+type usageCounts struct {
+	Created int   `json:"pastes_created"`
+	Bytes   int64 `json:"bytes_uploaded"`
+	Views   int   `json:"views"`
+}
+
+// UsageLedger counts usage per user and month. Views are counted in memory
+// and saved with the next create or Save, like read counts in the store.
+type UsageLedger struct {
+	mu       sync.Mutex
+	fileName string
+	// counts is keyed by "month/user"; user names can't contain slashes
+	// or spaces.
+	counts map[string]*usageCounts
+}
+
+// LoadUsageLedger opens the ledger kept in fileName, which need not exist
+// yet. An empty fileName keeps the ledger in memory only.
+func LoadUsageLedger(fileName string) *UsageLedger {
+	l := &UsageLedger{fileName: fileName, counts: make(map[string]*usageCounts)}
+	if fileName == "" {
+		return l
+	}
+	for key, value := range pairfile.Read(fileName) {
+		c := &usageCounts{}
+		if _, err := fmt.Sscan(value, &c.Created, &c.Bytes, &c.Views); err == nil {
+			l.counts[key] = c
+		}
+	}
+	return l
+}
+
+// Save writes the ledger out.
+func (l *UsageLedger) Save() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.save()
+}
+
+func (l *UsageLedger) save() {
+	if l == nil || l.fileName == "" {
+		return
+	}
+	pairs := make(map[string]string, len(l.counts))
+	for key, c := range l.counts {
+		pairs[key] = fmt.Sprintf("%d %d %d", c.Created, c.Bytes, c.Views)
+	}
+	pairfile.Write(l.fileName, pairs)
+}
+
+// entry returns the counts for user in the month of at; callers hold mu.
+func (l *UsageLedger) entry(user string, at time.Time) *usageCounts {
+	key := at.UTC().Format(monthLayout) + "/" + user
+	c, ok := l.counts[key]
+	if !ok {
+		c = &usageCounts{}
+		l.counts[key] = c
+	}
+	return c
+}
+
+func (l *UsageLedger) recordCreate(user string, size int, at time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c := l.entry(user, at)
+	c.Created++
+	c.Bytes += int64(size)
+	l.save()
+}
+
+func (l *UsageLedger) recordView(owner string, at time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entry(owner, at).Views++
+}
+
+func (l *UsageLedger) get(user, month string) usageCounts {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if c, ok := l.counts[month+"/"+user]; ok {
+		return *c
+	}
+	return usageCounts{}
+}
+
+// UsageReport is a user's summary for one month. The stored figures are as
+// of now rather than the end of the month.
+type UsageReport struct {
+	User  string `json:"user"`
+	Month string `json:"month"`
+	usageCounts
+	PastesStored int   `json:"pastes_stored"`
+	BytesStored  int64 `json:"bytes_stored"`
+}
+
+// Report summarizes user's usage in month ("2006-01") against st.
+func (l *UsageLedger) Report(st *store.Store, user, month string) UsageReport {
+	report := UsageReport{User: user, Month: month, usageCounts: l.get(user, month)}
+	for _, info := range st.ListByOwner(user) {
+		report.PastesStored++
+		report.BytesStored += int64(info.Size)
+	}
+	return report
+}
+
+// Users returns the users with any usage recorded in month, sorted.
+func (l *UsageLedger) Users(month string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var users []string
+	for key := range l.counts {
+		if m, user, _ := strings.Cut(key, "/"); m == month {
+			users = append(users, user)
+		}
+	}
+	sort.Strings(users)
+	return users
+}
+
+// recordUsage is the event subscriber feeding the ledger.
+func (s *Server) recordUsage(e event) {
+	switch e.kind {
+	case eventCreate:
+		if e.user == "" {
+			return
+		}
+		info, _ := s.store().Meta(e.id)
+		s.usage.recordCreate(e.user, info.Size, e.at)
+	case eventRead:
+		if owner, _ := s.store().OwnerOf(e.id); owner != "" && owner != e.user {
+			s.usage.recordView(owner, e.at)
+		}
+	}
+}
+
+// serveMyUsage reports the caller's usage for the month given as ?month=,
+// by default the current one.
+func (s *Server) serveMyUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := s.users.Authenticate(r)
+	if !ok || user == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="pb"`)
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	month := r.URL.Query().Get("month")
+	if month == "" {
+		month = s.clock.Now().UTC().Format(monthLayout)
+	} else if _, err := time.Parse(monthLayout, month); err != nil {
+		http.Error(w, "Invalid month, want YYYY-MM", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.usage.Report(s.store(), user, month))
+}
@@ -0,0 +1,155 @@
+// Package httpapi implements GET /user/{name}/export, the archive a user
+// takes their pastes elsewhere with: every paste they own, private ones and
+// drafts included, as a file named after its ID with an extension from its
+// language or media type, in a zip file or, with ?format=tar, a tar.gz.
+// Unlike /api/v1/me/export.ndjson it carries contents only, for tools that
+// expect files rather than pb's metadata.
+package httpapi
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"time"
+
+	"pb/auth"
+	"pb/store"
+)
+
+// archiveExtensions are the extensions binary pastes of common types get;
+// mime.ExtensionsByType lists several for some and sorts the odd one first.
+var archiveExtensions = map[string]string{
+	"image/png":       ".png",
+	"image/jpeg":      ".jpg",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"application/pdf": ".pdf",
+	"application/zip": ".zip",
+}
+
+// archiveName is the file name of the paste info in an export archive.
+func archiveName(info store.Info) string {
+	switch {
+	case info.Encrypted:
+		return info.ID + ".enc"
+	case info.MediaType != "":
+		if ext, ok := archiveExtensions[info.MediaType]; ok {
+			return info.ID + ext
+		}
+		if exts, _ := mime.ExtensionsByType(info.MediaType); len(exts) > 0 {
+			return info.ID + exts[0]
+		}
+		return info.ID + ".bin"
+	case info.Lang != "":
+		return info.ID + "." + info.Lang
+	default:
+		return info.ID + ".txt"
+	}
+}
+
+// archiveTime is when the paste info was last written.
+func archiveTime(info store.Info) time.Time {
+	if info.Updated.IsZero() {
+		return info.Created
+	}
+	return info.Updated
+}
+
+// archiveWriter is what serveUserExport needs of zip and tar writers.
+type archiveWriter interface {
+	add(info store.Info, content string) error
+	Close() error
+}
+
+type zipExport struct{ *zip.Writer }
+
+func (z zipExport) add(info store.Info, content string) error {
+	f, err := z.CreateHeader(&zip.FileHeader{Name: archiveName(info), Method: zip.Deflate, Modified: archiveTime(info)})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(f, content)
+	return err
+}
+
+type tarExport struct {
+	*tar.Writer
+	zw *gzip.Writer
+}
+
+func (t tarExport) add(info store.Info, content string) error {
+	if err := t.WriteHeader(&tar.Header{Name: archiveName(info), Mode: 0644, Size: int64(len(content)), ModTime: archiveTime(info)}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(t, content)
+	return err
+}
+
+func (t tarExport) Close() error {
+	if err := t.Writer.Close(); err != nil {
+		return err
+	}
+	return t.zw.Close()
+}
+
+// serveUserExport streams the pastes of user name to them, or to an admin.
+func (s *Server) serveUserExport(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := s.users.Authenticate(r)
+	if !ok || user == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="pb"`)
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	if user != name && s.roleOf(user) != auth.RoleAdmin {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var archive archiveWriter
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "zip":
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "pb-"+name+".zip"))
+		archive = zipExport{zip.NewWriter(w)}
+	case "tar":
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "pb-"+name+".tar.gz"))
+		zw := gzip.NewWriter(w)
+		archive = tarExport{tar.NewWriter(zw), zw}
+	default:
+		http.Error(w, "format must be zip or tar", http.StatusBadRequest)
+		return
+	}
+
+	n := 0
+	all := func(store.Info) bool { return true }
+	var failed error
+	s.eachListed(r, s.exportIDs(name, exportKey{}), all, func(info store.Info) bool {
+		content, ok := s.store().Get(info.ID)
+		if !ok {
+			return true
+		}
+		if failed = archive.add(info, content); failed != nil {
+			return false
+		}
+		n++
+		return true
+	})
+	if failed == nil {
+		failed = archive.Close()
+	}
+	if failed != nil {
+		slog.Warn("User export cut short", "user", name, "err", failed, "request_id", RequestID(r.Context()))
+		return
+	}
+	slog.Info("Exported user's pastes", "user", name, "by", user, "count", n, "request_id", RequestID(r.Context()))
+}
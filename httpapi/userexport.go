@@ -0,0 +1,135 @@
+// Package httpapi implements GET /api/v1/me/export.ndjson, a machine-readable
+// export of the caller's pastes: one JSON object per line, oldest first,
+// with the metadata of GET /{id}/meta plus the content of small text
+// pastes, or a URL to fetch the rest from. Every line carries a cursor;
+// passing the last one received as ?cursor= resumes an interrupted export
+// after that paste, unaffected by pastes created or deleted meanwhile.
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"pb/store"
+)
+
+// exportInlineSize is the largest text paste an export carries inline.
+const exportInlineSize = 64 << 10
+
+type exportEntry struct {
+	metaResponse
+	Private bool   `json:"private,omitempty"`
+	URL     string `json:"url"`
+	// Content is set for text pastes up to exportInlineSize, and
+	// ContentURL for the others.
+	Content    *string `json:"content,omitempty"`
+	ContentURL string  `json:"content_url,omitempty"`
+	Cursor     string  `json:"cursor"`
+}
+
+// exportKey is a paste's place in an export: its creation time, to the
+// second as the index keeps it, then its ID.
+type exportKey struct {
+	created int64
+	id      string
+}
+
+func (k exportKey) less(other exportKey) bool {
+	return k.created < other.created || (k.created == other.created && k.id < other.id)
+}
+
+// String renders k as a cursor. IDs never contain the dot.
+func (k exportKey) String() string {
+	return strconv.FormatInt(k.created, 36) + "." + k.id
+}
+
+func parseExportKey(cursor string) (exportKey, bool) {
+	created, id, ok := strings.Cut(cursor, ".")
+	n, err := strconv.ParseInt(created, 36, 64)
+	if !ok || err != nil || id == "" {
+		return exportKey{}, false
+	}
+	return exportKey{n, id}, true
+}
+
+// exportIDs returns the IDs of user's pastes past cursor, or all of them
+// for the zero cursor, oldest first.
+func (s *Server) exportIDs(user string, cursor exportKey) []string {
+	var keys []exportKey
+	for _, id := range s.store().ListIDsByOwner(user) {
+		if info, ok := s.store().Meta(id); ok {
+			if k := (exportKey{info.Created.Unix(), id}); cursor == (exportKey{}) || cursor.less(k) {
+				keys = append(keys, k)
+			}
+		}
+	}
+	slices.SortFunc(keys, func(a, b exportKey) int {
+		if a.less(b) {
+			return -1
+		}
+		return 1
+	})
+	ids := make([]string, len(keys))
+	for i, k := range keys {
+		ids[i] = k.id
+	}
+	return ids
+}
+
+// serveMyExport streams the caller's pastes as NDJSON.
+func (s *Server) serveMyExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, ok := s.users.Authenticate(r)
+	if !ok || user == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="pb"`)
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	var cursor exportKey
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		if cursor, ok = parseExportKey(v); !ok {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+	ids := s.exportIDs(user, cursor)
+
+	w.Header().Set("Content-Type", ndjsonType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "pb-"+user+".ndjson"))
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	n := 0
+	all := func(store.Info) bool { return true }
+	s.eachListed(r, ids, all, func(info store.Info) bool {
+		entry := exportEntry{
+			metaResponse: newMetaResponse(info),
+			Private:      info.Private,
+			URL:          constructURL(r, info.ID),
+			Cursor:       exportKey{info.Created.Unix(), info.ID}.String(),
+		}
+		entry.Owner, entry.Slug = info.Owner, info.Slug
+		if info.MediaType == "" && info.Size <= exportInlineSize {
+			content, ok := s.store().Get(info.ID)
+			if !ok {
+				return true
+			}
+			entry.Content = &content
+		} else {
+			entry.ContentURL = constructURL(r, info.ID+"/raw")
+		}
+		if err := enc.Encode(entry); err != nil {
+			return false
+		}
+		if n++; n%flushEvery == 0 {
+			rc.Flush()
+		}
+		return true
+	})
+}
@@ -0,0 +1,189 @@
+// Package httpapi implements GET /version, which reports the build the
+// server runs (module version, VCS commit and Go version, as the Go
+// toolchain stamped them), and the optional check for newer pb releases.
+// The check is off unless asked for, since air-gapped installs have nothing
+// to reach; when on, it asks the releases URL for the latest release every
+// interval, logs when it is newer than the running build, and /version
+// shows it.
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultReleasesURL answers with pb's latest release, as the GitHub
+// releases API does: a JSON object with the release's tag_name.
+const DefaultReleasesURL = "https://api.github.com/repos/shmup/pb/releases/latest"
+
+// releaseCheckTimeout bounds one release check.
+const releaseCheckTimeout = 30 * time.Second
+
+// buildResponse is what GET /version reports.
+type buildResponse struct {
+	Version    string `json:"version"`
+	Commit     string `json:"commit,omitempty"`
+	CommitTime string `json:"commit_time,omitempty"`
+	// Modified builds had uncommitted changes.
+	Modified  bool   `json:"modified,omitempty"`
+	GoVersion string `json:"go_version"`
+	// Latest is the newest release the update check found, and
+	// UpdateAvailable whether it is newer than this build.
+	Latest          string     `json:"latest,omitempty"`
+	UpdateAvailable bool       `json:"update_available,omitempty"`
+	CheckedAt       *time.Time `json:"checked_at,omitempty"`
+}
+
+// latestRelease is the outcome of the last successful release check.
+type latestRelease struct {
+	tag string
+	at  time.Time
+}
+
+// buildVersion returns the build the running binary was made from.
+func buildVersion() buildResponse {
+	resp := buildResponse{Version: "unknown"}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return resp
+	}
+	resp.Version, resp.GoVersion = info.Main.Version, info.GoVersion
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			resp.Commit = setting.Value
+		case "vcs.time":
+			resp.CommitTime = setting.Value
+		case "vcs.modified":
+			resp.Modified = setting.Value == "true"
+		}
+	}
+	return resp
+}
+
+// parseSemver parses a release version such as v1.2.3, ignoring any
+// pre-release or build suffix.
+func parseSemver(v string) ([3]int, bool) {
+	var parts [3]int
+	v, ok := strings.CutPrefix(v, "v")
+	if !ok {
+		return parts, false
+	}
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	fields := strings.Split(v, ".")
+	if len(fields) != 3 {
+		return parts, false
+	}
+	for i, f := range fields {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 {
+			return parts, false
+		}
+		parts[i] = n
+	}
+	return parts, true
+}
+
+// newerRelease reports whether release latest is newer than version. Builds
+// without a release version, such as development builds stamped with a
+// pseudo-version like v0.0.0-20260101000000-abcdef123456, are never known to
+// be out of date.
+func newerRelease(latest, version string) bool {
+	if strings.ContainsAny(version, "-+") {
+		return false
+	}
+	l, ok1 := parseSemver(latest)
+	v, ok2 := parseSemver(version)
+	if !ok1 || !ok2 {
+		return false
+	}
+	for i := range l {
+		if l[i] != v[i] {
+			return l[i] > v[i]
+		}
+	}
+	return false
+}
+
+// CheckForUpdates asks releasesURL for the latest pb release every
+// interval until ctx is done, logging when one newer than the running
+// build comes out. It returns immediately if interval is zero.
+func (s *Server) CheckForUpdates(ctx context.Context, interval time.Duration, releasesURL string) {
+	if interval <= 0 {
+		return
+	}
+	client := &http.Client{Timeout: releaseCheckTimeout}
+	version := buildVersion().Version
+	announced := ""
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		tag, err := fetchLatestRelease(ctx, client, releasesURL)
+		if err != nil {
+			slog.Warn("Release check failed", "url", releasesURL, "err", err)
+		} else {
+			s.latest.Store(&latestRelease{tag: tag, at: s.clock.Now()})
+			if tag != announced && newerRelease(tag, version) {
+				slog.Info("A newer pb release is available", "version", version, "latest", tag)
+				announced = tag
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// fetchLatestRelease returns the tag of the release at url.
+func fetchLatestRelease(ctx context.Context, client *http.Client, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var release struct {
+		TagName string `json:"tag_name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return "", err
+	}
+	if release.TagName == "" {
+		return "", fmt.Errorf("no tag_name in the answer")
+	}
+	return release.TagName, nil
+}
+
+// serveVersion reports the running build and, if the update check is on,
+// the latest release.
+func (s *Server) serveVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	resp := buildVersion()
+	if latest := s.latest.Load(); latest != nil {
+		resp.Latest, resp.CheckedAt = latest.tag, &latest.at
+		resp.UpdateAvailable = newerRelease(latest.tag, resp.Version)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,291 @@
+// Package httpapi implements webhooks: snippet events are POSTed as JSON to
+// the configured URLs through a persistent delivery queue, which retries
+// failures with exponential backoff and keeps deliveries that keep failing
+// as dead letters for the admin API.
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"pb/internal/clock"
+	"pb/internal/pairfile"
+)
+
+const (
+	maxDeliveryAttempts = 10
+	maxDeliveryBackoff  = time.Hour
+	deliveryTimeout     = 10 * time.Second
+)
+
+type webhookPayload struct {
+	Event string    `json:"event"`
+	ID    string    `json:"id,omitempty"`
+	URL   string    `json:"url,omitempty"`
+	User  string    `json:"user,omitempty"`
+	At    time.Time `json:"at"`
+	// Requester is set on honeytoken alerts.
+	Requester *requester `json:"requester,omitempty"`
+	// Anomaly is set on anomaly alerts.
+	Anomaly *anomaly `json:"anomaly,omitempty"`
+}
+
+// delivery is one payload on its way to one target.
+type delivery struct {
+	ID        string          `json:"id"`
+	Target    string          `json:"target"`
+	Payload   json.RawMessage `json:"payload"`
+	Attempts  int             `json:"attempts"`
+	Next      time.Time       `json:"next"`
+	LastError string          `json:"last_error,omitempty"`
+	// Dead deliveries have run out of attempts and wait for an admin.
+	Dead bool `json:"dead"`
+}
+
+// deliveryQueue holds deliveries until they succeed, saving them to
+// fileName after every change so none are lost across restarts.
+type deliveryQueue struct {
+	mu       sync.Mutex
+	fileName string
+	items    map[string]*delivery
+	seq      uint64
+	wake     chan struct{}
+	client   *http.Client
+	// clock schedules attempts. Retries wait out their backoff in real
+	// time, so it is never stopped.
+	clock clock.Clock
+}
+
+func newDeliveryQueue(fileName string) *deliveryQueue {
+	q := &deliveryQueue{
+		fileName: fileName,
+		items:    make(map[string]*delivery),
+		wake:     make(chan struct{}, 1),
+		client:   &http.Client{Timeout: deliveryTimeout},
+		clock:    clock.System,
+	}
+	if fileName == "" {
+		return q
+	}
+	for id, value := range pairfile.Read(fileName) {
+		d := &delivery{}
+		if err := json.Unmarshal([]byte(value), d); err != nil {
+			slog.Warn("Dropping malformed delivery", "id", id, "err", err)
+			continue
+		}
+		q.items[id] = d
+	}
+	return q
+}
+
+// save writes the queue out; callers hold mu.
+func (q *deliveryQueue) save() {
+	if q.fileName == "" {
+		return
+	}
+	pairs := make(map[string]string, len(q.items))
+	for id, d := range q.items {
+		value, _ := json.Marshal(d)
+		pairs[id] = string(value)
+	}
+	pairfile.Write(q.fileName, pairs)
+}
+
+func (q *deliveryQueue) enqueue(target string, payload []byte) {
+	q.mu.Lock()
+	q.seq++
+	now := q.clock.Now()
+	id := strconv.FormatInt(now.UnixNano(), 36) + "-" + strconv.FormatUint(q.seq, 36)
+	q.items[id] = &delivery{ID: id, Target: target, Payload: payload, Next: now}
+	q.save()
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// due returns copies of the live deliveries whose time has come, and when
+// the next one after them is.
+func (q *deliveryQueue) due(now time.Time) ([]delivery, time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var ready []delivery
+	next := now.Add(time.Minute)
+	for _, d := range q.items {
+		switch {
+		case d.Dead:
+		case !d.Next.After(now):
+			ready = append(ready, *d)
+		case d.Next.Before(next):
+			next = d.Next
+		}
+	}
+	return ready, next
+}
+
+// attempt tries d once and records the outcome.
+func (q *deliveryQueue) attempt(ctx context.Context, d delivery) {
+	err := q.post(ctx, d)
+	if err != nil && ctx.Err() != nil {
+		return // shutting down; not the target's fault
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	item, ok := q.items[d.ID]
+	if !ok {
+		return
+	}
+	if err == nil {
+		delete(q.items, d.ID)
+		q.save()
+		return
+	}
+	item.Attempts++
+	item.LastError = err.Error()
+	if item.Attempts >= maxDeliveryAttempts {
+		item.Dead = true
+		slog.Error("Webhook delivery failed for good", "id", d.ID, "target", d.Target, "attempts", item.Attempts, "err", err)
+	} else {
+		backoff := time.Second << item.Attempts
+		if backoff > maxDeliveryBackoff {
+			backoff = maxDeliveryBackoff
+		}
+		item.Next = q.clock.Now().Add(backoff)
+		slog.Warn("Webhook delivery failed, will retry", "id", d.ID, "target", d.Target, "attempts", item.Attempts, "retry_in", backoff, "err", err)
+	}
+	q.save()
+}
+
+func (q *deliveryQueue) post(ctx context.Context, d delivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.Target, bytes.NewReader(d.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s answered %s", d.Target, resp.Status)
+	}
+	return nil
+}
+
+// list returns every queued delivery, oldest first.
+func (q *deliveryQueue) list() []delivery {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	list := make([]delivery, 0, len(q.items))
+	for _, d := range q.items {
+		list = append(list, *d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// retry revives a dead delivery for another full round of attempts,
+// reporting whether there was one with that ID.
+func (q *deliveryQueue) retry(id string) bool {
+	q.mu.Lock()
+	d, ok := q.items[id]
+	if ok && d.Dead {
+		d.Dead, d.Attempts, d.Next = false, 0, q.clock.Now()
+		q.save()
+	}
+	q.mu.Unlock()
+
+	if ok {
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+	return ok
+}
+
+// queueWebhooks is the event subscriber that queues a delivery of e to
+// every webhook.
+func (s *Server) queueWebhooks(e event) {
+	payload, err := json.Marshal(webhookPayload{Event: e.kind.String(), ID: e.id, URL: e.url, User: e.user, At: e.at, Requester: e.requester, Anomaly: e.anomaly})
+	if err != nil {
+		slog.Error("Failed to encode webhook payload", "err", err)
+		return
+	}
+	for _, target := range s.webhooks {
+		s.deliveries.enqueue(target, payload)
+	}
+}
+
+// DeliverWebhooks works through the delivery queue until ctx is done. It
+// returns immediately if no webhooks are configured.
+func (s *Server) DeliverWebhooks(ctx context.Context) {
+	q := s.deliveries
+	if q == nil {
+		return
+	}
+	for {
+		now := q.clock.Now()
+		ready, next := q.due(now)
+		for _, d := range ready {
+			if ctx.Err() != nil {
+				return
+			}
+			q.attempt(ctx, d)
+		}
+		if len(ready) > 0 {
+			continue
+		}
+		timer := time.NewTimer(next.Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-q.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// serveDeliveries lists queued and dead webhook deliveries on GET, and on
+// POST sends the dead delivery named by the id form field round again.
+func (s *Server) serveDeliveries(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAdmin(w, r) {
+		return
+	}
+	if s.deliveries == nil {
+		http.Error(w, "No webhooks are configured", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]delivery{"deliveries": s.deliveries.list()})
+	case http.MethodPost:
+		if !s.parseForm(w, r) {
+			return
+		}
+		if !s.deliveries.retry(r.FormValue("id")) {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintln(w, "queued")
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,216 @@
+// Package httpapi implements the web UI, for using pb without curl.
+// Browsers visiting / get a form with the paste, its language, expiry and
+// burn-after-read, which posts to / like any client; they are then sent on
+// to the paste, or shown its link if it has reads to burn. Owners edit
+// a paste's content at /{id}/edit. The browser that created a paste
+// anonymously keeps its edit token in a cookie, and can edit it too.
+package httpapi
+
+import (
+	"bytes"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"pb/store"
+)
+
+// editTokenCookie keeps the edit token of a paste created anonymously from
+// the web UI, scoped to the paste's path.
+const editTokenCookie = "pb_token"
+
+// editTokenCookieAge is how long the edit token of a paste that never
+// expires is kept, in seconds.
+const editTokenCookieAge = 365 * 24 * 60 * 60
+
+// webExpiries are the expiries the create form offers, "" for none.
+var webExpiries = []struct{ Value, Label string }{
+	{"", "Never"},
+	{"10m", "10 minutes"},
+	{"1h", "1 hour"},
+	{"1d", "1 day"},
+	{"7d", "1 week"},
+	{"30d", "1 month"},
+}
+
+var webStyle = stylesheet("webui.css")
+
+var createForm = template.Must(template.New("create").Parse(`<form class="paste-form" method="post" action="/" enctype="multipart/form-data">
+<p><textarea name="f:1" rows="24" autofocus required></textarea></p>
+<p><label>Language <select name="lang">
+<option value="">Plain text</option>
+{{range .Languages}}<option value="{{.Name}}">{{.Name}}</option>
+{{end}}</select></label>
+<label>Expires <select name="ttl:1">
+{{range .Expiries}}<option value="{{.Value}}">{{.Label}}</option>
+{{end}}</select></label>
+<label><input type="checkbox" name="read:1" value="1"> Burn after reading</label>
+<input type="submit" value="Create paste"></p>
+</form>
+`))
+
+var editForm = template.Must(template.New("edit").Parse(`<form class="paste-form" method="post" action="/{{.ID}}/edit" enctype="multipart/form-data" data-id="{{.ID}}" data-mode="{{.Mode}}" data-token="{{.Token}}">
+<p><a href="/{{.ID}}">{{.ID}}</a>{{with .Lang}} ({{.}}){{end}}</p>
+<p><textarea name="f:1" rows="24" autofocus>
+{{.Content}}</textarea></p>
+<p><input type="submit" value="Save"> <span class="status"></span></p>
+</form>
+{{.Script}}`))
+
+var createdPage = template.Must(template.New("created").Parse(`<p>Your paste can only be read so many times, so it isn't shown here. Share this link:</p>
+<p><a href="{{.}}">{{.}}</a></p>
+`))
+
+// serveCreateForm shows browsers the create form at /.
+func (s *Server) serveCreateForm(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Accept")
+	var body strings.Builder
+	err := createForm.Execute(&body, map[string]any{"Languages": highlightLanguages, "Expiries": webExpiries})
+	if err != nil {
+		http.Error(w, "Failed to render create form", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	pageTemplate.Execute(w, page{Title: "pb", Head: webStyle, Body: template.HTML(body.String())})
+}
+
+// browserForm reports whether r is a form a browser posted, such as the
+// web UI's.
+func browserForm(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return prefersHTML(r) && (mediaType == "multipart/form-data" || mediaType == "application/x-www-form-urlencoded")
+}
+
+// browserText undoes the CRLF line endings browsers submit textareas with,
+// for text posted from a browser form.
+func browserText(r *http.Request, body []byte) []byte {
+	if !browserForm(r) || store.DetectMediaType(string(body), false) != "" {
+		return body
+	}
+	return bytes.ReplaceAll(body, []byte("\r\n"), []byte("\n"))
+}
+
+// serveCreated answers a browser that created paste id, at url, from a
+// form: it is sent on to the paste, unless that would use up one of its
+// limited reads. An anonymous paste's edit token is kept in a cookie for its edit
+// view.
+func (s *Server) serveCreated(w http.ResponseWriter, r *http.Request, id, url string, opts store.CreateOptions) {
+	if opts.EditToken != "" {
+		cookie := &http.Cookie{Name: editTokenCookie, Value: opts.EditToken, Path: "/" + id, HttpOnly: true, SameSite: http.SameSiteStrictMode}
+		if !opts.Expires.IsZero() {
+			cookie.Expires = opts.Expires
+		} else {
+			cookie.MaxAge = editTokenCookieAge
+		}
+		http.SetCookie(w, cookie)
+	}
+	if opts.MaxReads == 0 {
+		http.Redirect(w, r, url, http.StatusSeeOther)
+		return
+	}
+	var body strings.Builder
+	if err := createdPage.Execute(&body, url); err != nil {
+		http.Error(w, "Failed to render page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Location", url)
+	w.WriteHeader(http.StatusCreated)
+	pageTemplate.Execute(w, page{Title: id, Body: template.HTML(body.String())})
+}
+
+// sameOrigin reports whether r was sent by a page of this server, for
+// forms that act with the credentials a browser sends on its own.
+func sameOrigin(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site == "same-origin" || site == "none"
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// editTokenFromCookie sends the edit token the browser keeps for the paste
+// r is about as the header authorize reads, unless r carries one, and
+// returns it.
+func editTokenFromCookie(r *http.Request) string {
+	c, err := r.Cookie(editTokenCookie)
+	if err != nil || r.Header.Get(editTokenHeader) != "" {
+		return ""
+	}
+	r.Header.Set(editTokenHeader, c.Value)
+	return c.Value
+}
+
+// serveEdit shows the edit view of paste id on GET /{id}/edit and saves
+// it on POST, for those who may update it.
+func (s *Server) serveEdit(w http.ResponseWriter, r *http.Request, id, user string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Method == http.MethodPost && !sameOrigin(r) {
+		http.Error(w, "Cross-site form rejected", http.StatusForbidden)
+		return
+	}
+	// The editor saves with PUT, which takes the token as a header.
+	cookieToken := editTokenFromCookie(r)
+	if !s.authorize(w, r, id, user) {
+		return
+	}
+	info, _ := s.store().Meta(id)
+	if info.Encrypted || info.MediaType != "" {
+		http.Error(w, "Only text snippets can be edited here", http.StatusBadRequest)
+		return
+	}
+	url := constructURL(r, id)
+	if info.Slug != "" {
+		url = constructURL(r, slugPath(info.Owner, info.Slug))
+	}
+
+	if r.Method == http.MethodGet {
+		content, ok := s.store().Get(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		data := map[string]any{"ID": id, "Lang": info.Lang, "Content": content}
+		head := webStyle
+		if r.URL.Query().Get("editor") != "plain" {
+			mode, _ := editorMode(info.Lang)
+			data["Mode"], data["Token"], data["Script"] = mode.mime, cookieToken, editorScript
+			head += editorHead(info.Lang)
+		}
+		var body strings.Builder
+		if err := editForm.Execute(&body, data); err != nil {
+			http.Error(w, "Failed to render edit form", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		pageTemplate.Execute(w, page{Title: "Edit " + id, Head: head, Body: template.HTML(body.String())})
+		return
+	}
+
+	if !s.creates.acquire(w, r) {
+		return
+	}
+	defer s.creates.release()
+	exists, ok := s.updatePaste(w, r, id, user)
+	if !ok {
+		return
+	}
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+	if !info.Draft {
+		s.events.publish(event{kind: eventUpdate, id: id, url: url, user: user, requestID: RequestID(r.Context())})
+	}
+	http.Redirect(w, r, url, http.StatusSeeOther)
+}
@@ -0,0 +1,366 @@
+// Package importer brings pastes over from other pastebins into a pb store,
+// keeping when each was created and who owned it. It reads three kinds of
+// export:
+//
+//   - GitHub Gist JSON, as the gists API returns it: one gist object or an
+//     array of them, each file of a gist becoming a paste;
+//   - pastebin.com XML, the <paste> elements its API lists, with each
+//     paste's content in a <paste_content> element or, for a file on disk,
+//     in a file named after its paste_key next to it;
+//   - 0x0-style directories of plain files, each file a paste created when
+//     it was last modified.
+//
+// Pastes keep their original ID where pb has it free and it is a valid pb
+// ID, so that links rewritten to the new host keep working.
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"pb/store"
+)
+
+// Options configures an import.
+type Options struct {
+	// Owner owns the pastes whose owner in the export isn't in Owners;
+	// "" leaves them anonymous.
+	Owner string
+	// Owners maps owners in the export, such as GitHub logins, to pb
+	// users.
+	Owners map[string]string
+	// Now decides which pastes have expired already; zero means the
+	// current time.
+	Now time.Time
+}
+
+// Result describes an import.
+type Result struct {
+	// Format is the kind of export read: "gist", "pastebin" or "dir".
+	Format string
+	// Imported counts the pastes created.
+	Imported int
+	// Skipped lists the pastes left out, by their name in the export,
+	// each with the reason.
+	Skipped []string
+}
+
+// paste is one paste read from an export.
+type paste struct {
+	// name identifies the paste in the export, for Result.Skipped, and id
+	// is the ID to try to keep.
+	name, id string
+	content  string
+	owner    string
+	created  time.Time
+	expires  time.Time
+	lang     string
+	private  bool
+}
+
+// importer creates the pastes of one import.
+type importer struct {
+	st     *store.Store
+	opts   Options
+	result Result
+}
+
+func (im *importer) add(p paste) {
+	if !p.expires.IsZero() && !p.expires.After(im.opts.Now) {
+		im.skip(p.name, "expired")
+		return
+	}
+	owner, mapped := im.opts.Owners[p.owner]
+	if !mapped {
+		owner = im.opts.Owner
+	}
+	if store.DetectMediaType(p.content, false) != "" {
+		p.lang = ""
+	}
+	opts := store.CreateOptions{
+		Owner:   owner,
+		Private: p.private,
+		Lang:    cleanLang(p.lang),
+		Expires: p.expires,
+		Created: p.created,
+	}
+	id := ""
+	if store.ValidID(p.id) {
+		opts.ID = p.id
+		id = im.st.Create(p.content, opts)
+		opts.ID = ""
+	}
+	if id == "" {
+		id = im.st.Create(p.content, opts)
+	}
+	if id == "" {
+		im.skip(p.name, "not stored")
+		return
+	}
+	im.result.Imported++
+}
+
+func (im *importer) skip(name, reason string) {
+	im.result.Skipped = append(im.result.Skipped, name+": "+reason)
+}
+
+// langPattern matches the languages pb accepts, as validLang in httpapi.
+var langPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9+#._-]{0,31}$`)
+
+// cleanLang returns lang as pb keeps languages, or "" for plain text and
+// anything pb wouldn't accept.
+func cleanLang(lang string) string {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if lang == "text" || lang == "txt" || !langPattern.MatchString(lang) {
+		return ""
+	}
+	return lang
+}
+
+// extLang is the language named by the extension of fileName, if any.
+func extLang(fileName string) string {
+	return strings.TrimPrefix(filepath.Ext(fileName), ".")
+}
+
+// File imports the export at path: a directory of files, or a Gist JSON
+// or pastebin.com XML file.
+func File(st *store.Store, path string, opts Options) (Result, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return Result{}, err
+	}
+	if info.IsDir() {
+		im := newImporter(st, opts)
+		im.result.Format = "dir"
+		err := im.dir(path)
+		return im.result, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return Result{}, err
+	}
+	defer f.Close()
+	return read(st, f, filepath.Dir(path), opts)
+}
+
+// Reader imports the Gist JSON or pastebin.com XML export read from r. The
+// pastebin pastes need their content inline.
+func Reader(st *store.Store, r io.Reader, opts Options) (Result, error) {
+	return read(st, r, "", opts)
+}
+
+func newImporter(st *store.Store, opts Options) *importer {
+	if opts.Now.IsZero() {
+		opts.Now = time.Now()
+	}
+	return &importer{st: st, opts: opts}
+}
+
+// read imports from r, telling the format by its first character. dir is
+// where pastebin content files are looked for, if anywhere.
+func read(st *store.Store, r io.Reader, dir string, opts Options) (Result, error) {
+	im := newImporter(st, opts)
+	br := bufio.NewReader(r)
+	for {
+		c, _, err := br.ReadRune()
+		if err != nil {
+			return im.result, errors.New("empty export")
+		}
+		if strings.ContainsRune(" \t\r\n\ufeff", c) {
+			continue
+		}
+		br.UnreadRune()
+		switch c {
+		case '{', '[':
+			im.result.Format = "gist"
+			err = im.gists(br)
+		case '<':
+			im.result.Format = "pastebin"
+			err = im.pastebin(br, dir)
+		default:
+			err = errors.New("not a Gist JSON or pastebin.com XML export")
+		}
+		return im.result, err
+	}
+}
+
+// gist is the part of a gist the importer reads.
+type gist struct {
+	ID        string    `json:"id"`
+	Public    bool      `json:"public"`
+	CreatedAt time.Time `json:"created_at"`
+	Owner     *struct {
+		Login string `json:"login"`
+	} `json:"owner"`
+	Files map[string]struct {
+		Content   *string `json:"content"`
+		Truncated bool    `json:"truncated"`
+	} `json:"files"`
+}
+
+// gists imports a gist object or an array of them. A gist's only file
+// keeps the gist's ID.
+func (im *importer) gists(r io.Reader) error {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return fmt.Errorf("gist export: %w", err)
+	}
+	var list []gist
+	if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{")) {
+		list = make([]gist, 1)
+		if err := json.Unmarshal(raw, &list[0]); err != nil {
+			return fmt.Errorf("gist export: %w", err)
+		}
+	} else if err := json.Unmarshal(raw, &list); err != nil {
+		return fmt.Errorf("gist export: %w", err)
+	}
+	for _, g := range list {
+		owner := ""
+		if g.Owner != nil {
+			owner = g.Owner.Login
+		}
+		for key, f := range g.Files {
+			name := g.ID + "/" + key
+			if f.Content == nil || f.Truncated {
+				im.skip(name, "content not in the export")
+				continue
+			}
+			p := paste{
+				name:    name,
+				content: *f.Content,
+				owner:   owner,
+				created: g.CreatedAt,
+				lang:    extLang(key),
+				private: !g.Public,
+			}
+			if len(g.Files) == 1 {
+				p.id = g.ID
+			}
+			im.add(p)
+		}
+	}
+	return nil
+}
+
+// pastebinPaste is a <paste> element of a pastebin.com export.
+type pastebinPaste struct {
+	Key     string  `xml:"paste_key"`
+	Date    int64   `xml:"paste_date"`
+	Expire  int64   `xml:"paste_expire_date"`
+	Private int     `xml:"paste_private"`
+	Format  string  `xml:"paste_format_short"`
+	Content *string `xml:"paste_content"`
+}
+
+// pastebin imports the <paste> elements in r, wherever they are nested.
+// Unlisted and private pastes both become private.
+func (im *importer) pastebin(r io.Reader, dir string) error {
+	dec := xml.NewDecoder(r)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("pastebin export: %w", err)
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "paste" {
+			continue
+		}
+		var pp pastebinPaste
+		if err := dec.DecodeElement(&pp, &start); err != nil {
+			return fmt.Errorf("pastebin export: %w", err)
+		}
+		name := pp.Key
+		if name == "" {
+			name = "paste " + strconv.Itoa(im.result.Imported+len(im.result.Skipped)+1)
+		}
+		content, err := pastebinContent(pp, dir)
+		if err != nil {
+			im.skip(name, err.Error())
+			continue
+		}
+		p := paste{
+			name:    name,
+			id:      pp.Key,
+			content: content,
+			lang:    pp.Format,
+			private: pp.Private != 0,
+		}
+		if pp.Date > 0 {
+			p.created = time.Unix(pp.Date, 0)
+		}
+		if pp.Expire > 0 {
+			p.expires = time.Unix(pp.Expire, 0)
+		}
+		im.add(p)
+	}
+}
+
+// pastebinContent is the content of pp: inline, or in dir as its key with
+// or without .txt.
+func pastebinContent(pp pastebinPaste, dir string) (string, error) {
+	if pp.Content != nil {
+		return *pp.Content, nil
+	}
+	if dir != "" && pp.Key != "" && pp.Key == filepath.Base(pp.Key) {
+		for _, name := range []string{pp.Key, pp.Key + ".txt"} {
+			if content, err := os.ReadFile(filepath.Join(dir, name)); err == nil {
+				return string(content), nil
+			}
+		}
+	}
+	return "", errors.New("content not in the export")
+}
+
+// dir imports every regular file under root, skipping hidden ones. A
+// file's name without its extension is the ID kept, and the extension the
+// language.
+func (im *importer) dir(root string) error {
+	return filepath.WalkDir(root, func(path string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(e.Name(), ".") && path != root {
+			if e.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !e.Type().IsRegular() {
+			return nil
+		}
+		name, _ := filepath.Rel(root, path)
+		info, err := e.Info()
+		if err != nil {
+			im.skip(name, err.Error())
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			im.skip(name, err.Error())
+			return nil
+		}
+		im.add(paste{
+			name:    name,
+			id:      strings.TrimSuffix(e.Name(), filepath.Ext(e.Name())),
+			content: string(content),
+			created: info.ModTime(),
+			lang:    extLang(e.Name()),
+		})
+		return nil
+	})
+}
@@ -0,0 +1,65 @@
+// Package atomicfile replaces files so that readers, and the file system
+// after a crash, see either the old content or the new, never a mix.
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// Write replaces fileName with data. It writes a temporary file beside it,
+// syncs it, renames it over fileName and syncs the directory, so the
+// rename itself survives a crash.
+func Write(fileName string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(fileName)
+	f, err := os.CreateTemp(dir, "."+filepath.Base(fileName)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+	defer os.Remove(tmpName) // fails harmlessly once renamed
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, fileName); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// Rename moves oldName, which the caller has already synced, to newName and
+// syncs the directory, for files written some other way than Write.
+func Rename(oldName, newName string) error {
+	if err := os.Rename(oldName, newName); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(newName))
+}
+
+func syncDir(dir string) error {
+	// Windows can't sync directories; the rename is still atomic there,
+	// just not guaranteed durable.
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
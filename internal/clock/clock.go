@@ -0,0 +1,22 @@
+// Package clock abstracts reading the time, so that it can be stopped for
+// reproducible runs.
+package clock
+
+import "time"
+
+// Clock tells the current time.
+type Clock interface {
+	Now() time.Time
+}
+
+// System is the real clock.
+var System Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// Fixed is a clock stopped at a moment.
+type Fixed time.Time
+
+func (f Fixed) Now() time.Time { return time.Time(f) }
@@ -0,0 +1,60 @@
+// Package pairfile reads and writes the "key value" line files pb keeps its
+// indexes in. Keys must not contain spaces or newlines; values run to the end
+// of the line.
+package pairfile
+
+import (
+	"os"
+	"sort"
+	"strings"
+
+	"pb/internal/atomicfile"
+)
+
+// Read reads a file of "key value" lines. A missing file reads as empty.
+func Read(fileName string) map[string]string {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return make(map[string]string)
+		}
+		panic("unable to read " + fileName + ": " + err.Error())
+	}
+
+	lines := strings.Split(string(content), "\n")
+	pairs := make(map[string]string)
+	for _, line := range lines {
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) == 2 {
+			pairs[parts[0]] = parts[1]
+		}
+	}
+	return pairs
+}
+
+// Write replaces fileName with pairs, one per line in key order, so the
+// same pairs always make the same file. The replacement is atomic, so a
+// crash leaves either the old file or the new one.
+func Write(fileName string, pairs map[string]string) {
+	err := atomicfile.Write(fileName, Encode(pairs), 0644)
+	if err != nil {
+		panic("unable to write " + fileName + ": " + err.Error())
+	}
+}
+
+// Encode renders pairs as Write writes them.
+func Encode(pairs map[string]string) []byte {
+	keys := make([]string, 0, len(pairs))
+	for key := range pairs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	for _, key := range keys {
+		sb.WriteString(key)
+		sb.WriteString(" ")
+		sb.WriteString(pairs[key])
+		sb.WriteString("\n")
+	}
+	return []byte(sb.String())
+}
@@ -1,119 +1,322 @@
 // Simple HTTP CRUD API for managing text snippets.
 //
-// This program creates an in-memory snippet store with CRUD operations exposed over HTTP.
+// This program serves a snippet store, kept in files or PostgreSQL, with CRUD operations over HTTP,
+// using the embeddable packages pb/store, pb/auth and pb/httpapi.
 // Supported methods:
 // - POST to create a new snippet
-// - GET to retrieve an existing snippet by ID
+// - GET to retrieve an existing snippet by ID, optionally rendered as /{id}/{class}
 // - PUT to update an existing snippet by ID
 // - DELETE to remove an existing snippet by ID
 //
 // The server starts on port 8080 and responds to the above HTTP methods at the root path.
+// Requests carrying HTTP basic credentials act as that user, and /user/{name}
+// lists the snippets they own.
+//
+// "pb [flags] service <install|uninstall|start|stop|restart>" manages pb as a
+// system service (Windows service, launchd daemon or systemd unit), and
+// "pb [flags] export-static <dir>" writes the public snippets as a static site,
+// "pb -key-file <file> rekey" re-encrypts snippet files with the current key,
+// "pb usage-report [YYYY-MM]" prints each user's usage for a month as JSON
+// lines, "pb invite" prints an invite code for invite-only instances, and
+// "pb [flags] backup <file>" writes the store and accounts to one archive,
+// "pb -dir <dir> restore <backup> [seq]" rebuilds a store from a -backup-to
+// backup as of its latest change or change seq, or from such an archive,
+// and "pb -database <url> import-store <dir>" copies the store in dir into
+// a PostgreSQL database. "pb [flags] import <export> [owner] [from=to...]"
+// brings in pastes exported from a Gist, pastebin.com or a 0x0-style
+// directory, owned by the pb user each from= owner maps to, or else owner.
+// "pb [flags] fsck [prune] [rebuild]" checks the store's files against its
+// index, pruning what doesn't match up or rebuilding a lost index.
+// "pb [flags] -validate-config" checks the configuration those flags make
+// and exits.
+// The command line client is cmd/pb.
 package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
-	"log"
-	"net/http"
+	"log/slog"
 	"os"
-	"os/signal"
-	"sync"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kardianos/service"
+
+	"pb/auth"
+	"pb/backup"
+	"pb/httpapi"
+	"pb/importer"
+	"pb/store"
 )
 
-type store struct {
-	sync.Mutex
-	snippets map[string]string
-	counter  int
+func main() {
+	cfg, err := parseConfig(os.Args[1:])
+	if err != nil {
+		os.Exit(2)
+	}
+	slog.SetDefault(newLogger(cfg.logFormat, os.Stderr))
+
+	if cfg.validateConfig {
+		if !validateConfig(cfg, os.Stdout) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	svc, err := newService(&program{cfg: cfg}, cfg)
+	if err != nil {
+		fatal("Failed to set up service", err)
+	}
+
+	if len(cfg.command) > 0 {
+		runCommand(cfg, svc)
+		return
+	}
+
+	if !service.Interactive() {
+		logger, err := svc.Logger(nil)
+		if err != nil {
+			fatal("Failed to open system log", err)
+		}
+		slog.SetDefault(newLogger(cfg.logFormat, serviceLogWriter{logger}))
+	}
+
+	if err := svc.Run(); err != nil {
+		fatal("Server failed", err)
+	}
 }
 
-func newStore() *store {
-	return &store{
-		snippets: make(map[string]string),
-		counter:  1,
+// newLogger returns a logger writing "text" (key=value) or "json" lines.
+func newLogger(format string, w io.Writer) *slog.Logger {
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(w, nil))
 	}
+	return slog.New(slog.NewTextHandler(w, nil))
 }
 
-func constructURL(r *http.Request, id string) string {
-	return fmt.Sprintf("%s%s/%s", "https://", r.Host, id)
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
 }
 
-func main() {
-	ps := newPermanentStore()
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		id := r.URL.Path[1:]
-
-		switch r.Method {
-		case http.MethodPost:
-			body, err := io.ReadAll(r.Body)
+func runCommand(cfg *config, svc service.Service) {
+	switch {
+	case len(cfg.command) == 2 && cfg.command[0] == "service":
+		if err := service.Control(svc, cfg.command[1]); err != nil {
+			fatal("Service "+cfg.command[1]+" failed", err)
+		}
+
+	case len(cfg.command) == 2 && cfg.command[0] == "export-static":
+		st, err := store.New(cfg.dir, cfg.storeOptions())
+		if err != nil {
+			fatal("Failed to open store", err)
+		}
+		n, err := httpapi.ExportStatic(st, cfg.command[1])
+		if err != nil {
+			fatal("Export failed", err)
+		}
+		slog.Info("Exported snippets", "count", n, "dir", cfg.command[1])
+
+	case len(cfg.command) <= 2 && cfg.command[0] == "usage-report":
+		st, err := store.New(cfg.dir, cfg.storeOptions())
+		if err != nil {
+			fatal("Failed to open store", err)
+		}
+		month := cfg.now().UTC().Format("2006-01")
+		if len(cfg.command) == 2 {
+			month = cfg.command[1]
+		}
+		ledger := httpapi.LoadUsageLedger(usagePath(cfg.dir))
+		for _, user := range ledger.Users(month) {
+			json.NewEncoder(os.Stdout).Encode(ledger.Report(st, user, month))
+		}
+
+	case len(cfg.command) == 1 && cfg.command[0] == "rekey":
+		st, err := store.New(cfg.dir, cfg.storeOptions())
+		if err != nil {
+			fatal("Failed to open store", err)
+		}
+		n, err := st.Rekey()
+		if err != nil {
+			fatal("Rekey failed", err)
+		}
+		slog.Info("Rekeyed snippets", "count", n)
+
+	case len(cfg.command) == 1 && cfg.command[0] == "invite":
+		// Issued by no account, so it counts against nobody's budget. Run
+		// it with the server stopped, which would otherwise overwrite it.
+		accounts, err := auth.New(cfg.dir)
+		if err != nil {
+			fatal("Failed to open accounts", err)
+		}
+		code, err := accounts.CreateInvite("", 0)
+		if err != nil {
+			fatal("Invite failed", err)
+		}
+		fmt.Println(code)
+
+	case len(cfg.command) == 2 && cfg.command[0] == "backup":
+		st, err := store.New(cfg.dir, cfg.storeOptions())
+		if err != nil {
+			fatal("Failed to open store", err)
+		}
+		seq, err := writeArchive(cfg.command[1], st, accountFiles(cfg.dir), cfg.keys)
+		if err != nil {
+			fatal("Backup failed", err)
+		}
+		slog.Info("Backed up store", "file", cfg.command[1], "seq", seq, "encrypted", cfg.keys != nil)
+
+	case (len(cfg.command) == 2 || len(cfg.command) == 3) && cfg.command[0] == "restore":
+		var upto uint64
+		if len(cfg.command) == 3 {
+			n, err := strconv.ParseUint(cfg.command[2], 10, 64)
 			if err != nil {
-				http.Error(w, "Failed to read request body", http.StatusBadRequest)
-				return
+				fatal("Invalid change number", err)
 			}
-			id := ps.createSnippet(string(body))
-			url := constructURL(r, id)
-			log.Printf("Created: %s", url)
-			w.Header().Set("Location", url)
-			w.WriteHeader(http.StatusCreated)
-			fmt.Fprint(w, url)
-
-		case http.MethodPut:
-			body, err := io.ReadAll(r.Body)
-			if err != nil {
-				http.Error(w, "Failed to read request body", http.StatusBadRequest)
-				return
+			upto = n
+		}
+		if cfg.database != "" {
+			fatal("Refusing to restore into a database", fmt.Errorf("restore into a -dir, then import-store it"))
+		}
+		if _, err := os.Stat(filepath.Join(cfg.dir, "index.txt")); err == nil {
+			fatal("Refusing to restore over a store", fmt.Errorf("%s already has one", cfg.dir))
+		}
+		var result backup.RestoreResult
+		var err error
+		if info, statErr := os.Stat(cfg.command[1]); statErr == nil && info.Mode().IsRegular() {
+			if upto != 0 {
+				fatal("Invalid change number", fmt.Errorf("an archive restores to the change it was taken at"))
 			}
-			if ps.updateSnippet(id, string(body)) {
-				url := constructURL(r, id)
-				fmt.Fprint(w, url)
-				log.Printf("Updated %s", id)
-			} else {
-				http.NotFound(w, r)
+			f, openErr := os.Open(cfg.command[1])
+			if openErr != nil {
+				fatal("Failed to open archive", openErr)
 			}
-
-		case http.MethodGet:
-			if content, ok := ps.getSnippet(id); ok {
-				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-				fmt.Fprint(w, content)
-				log.Printf("Fetched %s", id)
-			} else {
-				http.NotFound(w, r)
+			result, err = backup.RestoreArchive(context.Background(), f, cfg.dir, cfg.keys)
+			f.Close()
+		} else {
+			target, openErr := backup.Open(cfg.command[1])
+			if openErr != nil {
+				fatal("Failed to open backup", openErr)
 			}
+			result, err = backup.Restore(context.Background(), target, cfg.dir, upto)
+		}
+		if err != nil {
+			fatal("Restore failed", err)
+		}
+		if len(result.Missing) > 0 {
+			slog.Warn("Backup lacks some snippets; left them out", "ids", result.Missing)
+		}
+		slog.Info("Restored store", "dir", cfg.dir, "snapshot", result.Snapshot, "seq", result.Seq)
+
+	case len(cfg.command) == 2 && cfg.command[0] == "import-store":
+		if cfg.database == "" {
+			fatal("Nowhere to import to", fmt.Errorf("import-store needs -database"))
+		}
+		n, err := store.Import(cfg.command[1], cfg.storeOptions())
+		if err != nil {
+			fatal("Import failed", err)
+		}
+		slog.Info("Imported store", "dir", cfg.command[1], "snippets", n)
 
-		case http.MethodDelete:
-			if ps.deleteSnippet(id) {
-				url := constructURL(r, id)
-				fmt.Fprint(w, url)
-				log.Printf("Deleted %s", id)
+	case len(cfg.command) >= 2 && cfg.command[0] == "import":
+		opts := importer.Options{Owners: make(map[string]string)}
+		for _, arg := range cfg.command[2:] {
+			if from, to, ok := strings.Cut(arg, "="); ok {
+				opts.Owners[from] = to
+			} else if opts.Owner == "" {
+				opts.Owner = arg
 			} else {
-				http.NotFound(w, r)
+				fatal("Invalid import owner", fmt.Errorf("%q and %q: only one default owner", opts.Owner, arg))
 			}
+		}
+		st, err := store.New(cfg.dir, cfg.storeOptions())
+		if err != nil {
+			fatal("Failed to open store", err)
+		}
+		result, err := importer.File(st, cfg.command[1], opts)
+		for _, skipped := range result.Skipped {
+			slog.Warn("Skipped paste", "paste", skipped)
+		}
+		if err != nil {
+			fatal("Import failed", err)
+		}
+		slog.Info("Imported pastes", "format", result.Format, "count", result.Imported, "skipped", len(result.Skipped))
 
-		default:
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	case len(cfg.command) >= 1 && len(cfg.command) <= 3 && cfg.command[0] == "fsck":
+		var opts store.FsckOptions
+		for _, arg := range cfg.command[1:] {
+			switch arg {
+			case "prune":
+				opts.Prune = true
+			case "rebuild":
+				opts.Rebuild = true
+			default:
+				fatal("Invalid fsck repair", fmt.Errorf("unknown %q (want prune or rebuild)", arg))
+			}
+		}
+		st, err := store.New(cfg.dir, cfg.storeOptions())
+		if err != nil {
+			fatal("Failed to open store", err)
+		}
+		report, err := st.Fsck(opts)
+		if err != nil {
+			fatal("Fsck failed", err)
+		}
+		printFsckReport(os.Stdout, report)
+		if report.Unrepaired() > 0 {
+			os.Exit(1)
 		}
-	})
 
-	log.Println("Server is running on http://localhost:8080")
+	default:
+		fmt.Fprintf(os.Stderr, "usage: pb [flags] [service <%s> | export-static <dir> | rekey | usage-report [YYYY-MM] | invite | backup <file> | restore <backup> [seq] | import-store <dir> | import <export> [owner] [from=to...] | fsck [prune] [rebuild]]\n", joinActions())
+		os.Exit(2)
+	}
+}
 
-	srv := &http.Server{
-		Addr:    ":8080",
-		Handler: mux,
+// writeArchive writes an archive of st and files to fileName, or to
+// standard output for "-". The file only appears once complete.
+func writeArchive(fileName string, st *store.Store, files []string, keys *store.Keyring) (uint64, error) {
+	if fileName == "-" {
+		return backup.WriteArchive(os.Stdout, st, files, keys)
+	}
+	f, err := os.CreateTemp(filepath.Dir(fileName), "."+filepath.Base(fileName)+".tmp*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name()) // fails harmlessly once renamed
+	seq, err := backup.WriteArchive(f, st, files, keys)
+	if err == nil {
+		err = f.Sync()
 	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return seq, os.Rename(f.Name(), fileName)
+}
 
-	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Failed to start server: %v", err)
+// printFsckReport writes one line per problem fsck found, then a summary.
+func printFsckReport(w io.Writer, report store.FsckReport) {
+	for _, section := range []struct {
+		what string
+		list []string
+	}{
+		{"missing snippet", report.Missing},
+		{"missing revision of", report.MissingRevisions},
+		{"corrupt snippet", report.Corrupt},
+		{"corrupt revision", report.CorruptRevisions},
+		{"orphan snippet file", report.Orphans},
+		{"orphan revision file", report.OrphanRevisions},
+	} {
+		for _, name := range section.list {
+			fmt.Fprintln(w, section.what, name)
 		}
-	}()
-
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, os.Interrupt)
-	<-quit
-	log.Println("Shutting down server...")
-	if err := srv.Shutdown(context.Background()); err != nil {
-		log.Fatalf("Server Shutdown Failed:%+v", err)
 	}
-	log.Println("Server exited properly")
+	fmt.Fprintf(w, "%d files checked, %d problems, %d pruned, %d rebuilt\n",
+		report.Checked, report.Problems(), report.Pruned, report.Rebuilt)
 }
@@ -0,0 +1,430 @@
+// Package main implements the server lifecycle as a kardianos/service
+// program, so the same code runs in the foreground, as a Windows service or
+// as a launchd/systemd daemon.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kardianos/service"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/acme/autocert"
+
+	"pb/auth"
+	"pb/backup"
+	"pb/httpapi"
+	"pb/store"
+)
+
+type program struct {
+	cfg     *config
+	srv     *http.Server
+	api     *httpapi.Server
+	limiter *httpapi.RateLimiter
+	// filter applies -ip-filter; it is nil when unused.
+	filter  *httpapi.AddressFilter
+	plugins *httpapi.Plugins
+	// redirect serves -redirect-addr, and certs manages -autocert
+	// certificates; both are nil when unused.
+	redirect *http.Server
+	certs    *autocert.Manager
+	// redis is the client for -redis; nil when unused.
+	redis *redis.Client
+	// stopBackground ends the server's background loops.
+	stopBackground context.CancelFunc
+}
+
+func newService(prg *program, cfg *config) (service.Service, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	return service.New(prg, &service.Config{
+		Name:        "pb",
+		DisplayName: "pb pastebin",
+		Description: "Personal paste bin in the style of ix.io.",
+		// Installed services run with the flags and working directory they
+		// were installed from, so relative paths keep their meaning.
+		Arguments:        cfg.flagArgs,
+		WorkingDirectory: wd,
+	})
+}
+
+// Start sets the server up and begins serving. It must not block.
+func (p *program) Start(s service.Service) error {
+	policies, err := httpapi.LoadPolicies(p.cfg.policyFile)
+	if err != nil {
+		return err
+	}
+	blocklist, err := httpapi.LoadBlocklist(p.cfg.blocklist)
+	if err != nil {
+		return err
+	}
+	filters, err := httpapi.LoadContentFilters(p.cfg.contentFilter)
+	if err != nil {
+		return err
+	}
+	var robots []byte
+	if p.cfg.robots != "" {
+		if robots, err = os.ReadFile(p.cfg.robots); err != nil {
+			return err
+		}
+	}
+	storeOptions := p.cfg.storeOptions()
+	if p.cfg.redis != nil {
+		p.redis = redis.NewClient(p.cfg.redis)
+		storeOptions.Reads = store.RedisReads(p.redis)
+	}
+	st, err := store.New(p.cfg.dir, storeOptions)
+	if err != nil {
+		return err
+	}
+	if p.cfg.fsckOnStart {
+		report, err := st.Fsck(store.FsckOptions{})
+		if err != nil {
+			return err
+		}
+		if n := report.Problems(); n > 0 {
+			slog.Warn("Store check found problems; run pb fsck for the list", "problems", n, "missing", len(report.Missing)+len(report.MissingRevisions),
+				"corrupt", len(report.Corrupt)+len(report.CorruptRevisions), "orphans", len(report.Orphans)+len(report.OrphanRevisions))
+		} else {
+			slog.Info("Store check passed", "files", report.Checked)
+		}
+	}
+	accounts, err := auth.New(p.cfg.dir)
+	if err != nil {
+		return err
+	}
+	accounts.InviteOnly = p.cfg.inviteOnly
+	accounts.CertUsers = p.cfg.certUsers
+	tlsConfig, err := p.tlsConfig()
+	if err != nil {
+		return err
+	}
+	p.plugins, err = httpapi.StartPlugins(p.cfg.plugins)
+	if err != nil {
+		return err
+	}
+
+	var dnsMaxSize int64
+	if p.cfg.dnsAddr != "" {
+		dnsMaxSize = int64(p.cfg.dnsMaxSize)
+	}
+	var pow *httpapi.ProofOfWork
+	if p.cfg.powDifficulty > 0 {
+		pow = httpapi.NewProofOfWork(p.cfg.powDifficulty)
+	}
+	p.api = httpapi.New(httpapi.Options{
+		Store:          st,
+		Accounts:       accounts,
+		Plugins:        p.plugins,
+		Policies:       policies,
+		Blocklist:      blocklist,
+		ContentFilters: filters,
+		Admins:         p.cfg.admins,
+
+		MaxPasteSize:       int64(p.cfg.maxPasteSize),
+		MaxBinarySize:      int64(p.cfg.maxBinarySize),
+		MaxMultipartMemory: int64(p.cfg.maxMultipartMemory),
+		Primary:            p.cfg.primary,
+		Concurrency:        p.cfg.concurrency,
+		MemoryLimit:        int64(p.cfg.memoryLimit),
+		Webhooks:           p.cfg.webhooks,
+		DeliveryQueue:      filepath.Join(p.cfg.dir, "deliveries.txt"),
+		Bans:               filepath.Join(p.cfg.dir, "bans.txt"),
+		Disabled:           p.cfg.disabled,
+		Features:           filepath.Join(p.cfg.dir, "features.txt"),
+		BackupFiles:        accountFiles(p.cfg.dir),
+		GitHubAPI:          p.cfg.githubAPI,
+		Gists:              filepath.Join(p.cfg.dir, "gists.txt"),
+		Usage:              httpapi.LoadUsageLedger(usagePath(p.cfg.dir)),
+		DNSMaxSize:         dnsMaxSize,
+		AnomalyWindow:      p.cfg.anomalyWindow,
+		StatsEpsilon:       p.cfg.statsEpsilon,
+		StatsThreshold:     p.cfg.statsThreshold,
+		ProofOfWork:        pow,
+		Robots:             robots,
+		Sitemap:            p.cfg.sitemap,
+		Disposal:           p.cfg.disposal,
+		Clock:              p.cfg.clock,
+	})
+
+	var ctx context.Context
+	ctx, p.stopBackground = context.WithCancel(context.Background())
+	go p.api.Replicate(ctx, p.cfg.replicaInterval)
+	go p.api.MonitorMemory(ctx, time.Second)
+	go p.api.WatchAnomalies(ctx)
+	go p.api.DeliverWebhooks(ctx)
+	go p.api.ExpireSnippets(ctx, time.Minute)
+	go p.api.CheckForUpdates(ctx, p.cfg.updateCheck, p.cfg.updateURL)
+	if p.cfg.backupTo != "" {
+		target, err := backup.Open(p.cfg.backupTo)
+		if err != nil {
+			return err
+		}
+		go func() {
+			err := backup.Ship(ctx, st, target, backup.ShipOptions{
+				Interval:      p.cfg.backupInterval,
+				SnapshotEvery: p.cfg.backupSnapshotEvery,
+				Files:         accountFiles(p.cfg.dir),
+				Clock:         p.cfg.clock,
+			})
+			if err != nil {
+				fatal("Failed to start backups", err)
+			}
+		}()
+	}
+	if p.cfg.dnsAddr != "" {
+		go func() {
+			if err := p.api.ServeDNS(ctx, httpapi.DNSOptions{Addr: p.cfg.dnsAddr, Zone: p.cfg.dnsZone}); err != nil {
+				fatal("Failed to start DNS responder", err)
+			}
+		}()
+	}
+
+	var handler http.Handler = p.api
+	if p.cfg.shadowTo != nil {
+		shadow := httpapi.ShadowReads(handler, httpapi.ShadowOptions{Target: p.cfg.shadowTo, Percent: p.cfg.shadowPercent})
+		go shadow.ReportEvery(ctx, time.Minute)
+		handler = shadow
+	}
+	if p.cfg.signingKeys != nil {
+		handler = httpapi.RequireSignatures(handler, httpapi.SigningOptions{
+			Keys:        p.cfg.signingKeys,
+			MaxBodySize: int64(max(p.cfg.maxPasteSize, p.cfg.maxBinarySize)),
+		})
+	}
+	if p.cfg.rateLimit > 0 {
+		p.limiter = httpapi.RateLimit(handler, httpapi.RateLimitOptions{
+			PerMinute:   p.cfg.rateLimit,
+			Burst:       p.cfg.rateBurst,
+			ProofOfWork: pow,
+			Redis:       p.redis,
+		})
+		p.limiter.Load(p.rateLimitPath())
+		handler = p.limiter
+	}
+	if p.cfg.ipFilter != "" {
+		p.filter, err = httpapi.FilterAddresses(handler, p.cfg.ipFilter)
+		if err != nil {
+			return err
+		}
+		handler = p.filter
+		go p.reloadOnHangup(ctx)
+	}
+
+	if p.cfg.sshAddr != "" {
+		hostKey := p.cfg.sshHostKey
+		if hostKey == "" {
+			hostKey = filepath.Join(p.cfg.dir, "ssh_host_ed25519_key")
+		}
+		// Uploads over SSH are limited and filtered as HTTP's are.
+		sshHandler := handler
+		go func() {
+			err := p.api.ServeSSH(ctx, httpapi.SSHOptions{Addr: p.cfg.sshAddr, HostKey: hostKey, Host: p.cfg.urlHost, Handler: sshHandler})
+			if err != nil {
+				fatal("Failed to start SSH server", err)
+			}
+		}()
+	}
+
+	handler = httpapi.LogRequests(handler, slog.Default())
+	if len(p.cfg.trustedProxies) > 0 {
+		handler = httpapi.TrustProxies(handler, p.cfg.trustedProxies)
+	}
+
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+	}
+	host, port, _ := net.SplitHostPort(p.cfg.addr)
+	if host == "" {
+		host = "localhost"
+	}
+	slog.Info("Server is running", "url", scheme+"://"+net.JoinHostPort(host, port))
+
+	p.srv = &http.Server{
+		Addr:      p.cfg.addr,
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+	}
+	if p.cfg.redirectAddr != "" {
+		var redirect http.Handler = redirectToHTTPS(port)
+		// Let's Encrypt's HTTP challenges arrive here too.
+		if p.certs != nil {
+			redirect = p.certs.HTTPHandler(redirect)
+		}
+		p.redirect = &http.Server{Addr: p.cfg.redirectAddr, Handler: redirect}
+		go func() {
+			if err := p.redirect.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fatal("Failed to start redirect listener", err)
+			}
+		}()
+	}
+
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			err = p.srv.ListenAndServeTLS("", "")
+		} else {
+			err = p.srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			fatal("Failed to start server", err)
+		}
+	}()
+	return nil
+}
+
+// Stop shuts the server down gracefully.
+func (p *program) Stop(s service.Service) error {
+	slog.Info("Shutting down server")
+	defer p.plugins.Stop()
+	if p.redirect != nil {
+		p.redirect.Shutdown(context.Background())
+	}
+	if err := p.srv.Shutdown(context.Background()); err != nil {
+		return err
+	}
+	p.stopBackground()
+	p.api.Flush()
+	if p.limiter != nil {
+		p.limiter.Save(p.rateLimitPath())
+	}
+	p.api.Close()
+	if p.redis != nil {
+		p.redis.Close()
+	}
+	slog.Info("Server exited properly")
+	return nil
+}
+
+// tlsConfig loads the server certificate, or with -autocert sets up
+// getting certificates from Let's Encrypt as hosts are first asked for,
+// and with -client-ca asks for client certificates signed by those CAs. It
+// is nil when serving plain HTTP. Client certificates are optional so that
+// browsers and password users still get in.
+func (p *program) tlsConfig() (*tls.Config, error) {
+	var conf *tls.Config
+	switch {
+	case len(p.cfg.autocertHosts) > 0:
+		p.certs = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(filepath.Join(p.cfg.dir, "autocert")),
+			HostPolicy: autocert.HostWhitelist(p.cfg.autocertHosts...),
+			Email:      p.cfg.autocertEmail,
+		}
+		conf = p.certs.TLSConfig()
+		conf.MinVersion = tls.VersionTLS12
+	case p.cfg.tlsCert != "":
+		cert, err := tls.LoadX509KeyPair(p.cfg.tlsCert, p.cfg.tlsKey)
+		if err != nil {
+			return nil, err
+		}
+		conf = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	default:
+		return nil, nil
+	}
+	if p.cfg.clientCA != "" {
+		pem, err := os.ReadFile(p.cfg.clientCA)
+		if err != nil {
+			return nil, err
+		}
+		conf.ClientCAs = x509.NewCertPool()
+		if !conf.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no PEM certificates", p.cfg.clientCA)
+		}
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return conf, nil
+}
+
+// redirectToHTTPS sends plain HTTP reads to the same URL over HTTPS on
+// port, and refuses anything else rather than have it resent in the clear.
+func redirectToHTTPS(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Use HTTPS", http.StatusBadRequest)
+			return
+		}
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else {
+			host = strings.Trim(host, "[]")
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// reloadOnHangup reloads -ip-filter whenever the process gets SIGHUP, until
+// ctx is done. A file that fails to load is logged and the rules in force
+// are kept.
+func (p *program) reloadOnHangup(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+		if err := p.filter.Reload(); err != nil {
+			slog.Error("Failed to reload address filter", "err", err)
+			continue
+		}
+		slog.Info("Reloaded address filter", "file", p.cfg.ipFilter)
+	}
+}
+
+// rateLimitPath is where rate limiter buckets are kept across restarts.
+func (p *program) rateLimitPath() string {
+	return filepath.Join(p.cfg.dir, "ratelimit.txt")
+}
+
+// accountFiles are the paths of the account files in dir, which backups
+// carry next to the store.
+func accountFiles(dir string) []string {
+	var files []string
+	for _, name := range auth.FileNames {
+		files = append(files, filepath.Join(dir, name))
+	}
+	return files
+}
+
+// usagePath is where the monthly usage ledger is kept.
+func usagePath(dir string) string {
+	return filepath.Join(dir, "usage.txt")
+}
+
+// serviceLogWriter sends the standard logger to the system log (the Windows
+// event log or syslog) when running as a service.
+type serviceLogWriter struct {
+	logger service.Logger
+}
+
+func (w serviceLogWriter) Write(p []byte) (int, error) {
+	return len(p), w.logger.Info(strings.TrimSuffix(string(p), "\n"))
+}
+
+func joinActions() string {
+	return strings.Join(service.ControlAction[:], "|")
+}
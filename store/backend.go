@@ -0,0 +1,174 @@
+// Package store implements the storage backends a Store keeps its state
+// in. The state is the same whatever the backend: sets of key-value pairs
+// (the index, comments and history), files of content (snippets by ID,
+// revisions by hash) and append-only logs (the change journal and the
+// disposal audit trail). The default backend keeps them as files under a
+// directory; see postgres.go for the other.
+package store
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"pb/internal/atomicfile"
+	"pb/internal/pairfile"
+)
+
+// backend is where a Store keeps its state. Sets and logs are named by
+// the files the directory backend keeps them in, and files by the
+// directory they are in, dataDirName or revisionsDirName, and their name.
+// Reads of missing files fail with fs.ErrNotExist.
+type backend interface {
+	// readPairs returns the pairs of a set, empty if it doesn't exist.
+	readPairs(set string) (map[string]string, error)
+	// writePairs replaces a set with pairs and writes files with it, in
+	// one step if the backend has transactions.
+	writePairs(set string, pairs map[string]string, files ...file) error
+	readFile(dir, name string) ([]byte, error)
+	openFile(dir, name string) (io.ReadCloser, int64, error)
+	writeFile(f file) error
+	// copyFile keeps the content of one file as another, which must not
+	// change when the first is replaced.
+	copyFile(fromDir, from, toDir, to string) error
+	removeFile(dir, name string) error
+	listFiles(dir string) ([]string, error)
+	// readLog returns the content of a log.
+	readLog(name string) ([]byte, error)
+	// appendLog appends a line, ending in a newline, to a log.
+	appendLog(name, line string) error
+	// truncateLog cuts a log to its first size bytes.
+	truncateLog(name string, size int64) error
+	// spoolDir is where content being streamed in is copied to first.
+	spoolDir() string
+	close() error
+}
+
+// file is content to write: data, or the spooled file at path.
+type file struct {
+	dir, name string
+	data      []byte
+	spooled   string
+}
+
+// dirBackend keeps the state as files under a directory: pair files for
+// the sets, a file per snippet and revision, and line files for the logs.
+type dirBackend struct {
+	root string
+}
+
+// openDir returns the backend for dir, creating its directories.
+func openDir(dir string) (*dirBackend, error) {
+	if err := os.MkdirAll(filepath.Join(dir, dataDirName), 0755); err != nil {
+		return nil, errors.New("unable to create base directory for storage: " + err.Error())
+	}
+	if err := os.MkdirAll(filepath.Join(dir, revisionsDirName), 0755); err != nil {
+		return nil, errors.New("unable to create revisions directory: " + err.Error())
+	}
+	return &dirBackend{root: dir}, nil
+}
+
+func (b *dirBackend) path(elem ...string) string {
+	return filepath.Join(append([]string{b.root}, elem...)...)
+}
+
+func (b *dirBackend) readPairs(set string) (map[string]string, error) {
+	return pairfile.Read(b.path(set)), nil
+}
+
+// writePairs writes the files first, so a crash in between leaves at
+// worst a file the index doesn't know of yet, rather than an index entry
+// without its content.
+func (b *dirBackend) writePairs(set string, pairs map[string]string, files ...file) error {
+	for _, f := range files {
+		if err := b.writeFile(f); err != nil {
+			return err
+		}
+	}
+	pairfile.Write(b.path(set), pairs)
+	return nil
+}
+
+func (b *dirBackend) readFile(dir, name string) ([]byte, error) {
+	return os.ReadFile(b.path(dir, name))
+}
+
+func (b *dirBackend) openFile(dir, name string) (io.ReadCloser, int64, error) {
+	f, err := os.Open(b.path(dir, name))
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, fi.Size(), nil
+}
+
+func (b *dirBackend) writeFile(f file) error {
+	if f.spooled != "" {
+		return atomicfile.Rename(f.spooled, b.path(f.dir, f.name))
+	}
+	return atomicfile.Write(b.path(f.dir, f.name), f.data, 0644)
+}
+
+// copyFile links the files: snippet files are replaced by renaming over
+// them, so a link keeps the old content.
+func (b *dirBackend) copyFile(fromDir, from, toDir, to string) error {
+	err := os.Link(b.path(fromDir, from), b.path(toDir, to))
+	if errors.Is(err, fs.ErrExist) {
+		return nil
+	}
+	return err
+}
+
+func (b *dirBackend) removeFile(dir, name string) error {
+	return os.Remove(b.path(dir, name))
+}
+
+func (b *dirBackend) listFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(b.path(dir))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		// Skip uploads being spooled.
+		if !strings.HasPrefix(entry.Name(), ".") {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func (b *dirBackend) readLog(name string) ([]byte, error) {
+	content, err := os.ReadFile(b.path(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return content, err
+}
+
+func (b *dirBackend) appendLog(name, line string) error {
+	f, err := os.OpenFile(b.path(name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.WriteString(line); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func (b *dirBackend) truncateLog(name string, size int64) error {
+	return os.Truncate(b.path(name), size)
+}
+
+func (b *dirBackend) spoolDir() string { return b.path(dataDirName) }
+
+func (b *dirBackend) close() error { return nil }
@@ -0,0 +1,197 @@
+// Package store implements what continuous backups need from the store:
+// snapshots of the index as of a change journal sequence number, and the
+// journal after a number with each changed snippet's index line, from
+// which Restore rebuilds the store as of any change after a snapshot.
+// Snippet contents travel separately, as blobs named by their hash.
+package store
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"pb/internal/atomicfile"
+	"pb/internal/pairfile"
+)
+
+// BackupEntry is a change journal entry as a backup keeps it: the change
+// and, unless it is a deletion, the snippet's index line, its ID and the
+// fields index.txt holds for it.
+type BackupEntry struct {
+	Change
+	Line string
+}
+
+// Encode renders e as one line, ending in a newline.
+func (e BackupEntry) Encode() string {
+	return strings.TrimSuffix(e.Change.encode(), "\n") + "\t" + e.Line + "\n"
+}
+
+// DecodeBackupEntry parses a line written by Encode.
+func DecodeBackupEntry(line string) (BackupEntry, error) {
+	change, indexLine, ok := strings.Cut(strings.TrimSuffix(line, "\n"), "\t")
+	if !ok {
+		return BackupEntry{}, fmt.Errorf("missing index line")
+	}
+	c, err := decodeChange(change)
+	if err != nil {
+		return BackupEntry{}, err
+	}
+	return BackupEntry{Change: c, Line: indexLine}, nil
+}
+
+// lastSeq is the sequence number of the last change; callers hold the lock.
+func (ps *Store) lastSeq() uint64 {
+	if n := len(ps.changes); n > 0 {
+		return ps.changes[n-1].Seq
+	}
+	return 0
+}
+
+// Snapshot returns the files that make up the store's state other than
+// snippet contents and history, namely index.txt and comments.txt, by
+// name, and the sequence number of the last change they reflect.
+func (ps *Store) Snapshot() (uint64, map[string][]byte) {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	var index strings.Builder
+	ids := make([]string, 0, len(ps.index))
+	for id := range ps.index {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		index.WriteString(id + " " + ps.index[id].encode() + "\n")
+	}
+	files := map[string][]byte{indexFileName: []byte(index.String())}
+	if comments, err := ps.backend.readPairs(commentsFileName); err == nil && len(comments) > 0 {
+		files[commentsFileName] = pairfile.Encode(comments)
+	}
+	return ps.lastSeq(), files
+}
+
+// BackupEntries returns the changes after since, private ones included,
+// oldest first. The index line of each is the snippet's as it is now, so
+// a snippet changed twice since shows its latest state twice; a restore
+// to the first change sees the second one early, and no other harm.
+func (ps *Store) BackupEntries(since uint64) []BackupEntry {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	var entries []BackupEntry
+	for _, c := range ps.changes {
+		if c.Seq <= since {
+			continue
+		}
+		e := BackupEntry{Change: c}
+		if meta, exists := ps.index[c.ID]; exists && c.Kind != ChangeDeleted {
+			e.Line = c.ID + " " + meta.encode()
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// OpenBlob returns the file holding content hash as stored, encrypted if
+// the store encrypts its files, looking in id's snippet file and in the
+// kept revisions, and its size.
+func (ps *Store) OpenBlob(id, hash string) (io.ReadCloser, int64, bool) {
+	ps.RLock()
+	meta, exists := ps.index[id]
+	current := exists && meta.hash == hash
+	ps.RUnlock()
+
+	if current {
+		if f, size, err := ps.backend.openFile(dataDirName, id); err == nil {
+			return f, size, true
+		}
+	}
+	if f, size, err := ps.backend.openFile(revisionsDirName, hash); err == nil {
+		return f, size, true
+	}
+	return nil, 0, false
+}
+
+// Restore writes a store into dir, which should hold none yet, from the
+// files of a snapshot and the backup entries after it up to and including
+// sequence number upto. journal holds every entry up to upto, snapshot or
+// not, to rebuild the change journal from. blob opens the stored content
+// of a hash. Snippets whose content it can't find, or that were deleted
+// before their change was shipped, are left out and their IDs returned.
+func Restore(dir string, snapshotSeq uint64, snapshot map[string][]byte, journal []BackupEntry, upto uint64, blob func(hash string) (io.ReadCloser, error)) ([]string, error) {
+	dataDir := filepath.Join(dir, dataDirName)
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, err
+	}
+	for name, content := range snapshot {
+		if name == indexFileName {
+			continue
+		}
+		if err := atomicfile.Write(filepath.Join(dir, name), content, 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	index := make(map[string]string)
+	for _, line := range strings.Split(string(snapshot[indexFileName]), "\n") {
+		if id, value, ok := strings.Cut(line, " "); ok {
+			index[id] = value
+		}
+	}
+	var changes strings.Builder
+	gone := make(map[string]bool)
+	for _, e := range journal {
+		if e.Seq > upto {
+			break
+		}
+		changes.WriteString(e.Change.encode())
+		if e.Seq <= snapshotSeq {
+			continue
+		}
+		switch id, value, ok := strings.Cut(e.Line, " "); {
+		case e.Kind == ChangeDeleted:
+			delete(index, e.ID)
+			delete(gone, e.ID)
+		case ok:
+			index[id] = value
+		default:
+			delete(index, e.ID)
+			gone[e.ID] = true
+		}
+	}
+	if err := atomicfile.Write(filepath.Join(dir, changesFileName), []byte(changes.String()), 0644); err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for id := range gone {
+		missing = append(missing, id)
+	}
+	for id, value := range index {
+		hash, _, _ := strings.Cut(value, " ")
+		if err := restoreBlob(filepath.Join(dataDir, id), hash, blob); err != nil {
+			missing = append(missing, id)
+			delete(index, id)
+		}
+	}
+	pairfile.Write(filepath.Join(dir, indexFileName), index)
+	sort.Strings(missing)
+	return missing, nil
+}
+
+func restoreBlob(path, hash string, blob func(hash string) (io.ReadCloser, error)) error {
+	r, err := blob(hash)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return atomicfile.Write(path, content, 0644)
+}
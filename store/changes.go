@@ -0,0 +1,136 @@
+// Package store implements the change journal: every create, update and
+// delete is appended to changes.txt with an increasing sequence number, so
+// mirrors can ask for everything that happened after the last number they
+// saw instead of re-reading the whole store.
+package store
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const changesFileName = "changes.txt"
+
+// Change kinds.
+const (
+	ChangeCreated = "created"
+	ChangeUpdated = "updated"
+	ChangeDeleted = "deleted"
+)
+
+// Change is one entry of the change journal. Hash is empty for deletions.
+type Change struct {
+	Seq  uint64
+	Kind string
+	ID   string
+	Hash string
+	// Private changes, of private, honeytoken, password-protected and
+	// draft snippets, are left out of the feed.
+	Private bool
+	At      time.Time
+}
+
+func (c Change) encode() string {
+	hash := c.Hash
+	if hash == "" {
+		hash = "-"
+	}
+	return fmt.Sprintf("%d %s %s %s %t %d\n", c.Seq, c.Kind, c.ID, hash, c.Private, c.At.Unix())
+}
+
+func decodeChange(line string) (Change, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 6 {
+		return Change{}, fmt.Errorf("want 6 fields, got %d", len(fields))
+	}
+	seq, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return Change{}, err
+	}
+	private, err := strconv.ParseBool(fields[4])
+	if err != nil {
+		return Change{}, err
+	}
+	c := Change{Seq: seq, Kind: fields[1], ID: fields[2], Hash: fields[3], Private: private, At: parseUnix(fields[5])}
+	if c.Hash == "-" {
+		c.Hash = ""
+	}
+	return c, nil
+}
+
+func loadChanges(b backend) ([]Change, error) {
+	content, err := b.readLog(changesFileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	lines := strings.Split(string(content), "\n")
+	for n, line := range lines {
+		if line == "" {
+			continue
+		}
+		c, err := decodeChange(line)
+		if err != nil {
+			// A crash during an append leaves the last line without its
+			// newline; that change never completed, so cut it off before
+			// the next append runs into it.
+			if n == len(lines)-1 {
+				slog.Warn("Dropping incomplete change journal entry", "log", changesFileName, "line", n+1)
+				if err := b.truncateLog(changesFileName, int64(len(content)-len(line))); err != nil {
+					return nil, err
+				}
+				break
+			}
+			return nil, fmt.Errorf("%s:%d: %w", changesFileName, n+1, err)
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+// recordChange appends a change for id to the journal; callers hold the
+// write lock.
+func (ps *Store) recordChange(kind, id string, meta *snippetMeta) {
+	c := Change{
+		Kind:    kind,
+		ID:      id,
+		Private: meta.private || meta.honeytoken || meta.viewPassHash != "" || meta.draft,
+		At:      ps.clock.Now(),
+	}
+	if kind != ChangeDeleted {
+		c.Hash = meta.hash
+	}
+	if n := len(ps.changes); n > 0 {
+		c.Seq = ps.changes[n-1].Seq + 1
+	} else {
+		c.Seq = 1
+	}
+	ps.changes = append(ps.changes, c)
+
+	if err := ps.backend.appendLog(changesFileName, c.encode()); err != nil {
+		panic("unable to write change journal: " + err.Error())
+	}
+}
+
+// Changes returns up to limit changes with a sequence number above since,
+// oldest first, skipping those of private snippets. more reports whether
+// further changes follow the returned ones.
+func (ps *Store) Changes(since uint64, limit int) (changes []Change, more bool) {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	for _, c := range ps.changes {
+		if c.Seq <= since || c.Private {
+			continue
+		}
+		if len(changes) == limit {
+			return changes, true
+		}
+		changes = append(changes, c)
+	}
+	return changes, false
+}
@@ -0,0 +1,122 @@
+// Package store implements line comments: notes users attach to a line of a
+// snippet. They are kept in comments.txt, one JSON list per snippet, and go
+// when the snippet does.
+package store
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+const commentsFileName = "comments.txt"
+
+// Comment is a note on one line of a snippet.
+type Comment struct {
+	// ID numbers the snippet's comments from 1.
+	ID      int       `json:"id"`
+	Line    int       `json:"line"`
+	Author  string    `json:"author"`
+	Body    string    `json:"body"`
+	Created time.Time `json:"created"`
+	// Hash is the snippet's content hash when the comment was made, so
+	// comments on an older version can be told apart.
+	Hash string `json:"hash"`
+}
+
+func loadComments(b backend) (map[string][]Comment, error) {
+	pairs, err := b.readPairs(commentsFileName)
+	if err != nil {
+		return nil, err
+	}
+	comments := make(map[string][]Comment, len(pairs))
+	for id, value := range pairs {
+		var list []Comment
+		if err := json.Unmarshal([]byte(value), &list); err != nil {
+			slog.Error("Skipping unreadable comments", "id", id, "err", err)
+			continue
+		}
+		comments[id] = list
+	}
+	return comments, nil
+}
+
+func (ps *Store) saveComments() {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	pairs := make(map[string]string, len(ps.comments))
+	for id, list := range ps.comments {
+		encoded, err := json.Marshal(list)
+		if err != nil {
+			panic("unable to encode comments: " + err.Error())
+		}
+		pairs[id] = string(encoded)
+	}
+	if err := ps.backend.writePairs(commentsFileName, pairs); err != nil {
+		panic("unable to save comments: " + err.Error())
+	}
+}
+
+// Comments returns the comments on id, by line and then age.
+func (ps *Store) Comments(id string) []Comment {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	list := append([]Comment(nil), ps.comments[id]...)
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Line < list[j].Line })
+	return list
+}
+
+// AddComment attaches a comment by author to line of id, reporting false if
+// id doesn't exist. Checking that the line does is up to the caller.
+func (ps *Store) AddComment(id string, line int, author, body string) (Comment, bool) {
+	ps.Lock()
+	meta, exists := ps.index[id]
+	if !exists || meta.expired(ps.clock.Now()) {
+		ps.Unlock()
+		return Comment{}, false
+	}
+	c := Comment{ID: 1, Line: line, Author: author, Body: body, Created: ps.clock.Now().UTC().Truncate(time.Second), Hash: meta.hash}
+	if list := ps.comments[id]; len(list) > 0 {
+		c.ID = list[len(list)-1].ID + 1
+	}
+	ps.comments[id] = append(ps.comments[id], c)
+	ps.Unlock()
+
+	ps.saveComments()
+	return c, true
+}
+
+// DeleteComment removes comment commentID from id, reporting whether it
+// existed.
+func (ps *Store) DeleteComment(id string, commentID int) bool {
+	ps.Lock()
+	list := ps.comments[id]
+	i := sort.Search(len(list), func(i int) bool { return list[i].ID >= commentID })
+	if i == len(list) || list[i].ID != commentID {
+		ps.Unlock()
+		return false
+	}
+	list = append(list[:i:i], list[i+1:]...)
+	if len(list) == 0 {
+		delete(ps.comments, id)
+	} else {
+		ps.comments[id] = list
+	}
+	ps.Unlock()
+
+	ps.saveComments()
+	return true
+}
+
+// dropComments removes the comments on id, reporting whether there were
+// any; callers hold the write lock and save if so.
+func (ps *Store) dropComments(id string) bool {
+	if _, ok := ps.comments[id]; !ok {
+		return false
+	}
+	delete(ps.comments, id)
+	return true
+}
@@ -0,0 +1,202 @@
+// Package store implements encryption of snippet files at rest. Sealed
+// files are "pbenc1", the 4-byte ID of the key, a nonce and the AES-GCM
+// ciphertext; files without the prefix are plaintext from before encryption
+// was turned on, and stay readable.
+package store
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+var sealedMagic = []byte("pbenc1")
+
+const keyIDSize = 4
+
+// Keyring holds the keys snippet files are encrypted with. The first key
+// encrypts; all of them decrypt, so old keys can be kept while files are
+// re-encrypted with Rekey.
+type Keyring struct {
+	keys []sealKey
+}
+
+type sealKey struct {
+	id   [keyIDSize]byte
+	aead cipher.AEAD
+}
+
+// LoadKeyring reads a key file: one base64-encoded 32-byte AES-256 key per
+// line, current key first. Blank lines and lines starting with # are
+// ignored.
+func LoadKeyring(fileName string) (*Keyring, error) {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	kr := &Keyring{}
+	for n, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(line)
+		if err != nil || len(raw) != 32 {
+			return nil, fmt.Errorf("%s:%d: want a base64-encoded 32-byte key", fileName, n+1)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(raw)
+		var key sealKey
+		copy(key.id[:], sum[:keyIDSize])
+		key.aead = aead
+		kr.keys = append(kr.keys, key)
+	}
+	if len(kr.keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys", fileName)
+	}
+	return kr, nil
+}
+
+// seal encrypts data with the current key. A nil Keyring leaves data as is.
+func (kr *Keyring) seal(data []byte) []byte {
+	if kr == nil {
+		return data
+	}
+	key := kr.keys[0]
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic("unable to generate nonce: " + err.Error())
+	}
+	out := make([]byte, 0, len(sealedMagic)+keyIDSize+len(nonce)+len(data)+key.aead.Overhead())
+	out = append(out, sealedMagic...)
+	out = append(out, key.id[:]...)
+	out = append(out, nonce...)
+	return key.aead.Seal(out, nonce, data, nil)
+}
+
+// open decrypts a sealed file, passing plaintext files through.
+func (kr *Keyring) open(data []byte) ([]byte, error) {
+	if !isSealed(data) {
+		return data, nil
+	}
+	if kr == nil {
+		return nil, errors.New("snippet is encrypted but no key is configured")
+	}
+	data = data[len(sealedMagic):]
+	if len(data) < keyIDSize {
+		return nil, errors.New("truncated encrypted snippet")
+	}
+	for _, key := range kr.keys {
+		if !bytes.Equal(key.id[:], data[:keyIDSize]) {
+			continue
+		}
+		rest := data[keyIDSize:]
+		if len(rest) < key.aead.NonceSize() {
+			return nil, errors.New("truncated encrypted snippet")
+		}
+		nonce, ciphertext := rest[:key.aead.NonceSize()], rest[key.aead.NonceSize():]
+		return key.aead.Open(nil, nonce, ciphertext, nil)
+	}
+	return nil, errors.New("snippet is encrypted with an unknown key")
+}
+
+// current reports whether data is sealed with the current key.
+func (kr *Keyring) current(data []byte) bool {
+	if kr == nil {
+		return !isSealed(data)
+	}
+	return isSealed(data) && bytes.Equal(data[len(sealedMagic):len(sealedMagic)+keyIDSize], kr.keys[0].id[:])
+}
+
+func isSealed(data []byte) bool {
+	return len(data) >= len(sealedMagic)+keyIDSize && bytes.HasPrefix(data, sealedMagic)
+}
+
+// Rekey rewrites every snippet and revision file not yet encrypted with the current key:
+// plaintext files get encrypted and files sealed with an older key are
+// re-encrypted, after which that key can be dropped from the key file. It
+// returns how many files were rewritten.
+func (ps *Store) Rekey() (int, error) {
+	ps.RLock()
+	ids := make([]string, 0, len(ps.index))
+	for id := range ps.index {
+		ids = append(ids, id)
+	}
+	ps.RUnlock()
+
+	rewritten := 0
+	for _, id := range ids {
+		// Hold the write lock per file so updates can't interleave.
+		ps.Lock()
+		data, err := ps.backend.readFile(dataDirName, id)
+		if err != nil {
+			ps.Unlock()
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return rewritten, err
+		}
+		if ps.keys.current(data) {
+			ps.Unlock()
+			continue
+		}
+		content, err := ps.keys.open(data)
+		if err != nil {
+			ps.Unlock()
+			return rewritten, fmt.Errorf("snippet %s: %w", id, err)
+		}
+		// Create and Update write files after releasing the lock; if this
+		// one is stale, the write in flight replaces it anyway.
+		if meta, exists := ps.index[id]; !exists || meta.hash != contentHash(string(content)) {
+			ps.Unlock()
+			continue
+		}
+		ps.saveSnippet(id, string(content))
+		ps.Unlock()
+		rewritten++
+	}
+
+	// Revision files are named by their content's hash and never change.
+	hashes, err := ps.backend.listFiles(revisionsDirName)
+	if err != nil {
+		return rewritten, err
+	}
+	for _, hash := range hashes {
+		data, err := ps.backend.readFile(revisionsDirName, hash)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return rewritten, err
+		}
+		if ps.keys.current(data) {
+			continue
+		}
+		content, err := ps.keys.open(data)
+		if err != nil {
+			return rewritten, fmt.Errorf("revision %s: %w", hash, err)
+		}
+		// Replace rather than rewrite the file, which may be linked to
+		// a snippet file still.
+		if err := ps.backend.writeFile(file{dir: revisionsDirName, name: hash, data: ps.keys.seal(content)}); err != nil {
+			return rewritten, err
+		}
+		rewritten++
+	}
+	return rewritten, nil
+}
@@ -0,0 +1,194 @@
+// Package store implements the integrity check. Fsck reads every file the
+// index and history point at and checks its content against the recorded
+// hash, and looks for the two ways index and files drift apart: entries
+// whose file is gone, and files no entry refers to. It can prune both, and
+// rebuild the index from the data files when it has been lost, adopting
+// each file as an anonymous snippet.
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+)
+
+// FsckOptions choose what Fsck repairs; the zero value only reports.
+type FsckOptions struct {
+	// Prune drops index entries whose data file is missing and removes
+	// files nothing refers to.
+	Prune bool
+	// Rebuild adds an index entry for every data file without one, as an
+	// anonymous snippet created now. It runs before Prune, which then has
+	// no data files left to remove.
+	Rebuild bool
+}
+
+// FsckReport is what Fsck found. Problems it repaired are listed too, and
+// counted in Pruned and Rebuilt.
+type FsckReport struct {
+	// Checked is how many snippet and revision files were read.
+	Checked int
+	// Missing are snippets whose data file is gone, and MissingRevisions
+	// versions whose revision file is, as "id version n".
+	Missing          []string
+	MissingRevisions []string
+	// Corrupt are snippets whose content doesn't match the index, and
+	// CorruptRevisions revision files whose content doesn't match their
+	// name, or files of either that can't be read or decrypted.
+	Corrupt          []string
+	CorruptRevisions []string
+	// Orphans are data files no snippet refers to, and OrphanRevisions
+	// revision files no version does.
+	Orphans         []string
+	OrphanRevisions []string
+	Pruned, Rebuilt int
+}
+
+// Problems counts the problems found, repaired or not.
+func (r FsckReport) Problems() int {
+	return len(r.Missing) + len(r.MissingRevisions) + len(r.Corrupt) + len(r.CorruptRevisions) +
+		len(r.Orphans) + len(r.OrphanRevisions)
+}
+
+// Unrepaired counts the problems still in the store: corrupt files and
+// missing revisions are only ever reported.
+func (r FsckReport) Unrepaired() int {
+	return r.Problems() - r.Pruned - r.Rebuilt
+}
+
+// Fsck checks the store, repairing what opts asks for. It holds the write
+// lock while it reads every file, so run it while the store is not
+// serving: before a server starts, or from the command line.
+func (ps *Store) Fsck(opts FsckOptions) (FsckReport, error) {
+	var report FsckReport
+	data, err := ps.fileSet(dataDirName)
+	if err != nil {
+		return report, err
+	}
+	revisions, err := ps.fileSet(revisionsDirName)
+	if err != nil {
+		return report, err
+	}
+
+	ps.Lock()
+	var missing []string
+	for id, meta := range ps.index {
+		if !data[id] {
+			report.Missing = append(report.Missing, id)
+			missing = append(missing, id)
+			continue
+		}
+		report.Checked++
+		if content, err := ps.readContent(dataDirName, id); err != nil || contentHash(content) != meta.hash {
+			report.Corrupt = append(report.Corrupt, id)
+		}
+	}
+	referenced := make(map[string]bool)
+	for id, list := range ps.history {
+		for _, rev := range list {
+			referenced[rev.Hash] = true
+			if !revisions[rev.Hash] {
+				report.MissingRevisions = append(report.MissingRevisions, fmt.Sprintf("%s version %d", id, rev.N))
+			}
+		}
+	}
+	for hash := range revisions {
+		if !referenced[hash] {
+			report.OrphanRevisions = append(report.OrphanRevisions, hash)
+			continue
+		}
+		report.Checked++
+		if content, err := ps.readContent(revisionsDirName, hash); err != nil || contentHash(content) != hash {
+			report.CorruptRevisions = append(report.CorruptRevisions, hash)
+		}
+	}
+	for id := range data {
+		if _, indexed := ps.index[id]; !indexed {
+			report.Orphans = append(report.Orphans, id)
+		}
+	}
+
+	adopted := make(map[string]bool)
+	if opts.Rebuild {
+		for _, id := range report.Orphans {
+			if ps.reserved[id] {
+				continue
+			}
+			content, err := ps.readContent(dataDirName, id)
+			if err != nil {
+				continue
+			}
+			report.Checked++
+			ps.adopt(id, content)
+			adopted[id] = true
+			report.Rebuilt++
+		}
+	}
+	var hadComments, hadHistory bool
+	if opts.Prune {
+		for _, id := range missing {
+			c, h := ps.drop(id, ps.index[id])
+			hadComments, hadHistory = hadComments || c, hadHistory || h
+			report.Pruned++
+		}
+	}
+	ps.Unlock()
+
+	if opts.Rebuild || opts.Prune {
+		ps.saveIndex()
+	}
+	if hadComments {
+		ps.saveComments()
+	}
+	if hadHistory {
+		ps.saveHistory()
+	}
+	if opts.Prune {
+		for _, id := range report.Orphans {
+			if adopted[id] {
+				continue
+			}
+			if err := ps.backend.removeFile(dataDirName, id); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return report, err
+			}
+			report.Pruned++
+		}
+		for _, hash := range report.OrphanRevisions {
+			if err := ps.backend.removeFile(revisionsDirName, hash); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return report, err
+			}
+			report.Pruned++
+		}
+	}
+	for _, list := range [][]string{report.Missing, report.MissingRevisions, report.Corrupt, report.CorruptRevisions, report.Orphans, report.OrphanRevisions} {
+		sort.Strings(list)
+	}
+	return report, nil
+}
+
+// readContent returns the decrypted content of file name in dir.
+func (ps *Store) readContent(dir, name string) (string, error) {
+	data, err := ps.backend.readFile(dir, name)
+	if err != nil {
+		return "", err
+	}
+	content, err := ps.keys.open(data)
+	return string(content), err
+}
+
+// adopt indexes the data file id, holding content, as an anonymous
+// snippet created now; callers hold the write lock and save the index.
+func (ps *Store) adopt(id, content string) {
+	now := ps.clock.Now()
+	meta := &snippetMeta{
+		hash:      contentHash(content),
+		created:   now,
+		updated:   now,
+		size:      len(content),
+		mediaType: DetectMediaType(content, false),
+	}
+	ps.index[id] = meta
+	ps.addContent(meta, id)
+	ps.recordChange(ChangeCreated, id, meta)
+}
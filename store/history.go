@@ -0,0 +1,157 @@
+// Package store implements revision history. Updating a snippet keeps the
+// content it replaces as a revision: a file in the revisions directory
+// named by its hash, so identical revisions, of one snippet or several,
+// share a file. Each snippet's revisions are listed in history.txt as a
+// JSON list. Drafts keep no history until they are published, and a
+// snippet's history goes when it does.
+package store
+
+import (
+	"encoding/json"
+	"log/slog"
+	"time"
+)
+
+const (
+	historyFileName  = "history.txt"
+	revisionsDirName = "revisions"
+)
+
+// Revision is one version of a snippet.
+type Revision struct {
+	// N numbers the snippet's versions from 1, the one it was created with.
+	N         int    `json:"n"`
+	Hash      string `json:"hash"`
+	Size      int    `json:"size"`
+	MediaType string `json:"media_type,omitempty"`
+	// Created is when the version was saved.
+	Created time.Time `json:"created"`
+}
+
+func loadHistory(b backend) (map[string][]Revision, error) {
+	pairs, err := b.readPairs(historyFileName)
+	if err != nil {
+		return nil, err
+	}
+	history := make(map[string][]Revision, len(pairs))
+	for id, value := range pairs {
+		var list []Revision
+		if err := json.Unmarshal([]byte(value), &list); err != nil {
+			slog.Error("Skipping unreadable history", "id", id, "err", err)
+			continue
+		}
+		history[id] = list
+	}
+	return history, nil
+}
+
+func (ps *Store) saveHistory() {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	pairs := make(map[string]string, len(ps.history))
+	for id, list := range ps.history {
+		encoded, err := json.Marshal(list)
+		if err != nil {
+			panic("unable to encode history: " + err.Error())
+		}
+		pairs[id] = string(encoded)
+	}
+	if err := ps.backend.writePairs(historyFileName, pairs); err != nil {
+		panic("unable to save history: " + err.Error())
+	}
+}
+
+// latest is the version of id that meta describes, its current one.
+func (ps *Store) latest(id string, meta *snippetMeta) Revision {
+	created := meta.updated
+	if created.IsZero() {
+		created = meta.created
+	}
+	return Revision{N: len(ps.history[id]) + 1, Hash: meta.hash, Size: meta.size, MediaType: meta.mediaType, Created: created}
+}
+
+// keepRevision records the content of id that meta describes as a revision,
+// before it is replaced, reporting whether it did. Callers hold the write
+// lock and save the history if so.
+func (ps *Store) keepRevision(id string, meta *snippetMeta) bool {
+	if meta.draft {
+		return false
+	}
+	rev := ps.latest(id, meta)
+	if err := ps.backend.copyFile(dataDirName, id, revisionsDirName, rev.Hash); err != nil {
+		slog.Error("Failed to keep revision", "id", id, "n", rev.N, "err", err)
+		return false
+	}
+	ps.history[id] = append(ps.history[id], rev)
+	return true
+}
+
+// dropHistory removes the history of id, and any revision files no other
+// snippet's history shares, reporting whether there was any. Callers hold
+// the write lock and save if so.
+func (ps *Store) dropHistory(id string) bool {
+	list, ok := ps.history[id]
+	if !ok {
+		return false
+	}
+	delete(ps.history, id)
+	unused := make(map[string]bool, len(list))
+	for _, rev := range list {
+		unused[rev.Hash] = true
+	}
+	for _, other := range ps.history {
+		for _, rev := range other {
+			delete(unused, rev.Hash)
+		}
+	}
+	for hash := range unused {
+		if err := ps.backend.removeFile(revisionsDirName, hash); err != nil {
+			slog.Error("Failed to remove revision file", "hash", hash, "err", err)
+		}
+	}
+	return true
+}
+
+// History returns the versions of id, oldest first and ending with the
+// current one.
+func (ps *Store) History(id string) ([]Revision, bool) {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	meta, exists := ps.index[id]
+	if !exists || meta.expired(ps.clock.Now()) {
+		return nil, false
+	}
+	list := append([]Revision(nil), ps.history[id]...)
+	return append(list, ps.latest(id, meta)), true
+}
+
+// Revision returns the content of version n of id, as numbered by History.
+func (ps *Store) Revision(id string, n int) (string, Revision, bool) {
+	ps.RLock()
+	meta, exists := ps.index[id]
+	if !exists || meta.expired(ps.clock.Now()) || n < 1 || n > len(ps.history[id])+1 {
+		ps.RUnlock()
+		return "", Revision{}, false
+	}
+	if n == len(ps.history[id])+1 {
+		rev := ps.latest(id, meta)
+		ps.RUnlock()
+		content, ok := ps.Get(id)
+		return content, rev, ok
+	}
+	rev := ps.history[id][n-1]
+	ps.RUnlock()
+
+	data, err := ps.backend.readFile(revisionsDirName, rev.Hash)
+	if err != nil {
+		return "", Revision{}, false
+	}
+	content, err := ps.keys.open(data)
+	if err != nil {
+		slog.Error("Failed to decrypt revision", "id", id, "n", n, "err", err)
+		return "", Revision{}, false
+	}
+	return string(content), rev, true
+}
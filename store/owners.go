@@ -0,0 +1,129 @@
+// Package store implements what becomes of a removed account's snippets.
+// Each instance picks one disposal policy: orphan them (they stay, with no
+// owner, as if created anonymously), delete them, or transfer them to
+// another account such as an organization's. Dispose applies the policy to
+// all of an owner's snippets in one step under the store's lock and appends
+// what it did to owners.txt, the audit trail of disposals.
+package store
+
+import (
+	"fmt"
+	"strings"
+)
+
+const ownersFileName = "owners.txt"
+
+// Disposal is what a DisposalPolicy does with a removed owner's snippets.
+type Disposal int
+
+const (
+	// DisposeOrphan keeps the snippets without an owner. Their slugs go,
+	// anonymous snippets having no namespace.
+	DisposeOrphan Disposal = iota
+	// DisposeDelete deletes the snippets.
+	DisposeDelete
+	// DisposeTransfer gives the snippets to another owner. A slug the new
+	// owner already uses is dropped from the snippet taking it over.
+	DisposeTransfer
+)
+
+// DisposalPolicy decides what becomes of a removed owner's snippets. The
+// zero value orphans them.
+type DisposalPolicy struct {
+	Disposal Disposal
+	// To is the owner DisposeTransfer gives the snippets to.
+	To string
+}
+
+// ParseDisposalPolicy parses "orphan", "delete" or "transfer:NAME".
+func ParseDisposalPolicy(s string) (DisposalPolicy, error) {
+	switch action, to, _ := strings.Cut(s, ":"); action {
+	case "orphan":
+		return DisposalPolicy{Disposal: DisposeOrphan}, nil
+	case "delete":
+		return DisposalPolicy{Disposal: DisposeDelete}, nil
+	case "transfer":
+		if to == "" || strings.ContainsAny(to, " /\n") {
+			return DisposalPolicy{}, fmt.Errorf("invalid disposal policy %q (want transfer:NAME with a user name)", s)
+		}
+		return DisposalPolicy{Disposal: DisposeTransfer, To: to}, nil
+	}
+	return DisposalPolicy{}, fmt.Errorf("unknown disposal policy %q (want orphan, delete or transfer:NAME)", s)
+}
+
+func (p DisposalPolicy) String() string {
+	switch p.Disposal {
+	case DisposeDelete:
+		return "delete"
+	case DisposeTransfer:
+		return "transfer:" + p.To
+	}
+	return "orphan"
+}
+
+// Dispose applies policy to every snippet owner has, returning their IDs.
+// The snippets change hands, or are deleted, together: no reader sees some
+// of them moved and others not, and the index is saved once. Each is
+// recorded in the change journal, and the disposal as a whole in
+// owners.txt.
+func (ps *Store) Dispose(owner string, policy DisposalPolicy) []string {
+	if owner == "" || (policy.Disposal == DisposeTransfer && policy.To == owner) {
+		return nil
+	}
+	ps.Lock()
+	ids := make([]string, 0, len(ps.byOwner[owner]))
+	for id := range ps.byOwner[owner] {
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		ps.Unlock()
+		return nil
+	}
+	ps.sortIDsNewestFirst(ids)
+
+	var saveComments, saveHistory bool
+	for _, id := range ids {
+		meta := ps.index[id]
+		if policy.Disposal == DisposeDelete {
+			hadComments, hadHistory := ps.drop(id, meta)
+			saveComments = saveComments || hadComments
+			saveHistory = saveHistory || hadHistory
+			continue
+		}
+		ps.removeOwned(meta.owner, id)
+		ps.removeContent(meta, id)
+		ps.removeSlug(meta, id)
+		meta.owner = policy.To
+		if _, taken := ps.bySlug[slugKey(meta.owner, meta.slug)]; meta.owner == "" || taken {
+			meta.slug = ""
+		}
+		ps.addOwned(meta.owner, id)
+		ps.addContent(meta, id)
+		ps.addSlug(meta, id)
+		ps.recordChange(ChangeUpdated, id, meta)
+	}
+	ps.recordDisposal(owner, policy, ids)
+	ps.Unlock()
+
+	ps.saveIndex()
+	if saveComments {
+		ps.saveComments()
+	}
+	if saveHistory {
+		ps.saveHistory()
+	}
+	if policy.Disposal == DisposeDelete {
+		go ps.removeFiles(ids)
+	}
+	return ids
+}
+
+// recordDisposal appends a disposal to owners.txt, one line of the time,
+// the former owner, the policy and the snippets; callers hold the write
+// lock.
+func (ps *Store) recordDisposal(owner string, policy DisposalPolicy, ids []string) {
+	line := fmt.Sprintf("%d %s %s %s\n", ps.clock.Now().Unix(), owner, policy, strings.Join(ids, ","))
+	if err := ps.backend.appendLog(ownersFileName, line); err != nil {
+		panic("unable to write disposal log: " + err.Error())
+	}
+}
@@ -0,0 +1,446 @@
+// Package store implements the PostgreSQL backend, for operators who want
+// the store on a database server: replicated, backed up and restored with
+// the database's own tools. It keeps the same state as the directory
+// backend in three tables, pb_pairs, pb_files and pb_logs, whose schema is
+// brought up to date on open by the numbered migrations below, each applied
+// once in its own transaction and recorded in pb_migrations.
+//
+// A snippet's content is written in the same transaction as the index that
+// lists it, so the database never holds one without the other. The index
+// is still held in memory, so only one server may write to a database at a
+// time: opening takes a session advisory lock, held until Close, and a
+// second server fails to open rather than overwrite the first's changes.
+// Further instances run as read replicas of the one holding it, and a
+// standby takes over by opening the database once it is released.
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// pgLockKey is the advisory lock a server holds on its database.
+const pgLockKey = 0x7062 // "pb"
+
+// migrations are the schema changes, in order; migration n is
+// migrations[n-1]. Released migrations never change: a new schema is a
+// new migration.
+var migrations = [][]string{
+	{
+		`CREATE TABLE pb_pairs (
+			set_name text NOT NULL,
+			key text NOT NULL,
+			value text NOT NULL,
+			PRIMARY KEY (set_name, key)
+		)`,
+		`CREATE TABLE pb_files (
+			dir text NOT NULL,
+			name text NOT NULL,
+			data bytea NOT NULL,
+			PRIMARY KEY (dir, name)
+		)`,
+		`CREATE TABLE pb_logs (
+			id bigserial PRIMARY KEY,
+			name text NOT NULL,
+			line text NOT NULL
+		)`,
+		`CREATE INDEX pb_logs_name ON pb_logs (name, id)`,
+	},
+}
+
+// pgBackend keeps the state in a PostgreSQL database.
+type pgBackend struct {
+	pool *pgxpool.Pool
+	// lock is the connection holding the advisory lock.
+	lock *pgxpool.Conn
+	// mu serializes writePairs, and saved holds each set as last read or
+	// written, so that only the pairs that changed since are written.
+	mu    sync.Mutex
+	saved map[string]map[string]string
+}
+
+// openPostgres connects to the database at url, takes its advisory lock
+// and migrates its schema.
+func openPostgres(url string) (*pgBackend, error) {
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open database: %w", err)
+	}
+	b := &pgBackend{pool: pool, saved: make(map[string]map[string]string)}
+	if b.lock, err = pool.Acquire(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("unable to connect to database: %w", err)
+	}
+	var locked bool
+	if err := b.lock.QueryRow(ctx, `SELECT pg_try_advisory_lock($1::bigint)`, pgLockKey).Scan(&locked); err != nil {
+		b.close()
+		return nil, fmt.Errorf("unable to lock database: %w", err)
+	}
+	if !locked {
+		b.close()
+		return nil, errors.New("the database is in use by another pb server")
+	}
+	if err := migrate(ctx, b.lock.Conn()); err != nil {
+		b.close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// migrate applies the migrations the database hasn't had yet.
+func migrate(ctx context.Context, conn *pgx.Conn) error {
+	if _, err := conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS pb_migrations (
+		version integer PRIMARY KEY,
+		applied timestamptz NOT NULL DEFAULT now()
+	)`); err != nil {
+		return fmt.Errorf("unable to create migrations table: %w", err)
+	}
+	var version int
+	if err := conn.QueryRow(ctx, `SELECT COALESCE(MAX(version), 0) FROM pb_migrations`).Scan(&version); err != nil {
+		return fmt.Errorf("unable to read schema version: %w", err)
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than this pb's %d", version, len(migrations))
+	}
+	for v := version + 1; v <= len(migrations); v++ {
+		err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			for _, stmt := range migrations[v-1] {
+				if _, err := tx.Exec(ctx, stmt); err != nil {
+					return err
+				}
+			}
+			_, err := tx.Exec(ctx, `INSERT INTO pb_migrations (version) VALUES ($1)`, v)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d failed: %w", v, err)
+		}
+	}
+	return nil
+}
+
+func (b *pgBackend) readPairs(set string) (map[string]string, error) {
+	rows, err := b.pool.Query(context.Background(), `SELECT key, value FROM pb_pairs WHERE set_name = $1`, set)
+	if err != nil {
+		return nil, err
+	}
+	pairs := make(map[string]string)
+	var key, value string
+	_, err = pgx.ForEachRow(rows, []any{&key, &value}, func() error {
+		pairs[key] = value
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	saved := make(map[string]string, len(pairs))
+	for k, v := range pairs {
+		saved[k] = v
+	}
+	b.saved[set] = saved
+	return pairs, nil
+}
+
+// writePairs writes the pairs that changed since the set was last read or
+// written, and files, in one transaction.
+func (b *pgBackend) writePairs(set string, pairs map[string]string, files ...file) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	saved := b.saved[set]
+	batch := &pgx.Batch{}
+	for key, value := range pairs {
+		if old, ok := saved[key]; !ok || old != value {
+			batch.Queue(`INSERT INTO pb_pairs (set_name, key, value) VALUES ($1, $2, $3)
+				ON CONFLICT (set_name, key) DO UPDATE SET value = EXCLUDED.value`, set, key, value)
+		}
+	}
+	for key := range saved {
+		if _, ok := pairs[key]; !ok {
+			batch.Queue(`DELETE FROM pb_pairs WHERE set_name = $1 AND key = $2`, set, key)
+		}
+	}
+	for _, f := range files {
+		data, err := f.content()
+		if err != nil {
+			return err
+		}
+		queueWriteFile(batch, f.dir, f.name, data)
+	}
+
+	ctx := context.Background()
+	err := pgx.BeginFunc(ctx, b.pool, func(tx pgx.Tx) error {
+		return tx.SendBatch(ctx, batch).Close()
+	})
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		f.discard()
+	}
+	b.saved[set] = pairs
+	return nil
+}
+
+// content returns the data of f, reading it from its spool file if it has
+// one.
+func (f file) content() ([]byte, error) {
+	if f.spooled == "" {
+		return f.data, nil
+	}
+	return os.ReadFile(f.spooled)
+}
+
+// discard removes the spool file of f, once its content is stored.
+func (f file) discard() {
+	if f.spooled != "" {
+		os.Remove(f.spooled)
+	}
+}
+
+func queueWriteFile(batch *pgx.Batch, dir, name string, data []byte) {
+	batch.Queue(`INSERT INTO pb_files (dir, name, data) VALUES ($1, $2, $3)
+		ON CONFLICT (dir, name) DO UPDATE SET data = EXCLUDED.data`, dir, name, data)
+}
+
+func (b *pgBackend) readFile(dir, name string) ([]byte, error) {
+	var data []byte
+	err := b.pool.QueryRow(context.Background(), `SELECT data FROM pb_files WHERE dir = $1 AND name = $2`, dir, name).Scan(&data)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("%s/%s: %w", dir, name, fs.ErrNotExist)
+	}
+	return data, err
+}
+
+func (b *pgBackend) openFile(dir, name string) (io.ReadCloser, int64, error) {
+	data, err := b.readFile(dir, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
+
+func (b *pgBackend) writeFile(f file) error {
+	data, err := f.content()
+	if err != nil {
+		return err
+	}
+	batch := &pgx.Batch{}
+	queueWriteFile(batch, f.dir, f.name, data)
+	if err := b.pool.SendBatch(context.Background(), batch).Close(); err != nil {
+		return err
+	}
+	f.discard()
+	return nil
+}
+
+// copyFile copies the row; a file already there is left as it is, as the
+// directory backend leaves an existing link.
+func (b *pgBackend) copyFile(fromDir, from, toDir, to string) error {
+	tag, err := b.pool.Exec(context.Background(), `INSERT INTO pb_files (dir, name, data)
+		SELECT $3, $4, data FROM pb_files WHERE dir = $1 AND name = $2
+		ON CONFLICT (dir, name) DO NOTHING`, fromDir, from, toDir, to)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		if _, err := b.readFile(toDir, to); err != nil {
+			return fmt.Errorf("%s/%s: %w", fromDir, from, fs.ErrNotExist)
+		}
+	}
+	return nil
+}
+
+func (b *pgBackend) removeFile(dir, name string) error {
+	tag, err := b.pool.Exec(context.Background(), `DELETE FROM pb_files WHERE dir = $1 AND name = $2`, dir, name)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%s/%s: %w", dir, name, fs.ErrNotExist)
+	}
+	return nil
+}
+
+func (b *pgBackend) listFiles(dir string) ([]string, error) {
+	rows, err := b.pool.Query(context.Background(), `SELECT name FROM pb_files WHERE dir = $1`, dir)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+func (b *pgBackend) readLog(name string) ([]byte, error) {
+	rows, err := b.pool.Query(context.Background(), `SELECT line FROM pb_logs WHERE name = $1 ORDER BY id`, name)
+	if err != nil {
+		return nil, err
+	}
+	lines, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strings.Join(lines, "")), nil
+}
+
+func (b *pgBackend) appendLog(name, line string) error {
+	_, err := b.pool.Exec(context.Background(), `INSERT INTO pb_logs (name, line) VALUES ($1, $2)`, name, line)
+	return err
+}
+
+// truncateLog deletes the lines from the one that would run past size.
+// Lines are appended whole, so logs in a database end in a newline and
+// this is not needed in practice.
+func (b *pgBackend) truncateLog(name string, size int64) error {
+	ctx := context.Background()
+	rows, err := b.pool.Query(ctx, `SELECT id, line FROM pb_logs WHERE name = $1 ORDER BY id`, name)
+	if err != nil {
+		return err
+	}
+	var id, cut int64
+	var line string
+	var total int64
+	_, err = pgx.ForEachRow(rows, []any{&id, &line}, func() error {
+		total += int64(len(line))
+		if total > size && cut == 0 {
+			cut = id
+		}
+		return nil
+	})
+	if err != nil || cut == 0 {
+		return err
+	}
+	_, err = b.pool.Exec(ctx, `DELETE FROM pb_logs WHERE name = $1 AND id >= $2`, name, cut)
+	return err
+}
+
+func (b *pgBackend) spoolDir() string { return os.TempDir() }
+
+// close releases the advisory lock, by closing its connection, and the
+// rest of the pool.
+func (b *pgBackend) close() error {
+	if b.lock != nil {
+		b.lock.Release()
+	}
+	b.pool.Close()
+	return nil
+}
+
+// CheckDatabase connects to the database at url and checks that this pb
+// can use its schema. Unlike opening a store in it, it takes no lock, so
+// it can run next to the server using the database.
+func CheckDatabase(url string) error {
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+	var version int
+	err = conn.QueryRow(ctx, `SELECT COALESCE(MAX(version), 0) FROM pb_migrations`).Scan(&version)
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgUndefinedTable {
+		// A new database, which the server will set up.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than this pb's %d", version, len(migrations))
+	}
+	return nil
+}
+
+// pgUndefinedTable is the SQLSTATE of queries on tables that don't exist.
+const pgUndefinedTable = "42P01"
+
+// Import copies the store in dir, its snippets, revisions, comments,
+// history and logs, into the database opts.Database, which must not hold
+// a store yet, and returns how many snippets it copied. Whatever an
+// interrupted import left in the database is cleared first, so it can be
+// run again. No server may be using either store meanwhile.
+func Import(dir string, opts Options) (int, error) {
+	from, err := openDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	to, err := openPostgres(opts.Database)
+	if err != nil {
+		return 0, err
+	}
+	defer to.close()
+
+	index, err := from.readPairs(indexFileName)
+	if err != nil {
+		return 0, err
+	}
+	if existing, err := to.readPairs(indexFileName); err != nil {
+		return 0, err
+	} else if len(existing) > 0 {
+		return 0, errors.New("the database already holds a store")
+	}
+	ctx := context.Background()
+	for _, table := range []string{"pb_pairs", "pb_files", "pb_logs"} {
+		if _, err := to.pool.Exec(ctx, `DELETE FROM `+table); err != nil {
+			return 0, err
+		}
+	}
+	to.saved = make(map[string]map[string]string)
+
+	for _, d := range []string{dataDirName, revisionsDirName} {
+		names, err := from.listFiles(d)
+		if err != nil {
+			return 0, err
+		}
+		for _, name := range names {
+			data, err := from.readFile(d, name)
+			if err != nil {
+				return 0, err
+			}
+			if err := to.writeFile(file{dir: d, name: name, data: data}); err != nil {
+				return 0, err
+			}
+		}
+	}
+	for _, name := range []string{changesFileName, ownersFileName} {
+		content, err := from.readLog(name)
+		if err != nil {
+			return 0, err
+		}
+		batch := &pgx.Batch{}
+		for _, line := range strings.SplitAfter(string(content), "\n") {
+			if strings.HasSuffix(line, "\n") {
+				batch.Queue(`INSERT INTO pb_logs (name, line) VALUES ($1, $2)`, name, line)
+			}
+		}
+		if err := to.pool.SendBatch(ctx, batch).Close(); err != nil {
+			return 0, err
+		}
+	}
+	// The index goes last: until it is in, the database holds no store.
+	for _, set := range []string{commentsFileName, historyFileName, indexFileName} {
+		pairs, err := from.readPairs(set)
+		if err != nil {
+			return 0, err
+		}
+		if err := to.writePairs(set, pairs); err != nil {
+			return 0, err
+		}
+	}
+	return len(index), nil
+}
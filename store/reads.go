@@ -0,0 +1,120 @@
+// Package store implements shared read counting. A snippet with a read
+// limit expires once read that many times, but read counts only reach the
+// index with its next save, so a server taking over the store from one
+// that crashed, such as a standby on the same database, would serve reads
+// the first had already served, and servers sharing a store would each
+// serve the last read. Given a ReadCounter, ClaimRead takes each read of
+// such snippets there before it is served, so only one reader gets it; the
+// index catches up with the counter as reads are claimed and when expired
+// snippets are swept. Other read counts are statistics and stay per server.
+package store
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ReadCounter counts reads of read-limited snippets for every server that
+// serves them.
+type ReadCounter interface {
+	// Add counts a read of the snippet keyed key, returning its reads so
+	// far.
+	Add(key string) (int, error)
+	// Count returns the reads counted for key, zero if none.
+	Count(key string) (int, error)
+}
+
+// readKey keys the reads of id, whose metadata is meta. It includes the
+// creation time so that a new snippet reusing a deleted one's ID starts
+// with no reads.
+func readKey(id string, meta *snippetMeta) string {
+	return id + "@" + strconv.FormatInt(meta.created.Unix(), 10)
+}
+
+// sharesReads reports whether reads of meta are counted in ps.reads.
+func (ps *Store) sharesReads(meta *snippetMeta) bool {
+	return ps.reads != nil && meta.maxReads > 0
+}
+
+// syncReads brings the read counts of ids up to date with the shared
+// counter. Counters that fail are left as the index has them.
+func (ps *Store) syncReads(ids ...string) {
+	if ps.reads == nil {
+		return
+	}
+	keys := make(map[string]string, len(ids))
+	ps.RLock()
+	for _, id := range ids {
+		if meta, exists := ps.index[id]; exists && ps.sharesReads(meta) {
+			keys[id] = readKey(id, meta)
+		}
+	}
+	ps.RUnlock()
+	for id, key := range keys {
+		n, err := ps.reads.Count(key)
+		if err != nil {
+			slog.Error("Failed to read shared read count", "id", id, "err", err)
+			continue
+		}
+		ps.setReads(id, key, n)
+	}
+}
+
+// setReads raises the reads of id to n, the shared count for key, unless
+// id has since been replaced.
+func (ps *Store) setReads(id, key string, n int) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	if meta, exists := ps.index[id]; exists && readKey(id, meta) == key && n > meta.reads {
+		meta.reads = n
+		ps.dirty = true
+	}
+}
+
+// redisReadTTL is how long a snippet's shared read count is kept after
+// its last read. Servers keep their own count in the index too, so a
+// count that lapses only forgets reads served elsewhere.
+const redisReadTTL = 30 * 24 * time.Hour
+
+// redisTimeout bounds one Redis command.
+const redisTimeout = 2 * time.Second
+
+// redisReads is a ReadCounter in Redis, with a counter per snippet.
+type redisReads struct {
+	client *redis.Client
+}
+
+// RedisReads returns a ReadCounter keeping counts in Redis under pb:reads:.
+func RedisReads(client *redis.Client) ReadCounter {
+	return redisReads{client: client}
+}
+
+func (r redisReads) Add(key string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	var incr *redis.IntCmd
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.Incr(ctx, "pb:reads:"+key)
+		pipe.Expire(ctx, "pb:reads:"+key, redisReadTTL)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(incr.Val()), nil
+}
+
+func (r redisReads) Count(key string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	n, err := r.client.Get(ctx, "pb:reads:"+key).Int()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return n, err
+}
@@ -0,0 +1,161 @@
+// Package store implements encryption of streams too large to seal in one
+// piece, such as backup archives. A sealed stream is "pbstr1", the 4-byte
+// ID of the key and an 8-byte random prefix, then chunks of up to 64 KiB,
+// each its 4-byte ciphertext length and its AES-GCM ciphertext. A chunk's
+// nonce is the prefix and its number, and its additional data marks the
+// last one, so chunks can be neither reordered nor cut off unnoticed.
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var streamMagic = []byte("pbstr1")
+
+const (
+	streamChunkSize  = 64 << 10
+	streamPrefixSize = 8
+)
+
+var (
+	chunkMore = []byte{0}
+	chunkLast = []byte{1}
+)
+
+// IsSealedStream reports whether data starts a stream written by
+// SealStream.
+func IsSealedStream(data []byte) bool {
+	return bytes.HasPrefix(data, streamMagic)
+}
+
+// SealStream returns a writer encrypting what is written to it onto w with
+// the current key; kr must not be nil. Close writes the last chunk; it
+// does not close w.
+func (kr *Keyring) SealStream(w io.Writer) (io.WriteCloser, error) {
+	key := kr.keys[0]
+	s := &streamSealer{w: w, aead: key.aead, nonce: make([]byte, key.aead.NonceSize())}
+	if _, err := rand.Read(s.nonce[:streamPrefixSize]); err != nil {
+		return nil, err
+	}
+	header := append(append(append([]byte{}, streamMagic...), key.id[:]...), s.nonce[:streamPrefixSize]...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+type streamSealer struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	nonce []byte
+	n     uint32
+	buf   []byte
+}
+
+func (s *streamSealer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more follows, so that the last
+		// one is never empty unless the stream is.
+		if len(s.buf) == streamChunkSize {
+			if err := s.flush(chunkMore); err != nil {
+				return written, err
+			}
+		}
+		n := min(len(p), streamChunkSize-len(s.buf))
+		s.buf = append(s.buf, p[:n]...)
+		p, written = p[n:], written+n
+	}
+	return written, nil
+}
+
+func (s *streamSealer) Close() error {
+	return s.flush(chunkLast)
+}
+
+func (s *streamSealer) flush(last []byte) error {
+	binary.BigEndian.PutUint32(s.nonce[streamPrefixSize:], s.n)
+	s.n++
+	sealed := s.aead.Seal(make([]byte, 4, 4+len(s.buf)+s.aead.Overhead()), s.nonce, s.buf, last)
+	binary.BigEndian.PutUint32(sealed, uint32(len(sealed)-4))
+	s.buf = s.buf[:0]
+	_, err := s.w.Write(sealed)
+	return err
+}
+
+// OpenStream returns a reader decrypting the stream sealed onto r by
+// SealStream with any of the keys.
+func (kr *Keyring) OpenStream(r io.Reader) (io.Reader, error) {
+	header := make([]byte, len(streamMagic)+keyIDSize+streamPrefixSize)
+	if _, err := io.ReadFull(r, header); err != nil || !IsSealedStream(header) {
+		return nil, errors.New("not an encrypted stream")
+	}
+	if kr == nil {
+		return nil, errors.New("stream is encrypted but no key is configured")
+	}
+	id := header[len(streamMagic) : len(streamMagic)+keyIDSize]
+	for _, key := range kr.keys {
+		if bytes.Equal(key.id[:], id) {
+			o := &streamOpener{r: bufio.NewReader(r), aead: key.aead, nonce: make([]byte, key.aead.NonceSize())}
+			copy(o.nonce, header[len(header)-streamPrefixSize:])
+			return o, nil
+		}
+	}
+	return nil, errors.New("stream is encrypted with an unknown key")
+}
+
+type streamOpener struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	nonce []byte
+	n     uint32
+	buf   []byte
+	done  bool
+}
+
+func (o *streamOpener) Read(p []byte) (int, error) {
+	for len(o.buf) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+		if err := o.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, o.buf)
+	o.buf = o.buf[n:]
+	return n, nil
+}
+
+// next decrypts the next chunk into o.buf.
+func (o *streamOpener) next() error {
+	var size [4]byte
+	if _, err := io.ReadFull(o.r, size[:]); err != nil {
+		return errors.New("truncated encrypted stream")
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > streamChunkSize+uint32(o.aead.Overhead()) {
+		return errors.New("corrupt encrypted stream")
+	}
+	sealed := make([]byte, n)
+	if _, err := io.ReadFull(o.r, sealed); err != nil {
+		return errors.New("truncated encrypted stream")
+	}
+	binary.BigEndian.PutUint32(o.nonce[streamPrefixSize:], o.n)
+	o.n++
+	plain, err := o.aead.Open(nil, o.nonce, sealed, chunkMore)
+	if err != nil {
+		if plain, err = o.aead.Open(nil, o.nonce, sealed, chunkLast); err != nil {
+			return errors.New("corrupt encrypted stream")
+		}
+		o.done = true
+	}
+	o.buf = plain
+	return nil
+}
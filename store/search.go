@@ -0,0 +1,128 @@
+// Package store implements full-text search over snippet content with an
+// inverted index, kept in memory and built when the store is opened. Only
+// text snippets that can be searched by someone are indexed: those created
+// searchable, and those with an owner, who may search their own.
+package store
+
+import (
+	"log/slog"
+	"strings"
+	"unicode"
+)
+
+// Search terms are runs of letters and digits, compared in lower case;
+// those shorter than minTermLength or longer than maxTermLength are left
+// out of the index and of queries.
+const (
+	minTermLength = 2
+	maxTermLength = 64
+)
+
+// SearchTerms returns the distinct terms of s, in order of appearance.
+func SearchTerms(s string) []string {
+	seen := make(map[string]bool)
+	var terms []string
+	for _, word := range strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		term := strings.ToLower(word)
+		if n := len(term); n < minTermLength || n > maxTermLength || seen[term] {
+			continue
+		}
+		seen[term] = true
+		terms = append(terms, term)
+	}
+	return terms
+}
+
+// indexed reports whether the snippet belongs in the search index.
+func (meta *snippetMeta) indexed() bool {
+	return (meta.searchable || meta.owner != "") && meta.mediaType == "" && !meta.encrypted && !meta.honeytoken
+}
+
+// indexTerms indexes the current content of id, replacing what the index
+// held for it. It reads the snippet file, so callers hold no lock.
+func (ps *Store) indexTerms(id string) {
+	ps.RLock()
+	meta, exists := ps.index[id]
+	indexed := exists && meta.indexed()
+	ps.RUnlock()
+
+	var terms []string
+	if indexed {
+		data, err := ps.backend.readFile(dataDirName, id)
+		if err != nil {
+			slog.Error("Failed to index snippet", "id", id, "err", err)
+			return
+		}
+		content, err := ps.keys.open(data)
+		if err != nil {
+			slog.Error("Failed to index snippet", "id", id, "err", err)
+			return
+		}
+		terms = SearchTerms(string(content))
+	}
+
+	ps.Lock()
+	defer ps.Unlock()
+	ps.removeTerms(id)
+	if _, exists := ps.index[id]; !exists {
+		return
+	}
+	for _, term := range terms {
+		if ps.byTerm[term] == nil {
+			ps.byTerm[term] = make(map[string]struct{})
+		}
+		ps.byTerm[term][id] = struct{}{}
+	}
+	if len(terms) > 0 {
+		ps.termsOf[id] = terms
+	}
+}
+
+// removeTerms drops id from the search index; callers hold the write lock.
+func (ps *Store) removeTerms(id string) {
+	for _, term := range ps.termsOf[id] {
+		delete(ps.byTerm[term], id)
+		if len(ps.byTerm[term]) == 0 {
+			delete(ps.byTerm, term)
+		}
+	}
+	delete(ps.termsOf, id)
+}
+
+// Search returns the IDs of the snippets whose content holds every one of
+// terms, as SearchTerms finds them, newest first. Callers decide which of
+// them the searcher may see: Info.Searchable is set for snippets anyone
+// may find, and owners may find all of theirs.
+func (ps *Store) Search(terms []string) []string {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	if len(terms) == 0 {
+		return nil
+	}
+	// Walk the rarest term's snippets and check the others against them.
+	rarest := terms[0]
+	for _, term := range terms[1:] {
+		if len(ps.byTerm[term]) < len(ps.byTerm[rarest]) {
+			rarest = term
+		}
+	}
+	var ids []string
+	now := ps.clock.Now()
+	for id := range ps.byTerm[rarest] {
+		all := true
+		for _, term := range terms {
+			if _, ok := ps.byTerm[term][id]; !ok {
+				all = false
+				break
+			}
+		}
+		if meta := ps.index[id]; all && !meta.expired(now) {
+			ids = append(ids, id)
+		}
+	}
+	ps.sortIDsNewestFirst(ids)
+	return ids
+}
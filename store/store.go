@@ -0,0 +1,1414 @@
+// Package store implements a thread-safe permanent storage system for managing
+// text snippets. It features an index to track stored snippets by unique IDs,
+// persistence to files or PostgreSQL, and content deduplication using
+// SHA-256 hashing.
+// Supports create, read, update, and delete (CRUD) operations.
+//
+// Each index line is "id hash", optionally followed by a URL-encoded set of
+// metadata fields, so indexes written by older versions still load.
+package store
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"pb/internal/clock"
+)
+
+const (
+	indexFileName = "index.txt"
+	dataDirName   = "data"
+	idChars       = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	// maxIDLength caps IDs chosen with CreateOptions.ID.
+	maxIDLength = 64
+)
+
+// Store keeps snippets in a backend, by default as files under a root
+// directory, with an index recording their metadata. The index is held in
+// memory and saved whole. It is safe for concurrent use.
+type Store struct {
+	sync.RWMutex
+	backend backend
+	changes []Change
+	// comments holds line comments, by snippet.
+	comments map[string][]Comment
+	// history holds the earlier versions of snippets, whose content is in
+	// revisionsDirName.
+	history map[string][]Revision
+	index   map[string]*snippetMeta
+	byOwner map[string]map[string]struct{}
+	byLang  map[string]map[string]struct{}
+	dedup   DedupPolicy
+	// byContent maps a dedup key to the snippet Create hands out for it.
+	byContent map[string]string
+	// bySlug maps an owner and slug, joined by slugKey, to its snippet.
+	bySlug map[string]string
+	// byTerm maps a search term to the snippets holding it, and termsOf
+	// a snippet to its terms; see search.go.
+	byTerm  map[string]map[string]struct{}
+	termsOf map[string][]string
+	// reserved IDs are never handed out, typically because they collide
+	// with routes of whoever serves the store.
+	reserved map[string]bool
+	// dirty is set when the index has changes not yet saved, such as read
+	// counts.
+	dirty bool
+	// keys encrypt snippet files; nil stores them in plain text.
+	keys *Keyring
+	// clock tells the time, and rand, seeded with seed, picks new IDs
+	// under the write lock.
+	clock clock.Clock
+	seed  int64
+	rand  *rand.Rand
+	// database is the URL of the database the backend keeps the store in,
+	// if it does.
+	database string
+	// reads, if set, also counts reads of read-limited snippets; see
+	// reads.go.
+	reads ReadCounter
+}
+
+// snippetMeta is what the index records about a snippet besides its content.
+type snippetMeta struct {
+	hash    string
+	owner   string
+	created time.Time
+	updated time.Time
+	size    int
+	lang    string
+	private bool
+	reads   int
+	// encrypted snippets hold ciphertext the server has no key for.
+	encrypted bool
+	// expires, if set, is when the snippet stops being served; maxReads,
+	// if set, is how many reads it is served for.
+	expires  time.Time
+	maxReads int
+	// tokenHash is the SHA-256 of the snippet's edit token, if it has one.
+	tokenHash string
+	// flagged snippets are held back from listings pending review.
+	flagged bool
+	// honeytoken snippets are decoys whose ID is never published.
+	honeytoken bool
+	// viewPassHash is a bcrypt hash of the password needed to read the
+	// snippet, if it has one.
+	viewPassHash string
+	// dns snippets may be fetched over the DNS responder.
+	dns bool
+	// mediaType is the detected type of binary content; "" for text.
+	mediaType string
+	// draft snippets are readable by their author only until published.
+	draft bool
+	// slug names the snippet within its owner's namespace, if it has one.
+	slug string
+	// redirect snippets are a URL to send readers to.
+	redirect bool
+	// searchable snippets may be found by anyone through Search.
+	searchable bool
+	// noIndex asks search engines not to index the snippet, and noUnfurl
+	// link previews not to show it.
+	noIndex  bool
+	noUnfurl bool
+}
+
+// CreateOptions are the caller-supplied attributes of a new snippet.
+type CreateOptions struct {
+	Owner string
+	// Private keeps the snippet out of public listings.
+	Private bool
+	// Encrypted marks content encrypted by the client, which the server
+	// stores and serves but cannot read.
+	Encrypted bool
+	// Lang is the language to highlight the snippet as by default.
+	Lang string
+	// Expires, if set, is when the snippet expires.
+	Expires time.Time
+	// MaxReads, if set, expires the snippet after that many reads.
+	MaxReads int
+	// EditToken, if set, is a secret that lets its holder update or delete
+	// the snippet without owning it; see CheckEditToken. Only its hash is
+	// stored.
+	EditToken string
+	// Honeytoken makes the snippet a decoy: it is left out of listings,
+	// the changes feed and content dedup, so its ID is never published.
+	Honeytoken bool
+	// ViewPassword, if set, is needed to read the snippet; see
+	// CheckViewPassword. Only its bcrypt hash is stored, and the snippet
+	// is left out of the changes feed and content dedup.
+	ViewPassword string
+	// DNS opts the snippet in to retrieval over the DNS responder. Such
+	// snippets are not deduplicated, so the choice stays with each one.
+	DNS bool
+	// Draft keeps the snippet to its author, out of listings, the changes
+	// feed and content dedup, until it is published; see Publish.
+	Draft bool
+	// ID, if set, is the ID to store the snippet under in place of a
+	// generated one. It must pass ValidID, and Create returns "" if it is
+	// taken or reserved. Such snippets are not deduplicated.
+	ID string
+	// Slug, if set, names the snippet within its owner's namespace, where
+	// Slug looks it up. It must pass ValidID and Create returns "" if the
+	// owner already has it. Such snippets are not deduplicated.
+	Slug string
+	// Redirect marks the snippet as a shortlink: its content is a URL that
+	// readers are sent to. Such snippets are not deduplicated, so a URL
+	// pasted as text stays text.
+	Redirect bool
+	// Searchable lets anyone find the snippet through Search, where
+	// otherwise only its owner can. Such snippets are not deduplicated,
+	// so the choice stays with each one.
+	Searchable bool
+	// NoIndex and NoUnfurl ask search engines not to index the snippet
+	// and link previews not to show it. Such snippets are not
+	// deduplicated, so the choice stays with each one.
+	NoIndex  bool
+	NoUnfurl bool
+	// Created, if set, is when the snippet was created, for snippets
+	// brought over from elsewhere; it is now otherwise.
+	Created time.Time
+}
+
+// Info is a snapshot of a snippet's metadata, safe to use unlocked.
+type Info struct {
+	ID        string
+	Hash      string
+	Owner     string
+	Created   time.Time
+	Updated   time.Time
+	Size      int
+	Lang      string
+	Private   bool
+	Reads     int
+	Encrypted bool
+	Expires   time.Time
+	MaxReads  int
+	// HasEditToken is set for snippets created with an edit token.
+	HasEditToken bool
+	// Flagged is set for snippets held back from listings pending review.
+	Flagged bool
+	// Honeytoken is set for decoy snippets.
+	Honeytoken bool
+	// HasViewPassword is set for snippets that need a password to read.
+	HasViewPassword bool
+	// DNS is set for snippets that may be fetched over DNS.
+	DNS bool
+	// MediaType is the MIME type of binary snippets, such as image/png,
+	// and "" for text.
+	MediaType string
+	// Draft is set for snippets not published yet.
+	Draft bool
+	// Slug is the snippet's name within its owner's namespace, if any.
+	Slug string
+	// Redirect is set for shortlinks, whose content is a URL.
+	Redirect bool
+	// Searchable is set for snippets anyone may find through Search.
+	Searchable bool
+	// NoIndex and NoUnfurl are set for snippets kept out of search
+	// engines and link previews.
+	NoIndex  bool
+	NoUnfurl bool
+}
+
+// DedupPolicy decides when Create returns an existing snippet for content
+// that is already stored.
+type DedupPolicy int
+
+const (
+	// DedupPerOwner reuses a snippet only for the owner who created it, with
+	// anonymous snippets forming one more owner.
+	DedupPerOwner DedupPolicy = iota
+	// DedupGlobal reuses any snippet with identical content, whoever owns it.
+	DedupGlobal
+	// DedupNone always creates a new snippet.
+	DedupNone
+)
+
+// ParseDedupPolicy parses "owner", "global" or "none".
+func ParseDedupPolicy(s string) (DedupPolicy, error) {
+	switch s {
+	case "owner":
+		return DedupPerOwner, nil
+	case "global":
+		return DedupGlobal, nil
+	case "none":
+		return DedupNone, nil
+	}
+	return 0, fmt.Errorf("unknown dedup policy %q (want owner, global or none)", s)
+}
+
+// Options tune a Store. The zero value is ready to use.
+type Options struct {
+	Dedup DedupPolicy
+	// Keys, if set, encrypt snippet files at rest.
+	Keys *Keyring
+	// Clock, if set, is where creation and update times and expiry come
+	// from in place of the system clock.
+	Clock clock.Clock
+	// Seed, if not zero, seeds the choice of generated IDs, so that the
+	// same requests in the same order get the same IDs.
+	Seed int64
+	// Database, if set, is the URL of a PostgreSQL database to keep the
+	// store in, in place of the directory; see postgres.go.
+	Database string
+	// Reads, if set, counts reads of read-limited snippets with the other
+	// servers that may serve the store.
+	Reads ReadCounter
+}
+
+// New opens the store rooted at dir, which holds index.txt and a data
+// directory of snippet files. Both are created on first use. With
+// opts.Database, the store is kept in that database instead and dir is
+// not used.
+func New(dir string, opts Options) (*Store, error) {
+	var b backend
+	var err error
+	if opts.Database != "" {
+		b, err = openPostgres(opts.Database)
+	} else {
+		b, err = openDir(dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ps := &Store{
+		backend:   b,
+		byOwner:   make(map[string]map[string]struct{}),
+		byLang:    make(map[string]map[string]struct{}),
+		bySlug:    make(map[string]string),
+		byTerm:    make(map[string]map[string]struct{}),
+		termsOf:   make(map[string][]string),
+		dedup:     opts.Dedup,
+		byContent: make(map[string]string),
+		reserved:  make(map[string]bool),
+		keys:      opts.Keys,
+		clock:     opts.Clock,
+		seed:      opts.Seed,
+		database:  opts.Database,
+		reads:     opts.Reads,
+	}
+	if ps.clock == nil {
+		ps.clock = clock.System
+	}
+	seed := ps.seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	ps.rand = rand.New(rand.NewSource(seed))
+	if ps.index, err = loadIndex(b); err == nil {
+		ps.changes, err = loadChanges(b)
+	}
+	if err == nil {
+		ps.comments, err = loadComments(b)
+	}
+	if err == nil {
+		ps.history, err = loadHistory(b)
+	}
+	if err != nil {
+		b.close()
+		return nil, err
+	}
+	for id, meta := range ps.index {
+		ps.addOwned(meta.owner, id)
+		ps.addLang(meta.lang, id)
+		ps.addContent(meta, id)
+		ps.addSlug(meta, id)
+	}
+	for id, meta := range ps.index {
+		if meta.indexed() {
+			ps.indexTerms(id)
+		}
+	}
+	return ps, nil
+}
+
+// Options returns the options the store was opened with.
+func (ps *Store) Options() Options {
+	return Options{Dedup: ps.dedup, Keys: ps.keys, Clock: ps.clock, Seed: ps.seed, Database: ps.database}
+}
+
+// Close releases the store's backend, such as its database connections.
+// The store must not be used after.
+func (ps *Store) Close() error {
+	return ps.backend.close()
+}
+
+// Verify checks that every indexed snippet has its data file, and every
+// revision its revision file.
+func (ps *Store) Verify() error {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	data, err := ps.fileSet(dataDirName)
+	if err != nil {
+		return err
+	}
+	revisions, err := ps.fileSet(revisionsDirName)
+	if err != nil {
+		return err
+	}
+	for id := range ps.index {
+		if !data[id] {
+			return fmt.Errorf("snippet %s: %w", id, fs.ErrNotExist)
+		}
+	}
+	for id, list := range ps.history {
+		for _, rev := range list {
+			if !revisions[rev.Hash] {
+				return fmt.Errorf("snippet %s version %d: %w", id, rev.N, fs.ErrNotExist)
+			}
+		}
+	}
+	return nil
+}
+
+// fileSet returns the names of the files in dir.
+func (ps *Store) fileSet(dir string) (map[string]bool, error) {
+	names, err := ps.backend.listFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[name] = true
+	}
+	return set, nil
+}
+
+// Len returns the number of snippets.
+func (ps *Store) Len() int {
+	ps.RLock()
+	defer ps.RUnlock()
+	return len(ps.index)
+}
+
+// Size returns the total size of the snippets' current content, not
+// counting kept versions.
+func (ps *Store) Size() int64 {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	var total int64
+	for _, meta := range ps.index {
+		total += int64(meta.size)
+	}
+	return total
+}
+
+// ValidID reports whether id can be chosen as a snippet ID: up to 64
+// letters, digits, '-' and '_', starting with a letter or digit.
+func ValidID(id string) bool {
+	if id == "" || len(id) > maxIDLength || id[0] == '-' || id[0] == '_' {
+		return false
+	}
+	for _, c := range id {
+		if !strings.ContainsRune(idChars+"-_", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// Reserve keeps ids from ever being generated for new snippets, or chosen.
+func (ps *Store) Reserve(ids ...string) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	for _, id := range ids {
+		ps.reserved[id] = true
+	}
+}
+
+func loadIndex(b backend) (map[string]*snippetMeta, error) {
+	pairs, err := b.readPairs(indexFileName)
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[string]*snippetMeta, len(pairs))
+	for id, value := range pairs {
+		hash, fields, _ := strings.Cut(value, " ")
+		index[id] = decodeMeta(hash, fields)
+	}
+	return index, nil
+}
+
+func decodeMeta(hash, fields string) *snippetMeta {
+	meta := &snippetMeta{hash: hash}
+	values, err := url.ParseQuery(fields)
+	if err != nil {
+		slog.Warn("Ignoring malformed metadata", "hash", hash, "err", err)
+		return meta
+	}
+	meta.owner = values.Get("owner")
+	meta.created = parseUnix(values.Get("created"))
+	meta.updated = parseUnix(values.Get("updated"))
+	meta.size, _ = strconv.Atoi(values.Get("size"))
+	meta.lang = values.Get("lang")
+	meta.private = values.Get("private") == "1"
+	meta.reads, _ = strconv.Atoi(values.Get("reads"))
+	meta.encrypted = values.Get("encrypted") == "1"
+	meta.expires = parseUnix(values.Get("expires"))
+	meta.maxReads, _ = strconv.Atoi(values.Get("maxreads"))
+	meta.tokenHash = values.Get("token")
+	meta.flagged = values.Get("flagged") == "1"
+	meta.honeytoken = values.Get("honeytoken") == "1"
+	meta.viewPassHash = values.Get("viewpass")
+	meta.dns = values.Get("dns") == "1"
+	meta.mediaType = values.Get("mime")
+	meta.draft = values.Get("draft") == "1"
+	meta.slug = values.Get("slug")
+	meta.redirect = values.Get("redirect") == "1"
+	meta.searchable = values.Get("search") == "1"
+	meta.noIndex = values.Get("noindex") == "1"
+	meta.noUnfurl = values.Get("nounfurl") == "1"
+	return meta
+}
+
+func (meta *snippetMeta) encode() string {
+	values := url.Values{}
+	if meta.owner != "" {
+		values.Set("owner", meta.owner)
+	}
+	if !meta.created.IsZero() {
+		values.Set("created", strconv.FormatInt(meta.created.Unix(), 10))
+	}
+	if !meta.updated.IsZero() {
+		values.Set("updated", strconv.FormatInt(meta.updated.Unix(), 10))
+	}
+	values.Set("size", strconv.Itoa(meta.size))
+	if meta.lang != "" {
+		values.Set("lang", meta.lang)
+	}
+	if meta.private {
+		values.Set("private", "1")
+	}
+	if meta.reads > 0 {
+		values.Set("reads", strconv.Itoa(meta.reads))
+	}
+	if meta.encrypted {
+		values.Set("encrypted", "1")
+	}
+	if !meta.expires.IsZero() {
+		values.Set("expires", strconv.FormatInt(meta.expires.Unix(), 10))
+	}
+	if meta.maxReads > 0 {
+		values.Set("maxreads", strconv.Itoa(meta.maxReads))
+	}
+	if meta.tokenHash != "" {
+		values.Set("token", meta.tokenHash)
+	}
+	if meta.flagged {
+		values.Set("flagged", "1")
+	}
+	if meta.honeytoken {
+		values.Set("honeytoken", "1")
+	}
+	if meta.viewPassHash != "" {
+		values.Set("viewpass", meta.viewPassHash)
+	}
+	if meta.dns {
+		values.Set("dns", "1")
+	}
+	if meta.mediaType != "" {
+		values.Set("mime", meta.mediaType)
+	}
+	if meta.draft {
+		values.Set("draft", "1")
+	}
+	if meta.slug != "" {
+		values.Set("slug", meta.slug)
+	}
+	if meta.redirect {
+		values.Set("redirect", "1")
+	}
+	if meta.searchable {
+		values.Set("search", "1")
+	}
+	if meta.noIndex {
+		values.Set("noindex", "1")
+	}
+	if meta.noUnfurl {
+		values.Set("nounfurl", "1")
+	}
+	return meta.hash + " " + values.Encode()
+}
+
+func parseUnix(s string) time.Time {
+	sec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
+// saveIndex saves the index, and with it files, the content of snippets
+// it now lists.
+func (ps *Store) saveIndex(files ...file) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	pairs := make(map[string]string, len(ps.index))
+	for id, meta := range ps.index {
+		pairs[id] = meta.encode()
+	}
+	if err := ps.backend.writePairs(indexFileName, pairs, files...); err != nil {
+		panic("unable to save index: " + err.Error())
+	}
+	ps.dirty = false
+}
+
+// Flush saves the index if it has unsaved changes. Call it before shutting
+// down so read counts aren't lost.
+func (ps *Store) Flush() {
+	ps.RLock()
+	dirty := ps.dirty
+	ps.RUnlock()
+	if dirty {
+		ps.saveIndex()
+	}
+}
+
+// addOwned and removeOwned maintain byOwner; callers hold the write lock.
+func (ps *Store) addOwned(owner, id string) {
+	if owner == "" {
+		return
+	}
+	if ps.byOwner[owner] == nil {
+		ps.byOwner[owner] = make(map[string]struct{})
+	}
+	ps.byOwner[owner][id] = struct{}{}
+}
+
+func (ps *Store) removeOwned(owner, id string) {
+	delete(ps.byOwner[owner], id)
+	if len(ps.byOwner[owner]) == 0 {
+		delete(ps.byOwner, owner)
+	}
+}
+
+// addSlug and removeSlug maintain bySlug; callers hold the write lock.
+func (ps *Store) addSlug(meta *snippetMeta, id string) {
+	if meta.slug != "" && meta.owner != "" {
+		ps.bySlug[slugKey(meta.owner, meta.slug)] = id
+	}
+}
+
+func (ps *Store) removeSlug(meta *snippetMeta, id string) {
+	if key := slugKey(meta.owner, meta.slug); ps.bySlug[key] == id {
+		delete(ps.bySlug, key)
+	}
+}
+
+func slugKey(owner, slug string) string {
+	return owner + "/" + slug
+}
+
+// Slug returns the ID of owner's snippet named slug.
+func (ps *Store) Slug(owner, slug string) (string, bool) {
+	ps.RLock()
+	defer ps.RUnlock()
+	id, ok := ps.bySlug[slugKey(owner, slug)]
+	return id, ok
+}
+
+// addLang and removeLang maintain byLang; callers hold the write lock.
+func (ps *Store) addLang(lang, id string) {
+	if lang == "" {
+		return
+	}
+	if ps.byLang[lang] == nil {
+		ps.byLang[lang] = make(map[string]struct{})
+	}
+	ps.byLang[lang][id] = struct{}{}
+}
+
+func (ps *Store) removeLang(lang, id string) {
+	delete(ps.byLang[lang], id)
+	if len(ps.byLang[lang]) == 0 {
+		delete(ps.byLang, lang)
+	}
+}
+
+// dedupKey is the byContent key for a snippet, or "" if it never dedups.
+func (ps *Store) dedupKey(hash, owner string) string {
+	switch ps.dedup {
+	case DedupGlobal:
+		return hash
+	case DedupPerOwner:
+		return hash + " " + owner
+	}
+	return ""
+}
+
+// dedupable reports whether identical content may share this snippet.
+// Snippets that will expire are never shared, since the next creator may
+// expect theirs to last, and neither are protected ones, honeytokens,
+// drafts, shortlinks, those served over DNS or found by search, and those
+// kept out of search engines or link previews.
+func (meta *snippetMeta) dedupable() bool {
+	return meta.expires.IsZero() && meta.maxReads == 0 && !meta.honeytoken && meta.viewPassHash == "" && !meta.dns && !meta.draft && !meta.redirect && !meta.searchable && !meta.noIndex && !meta.noUnfurl
+}
+
+// addContent and removeContent maintain byContent; callers hold the write
+// lock. The first dedupable snippet with a given key keeps it.
+func (ps *Store) addContent(meta *snippetMeta, id string) {
+	if !meta.dedupable() {
+		return
+	}
+	key := ps.dedupKey(meta.hash, meta.owner)
+	if _, exists := ps.byContent[key]; key != "" && !exists {
+		ps.byContent[key] = id
+	}
+}
+
+func (ps *Store) removeContent(meta *snippetMeta, id string) {
+	key := ps.dedupKey(meta.hash, meta.owner)
+	if ps.byContent[key] == id {
+		delete(ps.byContent, key)
+	}
+}
+
+func (ps *Store) generateID() string {
+	ps.Lock()
+	defer ps.Unlock()
+
+	length := 1
+	var indices []int
+
+	for {
+		possibleIDs := intPow(len(idChars), length)
+		if len(indices) == 0 {
+			indices = ps.rand.Perm(possibleIDs)
+		}
+
+		for _, idx := range indices {
+			id, err := baseN(idx, idChars, length)
+			if err != nil {
+				slog.Error("Failed to encode snippet ID", "err", err)
+				continue
+			}
+
+			if _, exists := ps.index[id]; !exists && !ps.reserved[id] {
+				indices = indices[1:]
+				return id
+			}
+		}
+
+		length++
+		indices = nil
+	}
+}
+
+// Create stores content and returns its ID. Depending on the store's dedup
+// policy, content identical to an existing snippet returns that snippet's ID
+// instead, except for snippets that expire, carry an edit token or view
+// password, are honeytokens, drafts or are served over DNS.
+func (ps *Store) Create(content string, opts CreateOptions) string {
+	meta := newMeta(contentHash(content), len(content), DetectMediaType(content, opts.Encrypted), opts)
+	id, _ := ps.insert(meta, opts, func(id string) file { return ps.snippetFile(id, content) })
+	return id
+}
+
+// newMeta returns the metadata of a new snippet.
+func newMeta(hash string, size int, mediaType string, opts CreateOptions) *snippetMeta {
+	meta := &snippetMeta{
+		hash:      hash,
+		owner:     opts.Owner,
+		size:      size,
+		private:   opts.Private,
+		encrypted: opts.Encrypted,
+		lang:      opts.Lang,
+		expires:   opts.Expires,
+		maxReads:  opts.MaxReads,
+
+		honeytoken: opts.Honeytoken,
+		dns:        opts.DNS,
+		mediaType:  mediaType,
+		draft:      opts.Draft,
+		slug:       opts.Slug,
+		redirect:   opts.Redirect,
+		searchable: opts.Searchable,
+		noIndex:    opts.NoIndex,
+		noUnfurl:   opts.NoUnfurl,
+	}
+	if opts.EditToken != "" {
+		meta.tokenHash = tokenHash(opts.EditToken)
+	}
+	if opts.ViewPassword != "" {
+		meta.viewPassHash = hashViewPassword(opts.ViewPassword)
+	}
+	return meta
+}
+
+// insert indexes meta under a new ID and saves the content file returns
+// with the index, unless dedup finds an existing snippet to return instead,
+// in which case stored is false and content is not called. If opts.ID
+// can't be had, id is "" as well.
+func (ps *Store) insert(meta *snippetMeta, opts CreateOptions, content func(id string) file) (id string, stored bool) {
+	ps.RLock()
+	if key := ps.dedupKey(meta.hash, opts.Owner); key != "" && meta.dedupable() && opts.EditToken == "" && opts.ID == "" && opts.Slug == "" {
+		if id, exists := ps.byContent[key]; exists {
+			ps.RUnlock()
+			return id, false
+		}
+	}
+	ps.RUnlock()
+
+	if opts.ID == "" {
+		id = ps.generateID()
+		ps.Lock()
+	} else {
+		id = opts.ID
+		ps.Lock()
+		if _, taken := ps.index[id]; taken || ps.reserved[id] || !ValidID(id) {
+			ps.Unlock()
+			return "", false
+		}
+	}
+	if opts.Slug != "" {
+		if _, taken := ps.bySlug[slugKey(opts.Owner, opts.Slug)]; taken || opts.Owner == "" || !ValidID(opts.Slug) {
+			ps.Unlock()
+			return "", false
+		}
+	}
+	meta.created = ps.clock.Now()
+	if !opts.Created.IsZero() {
+		meta.created = opts.Created
+	}
+	ps.index[id] = meta
+	ps.addOwned(opts.Owner, id)
+	ps.addLang(meta.lang, id)
+	ps.addContent(meta, id)
+	ps.addSlug(meta, id)
+	ps.recordChange(ChangeCreated, id, meta)
+	ps.Unlock()
+	ps.saveIndex(content(id))
+	ps.indexTerms(id)
+	return id, true
+}
+
+// snippetFile is the file holding content as the snippet id.
+func (ps *Store) snippetFile(id, content string) file {
+	return file{dir: dataDirName, name: id, data: ps.keys.seal([]byte(content))}
+}
+
+func (ps *Store) saveSnippet(id, content string) {
+	if err := ps.backend.writeFile(ps.snippetFile(id, content)); err != nil {
+		panic("unable to write snippet file: " + err.Error())
+	}
+}
+
+// Get returns the content of id.
+func (ps *Store) Get(id string) (string, bool) {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	meta, exists := ps.index[id]
+	if !exists || meta.expired(ps.clock.Now()) {
+		return "", false
+	}
+
+	data, err := ps.backend.readFile(dataDirName, id)
+	if err != nil {
+		return "", false
+	}
+	content, err := ps.keys.open(data)
+	if err != nil {
+		slog.Error("Failed to decrypt snippet", "id", id, "err", err)
+		return "", false
+	}
+	return string(content), true
+}
+
+// Update replaces the content of id, reporting whether it exists.
+func (ps *Store) Update(id, newContent string) bool {
+	ps.RLock()
+	meta, exists := ps.index[id]
+	encrypted := exists && meta.encrypted
+	ps.RUnlock()
+	return ps.replace(id, contentHash(newContent), len(newContent), DetectMediaType(newContent, encrypted),
+		func() file { return ps.snippetFile(id, newContent) })
+}
+
+// replace records new content for id and saves the file content returns
+// with the index, unless id doesn't exist or the content is unchanged,
+// reporting whether id exists.
+func (ps *Store) replace(id, hash string, size int, mediaType string, content func() file) bool {
+	ps.Lock()
+	meta, exists := ps.index[id]
+	if !exists {
+		ps.Unlock()
+		return false
+	}
+	if meta.hash == hash {
+		ps.Unlock()
+		return true
+	}
+
+	kept := ps.keepRevision(id, meta)
+	ps.removeContent(meta, id)
+	meta.hash = hash
+	ps.addContent(meta, id)
+	meta.size = size
+	meta.mediaType = mediaType
+	meta.updated = ps.clock.Now()
+	ps.recordChange(ChangeUpdated, id, meta)
+	ps.Unlock()
+
+	ps.saveIndex(content())
+	if kept {
+		ps.saveHistory()
+	}
+	ps.indexTerms(id)
+
+	return true
+}
+
+// Delete removes id, reporting whether it existed.
+func (ps *Store) Delete(id string) bool {
+	ps.Lock()
+	meta, exists := ps.index[id]
+	if !exists {
+		ps.Unlock()
+		return false
+	}
+
+	hadComments, hadHistory := ps.drop(id, meta)
+	ps.Unlock()
+
+	ps.saveIndex()
+	if hadComments {
+		ps.saveComments()
+	}
+	if hadHistory {
+		ps.saveHistory()
+	}
+
+	go ps.removeFiles([]string{id})
+
+	return true
+}
+
+// drop removes id, whose metadata is meta, from the index, reporting
+// whether it had comments or history to save; callers hold the write lock
+// and remove its file.
+func (ps *Store) drop(id string, meta *snippetMeta) (hadComments, hadHistory bool) {
+	delete(ps.index, id)
+	ps.removeOwned(meta.owner, id)
+	ps.removeLang(meta.lang, id)
+	ps.removeContent(meta, id)
+	ps.removeSlug(meta, id)
+	ps.removeTerms(id)
+	ps.recordChange(ChangeDeleted, id, meta)
+	return ps.dropComments(id), ps.dropHistory(id)
+}
+
+// removeFiles removes the files of deleted snippets.
+func (ps *Store) removeFiles(ids []string) {
+	for _, id := range ids {
+		if err := ps.backend.removeFile(dataDirName, id); err != nil {
+			slog.Error("Failed to remove snippet file", "id", id, "err", err)
+		}
+	}
+}
+
+// Publish makes the draft id public, as if it had just been created,
+// reporting false if id doesn't exist or is not a draft.
+func (ps *Store) Publish(id string) bool {
+	ps.Lock()
+	meta, exists := ps.index[id]
+	if !exists || !meta.draft || meta.expired(ps.clock.Now()) {
+		ps.Unlock()
+		return false
+	}
+	meta.draft = false
+	meta.created = ps.clock.Now()
+	ps.addContent(meta, id)
+	ps.recordChange(ChangeUpdated, id, meta)
+	ps.Unlock()
+
+	ps.saveIndex()
+	return true
+}
+
+// Mirror stores content under id with the metadata of info, replacing any
+// snippet already there. Unlike Create it keeps the caller's ID and
+// timestamps, for copying snippets from another store; the hash and size
+// are taken from content.
+func (ps *Store) Mirror(id, content string, info Info) {
+	ps.Lock()
+	kind := ChangeCreated
+	if old, exists := ps.index[id]; exists {
+		kind = ChangeUpdated
+		ps.removeOwned(old.owner, id)
+		ps.removeLang(old.lang, id)
+		ps.removeContent(old, id)
+		ps.removeSlug(old, id)
+	}
+	meta := &snippetMeta{
+		hash:      contentHash(content),
+		owner:     info.Owner,
+		created:   info.Created,
+		updated:   info.Updated,
+		size:      len(content),
+		lang:      info.Lang,
+		private:   info.Private,
+		reads:     info.Reads,
+		encrypted: info.Encrypted,
+		expires:   info.Expires,
+		maxReads:  info.MaxReads,
+		dns:       info.DNS,
+		mediaType: DetectMediaType(content, info.Encrypted),
+		slug:      info.Slug,
+		redirect:  info.Redirect,
+
+		searchable: info.Searchable,
+		noIndex:    info.NoIndex,
+		noUnfurl:   info.NoUnfurl,
+	}
+	ps.index[id] = meta
+	ps.addOwned(meta.owner, id)
+	ps.addLang(meta.lang, id)
+	ps.addContent(meta, id)
+	ps.addSlug(meta, id)
+	ps.recordChange(kind, id, meta)
+	ps.Unlock()
+	ps.saveIndex(ps.snippetFile(id, content))
+	ps.indexTerms(id)
+}
+
+// RecordRead counts a read of id. Counts are kept in memory and written out
+// with the next index save or Flush. Reads of read-limited snippets were
+// counted when ClaimRead took them, so they aren't counted again.
+func (ps *Store) RecordRead(id string) {
+	ps.Lock()
+	defer ps.Unlock()
+	meta, exists := ps.index[id]
+	if !exists || meta.maxReads > 0 {
+		return
+	}
+	meta.reads++
+	ps.dirty = true
+}
+
+// ClaimRead takes one of the reads of id before it is served, reporting
+// false if it has none left. Reads of snippets without a read limit are
+// free, and counted by RecordRead once served. With a shared ReadCounter
+// the read is taken there, so that no two servers serve the same one; if
+// it fails, the index decides.
+func (ps *Store) ClaimRead(id string) bool {
+	ps.Lock()
+	meta, exists := ps.index[id]
+	if !exists || meta.expired(ps.clock.Now()) {
+		ps.Unlock()
+		return false
+	}
+	if meta.maxReads == 0 {
+		ps.Unlock()
+		return true
+	}
+	maxReads, key := meta.maxReads, readKey(id, meta)
+	if !ps.sharesReads(meta) {
+		meta.reads++
+		ps.dirty = true
+		ps.Unlock()
+		return true
+	}
+	ps.Unlock()
+
+	n, err := ps.reads.Add(key)
+	if err != nil {
+		slog.Error("Failed to count shared read", "id", id, "err", err)
+		ps.Lock()
+		defer ps.Unlock()
+		if meta, exists := ps.index[id]; !exists || readKey(id, meta) != key || meta.expired(ps.clock.Now()) {
+			return false
+		}
+		meta.reads++
+		ps.dirty = true
+		return true
+	}
+	ps.setReads(id, key, n)
+	return n <= maxReads
+}
+
+// Meta returns the metadata recorded for id.
+func (ps *Store) Meta(id string) (Info, bool) {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	meta, exists := ps.index[id]
+	if !exists || meta.expired(ps.clock.Now()) {
+		return Info{}, false
+	}
+	return meta.info(id), true
+}
+
+// expired reports whether the snippet should no longer be served at now.
+func (meta *snippetMeta) expired(now time.Time) bool {
+	return (!meta.expires.IsZero() && !now.Before(meta.expires)) ||
+		(meta.maxReads > 0 && meta.reads >= meta.maxReads)
+}
+
+// Expired returns the snippets that have expired by now, for the caller to
+// Delete. Until then they are already hidden from Get and Meta.
+func (ps *Store) Expired(now time.Time) []string {
+	var limited []string
+	ps.RLock()
+	for id, meta := range ps.index {
+		if ps.sharesReads(meta) {
+			limited = append(limited, id)
+		}
+	}
+	ps.RUnlock()
+	ps.syncReads(limited...)
+
+	ps.RLock()
+	defer ps.RUnlock()
+
+	var ids []string
+	for id, meta := range ps.index {
+		if meta.expired(now) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// OwnerOf reports who owns id; anonymous snippets have no owner.
+func (ps *Store) OwnerOf(id string) (string, bool) {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	meta, exists := ps.index[id]
+	if !exists {
+		return "", false
+	}
+	return meta.owner, true
+}
+
+// SetFlagged flags id for review or clears the flag, reporting whether id
+// exists.
+func (ps *Store) SetFlagged(id string, flagged bool) bool {
+	ps.Lock()
+	meta, exists := ps.index[id]
+	if !exists {
+		ps.Unlock()
+		return false
+	}
+	changed := meta.flagged != flagged
+	meta.flagged = flagged
+	ps.Unlock()
+
+	if changed {
+		ps.saveIndex()
+	}
+	return true
+}
+
+// Flagged returns the snippets flagged for review, newest first.
+func (ps *Store) Flagged() []Info {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	var infos []Info
+	for id, meta := range ps.index {
+		if meta.flagged {
+			infos = append(infos, meta.info(id))
+		}
+	}
+	sortNewestFirst(infos)
+	return infos
+}
+
+// CheckEditToken reports whether token is the edit token id was created
+// with.
+func (ps *Store) CheckEditToken(id, token string) bool {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	meta, exists := ps.index[id]
+	if !exists || meta.tokenHash == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(meta.tokenHash), []byte(tokenHash(token))) == 1
+}
+
+// CheckViewPassword reports whether password is the view password of id.
+func (ps *Store) CheckViewPassword(id, password string) bool {
+	ps.RLock()
+	meta, exists := ps.index[id]
+	var hash string
+	if exists {
+		hash = meta.viewPassHash
+	}
+	ps.RUnlock()
+
+	if hash == "" || password == "" {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func hashViewPassword(password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		panic("unable to hash view password: " + err.Error())
+	}
+	return string(hash)
+}
+
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ListByOwner returns the owner's snippets, newest first.
+func (ps *Store) ListByOwner(owner string) []Info {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	infos := make([]Info, 0, len(ps.byOwner[owner]))
+	for id := range ps.byOwner[owner] {
+		infos = append(infos, ps.index[id].info(id))
+	}
+	sortNewestFirst(infos)
+	return infos
+}
+
+// ListIDsByOwner is ListByOwner for IDs only, so that a long listing can
+// look its snippets up one at a time with Meta instead of holding them all.
+func (ps *Store) ListIDsByOwner(owner string) []string {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	ids := make([]string, 0, len(ps.byOwner[owner]))
+	for id := range ps.byOwner[owner] {
+		ids = append(ids, id)
+	}
+	ps.sortIDsNewestFirst(ids)
+	return ids
+}
+
+// ListIDs is All for IDs only.
+func (ps *Store) ListIDs() []string {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	ids := make([]string, 0, len(ps.index))
+	for id := range ps.index {
+		ids = append(ids, id)
+	}
+	ps.sortIDsNewestFirst(ids)
+	return ids
+}
+
+// ListIDsByLang is ListByLang for IDs only.
+func (ps *Store) ListIDsByLang(lang string) []string {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	var ids []string
+	for id := range ps.byLang[lang] {
+		if ps.index[id].listed() {
+			ids = append(ids, id)
+		}
+	}
+	ps.sortIDsNewestFirst(ids)
+	return ids
+}
+
+// FlaggedIDs is Flagged for IDs only.
+func (ps *Store) FlaggedIDs() []string {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	var ids []string
+	for id, meta := range ps.index {
+		if meta.flagged {
+			ids = append(ids, id)
+		}
+	}
+	ps.sortIDsNewestFirst(ids)
+	return ids
+}
+
+// sortIDsNewestFirst orders ids as sortNewestFirst does their snippets;
+// callers hold the lock.
+func (ps *Store) sortIDsNewestFirst(ids []string) {
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := ps.index[ids[i]].created, ps.index[ids[j]].created
+		if !a.Equal(b) {
+			return a.After(b)
+		}
+		return ids[i] < ids[j]
+	})
+}
+
+// ListByLang returns the public snippets whose default language is lang,
+// newest first. Flagged snippets and honeytokens are left out.
+func (ps *Store) ListByLang(lang string) []Info {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	var infos []Info
+	for id := range ps.byLang[lang] {
+		if meta := ps.index[id]; meta.listed() {
+			infos = append(infos, meta.info(id))
+		}
+	}
+	sortNewestFirst(infos)
+	return infos
+}
+
+// Languages counts the public snippets per default language, with the same
+// exclusions as ListByLang.
+func (ps *Store) Languages() map[string]int {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	counts := make(map[string]int, len(ps.byLang))
+	for lang, ids := range ps.byLang {
+		for id := range ids {
+			if ps.index[id].listed() {
+				counts[lang]++
+			}
+		}
+	}
+	return counts
+}
+
+// listed reports whether the snippet may appear in public listings. Ones
+// with a read limit aren't, or anyone browsing could use up their reads.
+func (meta *snippetMeta) listed() bool {
+	return !meta.private && !meta.flagged && !meta.honeytoken && !meta.draft && meta.maxReads == 0
+}
+
+// ListRecentAnonymous returns up to limit of the newest anonymous snippets
+// that may be listed. Expired snippets are left out before the limit is
+// applied, so they don't crowd out live ones until they are swept.
+func (ps *Store) ListRecentAnonymous(limit int) []Info {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	now := ps.clock.Now()
+	var infos []Info
+	for id, meta := range ps.index {
+		if meta.owner == "" && meta.listed() && !meta.expired(now) {
+			infos = append(infos, meta.info(id))
+		}
+	}
+	sortNewestFirst(infos)
+	if len(infos) > limit {
+		infos = infos[:limit]
+	}
+	return infos
+}
+
+// All returns every snippet, newest first.
+func (ps *Store) All() []Info {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	infos := make([]Info, 0, len(ps.index))
+	for id, meta := range ps.index {
+		infos = append(infos, meta.info(id))
+	}
+	sortNewestFirst(infos)
+	return infos
+}
+
+func sortNewestFirst(infos []Info) {
+	sort.Slice(infos, func(i, j int) bool {
+		if !infos[i].Created.Equal(infos[j].Created) {
+			return infos[i].Created.After(infos[j].Created)
+		}
+		return infos[i].ID < infos[j].ID
+	})
+}
+
+func (meta *snippetMeta) info(id string) Info {
+	return Info{
+		ID:           id,
+		Hash:         meta.hash,
+		Owner:        meta.owner,
+		Created:      meta.created,
+		Updated:      meta.updated,
+		Size:         meta.size,
+		Lang:         meta.lang,
+		Private:      meta.private,
+		Reads:        meta.reads,
+		Encrypted:    meta.encrypted,
+		Expires:      meta.expires,
+		MaxReads:     meta.maxReads,
+		HasEditToken: meta.tokenHash != "",
+		Flagged:      meta.flagged,
+		Honeytoken:   meta.honeytoken,
+
+		HasViewPassword: meta.viewPassHash != "",
+		DNS:             meta.dns,
+		MediaType:       meta.mediaType,
+		Draft:           meta.draft,
+		Slug:            meta.slug,
+		Redirect:        meta.redirect,
+		Searchable:      meta.searchable,
+		NoIndex:         meta.noIndex,
+		NoUnfurl:        meta.noUnfurl,
+	}
+}
+
+// DetectMediaType returns the MIME type of binary content, or "" if it is
+// text. Encrypted content is never inspected.
+func DetectMediaType(content string, encrypted bool) string {
+	if encrypted {
+		return ""
+	}
+	// DetectContentType only looks at the first 512 bytes.
+	mediaType := http.DetectContentType([]byte(content[:min(len(content), 512)]))
+	if strings.HasPrefix(mediaType, "text/") {
+		return ""
+	}
+	return mediaType
+}
+
+func contentHash(content string) string {
+	hasher := sha256.New()
+	hasher.Write([]byte(content))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func intPow(base, exp int) int {
+	result := 1
+	for i := 0; i < exp; i++ {
+		result *= base
+	}
+	return result
+}
+
+func baseN(num int, chars string, length int) (string, error) {
+	base := len(chars)
+	maxNum := intPow(base, length) - 1
+	if num > maxNum {
+		return "", fmt.Errorf("number %d too large to encode with length %d in base %d", num, length, base)
+	}
+
+	res := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		res[i] = chars[num%base]
+		num /= base
+	}
+	return string(res), nil
+}
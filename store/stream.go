@@ -0,0 +1,155 @@
+// Package store implements streamed access to snippet content, so large
+// snippets pass between disk and network without being held in memory.
+// Stores with a keyring are the exception: a sealed file is authenticated
+// as a whole, so it is read, or written, in one piece. So are stores in
+// PostgreSQL, which keeps each file as one value.
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+)
+
+// sniffLen is how much of the content DetectMediaType looks at.
+const sniffLen = 512
+
+// Open returns a reader for the content of id, which the caller closes.
+func (ps *Store) Open(id string) (io.ReadCloser, bool) {
+	ps.RLock()
+	meta, exists := ps.index[id]
+	if !exists || meta.expired(ps.clock.Now()) {
+		ps.RUnlock()
+		return nil, false
+	}
+	ps.RUnlock()
+
+	if ps.keys != nil {
+		content, ok := ps.Get(id)
+		if !ok {
+			return nil, false
+		}
+		return io.NopCloser(bytes.NewReader([]byte(content))), true
+	}
+	f, _, err := ps.backend.openFile(dataDirName, id)
+	if err != nil {
+		return nil, false
+	}
+	return f, true
+}
+
+// spooled is content copied to a temporary file in the backend's spool
+// directory, waiting to be moved into place.
+type spooled struct {
+	name      string
+	hash      string
+	size      int
+	mediaType string
+}
+
+// spool copies r to a temporary file, hashing it on the way and sniffing its
+// media type. A failure to read r is returned as is, with nothing left
+// behind.
+func (ps *Store) spool(r io.Reader, encrypted bool) (*spooled, error) {
+	f, err := os.CreateTemp(ps.backend.spoolDir(), ".upload*")
+	if err != nil {
+		return nil, err
+	}
+	hasher := sha256.New()
+	br := bufio.NewReaderSize(r, sniffLen)
+	head, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	sp := &spooled{name: f.Name(), mediaType: DetectMediaType(string(head), encrypted)}
+	n, err := io.Copy(io.MultiWriter(f, hasher), br)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(sp.name)
+		return nil, err
+	}
+	sp.hash = hex.EncodeToString(hasher.Sum(nil))
+	sp.size = int(n)
+	return sp, nil
+}
+
+// file is the spooled content as the snippet id.
+func (sp *spooled) file(id string) file {
+	return file{dir: dataDirName, name: id, spooled: sp.name}
+}
+
+// ErrIDTaken is returned by CreateFrom when CreateOptions.ID is taken or
+// reserved, or the owner already has CreateOptions.Slug.
+var ErrIDTaken = errors.New("snippet ID is taken")
+
+// CreateFrom is Create for content read from r, which is streamed to disk.
+// If reading r fails, nothing is stored and the error is returned.
+func (ps *Store) CreateFrom(r io.Reader, opts CreateOptions) (string, error) {
+	if ps.keys != nil {
+		content, err := io.ReadAll(r)
+		if err != nil {
+			return "", err
+		}
+		if id := ps.Create(string(content), opts); id != "" {
+			return id, nil
+		}
+		return "", ErrIDTaken
+	}
+	sp, err := ps.spool(r, opts.Encrypted)
+	if err != nil {
+		return "", err
+	}
+	meta := newMeta(sp.hash, sp.size, sp.mediaType, opts)
+	id, stored := ps.insert(meta, opts, sp.file)
+	if !stored {
+		os.Remove(sp.name)
+	}
+	if id == "" {
+		return "", ErrIDTaken
+	}
+	return id, nil
+}
+
+// UpdateFrom is Update for content read from r, which is streamed to disk.
+// If reading r fails, id is left as it was and the error is returned.
+func (ps *Store) UpdateFrom(id string, r io.Reader) (bool, error) {
+	ps.RLock()
+	meta, exists := ps.index[id]
+	encrypted := exists && meta.encrypted
+	ps.RUnlock()
+	if !exists {
+		return false, nil
+	}
+
+	if ps.keys != nil {
+		content, err := io.ReadAll(r)
+		if err != nil {
+			return false, err
+		}
+		return ps.Update(id, string(content)), nil
+	}
+	sp, err := ps.spool(r, encrypted)
+	if err != nil {
+		return false, err
+	}
+	committed := false
+	exists = ps.replace(id, sp.hash, sp.size, sp.mediaType, func() file {
+		committed = true
+		return sp.file(id)
+	})
+	if !committed {
+		os.Remove(sp.name)
+	}
+	return exists, nil
+}
@@ -0,0 +1,191 @@
+// Package main implements -validate-config, a dry run of startup: it loads
+// and checks everything the flags point at and reports on each, so that a
+// bad deploy fails before it replaces a working server rather than part way
+// through serving.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"pb/backup"
+	"pb/httpapi"
+	"pb/store"
+)
+
+// validateTimeout bounds each check that goes over the network.
+const validateTimeout = 10 * time.Second
+
+// check is one item of a configuration report.
+type check struct {
+	name string
+	run  func() error
+}
+
+// validateConfig checks that the server configured by cfg could start and
+// serve: the data directory is writable, every file it names loads, and the
+// services it depends on answer. It writes one line per check to w and
+// reports whether all passed. Nothing is served and plugins are stopped
+// again, so it is safe to run next to a live instance before switching to
+// new flags; the only change it may make is creating a missing backup
+// directory, as the server would.
+func validateConfig(cfg *config, w io.Writer) bool {
+	checks := []check{
+		{"data directory " + cfg.dir + " is writable", func() error { return checkWritable(cfg.dir) }},
+	}
+	if cfg.database != "" {
+		checks = append(checks, check{"database " + redactedURL(cfg.database) + " answers", func() error {
+			return store.CheckDatabase(cfg.database)
+		}})
+	} else if _, err := os.Stat(filepath.Join(cfg.dir, "index.txt")); err == nil {
+		checks = append(checks, check{"store in " + cfg.dir + " opens and is complete", func() error {
+			st, err := store.New(cfg.dir, cfg.storeOptions())
+			if err != nil {
+				return err
+			}
+			return st.Verify()
+		}})
+	}
+	if cfg.policyFile != "" {
+		checks = append(checks, check{"policies in " + cfg.policyFile + " compile", func() error {
+			_, err := httpapi.LoadPolicies(cfg.policyFile)
+			return err
+		}})
+	}
+	if cfg.blocklist != "" {
+		checks = append(checks, check{"blocklist " + cfg.blocklist + " loads", func() error {
+			_, err := httpapi.LoadBlocklist(cfg.blocklist)
+			return err
+		}})
+	}
+	if cfg.contentFilter != "" {
+		checks = append(checks, check{"content filters in " + cfg.contentFilter + " load", func() error {
+			_, err := httpapi.LoadContentFilters(cfg.contentFilter)
+			return err
+		}})
+	}
+	if cfg.ipFilter != "" {
+		checks = append(checks, check{"address filter " + cfg.ipFilter + " loads", func() error {
+			_, err := httpapi.FilterAddresses(http.NotFoundHandler(), cfg.ipFilter)
+			return err
+		}})
+	}
+	if cfg.robots != "" {
+		checks = append(checks, check{"robots.txt " + cfg.robots + " is readable", func() error {
+			_, err := os.ReadFile(cfg.robots)
+			return err
+		}})
+	}
+	if cfg.tlsCert != "" || cfg.clientCA != "" {
+		checks = append(checks, check{"TLS certificates load", func() error {
+			_, err := (&program{cfg: cfg}).tlsConfig()
+			return err
+		}})
+	}
+	if cfg.sshHostKey != "" {
+		checks = append(checks, check{"SSH host key " + cfg.sshHostKey + " is readable", func() error {
+			_, err := os.ReadFile(cfg.sshHostKey)
+			return err
+		}})
+	}
+	for _, path := range cfg.plugins {
+		path := path
+		checks = append(checks, check{"plugin " + path + " starts", func() error {
+			plugins, err := httpapi.StartPlugins([]string{path})
+			if err == nil {
+				plugins.Stop()
+			}
+			return err
+		}})
+	}
+	if cfg.primary != nil {
+		checks = append(checks, check{"primary " + cfg.primary.String() + " answers", func() error {
+			return checkReachable(cfg.primary.JoinPath("api/v1/changes").String())
+		}})
+	}
+	if cfg.shadowTo != nil {
+		checks = append(checks, check{"shadow " + cfg.shadowTo.String() + " answers", func() error {
+			return checkReachable(cfg.shadowTo.JoinPath("version").String())
+		}})
+	}
+	if cfg.redis != nil {
+		checks = append(checks, check{"redis " + redactedURL(cfg.redisURL) + " answers", func() error {
+			client := redis.NewClient(cfg.redis)
+			defer client.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), validateTimeout)
+			defer cancel()
+			return client.Ping(ctx).Err()
+		}})
+	}
+	if cfg.backupTo != "" {
+		checks = append(checks, check{"backup target " + cfg.backupTo + " is reachable", func() error {
+			target, err := backup.Open(cfg.backupTo)
+			if err != nil {
+				return err
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), validateTimeout)
+			defer cancel()
+			_, err = target.List(ctx, "")
+			return err
+		}})
+	}
+
+	ok := true
+	for _, c := range checks {
+		if err := c.run(); err != nil {
+			fmt.Fprintf(w, "FAIL %s: %v\n", c.name, err)
+			ok = false
+			continue
+		}
+		fmt.Fprintf(w, "ok   %s\n", c.name)
+	}
+	return ok
+}
+
+// checkWritable creates and removes a file in dir, which need not exist
+// yet as long as it could be created.
+func checkWritable(dir string) error {
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil {
+			f, err := os.CreateTemp(d, ".pb-validate-*")
+			if err != nil {
+				return err
+			}
+			f.Close()
+			return os.Remove(f.Name())
+		}
+		if d == filepath.Dir(d) {
+			return fmt.Errorf("no existing parent of %s", dir)
+		}
+	}
+}
+
+// redactedURL is a database or Redis URL with its password masked, for the report.
+func redactedURL(s string) string {
+	if u, err := url.Parse(s); err == nil && u.Scheme != "" {
+		return u.Redacted()
+	}
+	return "from -database"
+}
+
+// checkReachable GETs url, failing on network errors and server errors.
+func checkReachable(url string) error {
+	client := &http.Client{Timeout: validateTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	return nil
+}